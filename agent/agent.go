@@ -50,6 +50,10 @@ const (
 		"but no reason was provided. This is a default message."
 	defaultServiceMaintReason = "Maintenance mode is enabled for this " +
 		"service, but no reason was provided. This is a default message."
+
+	// Default reason for pausing the Docker checks
+	defaultDockerPauseReason = "Docker checks are paused, but no reason " +
+		"was provided. This is a default message."
 )
 
 // dnsNameRe checks if a name or tag is dns-compatible.
@@ -119,12 +123,43 @@ type Agent struct {
 	// checkTCPs maps the check ID to an associated TCP check
 	checkTCPs map[types.CheckID]*CheckTCP
 
+	// checkGRPCs maps the check ID to an associated gRPC check
+	checkGRPCs map[types.CheckID]*CheckGRPC
+
 	// checkTTLs maps the check ID to an associated check TTL
 	checkTTLs map[types.CheckID]*CheckTTL
 
 	// checkDockers maps the check ID to an associated Docker Exec based check
 	checkDockers map[types.CheckID]*CheckDocker
 
+	// dockerExecs tracks the running execs of the Docker checks so they
+	// can be cancelled on reload
+	dockerExecs *ExecTracker
+
+	// dockerSlots limits the number of Docker checks running at the same
+	// time, if docker_config max_concurrent_checks is set.
+	dockerSlots *CheckSemaphore
+
+	// dockerPause pauses the Docker checks while the Docker daemon is
+	// under maintenance.
+	dockerPause *CheckPause
+
+	// dockerBreaker stops sending requests to the Docker daemon after
+	// repeated errors, if docker_config breaker_error_rate is set.
+	dockerBreaker *dockerBreaker
+
+	// dockerPressure caches the pressure of the Docker daemons for the
+	// Docker checks.
+	dockerPressure *PressureCache
+
+	// dockerResults passes the results of the Docker checks on to the
+	// handler set with SetDockerResultHandler.
+	dockerResults *DockerResultQueue
+
+	// dockerRegistrator registers the services of containers, if
+	// docker_config register_services is set.
+	dockerRegistrator *DockerRegistrator
+
 	// checkLock protects updates to the check* maps
 	checkLock sync.Mutex
 
@@ -149,10 +184,35 @@ type Agent struct {
 	// joinLANNotifier is called after a successful JoinLAN.
 	joinLANNotifier notifier
 
+	// lastJoinLAN and lastJoinWAN are the times of the last successful
+	// JoinLAN and JoinWAN, guarded by lastJoinLock.
+	lastJoinLAN  time.Time
+	lastJoinWAN  time.Time
+	lastJoinLock sync.Mutex
+
 	// retryJoinCh transports errors from the retry join
 	// attempts.
 	retryJoinCh chan error
 
+	// retryJoinStatusCh transports the state transitions of the retry
+	// joins. It's buffered and never blocks the join loops.
+	retryJoinStatusCh chan RetryJoinEvent
+
+	// retryJoinBackoff and retryJoinWanBackoff compute the waits between
+	// the attempts of the LAN and WAN retry joins. A nil Backoff uses the
+	// configured exponential backoff.
+	retryJoinBackoff    Backoff
+	retryJoinWanBackoff Backoff
+
+	// retryJoinPeers returns the number of other alive agents in the LAN
+	// pool so that retry join stops once the agent was joined some other
+	// way. A nil func never stops it early.
+	retryJoinPeers func() int
+
+	// retryJoinReloadCh passes reloaded configurations to the LAN retry
+	// join loop so it picks up changed servers and discovery providers.
+	retryJoinReloadCh chan *Config
+
 	// endpoints maps unique RPC endpoint names to common ones
 	// to allow overriding of RPC handlers since the golang
 	// net/rpc server does not allow this.
@@ -200,24 +260,33 @@ func New(c *Config) (*Agent, error) {
 	}
 
 	a := &Agent{
-		config:          c,
-		acls:            acls,
-		checkReapAfter:  make(map[types.CheckID]time.Duration),
-		checkMonitors:   make(map[types.CheckID]*CheckMonitor),
-		checkTTLs:       make(map[types.CheckID]*CheckTTL),
-		checkHTTPs:      make(map[types.CheckID]*CheckHTTP),
-		checkTCPs:       make(map[types.CheckID]*CheckTCP),
-		checkDockers:    make(map[types.CheckID]*CheckDocker),
-		eventCh:         make(chan serf.UserEvent, 1024),
-		eventBuf:        make([]*UserEvent, 256),
-		joinLANNotifier: &systemd.Notifier{},
-		reloadCh:        make(chan chan error),
-		retryJoinCh:     make(chan error),
-		shutdownCh:      make(chan struct{}),
-		endpoints:       make(map[string]string),
-		dnsAddrs:        dnsAddrs,
-		httpAddrs:       httpAddrs,
-	}
+		config:            c,
+		acls:              acls,
+		checkReapAfter:    make(map[types.CheckID]time.Duration),
+		checkMonitors:     make(map[types.CheckID]*CheckMonitor),
+		checkTTLs:         make(map[types.CheckID]*CheckTTL),
+		checkHTTPs:        make(map[types.CheckID]*CheckHTTP),
+		checkTCPs:         make(map[types.CheckID]*CheckTCP),
+		checkGRPCs:        make(map[types.CheckID]*CheckGRPC),
+		checkDockers:      make(map[types.CheckID]*CheckDocker),
+		dockerExecs:       NewExecTracker(),
+		dockerSlots:       NewCheckSemaphore(c.DockerConfig.MaxConcurrentChecks),
+		dockerPause:       &CheckPause{},
+		dockerResults:     NewDockerResultQueue(0),
+		dockerPressure:    NewPressureCache(dockerPressureTTL),
+		eventCh:           make(chan serf.UserEvent, 1024),
+		eventBuf:          make([]*UserEvent, 256),
+		joinLANNotifier:   &systemd.Notifier{},
+		reloadCh:          make(chan chan error),
+		retryJoinCh:       make(chan error),
+		retryJoinStatusCh: make(chan RetryJoinEvent, retryJoinStatusBuffer),
+		retryJoinReloadCh: make(chan *Config, 1),
+		shutdownCh:        make(chan struct{}),
+		endpoints:         make(map[string]string),
+		dnsAddrs:          dnsAddrs,
+		httpAddrs:         httpAddrs,
+	}
+	a.retryJoinPeers = a.lanPeers
 	if err := a.resolveTmplAddrs(); err != nil {
 		return nil, err
 	}
@@ -282,6 +351,10 @@ func (a *Agent) Start() error {
 		a.logger = log.New(logOutput, "", log.LstdFlags)
 	}
 
+	if c.DockerConfig.BreakerErrorRate > 0 {
+		a.dockerBreaker = newDockerBreaker(c.DockerConfig.BreakerErrorRate, c.DockerConfig.BreakerCooldown, a.logger)
+	}
+
 	// Retrieve or generate the node ID before setting up the rest of the
 	// agent, which depends on it.
 	if err := a.setupNodeID(c); err != nil {
@@ -377,6 +450,27 @@ func (a *Agent) Start() error {
 	go a.retryJoin()
 	go a.retryJoinWan()
 
+	if c.DockerConfig.RegisterServices {
+		if err := a.startDockerRegistrator(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// startDockerRegistrator starts registering the services of containers.
+func (a *Agent) startDockerRegistrator() error {
+	client, err := newDockerClient(a.dockerClientConfig(), a.logger)
+	if err != nil {
+		return fmt.Errorf("Failed to create the Docker client to register services: %v", err)
+	}
+	rc, ok := client.(DockerRegistratorClient)
+	if !ok {
+		return fmt.Errorf("Docker client can't follow the events of the daemon")
+	}
+	a.dockerRegistrator = NewDockerRegistrator(rc, a, a.logger)
+	go a.dockerRegistrator.Run(time.After)
 	return nil
 }
 
@@ -1122,6 +1216,12 @@ func (a *Agent) ShutdownAgent() error {
 	}
 	a.logger.Println("[INFO] agent: Requesting shutdown")
 
+	// Deregister the services of containers before their checks are
+	// stopped.
+	if a.dockerRegistrator != nil {
+		a.dockerRegistrator.Stop()
+	}
+
 	// Stop all the checks
 	a.checkLock.Lock()
 	defer a.checkLock.Unlock()
@@ -1137,6 +1237,9 @@ func (a *Agent) ShutdownAgent() error {
 	for _, chk := range a.checkTCPs {
 		chk.Stop()
 	}
+	for _, chk := range a.checkGRPCs {
+		chk.Stop()
+	}
 
 	var err error
 	if a.delegate != nil {
@@ -1148,6 +1251,8 @@ func (a *Agent) ShutdownAgent() error {
 		}
 	}
 
+	a.dockerResults.Stop()
+
 	pidErr := a.deletePid()
 	if pidErr != nil {
 		a.logger.Println("[WARN] agent: could not delete pid file ", pidErr)
@@ -1203,6 +1308,14 @@ func (a *Agent) RetryJoinCh() <-chan error {
 	return a.retryJoinCh
 }
 
+// RetryJoinStatusCh is a channel that transports the state transitions of
+// the retry join process, for example to gate readiness on the join. If
+// the channel isn't read, older events are dropped so that the latest ones
+// are kept.
+func (a *Agent) RetryJoinStatusCh() <-chan RetryJoinEvent {
+	return a.retryJoinStatusCh
+}
+
 // ShutdownCh is used to return a channel that can be
 // selected to wait for the agent to perform a shutdown.
 func (a *Agent) ShutdownCh() <-chan struct{} {
@@ -1214,6 +1327,11 @@ func (a *Agent) JoinLAN(addrs []string) (n int, err error) {
 	a.logger.Printf("[INFO] agent: (LAN) joining: %v", addrs)
 	n, err = a.delegate.JoinLAN(addrs)
 	a.logger.Printf("[INFO] agent: (LAN) joined: %d Err: %v", n, err)
+	if err == nil {
+		a.lastJoinLock.Lock()
+		a.lastJoinLAN = time.Now()
+		a.lastJoinLock.Unlock()
+	}
 	if err == nil && a.joinLANNotifier != nil {
 		if notifErr := a.joinLANNotifier.Notify(systemd.Ready); notifErr != nil {
 			a.logger.Printf("[DEBUG] agent: systemd notify failed: %v", notifErr)
@@ -1231,6 +1349,11 @@ func (a *Agent) JoinWAN(addrs []string) (n int, err error) {
 		err = fmt.Errorf("Must be a server to join WAN cluster")
 	}
 	a.logger.Printf("[INFO] agent: (WAN) joined: %d Err: %v", n, err)
+	if err == nil {
+		a.lastJoinLock.Lock()
+		a.lastJoinWAN = time.Now()
+		a.lastJoinLock.Unlock()
+	}
 	return
 }
 
@@ -1483,6 +1606,9 @@ func (a *Agent) AddService(service *structs.NodeService, chkTypes []*structs.Che
 		if !check.Valid() {
 			return fmt.Errorf("Check type is not valid")
 		}
+		if err := check.Validate(); err != nil {
+			return fmt.Errorf("Check type is not valid: %v", err)
+		}
 	}
 
 	// Warn if the service name is incompatible with DNS
@@ -1598,6 +1724,11 @@ func (a *Agent) AddCheck(check *structs.HealthCheck, chkType *structs.CheckType,
 	if chkType != nil && !chkType.Valid() {
 		return fmt.Errorf("Check type is not valid")
 	}
+	if chkType != nil {
+		if err := chkType.Validate(); err != nil {
+			return fmt.Errorf("Check %q: %v", check.CheckID, err)
+		}
+	}
 
 	if check.ServiceID != "" {
 		svc, ok := a.state.Services()[check.ServiceID]
@@ -1678,8 +1809,8 @@ func (a *Agent) AddCheck(check *structs.HealthCheck, chkType *structs.CheckType,
 			tcp.Start()
 			a.checkTCPs[check.CheckID] = tcp
 
-		} else if chkType.IsDocker() {
-			if existing, ok := a.checkDockers[check.CheckID]; ok {
+		} else if chkType.IsGRPC() {
+			if existing, ok := a.checkGRPCs[check.CheckID]; ok {
 				existing.Stop()
 			}
 			if chkType.Interval < MinInterval {
@@ -1688,18 +1819,93 @@ func (a *Agent) AddCheck(check *structs.HealthCheck, chkType *structs.CheckType,
 				chkType.Interval = MinInterval
 			}
 
+			grpc := &CheckGRPC{
+				Notify:        a.state,
+				CheckID:       check.CheckID,
+				GRPC:          chkType.GRPC,
+				Interval:      chkType.Interval,
+				Timeout:       chkType.Timeout,
+				Logger:        a.logger,
+				UseTLS:        chkType.GRPCUseTLS,
+				TLSSkipVerify: chkType.TLSSkipVerify,
+				TLSServerName: chkType.TLSServerName,
+			}
+			grpc.Start()
+			a.checkGRPCs[check.CheckID] = grpc
+
+		} else if chkType.IsDocker() {
+			// The check is validated before the existing one is stopped,
+			// so that an invalid update leaves it running.
+			if chkType.Privileged && !a.config.EnablePrivilegedDockerChecks {
+				return fmt.Errorf("Check %q requests a privileged exec but privileged Docker checks are not enabled", check.CheckID)
+			}
+			killSignal, err := ParseKillSignal(chkType.KillSignal)
+			if err != nil {
+				return fmt.Errorf("Check %q has an invalid kill_signal: %v", check.CheckID, err)
+			}
+			outputEncoding, err := ParseOutputEncoding(chkType.OutputEncoding)
+			if err != nil {
+				return fmt.Errorf("Check %q has an invalid output_encoding: %v", check.CheckID, err)
+			}
+			expect, err := stdoutExpectation(chkType)
+			if err != nil {
+				return fmt.Errorf("Check %q has an invalid stdout_matches: %v", check.CheckID, err)
+			}
+			clientConfig := a.dockerClientConfig()
+			if chkType.ContainerRuntime != "" {
+				clientConfig.ContainerRuntime = chkType.ContainerRuntime
+			}
+			runtime, err := ParseContainerRuntime(clientConfig.ContainerRuntime)
+			if err != nil {
+				return fmt.Errorf("Check %q has an invalid container_runtime: %v", check.CheckID, err)
+			}
+			if len(chkType.DockerContainerLabels) > 0 && (runtime == ContainerRuntimeLibpod || runtime == ContainerRuntimeContainerd) {
+				return fmt.Errorf("Check %q can't use Docker container labels with the %s runtime", check.CheckID, runtime)
+			}
+			if chkType.Interval < MinInterval {
+				a.logger.Println(fmt.Sprintf("[WARN] agent: check '%s' has interval below minimum of %v",
+					check.CheckID, MinInterval))
+				chkType.Interval = MinInterval
+			}
+
 			dockerCheck := &CheckDocker{
-				Notify:            a.state,
-				CheckID:           check.CheckID,
-				DockerContainerID: chkType.DockerContainerID,
-				Shell:             chkType.Shell,
-				Script:            chkType.Script,
-				Interval:          chkType.Interval,
-				Logger:            a.logger,
+				Notify:                a.state,
+				CheckID:               check.CheckID,
+				DockerContainerID:     chkType.DockerContainerID,
+				DockerContainerLabels: chkType.DockerContainerLabels,
+				Shell:                 chkType.Shell,
+				Privileged:            chkType.Privileged,
+				JSONStatusField:       chkType.JSONStatusField,
+				Script:                chkType.Script,
+				ScriptTemplate:        chkType.ScriptTemplate,
+				WarningExitCodes:      chkType.WarningExitCodes,
+				DiscardStderr:         chkType.DiscardStderr,
+				StartGracePeriod:      chkType.StartGracePeriod,
+				KillSignal:            killSignal,
+				KillGracePeriod:       chkType.KillGracePeriod,
+				Locale:                chkType.Locale,
+				ConsoleWidth:          chkType.ConsoleWidth,
+				ConsoleHeight:         chkType.ConsoleHeight,
+				CheckContainerState:   chkType.CheckContainerState,
+				OutputEncoding:        outputEncoding,
+				Expect:                expect,
+				NodeName:              a.config.NodeName,
+				Interval:              chkType.Interval,
+				Timeout:               chkType.Timeout,
+				Logger:                a.logger,
+				ClientConfig:          clientConfig,
+				Execs:                 a.dockerExecs,
+				Slots:                 a.dockerSlots,
+				Pause:                 a.dockerPause,
+				Results:               a.dockerResults,
+				Pressure:              a.dockerPressure,
 			}
 			if err := dockerCheck.Init(); err != nil {
 				return err
 			}
+			if existing, ok := a.checkDockers[check.CheckID]; ok {
+				existing.Stop()
+			}
 			dockerCheck.Start()
 			a.checkDockers[check.CheckID] = dockerCheck
 		} else if chkType.IsMonitor() {
@@ -1778,6 +1984,10 @@ func (a *Agent) RemoveCheck(checkID types.CheckID, persist bool) error {
 		check.Stop()
 		delete(a.checkTCPs, checkID)
 	}
+	if check, ok := a.checkGRPCs[checkID]; ok {
+		check.Stop()
+		delete(a.checkGRPCs, checkID)
+	}
 	if check, ok := a.checkTTLs[checkID]; ok {
 		check.Stop()
 		delete(a.checkTTLs, checkID)
@@ -1794,6 +2004,63 @@ func (a *Agent) RemoveCheck(checkID types.CheckID, persist bool) error {
 	return nil
 }
 
+// DockerCheckResults returns the result of the most recent run of each
+// Docker check, keyed by check ID. Checks which have not run yet are
+// omitted.
+func (a *Agent) DockerCheckResults() map[types.CheckID]*ExecResult {
+	a.checkLock.Lock()
+	defer a.checkLock.Unlock()
+
+	results := make(map[types.CheckID]*ExecResult)
+	for checkID, check := range a.checkDockers {
+		if res := check.LastResult(); res != nil {
+			results[checkID] = res
+		}
+	}
+	return results
+}
+
+// dockerCheckExecs returns the most recent exec of each Docker check which
+// ran in a single container, keyed by check ID.
+func (a *Agent) dockerCheckExecs() map[types.CheckID]*structs.CheckExec {
+	a.checkLock.Lock()
+	defer a.checkLock.Unlock()
+
+	execs := make(map[types.CheckID]*structs.CheckExec)
+	for checkID, check := range a.checkDockers {
+		if exec := check.LastExec(); exec != nil {
+			execs[checkID] = exec
+		}
+	}
+	return execs
+}
+
+// DockerCheckCommands returns the command each Docker check runs in its
+// container, keyed by check ID, with the audit_redact rules applied.
+func (a *Agent) DockerCheckCommands() map[types.CheckID][]string {
+	a.checkLock.Lock()
+	defer a.checkLock.Unlock()
+
+	cmds := make(map[types.CheckID][]string)
+	for checkID, check := range a.checkDockers {
+		cmds[checkID] = check.Command()
+	}
+	return cmds
+}
+
+// dockerClientConfig returns the configuration of the client of a Docker
+// check, with the agent's TLS files when use_agent_tls is set.
+func (a *Agent) dockerClientConfig() DockerConfig {
+	cfg := a.config.DockerConfig
+	cfg.breaker = a.dockerBreaker
+	if cfg.UseAgentTLS {
+		cfg.TLSCAFile = a.config.CAFile
+		cfg.TLSCertFile = a.config.CertFile
+		cfg.TLSKeyFile = a.config.KeyFile
+	}
+	return cfg
+}
+
 // updateTTLCheck is used to update the status of a TTL check via the Agent API.
 func (a *Agent) updateTTLCheck(checkID types.CheckID, status, output string) error {
 	a.checkLock.Lock()
@@ -1913,11 +2180,23 @@ func (a *Agent) Stats() map[string]map[string]string {
 	toString := func(v uint64) string {
 		return strconv.FormatUint(v, 10)
 	}
+	joinTime := func(t time.Time) string {
+		if t.IsZero() {
+			return "never"
+		}
+		return t.UTC().Format(time.RFC3339)
+	}
+	a.lastJoinLock.Lock()
+	lastJoinLAN, lastJoinWAN := a.lastJoinLAN, a.lastJoinWAN
+	a.lastJoinLock.Unlock()
+
 	stats := a.delegate.Stats()
 	stats["agent"] = map[string]string{
 		"check_monitors": toString(uint64(len(a.checkMonitors))),
 		"check_ttls":     toString(uint64(len(a.checkTTLs))),
 		"checks":         toString(uint64(len(a.state.checks))),
+		"last_join_lan":  joinTime(lastJoinLAN),
+		"last_join_wan":  joinTime(lastJoinWAN),
 		"services":       toString(uint64(len(a.state.services))),
 	}
 
@@ -2284,6 +2563,43 @@ func (a *Agent) DisableNodeMaintenance() {
 	a.logger.Printf("[INFO] agent: Node left maintenance mode")
 }
 
+// PauseDockerChecks pauses all Docker checks of the agent. They keep their
+// last status and don't make requests to the Docker daemon until
+// ResumeDockerChecks is called. The pause isn't kept across restarts.
+func (a *Agent) PauseDockerChecks(reason string) {
+	if reason == "" {
+		reason = defaultDockerPauseReason
+	}
+	a.dockerPause.Pause(reason)
+	a.logger.Printf("[INFO] agent: Docker checks paused: %s", reason)
+}
+
+// ResumeDockerChecks lets the Docker checks of the agent run again.
+func (a *Agent) ResumeDockerChecks() {
+	if paused, _ := a.dockerPause.Paused(); !paused {
+		return
+	}
+	a.dockerPause.Resume()
+	a.logger.Printf("[INFO] agent: Docker checks resumed")
+}
+
+// SetDockerResultHandler sets a handler which is passed the result of every
+// run of the agent's Docker checks. The handler is called from a single
+// goroutine and results are dropped while it falls behind, so a slow
+// handler doesn't hold up the checks. A nil handler stops passing results.
+func (a *Agent) SetDockerResultHandler(h DockerResultHandler) {
+	a.dockerResults.SetHandler(h)
+}
+
+// SetRetryJoinBackoff replaces the exponential backoff between the attempts
+// of the LAN and WAN retry joins, configured with retry_interval and
+// retry_max_interval, with the given ones. A nil Backoff keeps the default.
+// It must be called before the agent is started.
+func (a *Agent) SetRetryJoinBackoff(lan, wan Backoff) {
+	a.retryJoinBackoff = lan
+	a.retryJoinWanBackoff = wan
+}
+
 func (a *Agent) ReloadConfig(newCfg *Config) error {
 	// Bulk update the services and checks
 	a.PauseSync()
@@ -2301,12 +2617,21 @@ func (a *Agent) ReloadConfig(newCfg *Config) error {
 	if err := a.unloadChecks(); err != nil {
 		return fmt.Errorf("Failed unloading checks: %s", err)
 	}
+	if n := a.dockerExecs.CancelAll(); n > 0 {
+		a.logger.Printf("[INFO] agent: Cancelled %d running Docker check execs", n)
+	}
 	a.unloadMetadata()
 
 	// Reload service/check definitions and metadata.
 	if err := a.loadServices(newCfg); err != nil {
 		return fmt.Errorf("Failed reloading services: %s", err)
 	}
+
+	// The services of containers were unloaded with the others, so the
+	// registrator registers them again.
+	if a.dockerRegistrator != nil {
+		a.dockerRegistrator.Resync()
+	}
 	if err := a.loadChecks(newCfg); err != nil {
 		return fmt.Errorf("Failed reloading checks: %s", err)
 	}
@@ -2318,5 +2643,7 @@ func (a *Agent) ReloadConfig(newCfg *Config) error {
 		return fmt.Errorf("Failed reloading watches: %v", err)
 	}
 
+	a.reloadRetryJoin(newCfg)
+
 	return nil
 }
@@ -125,6 +125,16 @@ func (s *HTTPServer) AgentChecks(resp http.ResponseWriter, req *http.Request) (i
 		}
 	}
 
+	// The checks are those of the local state, so the last execs of the
+	// Docker checks are added to copies.
+	for checkID, exec := range s.agent.dockerCheckExecs() {
+		if c, ok := checks[checkID]; ok {
+			c = c.Clone()
+			c.Exec = exec
+			checks[checkID] = c
+		}
+	}
+
 	return checks, nil
 }
 
@@ -227,7 +237,7 @@ func (s *HTTPServer) syncChanges() {
 	}
 }
 
-const invalidCheckMessage = "Must provide TTL or Script/DockerContainerID/HTTP/TCP and Interval"
+const invalidCheckMessage = "Must provide TTL or Script/DockerContainerID/HTTP/TCP/GRPC and Interval"
 
 func (s *HTTPServer) AgentRegisterCheck(resp http.ResponseWriter, req *http.Request) (interface{}, error) {
 	var args structs.CheckDefinition
@@ -264,6 +274,11 @@ func (s *HTTPServer) AgentRegisterCheck(resp http.ResponseWriter, req *http.Requ
 		fmt.Fprint(resp, invalidCheckMessage)
 		return nil, nil
 	}
+	if err := chkType.Validate(); err != nil {
+		resp.WriteHeader(400)
+		fmt.Fprint(resp, err.Error())
+		return nil, nil
+	}
 
 	// Get the provided token, if any, and vet against any ACL policies.
 	var token string
@@ -477,6 +492,11 @@ func (s *HTTPServer) AgentRegisterService(resp http.ResponseWriter, req *http.Re
 			fmt.Fprint(resp, invalidCheckMessage)
 			return nil, nil
 		}
+		if err := check.Validate(); err != nil {
+			resp.WriteHeader(400)
+			fmt.Fprint(resp, err.Error())
+			return nil, nil
+		}
 	}
 
 	// Get the provided token, if any, and vet against any ACL policies.
@@ -610,6 +630,49 @@ func (s *HTTPServer) AgentNodeMaintenance(resp http.ResponseWriter, req *http.Re
 	return nil, nil
 }
 
+// AgentDockerPause pauses or resumes the Docker checks of the agent.
+func (s *HTTPServer) AgentDockerPause(resp http.ResponseWriter, req *http.Request) (interface{}, error) {
+	// Only PUT supported
+	if req.Method != "PUT" {
+		resp.WriteHeader(405)
+		return nil, nil
+	}
+
+	// Ensure we have some action
+	params := req.URL.Query()
+	if _, ok := params["enable"]; !ok {
+		resp.WriteHeader(400)
+		fmt.Fprint(resp, "Missing value for enable")
+		return nil, nil
+	}
+
+	raw := params.Get("enable")
+	enable, err := strconv.ParseBool(raw)
+	if err != nil {
+		resp.WriteHeader(400)
+		fmt.Fprintf(resp, "Invalid value for enable: %q", raw)
+		return nil, nil
+	}
+
+	// Get the provided token, if any, and vet against any ACL policies.
+	var token string
+	s.parseToken(req, &token)
+	acl, err := s.agent.resolveToken(token)
+	if err != nil {
+		return nil, err
+	}
+	if acl != nil && !acl.NodeWrite(s.agent.config.NodeName) {
+		return nil, errPermissionDenied
+	}
+
+	if enable {
+		s.agent.PauseDockerChecks(params.Get("reason"))
+	} else {
+		s.agent.ResumeDockerChecks()
+	}
+	return nil, nil
+}
+
 func (s *HTTPServer) AgentMonitor(resp http.ResponseWriter, req *http.Request) (interface{}, error) {
 	// Only GET supported.
 	if req.Method != "GET" {
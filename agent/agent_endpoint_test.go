@@ -14,6 +14,7 @@ import (
 	"time"
 
 	"github.com/hashicorp/consul/agent/consul/structs"
+	"github.com/hashicorp/consul/agent/mock"
 	"github.com/hashicorp/consul/api"
 	"github.com/hashicorp/consul/logger"
 	"github.com/hashicorp/consul/testutil/retry"
@@ -130,6 +131,49 @@ func TestAgent_Checks(t *testing.T) {
 	}
 }
 
+func TestAgent_Checks_DockerExec(t *testing.T) {
+	t.Parallel()
+	a := NewTestAgent(t.Name(), nil)
+	defer a.Shutdown()
+
+	chk := &structs.HealthCheck{
+		Node:    a.Config.NodeName,
+		CheckID: "docker",
+		Name:    "docker",
+		Status:  api.HealthPassing,
+	}
+	a.state.AddCheck(chk, "")
+	dockerCheck := &CheckDocker{
+		Notify:            mock.NewNotify(),
+		CheckID:           chk.CheckID,
+		Script:            "/health.sh",
+		DockerContainerID: "54432bad1fc7",
+		Shell:             "/bin/sh",
+		Logger:            a.logger,
+		dockerClient:      &fakeDockerClientWithOutput{output: "OK"},
+	}
+	dockerCheck.check()
+	a.checkLock.Lock()
+	a.checkDockers[chk.CheckID] = dockerCheck
+	a.checkLock.Unlock()
+
+	req, _ := http.NewRequest("GET", "/v1/agent/checks", nil)
+	obj, err := a.srv.AgentChecks(nil, req)
+	if err != nil {
+		t.Fatalf("Err: %v", err)
+	}
+	val := obj.(map[types.CheckID]*structs.HealthCheck)
+	exec := val["docker"].Exec
+	if exec == nil || exec.ExitCode != 0 || exec.OutputBytes != 2 || exec.Truncated {
+		t.Fatalf("bad exec: %#v", exec)
+	}
+
+	// The check of the local state is left alone.
+	if c := a.state.Checks()["docker"]; c.Exec != nil {
+		t.Fatalf("bad check: %#v", c)
+	}
+}
+
 func TestAgent_Checks_ACLFilter(t *testing.T) {
 	t.Parallel()
 	a := NewTestAgent(t.Name(), TestACLConfig())
@@ -402,6 +446,12 @@ func TestAgent_Join(t *testing.T) {
 	if len(a1.LANMembers()) != 2 {
 		t.Fatalf("should have 2 members")
 	}
+	if got := a1.Stats()["agent"]["last_join_lan"]; got == "never" {
+		t.Fatalf("got last LAN join %q", got)
+	}
+	if got, want := a2.Stats()["agent"]["last_join_lan"], "never"; got != want {
+		t.Fatalf("got last LAN join %q want %q", got, want)
+	}
 
 	retry.Run(t, func(r *retry.R) {
 		if got, want := len(a2.LANMembers()), 2; got != want {
@@ -728,6 +778,31 @@ func TestAgent_RegisterCheck_BadStatus(t *testing.T) {
 	}
 }
 
+func TestAgent_RegisterCheck_InvalidDocker(t *testing.T) {
+	t.Parallel()
+	a := NewTestAgent(t.Name(), nil)
+	defer a.Shutdown()
+
+	args := &structs.CheckDefinition{
+		Name:                  "test",
+		Script:                "exit 0",
+		DockerContainerID:     "54432bad1fc7",
+		DockerContainerLabels: []string{"app=web"},
+		Interval:              time.Hour,
+	}
+	req, _ := http.NewRequest("GET", "/v1/agent/check/register", jsonReader(args))
+	resp := httptest.NewRecorder()
+	if _, err := a.srv.AgentRegisterCheck(resp, req); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if resp.Code != 400 || !strings.Contains(resp.Body.String(), "both a Docker container ID and container labels") {
+		t.Fatalf("got %d %q", resp.Code, resp.Body.String())
+	}
+	if _, ok := a.state.Checks()["test"]; ok {
+		t.Fatalf("check should not be registered")
+	}
+}
+
 func TestAgent_RegisterCheck_ACLDeny(t *testing.T) {
 	t.Parallel()
 	a := NewTestAgent(t.Name(), TestACLConfig())
@@ -1526,6 +1601,55 @@ func TestAgent_NodeMaintenance_ACLDeny(t *testing.T) {
 	})
 }
 
+func TestAgent_DockerPause(t *testing.T) {
+	t.Parallel()
+	a := NewTestAgent(t.Name(), nil)
+	defer a.Shutdown()
+
+	// Fails when no enable flag provided
+	req, _ := http.NewRequest("PUT", "/v1/agent/docker/pause", nil)
+	resp := httptest.NewRecorder()
+	if _, err := a.srv.AgentDockerPause(resp, req); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if resp.Code != 400 {
+		t.Fatalf("expected 400, got %d", resp.Code)
+	}
+
+	req, _ = http.NewRequest("PUT", "/v1/agent/docker/pause?enable=true&reason=upgrade", nil)
+	resp = httptest.NewRecorder()
+	if _, err := a.srv.AgentDockerPause(resp, req); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if paused, reason := a.dockerPause.Paused(); !paused || reason != "upgrade" {
+		t.Fatalf("got paused %v reason %q", paused, reason)
+	}
+
+	req, _ = http.NewRequest("PUT", "/v1/agent/docker/pause?enable=false", nil)
+	resp = httptest.NewRecorder()
+	if _, err := a.srv.AgentDockerPause(resp, req); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if paused, _ := a.dockerPause.Paused(); paused {
+		t.Fatal("should have resumed the Docker checks")
+	}
+}
+
+func TestAgent_DockerPause_ACLDeny(t *testing.T) {
+	t.Parallel()
+	a := NewTestAgent(t.Name(), TestACLConfig())
+	defer a.Shutdown()
+
+	req, _ := http.NewRequest("PUT", "/v1/agent/docker/pause?enable=true", nil)
+	if _, err := a.srv.AgentDockerPause(nil, req); !isPermissionDenied(err) {
+		t.Fatalf("err: %v", err)
+	}
+	req, _ = http.NewRequest("PUT", "/v1/agent/docker/pause?enable=true&token=root", nil)
+	if _, err := a.srv.AgentDockerPause(nil, req); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
 func TestAgent_RegisterCheck_Service(t *testing.T) {
 	t.Parallel()
 	a := NewTestAgent(t.Name(), nil)
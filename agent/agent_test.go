@@ -733,6 +733,263 @@ func TestAgent_AddCheck_MinInterval(t *testing.T) {
 	}
 }
 
+func TestAgent_AddCheck_PrivilegedDocker(t *testing.T) {
+	t.Parallel()
+	a := NewTestAgent(t.Name(), nil)
+	defer a.Shutdown()
+
+	health := &structs.HealthCheck{
+		Node:    "foo",
+		CheckID: "docker",
+		Name:    "docker",
+		Status:  api.HealthCritical,
+	}
+	chk := &structs.CheckType{
+		Script:            "exit 0",
+		DockerContainerID: "54432bad1fc7",
+		Interval:          time.Second,
+		Privileged:        true,
+	}
+	err := a.AddCheck(health, chk, false, "")
+	if err == nil || !strings.Contains(err.Error(), "privileged Docker checks are not enabled") {
+		t.Fatalf("err: %v", err)
+	}
+	if _, ok := a.state.Checks()["docker"]; ok {
+		t.Fatalf("check should not be registered")
+	}
+}
+
+func TestAgent_AddCheck_DockerKillSignal(t *testing.T) {
+	t.Parallel()
+	a := NewTestAgent(t.Name(), nil)
+	defer a.Shutdown()
+
+	health := &structs.HealthCheck{
+		Node:    "foo",
+		CheckID: "docker",
+		Name:    "docker",
+		Status:  api.HealthCritical,
+	}
+	chk := &structs.CheckType{
+		Script:            "exit 0",
+		DockerContainerID: "54432bad1fc7",
+		Interval:          time.Second,
+		KillSignal:        "STOP",
+	}
+	err := a.AddCheck(health, chk, false, "")
+	if err == nil || !strings.Contains(err.Error(), "invalid kill_signal") {
+		t.Fatalf("err: %v", err)
+	}
+	if _, ok := a.state.Checks()["docker"]; ok {
+		t.Fatalf("check should not be registered")
+	}
+}
+
+func TestAgent_AddCheck_DockerConsoleSize(t *testing.T) {
+	t.Parallel()
+	a := NewTestAgent(t.Name(), nil)
+	defer a.Shutdown()
+
+	health := &structs.HealthCheck{
+		Node:    "foo",
+		CheckID: "docker",
+		Name:    "docker",
+		Status:  api.HealthCritical,
+	}
+	chk := &structs.CheckType{
+		Script:            "exit 0",
+		DockerContainerID: "54432bad1fc7",
+		Interval:          time.Second,
+		ConsoleWidth:      -1,
+	}
+	err := a.AddCheck(health, chk, false, "")
+	if err == nil || !strings.Contains(err.Error(), "negative console_width") {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestAgent_AddCheck_DockerInvalidUpdate(t *testing.T) {
+	t.Parallel()
+	a := NewTestAgent(t.Name(), nil)
+	defer a.Shutdown()
+
+	health := &structs.HealthCheck{
+		Node:    "foo",
+		CheckID: "docker",
+		Name:    "docker",
+		Status:  api.HealthCritical,
+	}
+	chk := &structs.CheckType{
+		Script:            "exit 0",
+		DockerContainerID: "54432bad1fc7",
+		Interval:          time.Hour,
+	}
+	if err := a.AddCheck(health, chk, false, ""); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	existing := a.checkDockers["docker"]
+
+	// An invalid update is rejected and leaves the existing check running.
+	for _, chk := range []*structs.CheckType{
+		{Script: "exit 0", DockerContainerID: "54432bad1fc7", Interval: time.Hour, KillSignal: "STOP"},
+		{Script: "exit 0", DockerContainerID: "54432bad1fc7", Interval: time.Hour, ConsoleHeight: -1},
+	} {
+		if err := a.AddCheck(health, chk, false, ""); err == nil {
+			t.Fatalf("%#v: should fail", chk)
+		}
+	}
+	if a.checkDockers["docker"] != existing {
+		t.Fatalf("check should not be replaced")
+	}
+	existing.stopLock.Lock()
+	stopped := existing.stop
+	existing.stopLock.Unlock()
+	if stopped {
+		t.Fatalf("check should not be stopped")
+	}
+}
+
+func TestAgent_AddCheck_DockerContainerRuntime(t *testing.T) {
+	t.Parallel()
+	a := NewTestAgent(t.Name(), nil)
+	defer a.Shutdown()
+
+	health := &structs.HealthCheck{
+		Node:    "foo",
+		CheckID: "docker",
+		Name:    "docker",
+		Status:  api.HealthCritical,
+	}
+	chk := &structs.CheckType{
+		Script:            "exit 0",
+		DockerContainerID: "54432bad1fc7",
+		Interval:          time.Second,
+		ContainerRuntime:  "rkt",
+	}
+	err := a.AddCheck(health, chk, false, "")
+	if err == nil || !strings.Contains(err.Error(), "invalid container_runtime") {
+		t.Fatalf("err: %v", err)
+	}
+
+	chk = &structs.CheckType{
+		Script:                "exit 0",
+		DockerContainerLabels: []string{"app=web"},
+		Interval:              time.Second,
+		ContainerRuntime:      "containerd",
+	}
+	err = a.AddCheck(health, chk, false, "")
+	if err == nil || !strings.Contains(err.Error(), "labels with the containerd runtime") {
+		t.Fatalf("err: %v", err)
+	}
+
+	chk = &structs.CheckType{
+		Script:            "exit 0",
+		DockerContainerID: "54432bad1fc7",
+		Interval:          time.Hour,
+		ContainerRuntime:  "podman",
+	}
+	if err := a.AddCheck(health, chk, false, ""); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if got := a.checkDockers["docker"].ClientConfig.ContainerRuntime; got != "podman" {
+		t.Fatalf("got runtime %q", got)
+	}
+
+	chk = &structs.CheckType{
+		Script:            "exit 0",
+		DockerContainerID: "54432bad1fc7",
+		Interval:          time.Hour,
+		ContainerRuntime:  "libpod",
+	}
+	if err := a.AddCheck(health, chk, false, ""); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, ok := a.checkDockers["docker"].dockerClient.(*libpodClient); !ok {
+		t.Fatalf("got client %#v", a.checkDockers["docker"].dockerClient)
+	}
+}
+
+func TestAgent_AddCheck_DockerContainerState(t *testing.T) {
+	t.Parallel()
+	a := NewTestAgent(t.Name(), nil)
+	defer a.Shutdown()
+
+	health := &structs.HealthCheck{
+		Node:    "foo",
+		CheckID: "docker",
+		Name:    "docker",
+		Status:  api.HealthCritical,
+	}
+	chk := &structs.CheckType{
+		Script:                "exit 0",
+		DockerContainerLabels: []string{"app=web"},
+		Interval:              time.Second,
+		CheckContainerState:   true,
+	}
+	err := a.AddCheck(health, chk, false, "")
+	if err == nil || !strings.Contains(err.Error(), "check_container_state") {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestAgent_AddCheck_DockerStdoutMatches(t *testing.T) {
+	t.Parallel()
+	a := NewTestAgent(t.Name(), nil)
+	defer a.Shutdown()
+
+	health := &structs.HealthCheck{
+		Node:    "foo",
+		CheckID: "docker",
+		Name:    "docker",
+		Status:  api.HealthCritical,
+	}
+	chk := &structs.CheckType{
+		Script:            "exit 0",
+		DockerContainerID: "54432bad1fc7",
+		Interval:          time.Second,
+		StdoutMatches:     "(",
+	}
+	err := a.AddCheck(health, chk, false, "")
+	if err == nil || !strings.Contains(err.Error(), "stdout_matches") {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestAgent_AddCheck_GRPC(t *testing.T) {
+	t.Parallel()
+	a := NewTestAgent(t.Name(), nil)
+	defer a.Shutdown()
+
+	health := &structs.HealthCheck{
+		Node:    "foo",
+		CheckID: "grpc",
+		Name:    "grpc",
+		Status:  api.HealthCritical,
+	}
+	chk := &structs.CheckType{
+		GRPC:          "127.0.0.1:50051/api",
+		GRPCUseTLS:    true,
+		TLSServerName: "api.internal",
+		Interval:      15 * time.Second,
+	}
+	if err := a.AddCheck(health, chk, false, ""); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	check, ok := a.checkGRPCs["grpc"]
+	if !ok {
+		t.Fatalf("missing grpc check")
+	}
+	if !check.UseTLS || check.TLSServerName != "api.internal" {
+		t.Fatalf("bad: %#v", check)
+	}
+	if err := a.RemoveCheck("grpc", false); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, ok := a.checkGRPCs["grpc"]; ok {
+		t.Fatalf("should have removed the grpc check")
+	}
+}
+
 func TestAgent_AddCheck_MissingService(t *testing.T) {
 	t.Parallel()
 	a := NewTestAgent(t.Name(), nil)
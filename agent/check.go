@@ -1,25 +1,35 @@
 package agent
 
 import (
+	"bytes"
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"os"
 	"os/exec"
+	"regexp"
+	"strings"
 	"sync"
 	"syscall"
+	"text/template"
 	"time"
+	"unicode/utf8"
 
 	"github.com/armon/circbuf"
-	docker "github.com/fsouza/go-dockerclient"
+	"github.com/armon/go-metrics"
 	"github.com/hashicorp/consul/agent/consul/structs"
 	"github.com/hashicorp/consul/api"
 	"github.com/hashicorp/consul/lib"
 	"github.com/hashicorp/consul/types"
 	"github.com/hashicorp/go-cleanhttp"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 )
 
 const (
@@ -33,6 +43,26 @@ const (
 	// from being captured
 	CheckBufSize = 4 * 1024 // 4KB
 
+	// dockerTruncationWarnRuns is the number of consecutive runs of a
+	// Docker check with truncated output before a warning is logged.
+	dockerTruncationWarnRuns = 3
+
+	// dockerTruncationWarnInterval is the minimum time between warnings
+	// about the truncated output of a Docker check.
+	dockerTruncationWarnInterval = 10 * time.Minute
+
+	// defaultDockerKillGracePeriod is how long the script of a Docker check
+	// has to exit after its kill signal before it's sent KILL.
+	defaultDockerKillGracePeriod = 5 * time.Second
+
+	// dockerPolicyCheckTimeout is how long looking up the container of a
+	// Docker check for the container policy may take at registration.
+	dockerPolicyCheckTimeout = 5 * time.Second
+
+	// dockerCheckInspectTimeout is how long inspecting the container on a
+	// run of a Docker check without a timeout may take.
+	dockerCheckInspectTimeout = 10 * time.Second
+
 	// UserAgent is the value of the User-Agent header
 	// for HTTP health checks.
 	UserAgent = "Consul Health Check"
@@ -516,12 +546,125 @@ func (c *CheckTCP) check() {
 	c.Notify.UpdateCheck(c.CheckID, api.HealthPassing, fmt.Sprintf("TCP connect %s: Success", c.TCP))
 }
 
-// DockerClient defines an interface for a docker client
-// which is used for injecting a fake client during tests.
-type DockerClient interface {
-	CreateExec(docker.CreateExecOptions) (*docker.Exec, error)
-	StartExec(string, docker.StartExecOptions) error
-	InspectExec(string) (*docker.ExecInspect, error)
+// CheckGRPC is used to periodically call the standard gRPC health checking
+// protocol of a gRPC server. GRPC is the "host:port" of the server and
+// may be followed by "/service" to check a single service instead of the
+// server as a whole. SERVING is passing, UNKNOWN is warning and any other
+// status or error is critical.
+type CheckGRPC struct {
+	Notify   CheckNotifier
+	CheckID  types.CheckID
+	GRPC     string
+	Interval time.Duration
+	Timeout  time.Duration
+	Logger   *log.Logger
+
+	// UseTLS connects to the server over TLS. Its certificate is
+	// verified against the system's roots unless TLSSkipVerify is set,
+	// with TLSServerName as the name of the server if it's set.
+	UseTLS        bool
+	TLSSkipVerify bool
+	TLSServerName string
+
+	// rootCAs replaces the system's roots, for tests.
+	rootCAs *x509.CertPool
+
+	stop     bool
+	stopCh   chan struct{}
+	stopLock sync.Mutex
+}
+
+// Start is used to start a gRPC check.
+// The check runs until stop is called
+func (c *CheckGRPC) Start() {
+	c.stopLock.Lock()
+	defer c.stopLock.Unlock()
+	c.stop = false
+	c.stopCh = make(chan struct{})
+	go c.run()
+}
+
+// Stop is used to stop a gRPC check.
+func (c *CheckGRPC) Stop() {
+	c.stopLock.Lock()
+	defer c.stopLock.Unlock()
+	if !c.stop {
+		c.stop = true
+		close(c.stopCh)
+	}
+}
+
+// run is invoked by a goroutine to run until Stop() is called
+func (c *CheckGRPC) run() {
+	// Get the randomized initial pause time
+	initialPauseTime := lib.RandomStagger(c.Interval)
+	c.Logger.Printf("[DEBUG] agent: pausing %v before first gRPC health check of %s", initialPauseTime, c.GRPC)
+	next := time.After(initialPauseTime)
+	for {
+		select {
+		case <-next:
+			c.check()
+			next = time.After(c.Interval)
+		case <-c.stopCh:
+			return
+		}
+	}
+}
+
+// timeout returns how long a call may take, like the socket timeout of a
+// TCP check.
+func (c *CheckGRPC) timeout() time.Duration {
+	if c.Timeout > 0 && c.Timeout < c.Interval {
+		return c.Timeout
+	}
+	if c.Interval < 10*time.Second {
+		return c.Interval
+	}
+	return 10 * time.Second
+}
+
+// check is invoked periodically to perform the gRPC check
+func (c *CheckGRPC) check() {
+	addr, service := parseGRPCTarget(c.GRPC)
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout())
+	defer cancel()
+
+	opts := []grpc.DialOption{grpc.WithBlock()}
+	if c.UseTLS {
+		opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{
+			RootCAs:            c.rootCAs,
+			ServerName:         c.TLSServerName,
+			InsecureSkipVerify: c.TLSSkipVerify,
+		})))
+	} else {
+		opts = append(opts, grpc.WithInsecure())
+	}
+	conn, err := grpc.DialContext(ctx, addr, opts...)
+	if err != nil {
+		c.Logger.Printf("[WARN] agent: gRPC connection failed '%s': %s", c.GRPC, err)
+		c.Notify.UpdateCheck(c.CheckID, api.HealthCritical, fmt.Sprintf("gRPC connect %s: %s", addr, err))
+		return
+	}
+	defer conn.Close()
+
+	status, err := grpcHealthCheck(ctx, conn, service)
+	if err != nil {
+		c.Logger.Printf("[WARN] agent: gRPC health check failed '%s': %s", c.GRPC, grpc.ErrorDesc(err))
+		c.Notify.UpdateCheck(c.CheckID, api.HealthCritical, fmt.Sprintf("gRPC health check %s: %s", c.GRPC, grpc.ErrorDesc(err)))
+		return
+	}
+	output := fmt.Sprintf("gRPC health check %s: %s", c.GRPC, grpcHealthStatusName(status))
+	switch status {
+	case grpcHealthServing:
+		c.Logger.Printf("[DEBUG] agent: Check '%v' is passing", c.CheckID)
+		c.Notify.UpdateCheck(c.CheckID, api.HealthPassing, output)
+	case grpcHealthUnknown:
+		c.Logger.Printf("[WARN] agent: Check '%v' is now warning", c.CheckID)
+		c.Notify.UpdateCheck(c.CheckID, api.HealthWarning, output)
+	default:
+		c.Logger.Printf("[WARN] agent: Check '%v' is now critical", c.CheckID)
+		c.Notify.UpdateCheck(c.CheckID, api.HealthCritical, output)
+	}
 }
 
 // CheckDocker is used to periodically invoke a script to
@@ -537,24 +680,247 @@ type CheckDocker struct {
 	Interval          time.Duration
 	Logger            *log.Logger
 
+	// DockerContainerLabels, if set instead of DockerContainerID, runs
+	// the script in every running container which has all of the labels
+	// and aggregates the results.
+	DockerContainerLabels []string
+
+	// Timeout is how long to wait for the script to finish. The check is
+	// critical with the output captured so far if it takes longer. Zero
+	// means no timeout.
+	Timeout time.Duration
+
+	// Privileged runs the script with extended privileges inside the
+	// container. Docker does not support resource limits for execs so
+	// the script shares the limits of the container.
+	Privileged bool
+
+	// JSONStatusField, if set, makes the script report its status as a
+	// JSON object with the status in this field instead of through its
+	// exit code.
+	JSONStatusField string
+
+	// ScriptTemplate makes the script a text/template which is rendered
+	// with dockerScriptVars before every run. NodeName is the name of the
+	// agent's node used for rendering it.
+	ScriptTemplate bool
+	NodeName       string
+
+	// DiscardStderr captures only the stdout of the script so that all of
+	// the output buffer is used for it.
+	DiscardStderr bool
+
+	// WarningExitCodes are the exit codes of the script which set the check
+	// to warning instead of critical. DefaultWarningExitCodes are used if
+	// it's empty.
+	WarningExitCodes []int
+
+	// StartGracePeriod, if >0, ignores warning and critical results of the
+	// script until the container has been running for this long, so that
+	// an application which is still starting doesn't fail its check.
+	StartGracePeriod time.Duration
+
+	// KillSignal is the signal the script is killed with when it times
+	// out or is cancelled, and KillGracePeriod is how long it then has to
+	// exit before it's sent KILL. Zero uses defaultDockerKillGracePeriod.
+	KillSignal      string
+	KillGracePeriod time.Duration
+
+	// Locale, if set, is the LANG and LC_ALL of the script so that its
+	// output doesn't depend on the locale of the container.
+	Locale string
+
+	// ConsoleWidth and ConsoleHeight, if >0, are the size of the console
+	// the script formats its output for. The exec has no TTY so they're
+	// passed on as COLUMNS and LINES.
+	ConsoleWidth  int
+	ConsoleHeight int
+
+	// CheckContainerState inspects the container before every run and
+	// only runs the script if the container is running, healthy by its
+	// own health check and not restarting in a loop. The summary of the
+	// state is put in front of the output.
+	CheckContainerState bool
+
+	// OutputEncoding is the encoding of the output of the script, which
+	// is decoded to UTF-8 before it's reported. See ParseOutputEncoding.
+	OutputEncoding string
+
+	// Expect, if set, is an expectation on the stdout of the script which
+	// fails the check if it doesn't hold, even if the script exits with 0.
+	Expect *OutputExpectation
+
+	// OutputTransformer, if set, changes the output of the check before
+	// it's reported, after truncation and JSON parsing.
+	OutputTransformer OutputTransformer
+
+	// ClientConfig is the agent's configuration for the Docker client.
+	ClientConfig DockerConfig
+
+	// Execs, if set, tracks the running execs of the check so that they
+	// can be cancelled.
+	Execs *ExecTracker
+
+	// Slots, if set, limits how many Docker checks run at the same time.
+	// A run which can't get a slot within the interval is deferred.
+	Slots *CheckSemaphore
+
+	// Pause, if set, skips the runs of the check while it's paused.
+	Pause *CheckPause
+
+	// Results, if set, is passed the result of every run of the script.
+	Results *DockerResultQueue
+
+	// Pressure, if set, caches the pressure of the daemon across the
+	// checks when CheckPressure is set.
+	Pressure *PressureCache
+
 	dockerClient DockerClient
 	cmd          []string
+	tmpl         *template.Template
+	auditLog     *dockerAuditLog
+	redact       []*regexp.Regexp
+	policy       *ContainerPolicy
+	version      daemonVersionCache
 	stop         bool
 	stopCh       chan struct{}
 	stopLock     sync.Mutex
+
+	// apiVersionChecked is set once the API version of the daemon was
+	// looked up for the environment of the execs.
+	apiVersionChecked bool
+
+	// lastResult is the result of the most recent run of the script, or
+	// nil if it has not run yet or could not be started. lastErr is the
+	// error of that run.
+	lastResult     *ExecResult
+	lastErr        error
+	lastJSONOutput *JSONOutput
+	lastCmd        []string
+	lastResultLock sync.RWMutex
+
+	// truncatedRuns is the number of consecutive runs whose output was
+	// truncated and lastTruncationWarning is when this was last logged.
+	truncatedRuns         int
+	lastTruncationWarning time.Time
+
+	// restarts tracks the restarts of the container for
+	// CheckContainerState and stateSummary is the summary of the state
+	// of the current run, if it was inspected.
+	restarts     restartTracker
+	stateSummary string
+
+	// container is the container as inspected on the current run, or nil
+	// if it wasn't.
+	container *ContainerInfo
 }
 
 // Init initializes the Docker Client
-func (c *CheckDocker) Init() error {
-	var err error
-	c.dockerClient, err = docker.NewClientFromEnv()
+func (c *CheckDocker) Init() (err error) {
+	c.dockerClient, err = newDockerClient(c.ClientConfig, c.Logger)
 	if err != nil {
 		c.Logger.Printf("[DEBUG] Error creating the Docker client: %s", err.Error())
 		return err
 	}
+	defer func() {
+		if err != nil {
+			closeDockerClient(c.dockerClient)
+		}
+	}()
+	if n := c.ClientConfig.ExecOutputBytes; n < 0 {
+		c.Logger.Printf("[WARN] agent: Invalid Docker exec_output_bytes %d for check '%s', capturing %d bytes instead",
+			n, c.CheckID, CheckBufSize)
+	}
+	if c.redact, err = compileRedactions(c.ClientConfig.AuditRedact); err != nil {
+		return err
+	}
+	c.policy, err = NewContainerPolicy(c.ClientConfig.AllowedContainerNames, c.ClientConfig.AllowedContainerLabels)
+	if err != nil {
+		return err
+	}
+	if err := c.checkPolicy(); err != nil {
+		return err
+	}
+	if dir := c.ClientConfig.AuditLogDir; dir != "" {
+		c.auditLog, err = newDockerAuditLog(dir, c.CheckID, c.ClientConfig.AuditLogMaxBytes, c.ClientConfig.AuditRedact)
+		if err != nil {
+			return err
+		}
+	}
+	return c.parseTemplate()
+}
+
+// checkPolicy returns an error if the container policy doesn't allow the
+// containers of the check. Containers which can't be looked up now, or
+// which are found by labels the policy can't rule on by itself, are
+// checked again on every run.
+func (c *CheckDocker) checkPolicy() error {
+	if c.policy == nil {
+		return nil
+	}
+	if len(c.DockerContainerLabels) > 0 {
+		if !c.policy.AllowsSelector(c.DockerContainerLabels) && !c.policy.MatchesNames() {
+			return fmt.Errorf("Check %q targets containers with labels %v which are not allowed by the allowed_container_labels of docker_config",
+				c.CheckID, c.DockerContainerLabels)
+		}
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), dockerPolicyCheckTimeout)
+	defer cancel()
+	err := c.policy.CheckContainer(ctx, c.dockerClient, c.DockerContainerID)
+	if perr, ok := err.(*ContainerPolicyError); ok {
+		return fmt.Errorf("Check %q: %v", c.CheckID, perr)
+	}
+	if err != nil {
+		c.Logger.Printf("[WARN] agent: Unable to check the container of check '%s' against the allowed containers: %s", c.CheckID, err)
+	}
 	return nil
 }
 
+// dockerScriptVars are the variables available to the script of a Docker
+// check when ScriptTemplate is set, as in {{.ContainerName}}.
+type dockerScriptVars struct {
+	Node          string
+	ContainerID   string
+	ContainerName string
+}
+
+// parseTemplate parses the script if ScriptTemplate is set. The template
+// is rendered once with empty variables so that references to unknown
+// variables fail when the check is registered rather than on every run.
+func (c *CheckDocker) parseTemplate() error {
+	if !c.ScriptTemplate {
+		return nil
+	}
+	tmpl, err := template.New(string(c.CheckID)).Parse(c.Script)
+	if err != nil {
+		return fmt.Errorf("Invalid script template: %s", err)
+	}
+	if err := tmpl.Execute(ioutil.Discard, dockerScriptVars{}); err != nil {
+		return fmt.Errorf("Invalid script template: %s", err)
+	}
+	c.tmpl = tmpl
+	return nil
+}
+
+// renderScript renders the script template with the current name of the
+// container, which is empty if it wasn't inspected.
+func (c *CheckDocker) renderScript(containerID string, info *ContainerInfo) (string, error) {
+	vars := dockerScriptVars{
+		Node:        c.NodeName,
+		ContainerID: containerID,
+	}
+	if info != nil {
+		vars.ContainerName = info.Name
+	}
+
+	var buf bytes.Buffer
+	if err := c.tmpl.Execute(&buf, vars); err != nil {
+		return "", fmt.Errorf("Unable to render script template: %s", err)
+	}
+	return buf.String(), nil
+}
+
 // Start is used to start checks.
 // Docker Checks runs until stop is called
 func (c *CheckDocker) Start() {
@@ -573,13 +939,15 @@ func (c *CheckDocker) Start() {
 	go c.run()
 }
 
-// Stop is used to stop a docker check.
+// Stop is used to stop a docker check. It also closes the connection of
+// its client to the container runtime, if it holds one.
 func (c *CheckDocker) Stop() {
 	c.stopLock.Lock()
 	defer c.stopLock.Unlock()
 	if !c.stop {
 		c.stop = true
 		close(c.stopCh)
+		closeDockerClient(c.dockerClient)
 	}
 }
 
@@ -600,69 +968,558 @@ func (c *CheckDocker) run() {
 	}
 }
 
-func (c *CheckDocker) check() {
-	//Set up the Exec since
-	execOpts := docker.CreateExecOptions{
-		AttachStdin:  false,
-		AttachStdout: true,
-		AttachStderr: true,
-		Tty:          false,
-		Cmd:          c.cmd,
-		Container:    c.DockerContainerID,
-	}
-	var (
-		exec *docker.Exec
-		err  error
-	)
-	if exec, err = c.dockerClient.CreateExec(execOpts); err != nil {
-		c.Logger.Printf("[DEBUG] agent: Error while creating Exec: %s", err.Error())
-		c.Notify.UpdateCheck(c.CheckID, api.HealthCritical, fmt.Sprintf("Unable to create Exec, error: %s", err.Error()))
+// LastResult returns the result of the most recent run of the script. It
+// returns nil if the script has not run yet or could not be started.
+func (c *CheckDocker) LastResult() *ExecResult {
+	c.lastResultLock.RLock()
+	defer c.lastResultLock.RUnlock()
+	return c.lastResult
+}
+
+// LastExec describes the most recent run of the script for the checks
+// endpoint of the agent. It returns nil if the script has not run yet.
+func (c *CheckDocker) LastExec() *structs.CheckExec {
+	c.lastResultLock.RLock()
+	defer c.lastResultLock.RUnlock()
+	if c.lastResult == nil && c.lastErr == nil {
+		return nil
+	}
+	exec := &structs.CheckExec{}
+	if res := c.lastResult; res != nil {
+		exec.Duration = res.Duration.String()
+		exec.Truncated = res.Truncated()
+		exec.OutputBytes = res.TotalWritten
+		if c.lastErr == nil {
+			exec.ExitCode = res.ExitCode
+		}
+	}
+	if c.lastErr != nil {
+		exec.Error = c.lastErr.Error()
+	}
+	return exec
+}
+
+// LastJSONOutput returns the parsed output of the most recent run of the
+// script when JSONStatusField is set. It returns nil if the script has not
+// run yet or its output could not be parsed.
+func (c *CheckDocker) LastJSONOutput() *JSONOutput {
+	c.lastResultLock.RLock()
+	defer c.lastResultLock.RUnlock()
+	return c.lastJSONOutput
+}
+
+// Command returns the command the check runs in the container, with the
+// audit_redact rules applied. Once the script has run this is the command
+// of the most recent run, with its script template rendered.
+func (c *CheckDocker) Command() []string {
+	c.lastResultLock.RLock()
+	cmd := c.lastCmd
+	c.lastResultLock.RUnlock()
+	if cmd == nil {
+		sh := c.Shell
+		if sh == "" {
+			sh = shell()
+		}
+		cmd = []string{sh, "-c", c.Script}
+	}
+	return redactArgs(c.redact, cmd)
+}
+
+// DaemonVersion returns the version of the Docker daemon the check runs
+// against. It's queried on the first call and cached after.
+func (c *CheckDocker) DaemonVersion() (DaemonVersion, error) {
+	return c.version.Get(c.dockerClient)
+}
+
+// checkTruncation counts the runs whose output was truncated and logs a
+// warning if this happened on several runs in a row, since this usually
+// means the output of the check is useless. The warning is rate limited.
+func (c *CheckDocker) checkTruncation(res *ExecResult) {
+	if !res.Truncated() {
+		c.truncatedRuns = 0
 		return
 	}
 
-	// Collect the output
-	output, _ := circbuf.NewBuffer(CheckBufSize)
+	metrics.IncrCounter([]string{"consul", "agent", "check", "docker", "truncated", string(c.CheckID)}, 1)
+	c.truncatedRuns++
+	if c.truncatedRuns < dockerTruncationWarnRuns ||
+		time.Since(c.lastTruncationWarning) < dockerTruncationWarnInterval {
+		return
+	}
+	c.lastTruncationWarning = time.Now()
+	c.Logger.Printf("[WARN] agent: Output of check '%v' was truncated on the last %d runs, "+
+		"only the last %d of %d bytes are kept. Reduce the output of script '%s' to keep it useful",
+		c.CheckID, c.truncatedRuns, len(res.Output), res.TotalWritten, c.Script)
+}
 
-	err = c.dockerClient.StartExec(exec.ID, docker.StartExecOptions{Detach: false, Tty: false, OutputStream: output, ErrorStream: output})
+// OutputTransformer changes the output of a Docker check before it's
+// reported, for example to only keep the relevant line of a verbose
+// script.
+type OutputTransformer interface {
+	Transform(output string) string
+}
+
+// OutputTransformerFunc adapts a function to an OutputTransformer.
+type OutputTransformerFunc func(output string) string
+
+// Transform calls f(output).
+func (f OutputTransformerFunc) Transform(output string) string {
+	return f(output)
+}
+
+// updateCheck reports the status of the check unless it's a failure
+// within the start grace period of the container.
+func (c *CheckDocker) updateCheck(status, output string) {
+	if status != api.HealthPassing && c.inStartGracePeriod() {
+		c.Logger.Printf("[DEBUG] agent: Ignoring %s status of check '%s' during the start grace period of container %s",
+			status, c.CheckID, c.DockerContainerID)
+		return
+	}
+	if c.stateSummary != "" {
+		output = c.stateSummary + "\n" + output
+	}
+	if status != api.HealthPassing {
+		if pressure := c.daemonPressure(); pressure != "" {
+			c.Logger.Printf("[WARN] agent: Check '%v' failed while the Docker daemon is under pressure: %s", c.CheckID, pressure)
+			if s := c.ClientConfig.InfrastructureStatus; s != "" {
+				status = s
+			}
+			output = pressure + "\n" + output
+		}
+	}
+	if c.OutputTransformer != nil {
+		output = c.OutputTransformer.Transform(output)
+	}
+	c.Notify.UpdateCheck(c.CheckID, status, limitOutput(output, c.ClientConfig.OutputMaxBytes, c.ClientConfig.OutputKeep))
+}
+
+// daemonPressure returns a message about the storage resources the Docker
+// daemon is low on if CheckPressure is set, or an empty string.
+func (c *CheckDocker) daemonPressure() string {
+	if !c.ClientConfig.CheckPressure {
+		return ""
+	}
+	client, ok := c.dockerClient.(DockerInfoClient)
+	if !ok {
+		return ""
+	}
+	pressure, err := c.Pressure.Get(c.daemonKey(), client)
 	if err != nil {
-		c.Logger.Printf("[DEBUG] Error in executing health checks: %s", err.Error())
-		c.Notify.UpdateCheck(c.CheckID, api.HealthCritical, fmt.Sprintf("Unable to start Exec: %s", err.Error()))
+		c.Logger.Printf("[DEBUG] agent: Unable to check the Docker daemon for pressure: %s", err)
+		return ""
+	}
+	return pressure
+}
+
+// daemonKey identifies the daemon the check runs on among those of the
+// other checks.
+func (c *CheckDocker) daemonKey() string {
+	cfg := c.ClientConfig
+	return strings.Join([]string{cfg.ContainerRuntime, cfg.Host, cfg.Context, cfg.PodmanHost}, "|")
+}
+
+// limitOutput truncates the output of a check to max bytes, or to
+// CheckBufSize if max is zero, keeping its head if keep is "head" and its
+// tail otherwise. This is separate from the limit on the output read from
+// the daemon so that more can be read to determine the status than is
+// stored. The output is cut between two characters, so a little less than
+// max bytes may be kept.
+func limitOutput(output string, max int, keep string) string {
+	if max <= 0 {
+		max = CheckBufSize
+	}
+	if len(output) <= max {
+		return output
+	}
+	if keep == "head" {
+		end := max
+		for end > 0 && !utf8.RuneStart(output[end]) {
+			end--
+		}
+		return fmt.Sprintf("%s\n...\nKept %d of %d bytes", output[:end], end, len(output))
+	}
+	start := len(output) - max
+	for start < len(output) && !utf8.RuneStart(output[start]) {
+		start++
+	}
+	return fmt.Sprintf("Kept %d of %d bytes\n...\n%s", len(output)-start, len(output), output[start:])
+}
+
+// errorStatus returns the status of the check for an error running its
+// script. Errors of the Docker daemon get the InfrastructureStatus of the
+// client config, all others make the check critical.
+func (c *CheckDocker) errorStatus(err error) string {
+	if c.ClientConfig.InfrastructureStatus == "" || !isDockerInfrastructureError(err) {
+		return api.HealthCritical
+	}
+	c.Logger.Printf("[WARN] agent: Check '%v' failed because of the Docker daemon, setting it to %s",
+		c.CheckID, c.ClientConfig.InfrastructureStatus)
+	return c.ClientConfig.InfrastructureStatus
+}
+
+// inStartGracePeriod returns true if the container started less than
+// StartGracePeriod ago. The start time is the one of the current run since
+// the daemon may have restarted the container.
+func (c *CheckDocker) inStartGracePeriod() bool {
+	if c.StartGracePeriod <= 0 || c.container == nil {
+		return false
+	}
+	return time.Since(c.container.StartedAt) < c.StartGracePeriod
+}
+
+// containerState returns the status and summary of the container for
+// CheckContainerState and whether the script should be run. The script is
+// run without a summary if the client can't inspect.
+func (c *CheckDocker) containerState(info *ContainerInfo) (string, string, bool) {
+	if info == nil {
+		return api.HealthPassing, "", true
+	}
+	restarts := c.restarts.observe(time.Now(), info.RestartCount)
+	return containerVerdict(*info, restarts)
+}
+
+// runContext returns the context of the requests of a run besides the
+// exec. It's done after the timeout of the check, or after
+// dockerCheckInspectTimeout without one, or once the check is stopped, so
+// a daemon which stalls doesn't hold up the check.
+func (c *CheckDocker) runContext() (context.Context, context.CancelFunc) {
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = dockerCheckInspectTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	stopCh := c.stopCh
+	go func() {
+		select {
+		case <-stopCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// inspectContainer inspects a container of the check for a run. It returns
+// nil without an error if the client can't inspect.
+func (c *CheckDocker) inspectContainer(containerID string) (*ContainerInfo, error) {
+	client, ok := c.dockerClient.(DockerInspectClient)
+	if !ok {
+		return nil, nil
+	}
+	ctx, cancel := c.runContext()
+	defer cancel()
+	info, err := InspectContainer(ctx, client, containerID)
+	if err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// command returns the command to run in the container, rendering the
+// script template if there is one with the container as inspected.
+func (c *CheckDocker) command(containerID string, info *ContainerInfo) ([]string, error) {
+	if c.tmpl == nil {
+		return c.cmd, nil
+	}
+	script, err := c.renderScript(containerID, info)
+	if err != nil {
+		c.Logger.Printf("[DEBUG] agent: Check '%s' failed to render script '%s': %s",
+			c.CheckID, c.Script, err)
+		return nil, err
+	}
+	return []string{c.Shell, "-c", script}, nil
+}
+
+// env returns the environment variables the script is run with.
+func (c *CheckDocker) env() []string {
+	var env []string
+	if c.Locale != "" {
+		env = append(env, "LANG="+c.Locale, "LC_ALL="+c.Locale)
+	}
+	if c.ConsoleWidth > 0 {
+		env = append(env, fmt.Sprintf("COLUMNS=%d", c.ConsoleWidth))
+	}
+	if c.ConsoleHeight > 0 {
+		env = append(env, fmt.Sprintf("LINES=%d", c.ConsoleHeight))
+	}
+	return env
+}
+
+// checkAPIVersion looks up the API version of the daemon before the first
+// exec with environment variables, until it succeeds.
+func (c *CheckDocker) checkAPIVersion(env []string) error {
+	if len(env) == 0 || c.apiVersionChecked {
+		return nil
+	}
+	if err := checkDockerAPIVersion(c.dockerClient); err != nil {
+		return err
+	}
+	c.apiVersionChecked = true
+	return nil
+}
+
+// exec runs the command in the container and writes the run to the audit
+// log, if there is one.
+func (c *CheckDocker) exec(containerID string, cmd []string, budget *ByteBudget) (*ExecResult, error) {
+	opts := ExecOptions{
+		Budget:          budget,
+		ContainerID:     containerID,
+		Cmd:             cmd,
+		Privileged:      c.Privileged,
+		CreateRetries:   c.ClientConfig.ExecCreateRetries,
+		PollInterval:    c.ClientConfig.ExecPollInterval,
+		DiscardStderr:   c.DiscardStderr,
+		Tracker:         c.Execs,
+		MaxOutputBytes:  c.ClientConfig.ExecOutputBytes,
+		KillSignal:      c.KillSignal,
+		KillGracePeriod: c.KillGracePeriod,
+		Env:             c.env(),
+		OutputEncoding:  c.OutputEncoding,
+		Expect:          c.Expect,
+		breaker:         c.ClientConfig.breaker,
+	}
+	if opts.KillGracePeriod == 0 {
+		opts.KillGracePeriod = defaultDockerKillGracePeriod
+	}
+	var res *ExecResult
+	err := c.checkAPIVersion(opts.Env)
+	switch {
+	case err != nil:
+		err = newExecError(ExecOpCreate, containerID, "", err)
+	case c.Timeout > 0:
+		res, err = ExecWithTimeout(c.dockerClient, opts, c.Timeout)
+	default:
+		res, err = Exec(c.dockerClient, opts)
+	}
+	if err == ErrExecCancelled {
+		return nil, err
+	}
+	c.lastResultLock.Lock()
+	c.lastCmd = cmd
+	c.lastResultLock.Unlock()
+	if c.auditLog != nil {
+		if auditErr := c.auditLog.Write(containerID, cmd, res, err); auditErr != nil {
+			c.Logger.Printf("[WARN] agent: Unable to write audit log of check '%s': %s", c.CheckID, auditErr)
+		}
+	}
+	c.Results.push(c.CheckID, res, err)
+	if err != nil {
+		c.Logger.Printf("[DEBUG] agent: Check '%s' failed to run script '%s' in container %s: %s",
+			c.CheckID, c.Script, containerID, err)
+	}
+	return res, err
+}
+
+func (c *CheckDocker) check() {
+	if paused, reason := c.Pause.Paused(); paused {
+		c.Logger.Printf("[DEBUG] agent: Check '%v' skipped, Docker checks are paused: %s", c.CheckID, reason)
+		return
+	}
+	if !c.Slots.Acquire(c.Interval, c.stopCh) {
+		// The status is left as it is since the script didn't run.
+		c.Logger.Printf("[WARN] agent: Check '%v' deferred, too many Docker checks are running", c.CheckID)
+		metrics.IncrCounter([]string{"consul", "agent", "check", "docker", "deferred", string(c.CheckID)}, 1)
 		return
 	}
+	defer c.Slots.Release()
 
-	// Get the output, add a message about truncation
-	outputStr := string(output.Bytes())
-	if output.TotalWritten() > output.Size() {
-		outputStr = fmt.Sprintf("Captured %d of %d bytes\n...\n%s",
-			output.Size(), output.TotalWritten(), outputStr)
+	if len(c.DockerContainerLabels) > 0 {
+		c.checkLabeled()
+		return
 	}
 
+	// The container is inspected once for the container policy, the
+	// state of the container, the script template and the start grace
+	// period.
+	c.stateSummary = ""
+	c.container = nil
+	if c.policy != nil || c.CheckContainerState || c.tmpl != nil || c.StartGracePeriod > 0 {
+		info, err := c.inspectContainer(c.DockerContainerID)
+		switch {
+		case err == nil:
+			c.container = info
+		case c.policy != nil || c.CheckContainerState:
+			c.Logger.Printf("[DEBUG] agent: Check '%s' failed to inspect container %s: %s", c.CheckID, c.DockerContainerID, err)
+			c.updateCheck(c.errorStatus(err), err.Error())
+			return
+		case c.tmpl != nil:
+			c.Logger.Printf("[DEBUG] agent: Check '%s' failed to render script '%s': %s", c.CheckID, c.Script, err)
+			c.updateCheck(api.HealthCritical, err.Error())
+			return
+		default:
+			c.Logger.Printf("[DEBUG] agent: Unable to get start time of container %s: %s", c.DockerContainerID, err)
+		}
+	}
+	if err := c.policy.checkContainer(c.DockerContainerID, c.container); err != nil {
+		c.Logger.Printf("[DEBUG] agent: Check '%s' container isn't allowed: %s", c.CheckID, err)
+		c.updateCheck(c.errorStatus(err), err.Error())
+		return
+	}
+	var summary string
+	if c.CheckContainerState {
+		status, msg, probe := c.containerState(c.container)
+		if !probe {
+			c.updateCheck(status, msg)
+			return
+		}
+		summary = msg
+	}
+	cmd, err := c.command(c.DockerContainerID, c.container)
+	if err != nil {
+		c.updateCheck(api.HealthCritical, err.Error())
+		return
+	}
+	res, err := c.exec(c.DockerContainerID, cmd, NewByteBudget(c.ClientConfig.MaxBytesPerInterval))
+	if err == ErrExecCancelled {
+		// The check is being reloaded so there's nothing to report.
+		c.Logger.Printf("[DEBUG] agent: Check '%s' was cancelled", c.CheckID)
+		return
+	}
+	switch {
+	case summary == "":
+	case err != nil:
+		c.stateSummary = summary + ", probe failed"
+	default:
+		c.stateSummary = fmt.Sprintf("%s, probe exit %d", summary, res.ExitCode)
+	}
+	c.lastResultLock.Lock()
+	c.lastResult = res
+	c.lastErr = err
+	c.lastJSONOutput = nil
+	c.lastResultLock.Unlock()
+	if err != nil {
+		msg := err.Error()
+		if res != nil && len(res.Output) > 0 {
+			msg = fmt.Sprintf("%s\n%s", msg, res.OutputString())
+		}
+		c.updateCheck(c.errorStatus(err), msg)
+		return
+	}
+
+	c.checkTruncation(res)
+
+	outputStr := res.OutputString()
 	c.Logger.Printf("[DEBUG] agent: Check '%s' script '%s' output: %s",
 		c.CheckID, c.Script, outputStr)
 
-	execInfo, err := c.dockerClient.InspectExec(exec.ID)
-	if err != nil {
-		c.Logger.Printf("[DEBUG] Error in inspecting check result : %s", err.Error())
-		c.Notify.UpdateCheck(c.CheckID, api.HealthCritical, fmt.Sprintf("Unable to inspect Exec: %s", err.Error()))
+	if c.JSONStatusField != "" {
+		c.updateFromJSON(res, outputStr)
 		return
 	}
 
-	// Sets the status of the check to healthy if exit code is 0
-	if execInfo.ExitCode == 0 {
-		c.Notify.UpdateCheck(c.CheckID, api.HealthPassing, outputStr)
+	if res.ExpectationFailure != "" {
+		outputStr = res.ExpectationFailure + "\n" + outputStr
+	}
+	switch status := res.Status(c.WarningExitCodes); status {
+	case api.HealthPassing:
+		c.updateCheck(status, outputStr)
+	case api.HealthWarning:
+		c.Logger.Printf("[DEBUG] Check failed with exit code: %d", res.ExitCode)
+		c.updateCheck(status, outputStr)
+	default:
+		c.Logger.Printf("[WARN] agent: Check '%v' is now critical", c.CheckID)
+		c.updateCheck(status, outputStr)
+	}
+}
+
+// checkLabeled runs the script in every running container with the labels
+// of DockerContainerLabels. The check passes if it passes in all of them
+// and is critical if no container has the labels. The status is always
+// taken from the exit codes.
+func (c *CheckDocker) checkLabeled() {
+	client, ok := c.dockerClient.(DockerListClient)
+	if !ok {
+		c.updateCheck(api.HealthCritical, "Docker client does not support listing containers")
+		return
+	}
+	ids, denied, err := ResolveAllowedContainers(client, c.DockerContainerLabels, c.policy)
+	if err != nil {
+		c.Logger.Printf("[DEBUG] agent: Check '%s' failed to find containers: %s", c.CheckID, err)
+		c.updateCheck(c.errorStatus(err), err.Error())
+		return
+	}
+	if len(ids) == 0 && len(denied) == 0 {
+		c.updateCheck(api.HealthCritical, fmt.Sprintf("No running container has the labels %v", c.DockerContainerLabels))
 		return
 	}
 
-	// Set the status of the check to Warning if exit code is 1
-	if execInfo.ExitCode == 1 {
-		c.Logger.Printf("[DEBUG] Check failed with exit code: %d", execInfo.ExitCode)
-		c.Notify.UpdateCheck(c.CheckID, api.HealthWarning, outputStr)
+	// The containers which aren't allowed fail the check without running
+	// the script in them.
+	var results []ContainerResult
+	for _, err := range denied {
+		results = append(results, ContainerResult{ContainerID: err.ContainerID, Err: err})
+	}
+	budget := NewByteBudget(c.ClientConfig.MaxBytesPerInterval)
+	for _, id := range ids {
+		var info *ContainerInfo
+		if c.tmpl != nil {
+			if info, err = c.inspectContainer(id); err != nil {
+				results = append(results, ContainerResult{ContainerID: id, Err: err})
+				continue
+			}
+		}
+		cmd, err := c.command(id, info)
+		if err != nil {
+			results = append(results, ContainerResult{ContainerID: id, Err: err})
+			continue
+		}
+		res, err := c.exec(id, cmd, budget)
+		if err == ErrExecCancelled {
+			c.Logger.Printf("[DEBUG] agent: Check '%s' was cancelled", c.CheckID)
+			return
+		}
+		results = append(results, ContainerResult{ContainerID: id, Result: res, Err: err})
+	}
+
+	status, output := AggregateResults(results, c.WarningExitCodes)
+	if status == api.HealthCritical {
+		c.Logger.Printf("[WARN] agent: Check '%v' is now critical", c.CheckID)
+	}
+	c.updateCheck(status, output)
+}
+
+// updateFromJSON sets the status of the check from the status field of the
+// JSON object printed by the script. The exit code is ignored.
+func (c *CheckDocker) updateFromJSON(res *ExecResult, outputStr string) {
+	out, err := res.JSONOutput(c.JSONStatusField)
+	if err != nil {
+		c.Logger.Printf("[WARN] agent: Check '%v' is now critical: %s", c.CheckID, err)
+		c.updateCheck(api.HealthCritical, fmt.Sprintf("%s\n%s", err, outputStr))
 		return
 	}
 
-	// Set the health as critical
-	c.Logger.Printf("[WARN] agent: Check '%v' is now critical", c.CheckID)
-	c.Notify.UpdateCheck(c.CheckID, api.HealthCritical, outputStr)
+	c.lastResultLock.Lock()
+	c.lastJSONOutput = out
+	c.lastResultLock.Unlock()
+
+	switch out.Status {
+	case api.HealthPassing, api.HealthWarning:
+		c.updateCheck(out.Status, outputStr)
+	case api.HealthCritical:
+		c.Logger.Printf("[WARN] agent: Check '%v' is now critical", c.CheckID)
+		c.updateCheck(api.HealthCritical, outputStr)
+	default:
+		c.Logger.Printf("[WARN] agent: Check '%v' is now critical: invalid status %q", c.CheckID, out.Status)
+		c.updateCheck(api.HealthCritical,
+			fmt.Sprintf("Invalid status %q in field %q\n%s", out.Status, c.JSONStatusField, outputStr))
+	}
+}
+
+// stdoutExpectation returns the expectation on the stdout of a Docker
+// check, or nil if it has none.
+func stdoutExpectation(chkType *structs.CheckType) (*OutputExpectation, error) {
+	if chkType.StdoutContains == "" && chkType.StdoutMatches == "" {
+		return nil, nil
+	}
+	expect := &OutputExpectation{Contains: chkType.StdoutContains, Negate: chkType.StdoutNegate}
+	if chkType.StdoutMatches != "" {
+		re, err := regexp.Compile(chkType.StdoutMatches)
+		if err != nil {
+			return nil, err
+		}
+		expect.Matches = re
+	}
+	return expect, nil
 }
 
 func shell() string {
@@ -2,6 +2,8 @@ package agent
 
 import (
 	"bytes"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -21,6 +23,10 @@ import (
 	"github.com/hashicorp/consul/api"
 	"github.com/hashicorp/consul/testutil/retry"
 	"github.com/hashicorp/consul/types"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
 )
 
 func TestCheckMonitor(t *testing.T) {
@@ -512,6 +518,150 @@ func TestCheckTCPPassing(t *testing.T) {
 	tcpServer.Close()
 }
 
+// grpcHealthServer is the handler of the fake gRPC health service.
+type grpcHealthServer interface {
+	check(service string) (int32, error)
+}
+
+// fakeGRPCHealthServer answers with the statuses of its services and fails
+// for the services it doesn't know.
+type fakeGRPCHealthServer struct {
+	statuses map[string]int32
+}
+
+func (s *fakeGRPCHealthServer) check(service string) (int32, error) {
+	status, ok := s.statuses[service]
+	if !ok {
+		return 0, grpc.Errorf(codes.NotFound, "unknown service %q", service)
+	}
+	return status, nil
+}
+
+// startGRPCHealthServer serves the gRPC health checking protocol with the
+// statuses and returns its address.
+func startGRPCHealthServer(t *testing.T, statuses map[string]int32, opts ...grpc.ServerOption) (string, func()) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	srv := grpc.NewServer(opts...)
+	srv.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "grpc.health.v1.Health",
+		HandlerType: (*grpcHealthServer)(nil),
+		Methods: []grpc.MethodDesc{{
+			MethodName: "Check",
+			Handler: func(s interface{}, ctx context.Context, dec func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) {
+				var req grpcHealthCheckRequest
+				if err := dec(&req); err != nil {
+					return nil, err
+				}
+				status, err := s.(grpcHealthServer).check(req.Service)
+				if err != nil {
+					return nil, err
+				}
+				return &grpcHealthCheckResponse{Status: status}, nil
+			},
+		}},
+	}, &fakeGRPCHealthServer{statuses: statuses})
+	go srv.Serve(ln)
+	return ln.Addr().String(), srv.Stop
+}
+
+func TestCheckGRPC(t *testing.T) {
+	t.Parallel()
+	addr, stop := startGRPCHealthServer(t, map[string]int32{
+		"":        grpcHealthServing,
+		"api":     grpcHealthServing,
+		"worker":  grpcHealthNotServing,
+		"batch":   grpcHealthUnknown,
+		"removed": 3,
+	})
+	defer stop()
+
+	tests := []struct {
+		target, status, output string
+	}{
+		{addr, api.HealthPassing, "gRPC health check " + addr + ": SERVING"},
+		{addr + "/api", api.HealthPassing, "gRPC health check " + addr + "/api: SERVING"},
+		{addr + "/worker", api.HealthCritical, "gRPC health check " + addr + "/worker: NOT_SERVING"},
+		{addr + "/batch", api.HealthWarning, "gRPC health check " + addr + "/batch: UNKNOWN"},
+		{addr + "/removed", api.HealthCritical, "gRPC health check " + addr + "/removed: SERVICE_UNKNOWN"},
+		{addr + "/missing", api.HealthCritical, `gRPC health check ` + addr + `/missing: unknown service "missing"`},
+	}
+	for _, tt := range tests {
+		notif := mock.NewNotify()
+		check := &CheckGRPC{
+			Notify:   notif,
+			CheckID:  types.CheckID("foo"),
+			GRPC:     tt.target,
+			Interval: time.Second,
+			Logger:   log.New(ioutil.Discard, UniqueID(), log.LstdFlags),
+		}
+		check.check()
+		if got := notif.State("foo"); got != tt.status {
+			t.Fatalf("%s: got status %q want %q", tt.target, got, tt.status)
+		}
+		if got := notif.Output("foo"); got != tt.output {
+			t.Fatalf("%s: got output %q want %q", tt.target, got, tt.output)
+		}
+	}
+
+	// A server which isn't listening is critical once the timeout is up.
+	stop()
+	notif := mock.NewNotify()
+	check := &CheckGRPC{
+		Notify:   notif,
+		CheckID:  types.CheckID("foo"),
+		GRPC:     addr,
+		Interval: time.Second,
+		Timeout:  100 * time.Millisecond,
+		Logger:   log.New(ioutil.Discard, UniqueID(), log.LstdFlags),
+	}
+	check.check()
+	if got := notif.State("foo"); got != api.HealthCritical {
+		t.Fatalf("got status %q", got)
+	}
+}
+
+func TestCheckGRPC_TLS(t *testing.T) {
+	t.Parallel()
+	// The certificate of httptest is valid for example.com and 127.0.0.1.
+	https := httptest.NewUnstartedServer(http.NotFoundHandler())
+	https.StartTLS()
+	https.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(https.Certificate())
+	creds := credentials.NewTLS(&tls.Config{Certificates: https.TLS.Certificates})
+	addr, stop := startGRPCHealthServer(t, map[string]int32{"": grpcHealthServing}, grpc.Creds(creds))
+	defer stop()
+
+	tests := []struct {
+		name   string
+		check  *CheckGRPC
+		status string
+	}{
+		{"verified", &CheckGRPC{rootCAs: roots}, api.HealthPassing},
+		{"server name", &CheckGRPC{rootCAs: roots, TLSServerName: "example.com"}, api.HealthPassing},
+		{"wrong server name", &CheckGRPC{rootCAs: roots, TLSServerName: "consul.test"}, api.HealthCritical},
+		{"system roots", &CheckGRPC{}, api.HealthCritical},
+		{"skip verify", &CheckGRPC{TLSSkipVerify: true}, api.HealthPassing},
+	}
+	for _, tt := range tests {
+		notif := mock.NewNotify()
+		check := tt.check
+		check.Notify = notif
+		check.CheckID = types.CheckID("foo")
+		check.GRPC = addr
+		check.UseTLS = true
+		check.Interval = time.Second
+		check.Logger = log.New(ioutil.Discard, UniqueID(), log.LstdFlags)
+		check.check()
+		if got := notif.State("foo"); got != tt.status {
+			t.Fatalf("%s: got status %q want %q: %s", tt.name, got, tt.status, notif.Output("foo"))
+		}
+	}
+}
+
 // A fake docker client to test happy path scenario
 type fakeDockerClientWithNoErrors struct {
 }
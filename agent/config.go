@@ -139,6 +139,161 @@ type HTTPConfig struct {
 	ResponseHeaders map[string]string `mapstructure:"response_headers"`
 }
 
+// DockerConfig is used to configure the client used by Docker checks.
+type DockerConfig struct {
+	// Host is the address of the Docker daemon, for example
+	// unix:///var/run/docker.sock or tcp://127.0.0.1:2375. When empty,
+	// DOCKER_HOST and the other Docker environment variables are used.
+	Host string `mapstructure:"host"`
+
+	// Context is the name of a context in the Docker CLI's contexts store
+	// whose endpoint and TLS material are used instead of Host.
+	Context string `mapstructure:"context"`
+
+	// Headers are added to every request sent to the Docker daemon, for
+	// example to authenticate with a gateway in front of it.
+	Headers map[string]string `mapstructure:"headers" json:"-"`
+
+	// RedactHeaders is a list of headers whose values are hidden when the
+	// headers are logged.
+	RedactHeaders []string `mapstructure:"redact_headers"`
+
+	// Token is a bearer token sent in the Authorization header of every
+	// request sent to the Docker daemon.
+	Token string `mapstructure:"token" json:"-"`
+
+	// TokenFile is a file the bearer token is read from. The file is read
+	// again when the token is rejected so it can be rotated without a
+	// restart.
+	TokenFile string `mapstructure:"token_file" json:"-"`
+
+	// TLSFingerprint is the hex encoded SHA-256 fingerprint of the public
+	// key of the Docker daemon's certificate. When set, only a daemon with
+	// that key is trusted, even if its certificate is self-signed.
+	TLSFingerprint string `mapstructure:"tls_fingerprint"`
+
+	// UseAgentTLS makes the client verify a Docker daemon reached over
+	// TCP with the agent's ca_file and authenticate with its cert_file
+	// and key_file, instead of setting up TLS for Docker separately. The
+	// files are filled in by the agent when the client is created.
+	UseAgentTLS bool   `mapstructure:"use_agent_tls"`
+	TLSCAFile   string `mapstructure:"-" json:"-"`
+	TLSCertFile string `mapstructure:"-" json:"-"`
+	TLSKeyFile  string `mapstructure:"-" json:"-"`
+
+	// CAFile, CertFile and KeyFile set up mutual TLS with a Docker daemon
+	// reached over TCP, like the --tlscacert, --tlscert and --tlskey flags
+	// of the Docker CLI. The files which aren't set are looked up in
+	// CertPath as ca.pem, cert.pem and key.pem, like in DOCKER_CERT_PATH.
+	// The daemon's certificate is verified unless TLSSkipVerify is set.
+	CAFile        string `mapstructure:"ca_file"`
+	CertFile      string `mapstructure:"cert_file"`
+	KeyFile       string `mapstructure:"key_file"`
+	CertPath      string `mapstructure:"cert_path"`
+	TLSSkipVerify bool   `mapstructure:"tls_skip_verify"`
+
+	// ConnectTimeout is how long connecting to the Docker daemon may take
+	// before the request fails with a DockerTimeoutError for the connect
+	// phase. Zero uses the default of the Docker client.
+	ConnectTimeout    time.Duration `mapstructure:"-"`
+	ConnectTimeoutRaw string        `mapstructure:"connect_timeout" json:"-"`
+
+	// ExecCreateRetries is the number of times creating the exec of a
+	// Docker check is retried if it fails.
+	ExecCreateRetries int `mapstructure:"exec_create_retries"`
+
+	// MaxConcurrentChecks is the number of Docker checks of the agent
+	// which can run at the same time. A check which can't run within its
+	// interval is deferred to the next one. Zero doesn't limit them.
+	MaxConcurrentChecks int `mapstructure:"max_concurrent_checks"`
+
+	// ExecPollInterval is the time to wait before polling a running exec
+	// of a Docker check for the first time. The wait doubles between
+	// polls up to a second.
+	ExecPollInterval    time.Duration `mapstructure:"-"`
+	ExecPollIntervalRaw string        `mapstructure:"exec_poll_interval" json:"-"`
+
+	// ExecOutputBytes is the number of bytes of the output of a Docker
+	// check which are read from the daemon and kept to determine its
+	// status. Only the last bytes are kept. Zero uses CheckBufSize.
+	ExecOutputBytes int64 `mapstructure:"exec_output_bytes"`
+
+	// MaxBytesPerInterval is the number of bytes of output a Docker check
+	// may read from the daemon in one run, across all of its execs. A run
+	// which reads more is cut off and the check is critical. Zero doesn't
+	// limit it.
+	MaxBytesPerInterval int64 `mapstructure:"max_bytes_per_interval"`
+
+	// OutputMaxBytes is the number of bytes of the output of a Docker
+	// check which are stored as the output of the check, keeping the head
+	// or the tail of it as set by OutputKeep, which defaults to "tail".
+	// Zero uses CheckBufSize.
+	OutputMaxBytes int    `mapstructure:"output_max_bytes"`
+	OutputKeep     string `mapstructure:"output_keep"`
+
+	// InfrastructureStatus is the status of a Docker check whose script
+	// couldn't be run because the Docker daemon is unreachable or failed,
+	// rather than because of the application. It's "critical" by default
+	// and can be set to "warning" so that an outage of the daemon doesn't
+	// alert like an outage of the services.
+	InfrastructureStatus string `mapstructure:"infrastructure_status"`
+
+	// CheckPressure looks up the storage resources of the Docker daemon
+	// when a Docker check fails. If the daemon is low on them the failure
+	// is reported with InfrastructureStatus, if set, and a message about
+	// it instead of being blamed on the application.
+	CheckPressure bool `mapstructure:"check_pressure"`
+
+	// BreakerErrorRate is the share of the recent requests to the Docker
+	// daemon which may fail before the client stops sending requests for
+	// BreakerCooldown, failing the Docker checks with InfrastructureStatus
+	// instead of adding to the load of a struggling daemon. Zero disables
+	// the breaker.
+	BreakerErrorRate   float64       `mapstructure:"breaker_error_rate"`
+	BreakerCooldown    time.Duration `mapstructure:"-"`
+	BreakerCooldownRaw string        `mapstructure:"breaker_cooldown" json:"-"`
+
+	// breaker is the breaker of the agent, which the clients of all of
+	// its Docker checks share so it tracks the error rate of all of
+	// their requests. It's set by the agent if BreakerErrorRate is set.
+	breaker *dockerBreaker
+
+	// AuditLogDir is a directory where every run of a Docker check is
+	// appended to a log of the check, with the command, exit code and
+	// output. Logs are rotated once they reach AuditLogMaxBytes.
+	AuditLogDir      string `mapstructure:"audit_log_dir"`
+	AuditLogMaxBytes int64  `mapstructure:"audit_log_max_bytes"`
+
+	// AuditRedact is a list of regular expressions whose matches in the
+	// command and output are hidden before they are written to the audit
+	// log.
+	AuditRedact []string `mapstructure:"audit_redact"`
+
+	// AllowedContainerNames and AllowedContainerLabels limit the containers
+	// Docker checks may run in to those whose name matches one of the glob
+	// patterns or which have one of the labels, each "key=value" or just
+	// "key". When both are empty checks may run in any container.
+	AllowedContainerNames  []string `mapstructure:"allowed_container_names"`
+	AllowedContainerLabels []string `mapstructure:"allowed_container_labels"`
+
+	// RegisterServices registers the services of the running containers
+	// with a consul.service.name label, with the checks of their other
+	// consul labels, and deregisters them when the containers stop.
+	RegisterServices bool `mapstructure:"register_services"`
+
+	// ContainerRuntime is the runtime the checks run their execs with:
+	// "docker", the default, "podman" for the Docker compatible API of
+	// Podman, "libpod" for its native API or "containerd" for the CRI
+	// API of containerd. A check can use another runtime than this.
+	ContainerRuntime string `mapstructure:"container_runtime"`
+
+	// PodmanHost and ContainerdHost are the sockets of Podman and
+	// containerd. PodmanHost defaults to CONTAINER_HOST or the socket of
+	// the user and ContainerdHost to unix:///run/containerd/containerd.sock.
+	PodmanHost     string `mapstructure:"podman_host"`
+	ContainerdHost string `mapstructure:"containerd_host"`
+}
+
 // RetryJoinEC2 is used to configure discovery of instances via Amazon's EC2 api
 type RetryJoinEC2 struct {
 	// The AWS region to look for instances in
@@ -191,6 +346,73 @@ type RetryJoinAzure struct {
 	SecretAccessKey string `mapstructure:"secret_access_key" json:"-"`
 }
 
+// RetryJoinExec is used to configure discovery of servers by running a
+// program which prints their addresses, one host:port per line.
+type RetryJoinExec struct {
+	// Command is the path of the program to run.
+	Command string `mapstructure:"command"`
+
+	// Args are the arguments passed to the program.
+	Args []string `mapstructure:"args"`
+
+	// Timeout is how long the program may run before it is killed and the
+	// discovery fails. The default is 10 seconds.
+	Timeout    time.Duration `mapstructure:"-"`
+	TimeoutRaw string        `mapstructure:"timeout" json:"-"`
+}
+
+// RetryJoinK8s is used to configure discovery of servers from the endpoints
+// of a Kubernetes service, using the service account of the agent's pod.
+type RetryJoinK8s struct {
+	// Service is the name of the service, usually a headless one.
+	Service string `mapstructure:"service"`
+
+	// Namespace is the namespace of the service. It defaults to the
+	// namespace of the agent's pod.
+	Namespace string `mapstructure:"namespace"`
+
+	// PortName is the name of the port of the endpoints to join. If it's
+	// empty the addresses are joined on the Serf LAN port.
+	PortName string `mapstructure:"port_name"`
+}
+
+// RetryJoinNomad is used to configure discovery of servers from the
+// registrations of a service in Nomad's service catalog.
+type RetryJoinNomad struct {
+	// Address is the address of the Nomad HTTP API. It defaults to
+	// NOMAD_ADDR or the local Nomad agent.
+	Address string `mapstructure:"address"`
+
+	// Service is the name of the Nomad service of the servers.
+	Service string `mapstructure:"service"`
+
+	// Namespace and Region are the Nomad namespace and region of the
+	// service. They default to those of the Nomad agent.
+	Namespace string `mapstructure:"namespace"`
+	Region    string `mapstructure:"region"`
+
+	// Token is the ACL token of the requests. It defaults to NOMAD_TOKEN.
+	Token string `mapstructure:"token" json:"-"`
+}
+
+// RetryJoinProviderRetry overrides the retry settings of retry join for
+// one discovery provider.
+type RetryJoinProviderRetry struct {
+	// Interval is the minimum time between two queries of the provider.
+	// Zero queries it on every attempt.
+	Interval    time.Duration `mapstructure:"-"`
+	IntervalRaw string        `mapstructure:"interval" json:"-"`
+
+	// MaxAttempts is the number of attempts the provider is queried on
+	// before it's no longer used. Zero queries it until the join succeeds.
+	MaxAttempts int `mapstructure:"max_attempts"`
+
+	// MaxFailures is the number of queries in a row the provider can fail,
+	// or find no servers, before it's no longer used. Zero keeps querying
+	// it however often it fails.
+	MaxFailures int `mapstructure:"max_failures"`
+}
+
 // Performance is used to tune the performance of Consul's subsystems.
 type Performance struct {
 	// RaftMultiplier is an integer multiplier used to scale Raft timing
@@ -372,6 +594,9 @@ type Config struct {
 	// DNS configuration
 	DNSConfig DNSConfig `mapstructure:"dns_config"`
 
+	// DockerConfig configures the client used by Docker checks.
+	DockerConfig DockerConfig `mapstructure:"docker_config"`
+
 	// Domain is the DNS domain for the records. Defaults to "consul."
 	Domain string `mapstructure:"domain"`
 
@@ -486,6 +711,11 @@ type Config struct {
 	// EnableDebug is used to enable various debugging features
 	EnableDebug bool `mapstructure:"enable_debug"`
 
+	// EnablePrivilegedDockerChecks allows Docker checks to run their
+	// script as a privileged exec. Checks requesting it are rejected
+	// otherwise.
+	EnablePrivilegedDockerChecks bool `mapstructure:"enable_privileged_docker_checks"`
+
 	// VerifyIncoming is used to verify the authenticity of incoming connections.
 	// This means that TCP requests are forbidden, only allowing for TLS. TLS connections
 	// must match a provided certificate authority. This can be used to force client auth.
@@ -569,6 +799,13 @@ type Config struct {
 	RetryInterval    time.Duration `mapstructure:"-" json:"-"`
 	RetryIntervalRaw string        `mapstructure:"retry_interval"`
 
+	// RetryMaxInterval caps the exponential backoff between join attempts,
+	// which starts at RetryInterval and is jittered. This keeps an agent
+	// joining through a single load balancer address from retrying a bad
+	// backend too quickly. Zero disables the backoff. The default is 2m.
+	RetryMaxInterval    time.Duration `mapstructure:"-" json:"-"`
+	RetryMaxIntervalRaw string        `mapstructure:"retry_max_interval"`
+
 	// RetryJoinEC2 specifies the configuration for auto-join on EC2.
 	RetryJoinEC2 RetryJoinEC2 `mapstructure:"retry_join_ec2"`
 
@@ -578,9 +815,99 @@ type Config struct {
 	// RetryJoinAzure specifies the configuration for auto-join on Azure.
 	RetryJoinAzure RetryJoinAzure `mapstructure:"retry_join_azure"`
 
+	// RetryJoinExec specifies the configuration for auto-join through an
+	// external program.
+	RetryJoinExec RetryJoinExec `mapstructure:"retry_join_exec"`
+
+	// RetryJoinK8s specifies the configuration for auto-join from the
+	// endpoints of a Kubernetes service.
+	RetryJoinK8s RetryJoinK8s `mapstructure:"retry_join_k8s"`
+
+	// RetryJoinNomad specifies the configuration for auto-join from a
+	// service registered in Nomad.
+	RetryJoinNomad RetryJoinNomad `mapstructure:"retry_join_nomad"`
+
+	// RetryJoinAddressFamily is the address family preferred when joining
+	// the servers found by retry join, "ipv4", "ipv6" or "any". Addresses
+	// of the other family are only used if there are none of the preferred
+	// one. The default is "any".
+	RetryJoinAddressFamily string `mapstructure:"retry_join_address_family"`
+
+	// RetryJoinLastKnown saves the servers of the LAN pool to the data
+	// directory after retry join succeeds, and tries them before discovery
+	// the next time the agent starts.
+	RetryJoinLastKnown bool `mapstructure:"retry_join_last_known"`
+
+	// RetryJoinMinAgents is the number of agents a retry join attempt
+	// must sync with to succeed. Attempts which reach fewer agents, for
+	// example an isolated member, are retried.
+	RetryJoinMinAgents int `mapstructure:"retry_join_min_agents"`
+
+	// RetryJoinMinDomains is the number of failure domains, like
+	// availability zones, the servers a retry join attempt reaches must be
+	// in for it to succeed. The servers are ordered to take turns between
+	// the domains. It's only used when discovery reports the domains.
+	RetryJoinMinDomains int `mapstructure:"retry_join_min_domains"`
+
+	// RetryJoinFallback is a list of addresses which are only added to
+	// the servers retry join tries after RetryJoinFallbackAfter failed
+	// attempts, so that an emergency list doesn't hide broken discovery.
+	// RetryJoinFallbackAfter defaults to 3 and can't be negative.
+	RetryJoinFallback      []string `mapstructure:"retry_join_fallback"`
+	RetryJoinFallbackAfter int      `mapstructure:"retry_join_fallback_after"`
+
+	// RetryJoinSeeds is a list of addresses which are tried first on every
+	// retry join attempt. Unlike those of RetryJoin they're never skipped
+	// after failing or dropped for another address family.
+	RetryJoinSeeds []string `mapstructure:"retry_join_seeds"`
+
+	// RetryJoinFailFast stops querying a discovery provider once it fails
+	// with an error retrying won't fix, such as invalid credentials.
+	RetryJoinFailFast bool `mapstructure:"retry_join_fail_fast"`
+
+	// RetryJoinRoundRobin queries one discovery provider per attempt, in
+	// turn, instead of all of them on every attempt.
+	RetryJoinRoundRobin bool `mapstructure:"retry_join_round_robin"`
+
+	// RetryJoinOnce makes retry join attempt the join a single time, after
+	// discovery, and report the result without retrying, for supervisors
+	// which restart the agent themselves.
+	RetryJoinOnce bool `mapstructure:"retry_join_once"`
+
+	// RetryJoinSkipAfter skips the RetryJoin servers which failed this
+	// many attempts in a row for as many attempts, after which they're
+	// probed again. Zero tries them on every attempt.
+	RetryJoinSkipAfter int `mapstructure:"retry_join_skip_after"`
+
+	// RetryJoinOrder is which servers lead the list retry join tries,
+	// "discovered" for the servers found by discovery or "static" for the
+	// RetryJoin addresses. The default is "discovered".
+	RetryJoinOrder string `mapstructure:"retry_join_order"`
+
+	// RetryJoinProviderRetry overrides the retry settings for the discovery
+	// providers with the given names, like "ec2" or "k8s".
+	RetryJoinProviderRetry map[string]RetryJoinProviderRetry `mapstructure:"retry_join_provider_retry"`
+
+	// RetryJoinTagFilter drops the instances found by cloud discovery
+	// whose tags don't match all of the expressions, which are "key=value",
+	// "key!=value" or "key" for a tag which must be set. GCE instances are
+	// matched on their metadata.
+	RetryJoinTagFilter []string `mapstructure:"retry_join_tag_filter"`
+
+	// RetryJoinExclude drops the servers to join which match one of the
+	// addresses or CIDR blocks, wherever they come from, to leave out
+	// known bad servers discovery still returns. An address without a
+	// port matches the host on any port. RetryJoinSeeds are never dropped.
+	RetryJoinExclude []string `mapstructure:"retry_join_exclude"`
+
 	// RetryJoinWan is a list of addresses to join -wan with retry enabled.
 	RetryJoinWan []string `mapstructure:"retry_join_wan"`
 
+	// RetryJoinWanDiscovery makes join -wan also join the servers found by
+	// the discovery providers of retry join, on the Serf WAN port, for
+	// servers which find the servers of the other datacenters that way.
+	RetryJoinWanDiscovery bool `mapstructure:"retry_join_wan_discovery"`
+
 	// RetryMaxAttemptsWan specifies the maximum number of times to retry joining a
 	// -wan host on startup. This is useful for cases where we know the node will be
 	// online eventually.
@@ -592,6 +919,14 @@ type Config struct {
 	RetryIntervalWan    time.Duration `mapstructure:"-" json:"-"`
 	RetryIntervalWanRaw string        `mapstructure:"retry_interval_wan"`
 
+	// RetryMaxIntervalWan caps the exponential backoff between join -wan
+	// attempts, which starts at RetryIntervalWan and is jittered. Zero
+	// disables the backoff. The default is 5m, longer than is useful on
+	// the LAN, since WAN links are slower and failures take longer to
+	// clear.
+	RetryMaxIntervalWan    time.Duration `mapstructure:"-" json:"-"`
+	RetryMaxIntervalWanRaw string        `mapstructure:"retry_max_interval_wan"`
+
 	// ReconnectTimeout* specify the amount of time to wait to reconnect with
 	// another agent before deciding it's permanently gone. This can be used to
 	// control the time it takes to reap failed nodes from the cluster.
@@ -711,6 +1046,11 @@ type Config struct {
 	// feature. This is for security to prevent unknown scripts from running.
 	DisableRemoteExec *bool `mapstructure:"disable_remote_exec"`
 
+	// DisableDiscoveryLogs drops the log output of the cloud providers used
+	// to discover servers for retry join. It is logged at debug level
+	// otherwise.
+	DisableDiscoveryLogs bool `mapstructure:"disable_discovery_logs"`
+
 	// DisableUpdateCheck is used to turn off the automatic update and
 	// security bulletin checking.
 	DisableUpdateCheck bool `mapstructure:"disable_update_check"`
@@ -941,14 +1281,18 @@ func DefaultConfig() *Config {
 		SyncCoordinateRateTarget:  64.0, // updates / second
 		SyncCoordinateIntervalMin: 15 * time.Second,
 
-		ACLTTL:             30 * time.Second,
-		ACLDownPolicy:      "extend-cache",
-		ACLDefaultPolicy:   "allow",
-		ACLDisabledTTL:     120 * time.Second,
-		ACLEnforceVersion8: Bool(true),
-		DisableRemoteExec:  Bool(true),
-		RetryInterval:      30 * time.Second,
-		RetryIntervalWan:   30 * time.Second,
+		ACLTTL:              30 * time.Second,
+		ACLDownPolicy:       "extend-cache",
+		ACLDefaultPolicy:    "allow",
+		ACLDisabledTTL:      120 * time.Second,
+		ACLEnforceVersion8:  Bool(true),
+		DisableRemoteExec:   Bool(true),
+		RetryInterval:       30 * time.Second,
+		RetryMaxInterval:    2 * time.Minute,
+		RetryIntervalWan:    30 * time.Second,
+		RetryMaxIntervalWan: 5 * time.Minute,
+
+		RetryJoinFallbackAfter: 3,
 
 		TLSMinVersion: "tls10",
 
@@ -1223,6 +1567,60 @@ func DecodeConfig(r io.Reader) (*Config, error) {
 		result.DNSConfig.MaxStale = dur
 	}
 
+	if raw := result.DockerConfig.ConnectTimeoutRaw; raw != "" {
+		dur, err := time.ParseDuration(raw)
+		if err != nil {
+			return nil, fmt.Errorf("ConnectTimeout invalid: %v", err)
+		}
+		result.DockerConfig.ConnectTimeout = dur
+	}
+
+	if raw := result.DockerConfig.BreakerCooldownRaw; raw != "" {
+		dur, err := time.ParseDuration(raw)
+		if err != nil {
+			return nil, fmt.Errorf("BreakerCooldown invalid: %v", err)
+		}
+		result.DockerConfig.BreakerCooldown = dur
+	}
+
+	if raw := result.DockerConfig.ExecPollIntervalRaw; raw != "" {
+		dur, err := time.ParseDuration(raw)
+		if err != nil {
+			return nil, fmt.Errorf("ExecPollInterval invalid: %v", err)
+		}
+		result.DockerConfig.ExecPollInterval = dur
+	}
+
+	if fp := result.DockerConfig.TLSFingerprint; fp != "" {
+		if _, err := parseDockerFingerprint(fp); err != nil {
+			return nil, fmt.Errorf("TLSFingerprint invalid: %v", err)
+		}
+	}
+
+	if raw := result.RetryJoinExec.TimeoutRaw; raw != "" {
+		dur, err := time.ParseDuration(raw)
+		if err != nil {
+			return nil, fmt.Errorf("RetryJoinExec.Timeout invalid: %v", err)
+		}
+		result.RetryJoinExec.Timeout = dur
+	}
+
+	for name, retry := range result.RetryJoinProviderRetry {
+		switch name {
+		case "ec2", "gce", "azure", "exec", "k8s", "nomad":
+		default:
+			return nil, fmt.Errorf("RetryJoinProviderRetry invalid: unknown provider %q", name)
+		}
+		if raw := retry.IntervalRaw; raw != "" {
+			dur, err := time.ParseDuration(raw)
+			if err != nil {
+				return nil, fmt.Errorf("RetryJoinProviderRetry.%s.Interval invalid: %v", name, err)
+			}
+			retry.Interval = dur
+			result.RetryJoinProviderRetry[name] = retry
+		}
+	}
+
 	if raw := result.DNSConfig.RecursorTimeoutRaw; raw != "" {
 		dur, err := time.ParseDuration(raw)
 		if err != nil {
@@ -1268,6 +1666,14 @@ func DecodeConfig(r io.Reader) (*Config, error) {
 		result.RetryInterval = dur
 	}
 
+	if raw := result.RetryMaxIntervalRaw; raw != "" {
+		dur, err := time.ParseDuration(raw)
+		if err != nil {
+			return nil, fmt.Errorf("RetryMaxInterval invalid: %v", err)
+		}
+		result.RetryMaxInterval = dur
+	}
+
 	if raw := result.RetryIntervalWanRaw; raw != "" {
 		dur, err := time.ParseDuration(raw)
 		if err != nil {
@@ -1276,6 +1682,18 @@ func DecodeConfig(r io.Reader) (*Config, error) {
 		result.RetryIntervalWan = dur
 	}
 
+	if raw := result.RetryMaxIntervalWanRaw; raw != "" {
+		dur, err := time.ParseDuration(raw)
+		if err != nil {
+			return nil, fmt.Errorf("RetryMaxIntervalWan invalid: %v", err)
+		}
+		result.RetryMaxIntervalWan = dur
+	}
+
+	if err := result.ValidateRetryJoin(); err != nil {
+		return nil, err
+	}
+
 	const reconnectTimeoutMin = 8 * time.Hour
 	if raw := result.ReconnectTimeoutLanRaw; raw != "" {
 		dur, err := time.ParseDuration(raw)
@@ -1517,6 +1935,18 @@ func FixupCheckType(raw interface{}) error {
 			}
 			rawMap[k] = d
 
+		case "check_container_state":
+			replace(k, "CheckContainerState", v)
+
+		case "console_height":
+			replace(k, "ConsoleHeight", v)
+
+		case "console_width":
+			replace(k, "ConsoleWidth", v)
+
+		case "container_runtime":
+			replace(k, "ContainerRuntime", v)
+
 		case "deregister_critical_service_after", "deregistercriticalserviceafter":
 			d, err := parseDuration(v)
 			if err != nil {
@@ -1524,14 +1954,64 @@ func FixupCheckType(raw interface{}) error {
 			}
 			replace(k, "DeregisterCriticalServiceAfter", d)
 
+		case "discard_stderr":
+			replace(k, "DiscardStderr", v)
+
 		case "docker_container_id":
 			replace(k, "DockerContainerID", v)
 
+		case "docker_container_labels":
+			replace(k, "DockerContainerLabels", v)
+
+		case "grpc_use_tls":
+			replace(k, "GRPCUseTLS", v)
+
+		case "json_status_field":
+			replace(k, "JSONStatusField", v)
+
+		case "kill_grace_period", "killgraceperiod":
+			d, err := parseDuration(v)
+			if err != nil {
+				return fmt.Errorf("invalid %q: %v", k, err)
+			}
+			replace(k, "KillGracePeriod", d)
+
+		case "kill_signal":
+			replace(k, "KillSignal", v)
+
+		case "output_encoding":
+			replace(k, "OutputEncoding", v)
+
+		case "script_template":
+			replace(k, "ScriptTemplate", v)
+
+		case "stdout_contains":
+			replace(k, "StdoutContains", v)
+
+		case "stdout_matches":
+			replace(k, "StdoutMatches", v)
+
+		case "stdout_negate":
+			replace(k, "StdoutNegate", v)
+
+		case "start_grace_period", "startgraceperiod":
+			d, err := parseDuration(v)
+			if err != nil {
+				return fmt.Errorf("invalid %q: %v", k, err)
+			}
+			replace(k, "StartGracePeriod", d)
+
 		case "service_id":
 			replace(k, "ServiceID", v)
 
+		case "tls_server_name":
+			replace(k, "TLSServerName", v)
+
 		case "tls_skip_verify":
 			replace(k, "TLSSkipVerify", v)
+
+		case "warning_exit_codes":
+			replace(k, "WarningExitCodes", v)
 		}
 	}
 	return nil
@@ -1742,6 +2222,9 @@ func MergeConfig(a, b *Config) *Config {
 	if b.EnableDebug {
 		result.EnableDebug = true
 	}
+	if b.EnablePrivilegedDockerChecks {
+		result.EnablePrivilegedDockerChecks = true
+	}
 	if b.VerifyIncoming {
 		result.VerifyIncoming = true
 	}
@@ -1841,6 +2324,9 @@ func MergeConfig(a, b *Config) *Config {
 	if b.RetryInterval != 0 {
 		result.RetryInterval = b.RetryInterval
 	}
+	if b.RetryMaxInterval != 0 {
+		result.RetryMaxInterval = b.RetryMaxInterval
+	}
 	if b.RetryJoinEC2.AccessKeyID != "" {
 		result.RetryJoinEC2.AccessKeyID = b.RetryJoinEC2.AccessKeyID
 	}
@@ -1868,6 +2354,47 @@ func MergeConfig(a, b *Config) *Config {
 	if b.RetryJoinGCE.CredentialsFile != "" {
 		result.RetryJoinGCE.CredentialsFile = b.RetryJoinGCE.CredentialsFile
 	}
+	if b.RetryJoinAddressFamily != "" {
+		result.RetryJoinAddressFamily = b.RetryJoinAddressFamily
+	}
+	if b.RetryJoinLastKnown {
+		result.RetryJoinLastKnown = true
+	}
+	if b.RetryJoinMinAgents != 0 {
+		result.RetryJoinMinAgents = b.RetryJoinMinAgents
+	}
+	if b.RetryJoinMinDomains != 0 {
+		result.RetryJoinMinDomains = b.RetryJoinMinDomains
+	}
+	if b.RetryJoinFallbackAfter != 0 {
+		result.RetryJoinFallbackAfter = b.RetryJoinFallbackAfter
+	}
+	if b.RetryJoinFailFast {
+		result.RetryJoinFailFast = true
+	}
+	if b.RetryJoinRoundRobin {
+		result.RetryJoinRoundRobin = true
+	}
+	if b.RetryJoinOnce {
+		result.RetryJoinOnce = true
+	}
+	if b.RetryJoinOrder != "" {
+		result.RetryJoinOrder = b.RetryJoinOrder
+	}
+	if b.RetryJoinSkipAfter != 0 {
+		result.RetryJoinSkipAfter = b.RetryJoinSkipAfter
+	}
+	if len(b.RetryJoinProviderRetry) > 0 {
+		result.RetryJoinProviderRetry = make(map[string]RetryJoinProviderRetry)
+		for name, retry := range a.RetryJoinProviderRetry {
+			result.RetryJoinProviderRetry[name] = retry
+		}
+		for name, retry := range b.RetryJoinProviderRetry {
+			result.RetryJoinProviderRetry[name] = retry
+		}
+	}
+	result.RetryJoinTagFilter = append(a.RetryJoinTagFilter, b.RetryJoinTagFilter...)
+	result.RetryJoinExclude = append(a.RetryJoinExclude, b.RetryJoinExclude...)
 	if b.RetryJoinAzure.TagName != "" {
 		result.RetryJoinAzure.TagName = b.RetryJoinAzure.TagName
 	}
@@ -1886,12 +2413,48 @@ func MergeConfig(a, b *Config) *Config {
 	if b.RetryJoinAzure.SecretAccessKey != "" {
 		result.RetryJoinAzure.SecretAccessKey = b.RetryJoinAzure.SecretAccessKey
 	}
+	if b.RetryJoinExec.Command != "" {
+		result.RetryJoinExec.Command = b.RetryJoinExec.Command
+	}
+	if len(b.RetryJoinExec.Args) != 0 {
+		result.RetryJoinExec.Args = b.RetryJoinExec.Args
+	}
+	if b.RetryJoinExec.Timeout != 0 {
+		result.RetryJoinExec.Timeout = b.RetryJoinExec.Timeout
+	}
+	if b.RetryJoinK8s.Service != "" {
+		result.RetryJoinK8s.Service = b.RetryJoinK8s.Service
+	}
+	if b.RetryJoinK8s.Namespace != "" {
+		result.RetryJoinK8s.Namespace = b.RetryJoinK8s.Namespace
+	}
+	if b.RetryJoinK8s.PortName != "" {
+		result.RetryJoinK8s.PortName = b.RetryJoinK8s.PortName
+	}
+	if b.RetryJoinNomad.Address != "" {
+		result.RetryJoinNomad.Address = b.RetryJoinNomad.Address
+	}
+	if b.RetryJoinNomad.Service != "" {
+		result.RetryJoinNomad.Service = b.RetryJoinNomad.Service
+	}
+	if b.RetryJoinNomad.Namespace != "" {
+		result.RetryJoinNomad.Namespace = b.RetryJoinNomad.Namespace
+	}
+	if b.RetryJoinNomad.Region != "" {
+		result.RetryJoinNomad.Region = b.RetryJoinNomad.Region
+	}
+	if b.RetryJoinNomad.Token != "" {
+		result.RetryJoinNomad.Token = b.RetryJoinNomad.Token
+	}
 	if b.RetryMaxAttemptsWan != 0 {
 		result.RetryMaxAttemptsWan = b.RetryMaxAttemptsWan
 	}
 	if b.RetryIntervalWan != 0 {
 		result.RetryIntervalWan = b.RetryIntervalWan
 	}
+	if b.RetryMaxIntervalWan != 0 {
+		result.RetryMaxIntervalWan = b.RetryMaxIntervalWan
+	}
 	if b.ReconnectTimeoutLan != 0 {
 		result.ReconnectTimeoutLan = b.ReconnectTimeoutLan
 		result.ReconnectTimeoutLanRaw = b.ReconnectTimeoutLanRaw
@@ -1978,6 +2541,9 @@ func MergeConfig(a, b *Config) *Config {
 	if b.DisableRemoteExec != nil {
 		result.DisableRemoteExec = b.DisableRemoteExec
 	}
+	if b.DisableDiscoveryLogs {
+		result.DisableDiscoveryLogs = true
+	}
 	if b.DisableUpdateCheck {
 		result.DisableUpdateCheck = true
 	}
@@ -2012,6 +2578,110 @@ func MergeConfig(a, b *Config) *Config {
 		}
 	}
 
+	if len(b.DockerConfig.Headers) > 0 {
+		if result.DockerConfig.Headers == nil {
+			result.DockerConfig.Headers = make(map[string]string)
+		}
+		for field, value := range b.DockerConfig.Headers {
+			result.DockerConfig.Headers[field] = value
+		}
+	}
+	if b.DockerConfig.Host != "" {
+		result.DockerConfig.Host = b.DockerConfig.Host
+	}
+	if b.DockerConfig.Context != "" {
+		result.DockerConfig.Context = b.DockerConfig.Context
+	}
+	result.DockerConfig.RedactHeaders = append(a.DockerConfig.RedactHeaders,
+		b.DockerConfig.RedactHeaders...)
+	if b.DockerConfig.Token != "" {
+		result.DockerConfig.Token = b.DockerConfig.Token
+	}
+	if b.DockerConfig.TokenFile != "" {
+		result.DockerConfig.TokenFile = b.DockerConfig.TokenFile
+	}
+	if b.DockerConfig.TLSFingerprint != "" {
+		result.DockerConfig.TLSFingerprint = b.DockerConfig.TLSFingerprint
+	}
+	if b.DockerConfig.UseAgentTLS {
+		result.DockerConfig.UseAgentTLS = true
+	}
+	if b.DockerConfig.CAFile != "" {
+		result.DockerConfig.CAFile = b.DockerConfig.CAFile
+	}
+	if b.DockerConfig.CertFile != "" {
+		result.DockerConfig.CertFile = b.DockerConfig.CertFile
+	}
+	if b.DockerConfig.KeyFile != "" {
+		result.DockerConfig.KeyFile = b.DockerConfig.KeyFile
+	}
+	if b.DockerConfig.CertPath != "" {
+		result.DockerConfig.CertPath = b.DockerConfig.CertPath
+	}
+	if b.DockerConfig.TLSSkipVerify {
+		result.DockerConfig.TLSSkipVerify = true
+	}
+	if b.DockerConfig.ConnectTimeout != 0 {
+		result.DockerConfig.ConnectTimeout = b.DockerConfig.ConnectTimeout
+	}
+	if b.DockerConfig.ExecCreateRetries != 0 {
+		result.DockerConfig.ExecCreateRetries = b.DockerConfig.ExecCreateRetries
+	}
+	if b.DockerConfig.MaxConcurrentChecks != 0 {
+		result.DockerConfig.MaxConcurrentChecks = b.DockerConfig.MaxConcurrentChecks
+	}
+	if b.DockerConfig.ExecPollInterval != 0 {
+		result.DockerConfig.ExecPollInterval = b.DockerConfig.ExecPollInterval
+	}
+	if b.DockerConfig.ExecOutputBytes != 0 {
+		result.DockerConfig.ExecOutputBytes = b.DockerConfig.ExecOutputBytes
+	}
+	if b.DockerConfig.MaxBytesPerInterval != 0 {
+		result.DockerConfig.MaxBytesPerInterval = b.DockerConfig.MaxBytesPerInterval
+	}
+	if b.DockerConfig.OutputMaxBytes != 0 {
+		result.DockerConfig.OutputMaxBytes = b.DockerConfig.OutputMaxBytes
+	}
+	if b.DockerConfig.OutputKeep != "" {
+		result.DockerConfig.OutputKeep = b.DockerConfig.OutputKeep
+	}
+	if b.DockerConfig.InfrastructureStatus != "" {
+		result.DockerConfig.InfrastructureStatus = b.DockerConfig.InfrastructureStatus
+	}
+	if b.DockerConfig.CheckPressure {
+		result.DockerConfig.CheckPressure = true
+	}
+	if b.DockerConfig.BreakerErrorRate != 0 {
+		result.DockerConfig.BreakerErrorRate = b.DockerConfig.BreakerErrorRate
+	}
+	if b.DockerConfig.BreakerCooldown != 0 {
+		result.DockerConfig.BreakerCooldown = b.DockerConfig.BreakerCooldown
+	}
+	if b.DockerConfig.AuditLogDir != "" {
+		result.DockerConfig.AuditLogDir = b.DockerConfig.AuditLogDir
+	}
+	if b.DockerConfig.AuditLogMaxBytes != 0 {
+		result.DockerConfig.AuditLogMaxBytes = b.DockerConfig.AuditLogMaxBytes
+	}
+	result.DockerConfig.AuditRedact = append(a.DockerConfig.AuditRedact,
+		b.DockerConfig.AuditRedact...)
+	result.DockerConfig.AllowedContainerNames = append(a.DockerConfig.AllowedContainerNames,
+		b.DockerConfig.AllowedContainerNames...)
+	result.DockerConfig.AllowedContainerLabels = append(a.DockerConfig.AllowedContainerLabels,
+		b.DockerConfig.AllowedContainerLabels...)
+	if b.DockerConfig.RegisterServices {
+		result.DockerConfig.RegisterServices = true
+	}
+	if b.DockerConfig.ContainerRuntime != "" {
+		result.DockerConfig.ContainerRuntime = b.DockerConfig.ContainerRuntime
+	}
+	if b.DockerConfig.PodmanHost != "" {
+		result.DockerConfig.PodmanHost = b.DockerConfig.PodmanHost
+	}
+	if b.DockerConfig.ContainerdHost != "" {
+		result.DockerConfig.ContainerdHost = b.DockerConfig.ContainerdHost
+	}
+
 	if len(b.Meta) != 0 {
 		if result.Meta == nil {
 			result.Meta = make(map[string]string)
@@ -2036,10 +2706,23 @@ func MergeConfig(a, b *Config) *Config {
 	result.RetryJoin = append(result.RetryJoin, a.RetryJoin...)
 	result.RetryJoin = append(result.RetryJoin, b.RetryJoin...)
 
+	// Copy the retry join fallback addresses
+	result.RetryJoinFallback = make([]string, 0, len(a.RetryJoinFallback)+len(b.RetryJoinFallback))
+	result.RetryJoinFallback = append(result.RetryJoinFallback, a.RetryJoinFallback...)
+	result.RetryJoinFallback = append(result.RetryJoinFallback, b.RetryJoinFallback...)
+
+	// Copy the retry join seed addresses
+	result.RetryJoinSeeds = make([]string, 0, len(a.RetryJoinSeeds)+len(b.RetryJoinSeeds))
+	result.RetryJoinSeeds = append(result.RetryJoinSeeds, a.RetryJoinSeeds...)
+	result.RetryJoinSeeds = append(result.RetryJoinSeeds, b.RetryJoinSeeds...)
+
 	// Copy the retry join -wan addresses
 	result.RetryJoinWan = make([]string, 0, len(a.RetryJoinWan)+len(b.RetryJoinWan))
 	result.RetryJoinWan = append(result.RetryJoinWan, a.RetryJoinWan...)
 	result.RetryJoinWan = append(result.RetryJoinWan, b.RetryJoinWan...)
+	if b.RetryJoinWanDiscovery {
+		result.RetryJoinWanDiscovery = true
+	}
 
 	return &result
 }
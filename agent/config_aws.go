@@ -12,8 +12,9 @@ import (
 )
 
 // discoverEc2Hosts searches an AWS region, returning a list of instance ips
-// where EC2TagKey = EC2TagValue
-func (c *Config) discoverEc2Hosts(logger *log.Logger) ([]string, error) {
+// where EC2TagKey = EC2TagValue, and their availability zones as their
+// failure domains
+func (c *Config) discoverEc2Hosts(logger *log.Logger) ([]string, map[string]string, error) {
 	config := c.RetryJoinEC2
 
 	ec2meta := ec2metadata.New(session.New())
@@ -21,19 +22,28 @@ func (c *Config) discoverEc2Hosts(logger *log.Logger) ([]string, error) {
 		logger.Printf("[INFO] agent: No EC2 region provided, querying instance metadata endpoint...")
 		identity, err := ec2meta.GetInstanceIdentityDocument()
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		config.Region = identity.Region
 	}
 
+	accessKeyID, err := resolveDiscoverySecret("retry_join_ec2 access_key_id", config.AccessKeyID)
+	if err != nil {
+		return nil, nil, err
+	}
+	secretAccessKey, err := resolveDiscoverySecret("retry_join_ec2 secret_access_key", config.SecretAccessKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	awsConfig := &aws.Config{
 		Region: &config.Region,
 		Credentials: credentials.NewChainCredentials(
 			[]credentials.Provider{
 				&credentials.StaticProvider{
 					Value: credentials.Value{
-						AccessKeyID:     config.AccessKeyID,
-						SecretAccessKey: config.SecretAccessKey,
+						AccessKeyID:     accessKeyID,
+						SecretAccessKey: secretAccessKey,
 					},
 				},
 				&credentials.EnvProvider{},
@@ -56,18 +66,40 @@ func (c *Config) discoverEc2Hosts(logger *log.Logger) ([]string, error) {
 	})
 
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+
+	filter, err := parseTagFilter(c.RetryJoinTagFilter)
+	if err != nil {
+		return nil, nil, err
 	}
 
 	var servers []string
+	domains := make(map[string]string)
+	var dropped int
 	for i := range resp.Reservations {
 		for _, instance := range resp.Reservations[i].Instances {
 			// Terminated instances don't have the PrivateIpAddress field
-			if instance.PrivateIpAddress != nil {
-				servers = append(servers, *instance.PrivateIpAddress)
+			if instance.PrivateIpAddress == nil {
+				continue
+			}
+			tags := make(map[string]string)
+			for _, t := range instance.Tags {
+				tags[aws.StringValue(t.Key)] = aws.StringValue(t.Value)
+			}
+			if !filter.Match(tags) {
+				dropped++
+				continue
+			}
+			servers = append(servers, *instance.PrivateIpAddress)
+			if instance.Placement != nil && aws.StringValue(instance.Placement.AvailabilityZone) != "" {
+				domains[*instance.PrivateIpAddress] = *instance.Placement.AvailabilityZone
 			}
 		}
 	}
+	if dropped > 0 {
+		logger.Printf("[INFO] agent: Dropped %d EC2 instances not matching the tag filter", dropped)
+	}
 
-	return servers, nil
+	return servers, domains, nil
 }
@@ -13,22 +13,39 @@ import (
 // where AzureTag_Name = AzureTag_Value
 func (c *Config) discoverAzureHosts(logger *log.Logger) ([]string, error) {
 	var servers []string
+	subscriptionID, err := resolveDiscoverySecret("retry_join_azure subscription_id", c.RetryJoinAzure.SubscriptionID)
+	if err != nil {
+		return nil, err
+	}
+	tenantID, err := resolveDiscoverySecret("retry_join_azure tenant_id", c.RetryJoinAzure.TenantID)
+	if err != nil {
+		return nil, err
+	}
+	clientID, err := resolveDiscoverySecret("retry_join_azure client_id", c.RetryJoinAzure.ClientID)
+	if err != nil {
+		return nil, err
+	}
+	secretAccessKey, err := resolveDiscoverySecret("retry_join_azure secret_access_key", c.RetryJoinAzure.SecretAccessKey)
+	if err != nil {
+		return nil, err
+	}
+
 	// Only works for the Azure PublicCLoud for now; no ability to test other Environment
-	oauthConfig, err := azure.PublicCloud.OAuthConfigForTenant(c.RetryJoinAzure.TenantID)
+	oauthConfig, err := azure.PublicCloud.OAuthConfigForTenant(tenantID)
 	if err != nil {
 		return nil, err
 	}
 	// Get the ServicePrincipalToken for use searching the NetworkInterfaces
 	sbt, tokerr := azure.NewServicePrincipalToken(*oauthConfig,
-		c.RetryJoinAzure.ClientID,
-		c.RetryJoinAzure.SecretAccessKey,
+		clientID,
+		secretAccessKey,
 		azure.PublicCloud.ResourceManagerEndpoint,
 	)
 	if tokerr != nil {
 		return nil, tokerr
 	}
 	// Setup the client using autorest; followed the structure from Terraform
-	vmnet := network.NewInterfacesClient(c.RetryJoinAzure.SubscriptionID)
+	vmnet := network.NewInterfacesClient(subscriptionID)
 	vmnet.Client.UserAgent = fmt.Sprint("Hashicorp-Consul")
 	vmnet.Authorizer = sbt
 	vmnet.Sender = autorest.CreateSender(autorest.WithLogging(logger))
@@ -37,12 +54,22 @@ func (c *Config) discoverAzureHosts(logger *log.Logger) ([]string, error) {
 	if neterr != nil {
 		return nil, neterr
 	}
+	filter, err := parseTagFilter(c.RetryJoinTagFilter)
+	if err != nil {
+		return nil, err
+	}
 	// For now, ignore Primary interfaces, choose any PrivateIPAddress with the matching tags
 	for _, oneint := range *netres.Value {
 		// Make it a little more robust just in case there is actually no Tags
 		if oneint.Tags != nil {
+			tags := make(map[string]string)
+			for k, v := range *oneint.Tags {
+				if v != nil {
+					tags[k] = *v
+				}
+			}
 			tv := (*oneint.Tags)[c.RetryJoinAzure.TagName]
-			if tv != nil && *tv == c.RetryJoinAzure.TagValue {
+			if tv != nil && *tv == c.RetryJoinAzure.TagValue && filter.Match(tags) {
 				// Make it a little more robust just in case IPConfigurations nil
 				if oneint.IPConfigurations != nil {
 					for _, onecfg := range *oneint.IPConfigurations {
@@ -28,7 +28,7 @@ func TestDiscoverEC2Hosts(t *testing.T) {
 		},
 	}
 
-	servers, err := c.discoverEc2Hosts(&log.Logger{})
+	servers, _, err := c.discoverEc2Hosts(&log.Logger{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -0,0 +1,74 @@
+package agent
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// defaultRetryJoinExecTimeout is how long the discovery program may run if
+// no timeout is configured.
+const defaultRetryJoinExecTimeout = 10 * time.Second
+
+// discoverExecHosts runs the discovery program of retry_join_exec and
+// returns the addresses it printed, and the failure domains of those it
+// printed one for. A program which exits with a non-zero exit code or runs
+// past the timeout is a failed discovery.
+func (c *Config) discoverExecHosts(logger *log.Logger) ([]string, map[string]string, error) {
+	timeout := c.RetryJoinExec.Timeout
+	if timeout == 0 {
+		timeout = defaultRetryJoinExecTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, c.RetryJoinExec.Command, c.RetryJoinExec.Args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if msg := strings.TrimSpace(stderr.String()); msg != "" {
+		logger.Printf("[DEBUG] agent: %s: %s", c.RetryJoinExec.Command, msg)
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil, nil, fmt.Errorf("Timed out after %s", timeout)
+	}
+	switch err.(type) {
+	case nil:
+	case *exec.Error, *os.PathError:
+		// The program could not be found or started.
+		return nil, nil, &permanentDiscoveryError{err}
+	default:
+		return nil, nil, err
+	}
+	return parseExecHosts(out)
+}
+
+// parseExecHosts parses the output of the discovery program. Every line
+// that isn't empty is an address, with or without a port, optionally
+// followed by the failure domain of the server as "domain=<name>".
+func parseExecHosts(out []byte) ([]string, map[string]string, error) {
+	var servers []string
+	var domains map[string]string
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 0:
+			continue
+		case len(fields) == 2 && strings.HasPrefix(fields[1], "domain=") && len(fields[1]) > len("domain="):
+			if domains == nil {
+				domains = make(map[string]string)
+			}
+			domains[fields[0]] = strings.TrimPrefix(fields[1], "domain=")
+		case len(fields) != 1:
+			return nil, nil, fmt.Errorf("Invalid address %q", strings.TrimSpace(line))
+		}
+		servers = append(servers, fields[0])
+	}
+	return servers, domains, nil
+}
@@ -0,0 +1,63 @@
+package agent
+
+import (
+	"io/ioutil"
+	"log"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDiscoverExecHosts(t *testing.T) {
+	t.Parallel()
+	logger := log.New(ioutil.Discard, "", 0)
+
+	c := &Config{RetryJoinExec: RetryJoinExec{
+		Command: "/bin/sh",
+		Args:    []string{"-c", "echo 10.0.0.1:8301; echo; echo 10.0.0.2"},
+	}}
+	servers, domains, err := c.discoverExecHosts(logger)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if want := []string{"10.0.0.1:8301", "10.0.0.2"}; !reflect.DeepEqual(servers, want) {
+		t.Fatalf("got %v want %v", servers, want)
+	}
+	if domains != nil {
+		t.Fatalf("got domains %v", domains)
+	}
+
+	c.RetryJoinExec.Args = []string{"-c", "echo 10.0.0.1 domain=us-east-1a; echo 10.0.0.2"}
+	servers, domains, err = c.discoverExecHosts(logger)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if want := []string{"10.0.0.1", "10.0.0.2"}; !reflect.DeepEqual(servers, want) {
+		t.Fatalf("got %v want %v", servers, want)
+	}
+	if want := map[string]string{"10.0.0.1": "us-east-1a"}; !reflect.DeepEqual(domains, want) {
+		t.Fatalf("got domains %v want %v", domains, want)
+	}
+
+	c.RetryJoinExec.Args = []string{"-c", "echo 10.0.0.1; exit 2"}
+	if _, _, err := c.discoverExecHosts(logger); err == nil || !strings.Contains(err.Error(), "exit status 2") {
+		t.Fatalf("got error %v", err)
+	}
+
+	c.RetryJoinExec.Args = []string{"-c", "echo 10.0.0.1 10.0.0.2"}
+	if _, _, err := c.discoverExecHosts(logger); err == nil || !strings.Contains(err.Error(), "Invalid address") {
+		t.Fatalf("got error %v", err)
+	}
+
+	c.RetryJoinExec.Args = []string{"-c", "exec sleep 10"}
+	c.RetryJoinExec.Timeout = 50 * time.Millisecond
+	if _, _, err := c.discoverExecHosts(logger); err == nil || !strings.Contains(err.Error(), "Timed out") {
+		t.Fatalf("got error %v", err)
+	}
+
+	c.RetryJoinExec.Command = "/no/such/discover"
+	if _, _, err := c.discoverExecHosts(logger); !isPermanentDiscoveryError(err) {
+		t.Fatalf("got error %v", err)
+	}
+}
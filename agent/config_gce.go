@@ -14,8 +14,9 @@ import (
 )
 
 // discoverGCEHosts searches a Google Compute Engine region, returning a list
-// of instance ips that match the tags given in GCETags.
-func (c *Config) discoverGCEHosts(logger *log.Logger) ([]string, error) {
+// of instance ips that match the tags given in GCETags, and their zones as
+// their failure domains.
+func (c *Config) discoverGCEHosts(logger *log.Logger) ([]string, map[string]string, error) {
 	config := c.RetryJoinGCE
 	ctx := oauth2.NoContext
 	var client *http.Client
@@ -26,31 +27,31 @@ func (c *Config) discoverGCEHosts(logger *log.Logger) ([]string, error) {
 		logger.Printf("[INFO] agent: Loading credentials from %s", config.CredentialsFile)
 		key, err := ioutil.ReadFile(config.CredentialsFile)
 		if err != nil {
-			return nil, err
+			return nil, nil, &permanentDiscoveryError{err}
 		}
 		jwtConfig, err := google.JWTConfigFromJSON(key, compute.ComputeScope)
 		if err != nil {
-			return nil, err
+			return nil, nil, &permanentDiscoveryError{err}
 		}
 		client = jwtConfig.Client(ctx)
 	} else {
 		logger.Printf("[INFO] agent: Using default credential chain")
 		client, err = google.DefaultClient(ctx, compute.ComputeScope)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 	}
 
 	computeService, err := compute.New(client)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	if config.ProjectName == "" {
 		logger.Printf("[INFO] agent: No GCE project provided, will discover from metadata.")
 		config.ProjectName, err = gceProjectIDFromMetadata(logger)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 	} else {
 		logger.Printf("[INFO] agent: Using pre-defined GCE project name: %s", config.ProjectName)
@@ -58,24 +59,33 @@ func (c *Config) discoverGCEHosts(logger *log.Logger) ([]string, error) {
 
 	zones, err := gceDiscoverZones(ctx, logger, computeService, config.ProjectName, config.ZonePattern)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	logger.Printf("[INFO] agent: Discovering GCE hosts with tag %s in zones: %s", config.TagValue, strings.Join(zones, ", "))
 
+	filter, err := parseTagFilter(c.RetryJoinTagFilter)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	var servers []string
+	domains := make(map[string]string)
 	for _, zone := range zones {
-		addresses, err := gceInstancesAddressesForZone(ctx, logger, computeService, config.ProjectName, zone, config.TagValue)
+		addresses, err := gceInstancesAddressesForZone(ctx, logger, computeService, config.ProjectName, zone, config.TagValue, filter)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		if len(addresses) > 0 {
 			logger.Printf("[INFO] agent: Discovered %d instances in %s/%s: %v", len(addresses), config.ProjectName, zone, addresses)
 		}
 		servers = append(servers, addresses...)
+		for _, addr := range addresses {
+			domains[addr] = zone
+		}
 	}
 
-	return servers, nil
+	return servers, domains, nil
 }
 
 // gceProjectIDFromMetadata queries the metadata service on GCE to get the
@@ -137,13 +147,16 @@ func gceDiscoverZones(ctx context.Context, logger *log.Logger, computeService *c
 }
 
 // gceInstancesAddressesForZone locates all instances within a specific project
-// and zone, matching the supplied tag. Only the private IP addresses are
-// returned, but ID is also logged.
-func gceInstancesAddressesForZone(ctx context.Context, logger *log.Logger, computeService *compute.Service, project, zone, tag string) ([]string, error) {
+// and zone, matching the supplied tag and whose metadata matches the filter.
+// Only the private IP addresses are returned, but ID is also logged.
+func gceInstancesAddressesForZone(ctx context.Context, logger *log.Logger, computeService *compute.Service, project, zone, tag string, filter tagFilter) ([]string, error) {
 	var addresses []string
 	call := computeService.Instances.List(project, zone)
 	if err := call.Pages(ctx, func(page *compute.InstanceList) error {
 		for _, v := range page.Items {
+			if len(filter) > 0 && !filter.Match(gceMetadata(v)) {
+				continue
+			}
 			for _, t := range v.Tags.Items {
 				if t == tag && len(v.NetworkInterfaces) > 0 && v.NetworkInterfaces[0].NetworkIP != "" {
 					addresses = append(addresses, v.NetworkInterfaces[0].NetworkIP)
@@ -157,3 +170,19 @@ func gceInstancesAddressesForZone(ctx context.Context, logger *log.Logger, compu
 
 	return addresses, nil
 }
+
+// gceMetadata returns the metadata of the instance as a map.
+func gceMetadata(instance *compute.Instance) map[string]string {
+	metadata := make(map[string]string)
+	if instance.Metadata == nil {
+		return metadata
+	}
+	for _, item := range instance.Metadata.Items {
+		if item.Value != nil {
+			metadata[item.Key] = *item.Value
+		} else {
+			metadata[item.Key] = ""
+		}
+	}
+	return metadata
+}
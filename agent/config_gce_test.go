@@ -25,7 +25,7 @@ func TestDiscoverGCEHosts(t *testing.T) {
 		},
 	}
 
-	servers, err := c.discoverGCEHosts(log.New(os.Stderr, "", log.LstdFlags))
+	servers, _, err := c.discoverGCEHosts(log.New(os.Stderr, "", log.LstdFlags))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -0,0 +1,218 @@
+package agent
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-cleanhttp"
+)
+
+// k8sServiceAccountDir is where Kubernetes mounts the credentials of the
+// pod's service account.
+var k8sServiceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// k8sRequestTimeout is the timeout of the requests to the Kubernetes API.
+const k8sRequestTimeout = 10 * time.Second
+
+// k8sEndpoints is the part of a Kubernetes Endpoints object holding the
+// ready addresses of a service.
+type k8sEndpoints struct {
+	Subsets []struct {
+		Addresses []struct {
+			IP string `json:"ip"`
+		} `json:"addresses"`
+		Ports []struct {
+			Name string `json:"name"`
+			Port int    `json:"port"`
+		} `json:"ports"`
+	} `json:"subsets"`
+}
+
+// discoverK8sHosts returns the ready addresses of the Kubernetes service of
+// retry_join_k8s. The API server is found through the environment Kubernetes
+// sets up in every pod and the service account's token authenticates the
+// request. The endpoints are queried on every attempt so pods which come
+// and go are picked up.
+func (c *Config) discoverK8sHosts(logger *log.Logger) ([]string, error) {
+	api, err := c.k8sAPI(k8sRequestTimeout)
+	if err != nil {
+		return nil, err
+	}
+	url := fmt.Sprintf("%s/api/v1/namespaces/%s/endpoints/%s", api.base, api.namespace, c.RetryJoinK8s.Service)
+	logger.Printf("[DEBUG] agent: Querying Kubernetes endpoints %s", url)
+	return c.k8sEndpointAddrs(api.client, url, api.token)
+}
+
+// watchK8sHosts watches the Endpoints object of the Kubernetes service of
+// retry_join_k8s and signals changed whenever it changes, so a retry join
+// doesn't have to wait for the retry interval when servers come up. The
+// watch is opened again when the API server closes it and runs until ctx
+// is done or it fails.
+func (c *Config) watchK8sHosts(ctx context.Context, logger *log.Logger, changed chan<- struct{}) error {
+	// The watch is a long-lived stream so the client has no timeout.
+	api, err := c.k8sAPI(0)
+	if err != nil {
+		return err
+	}
+	url := fmt.Sprintf("%s/api/v1/namespaces/%s/endpoints?watch=true&fieldSelector=metadata.name%%3D%s",
+		api.base, api.namespace, c.RetryJoinK8s.Service)
+	for ctx.Err() == nil {
+		logger.Printf("[DEBUG] agent: Watching Kubernetes endpoints %s", url)
+		if err := k8sWatchEndpoints(ctx, api.client, url, api.token, changed); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// k8sAPIClient is set up to talk to the Kubernetes API server from a pod.
+type k8sAPIClient struct {
+	client    *http.Client
+	base      string
+	token     string
+	namespace string
+}
+
+// k8sAPI sets up a client for the Kubernetes API server with the service
+// account of the pod and the namespace of retry_join_k8s.
+func (c *Config) k8sAPI(timeout time.Duration) (*k8sAPIClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, &permanentDiscoveryError{fmt.Errorf("Not running in a Kubernetes pod, KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT are not set")}
+	}
+	token, err := ioutil.ReadFile(filepath.Join(k8sServiceAccountDir, "token"))
+	if err != nil {
+		return nil, &permanentDiscoveryError{fmt.Errorf("Unable to read service account token: %v", err)}
+	}
+	ca, err := ioutil.ReadFile(filepath.Join(k8sServiceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read service account CA: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("No certificates in service account CA")
+	}
+
+	namespace := c.RetryJoinK8s.Namespace
+	if namespace == "" {
+		buf, err := ioutil.ReadFile(filepath.Join(k8sServiceAccountDir, "namespace"))
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read namespace of the pod: %v", err)
+		}
+		namespace = strings.TrimSpace(string(buf))
+	}
+
+	transport := cleanhttp.DefaultTransport()
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	return &k8sAPIClient{
+		client:    &http.Client{Transport: transport, Timeout: timeout},
+		base:      "https://" + net.JoinHostPort(host, port),
+		token:     strings.TrimSpace(string(token)),
+		namespace: namespace,
+	}, nil
+}
+
+// k8sWatchEndpoints reads the events of a watch of Endpoints objects at url
+// and signals changed for each without blocking. It returns nil when the
+// API server ends the watch.
+func k8sWatchEndpoints(ctx context.Context, client *http.Client, url, token string, changed chan<- struct{}) error {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("Unexpected response code %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var event struct {
+			Type string `json:"type"`
+		}
+		if err := dec.Decode(&event); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("Failed to decode watch event: %v", err)
+		}
+		if event.Type == "ERROR" {
+			return fmt.Errorf("Watch of endpoints failed")
+		}
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// k8sEndpointAddrs queries the Endpoints object at url and returns its
+// ready addresses. If a port name is configured the port of that name is
+// added to each address.
+func (c *Config) k8sEndpointAddrs(client *http.Client, url, token string) ([]string, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		err := fmt.Errorf("Unexpected response code %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+		if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+			return nil, &permanentDiscoveryError{err}
+		}
+		return nil, err
+	}
+	var endpoints k8sEndpoints
+	if err := json.NewDecoder(resp.Body).Decode(&endpoints); err != nil {
+		return nil, fmt.Errorf("Failed to decode endpoints: %v", err)
+	}
+
+	var servers []string
+	for _, subset := range endpoints.Subsets {
+		port := 0
+		if name := c.RetryJoinK8s.PortName; name != "" {
+			for _, p := range subset.Ports {
+				if p.Name == name {
+					port = p.Port
+				}
+			}
+			if port == 0 {
+				continue
+			}
+		}
+		for _, addr := range subset.Addresses {
+			if port == 0 {
+				servers = append(servers, addr.IP)
+				continue
+			}
+			servers = append(servers, net.JoinHostPort(addr.IP, strconv.Itoa(port)))
+		}
+	}
+	return servers, nil
+}
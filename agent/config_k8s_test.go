@@ -0,0 +1,92 @@
+package agent
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestK8sEndpointAddrs(t *testing.T) {
+	t.Parallel()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/namespaces/consul/endpoints/consul-server" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"subsets":[
+			{"addresses":[{"ip":"10.0.0.1"},{"ip":"10.0.0.2"}],"ports":[{"name":"http","port":8500},{"name":"serflan","port":8301}]},
+			{"addresses":[{"ip":"10.0.0.3"}],"ports":[{"name":"http","port":8500}]}
+		]}`))
+	}))
+	defer srv.Close()
+	url := srv.URL + "/api/v1/namespaces/consul/endpoints/consul-server"
+
+	c := &Config{}
+	servers, err := c.k8sEndpointAddrs(http.DefaultClient, url, "token")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if want := []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}; !reflect.DeepEqual(servers, want) {
+		t.Fatalf("got %v want %v", servers, want)
+	}
+
+	// Only the subsets with the named port are joined.
+	c.RetryJoinK8s.PortName = "serflan"
+	servers, err = c.k8sEndpointAddrs(http.DefaultClient, url, "token")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if want := []string{"10.0.0.1:8301", "10.0.0.2:8301"}; !reflect.DeepEqual(servers, want) {
+		t.Fatalf("got %v want %v", servers, want)
+	}
+
+	if _, err := c.k8sEndpointAddrs(http.DefaultClient, url, "bad"); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Fatalf("got error %v", err)
+	}
+}
+
+func TestK8sWatchEndpoints(t *testing.T) {
+	t.Parallel()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("watch") != "true" || r.URL.Query().Get("fieldSelector") != "metadata.name=consul-server" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"type":"ADDED","object":{"subsets":[]}}` + "\n"))
+		w.Write([]byte(`{"type":"MODIFIED","object":{"subsets":[{"addresses":[{"ip":"10.0.0.1"}]}]}}` + "\n"))
+		if r.URL.Query().Get("fail") != "" {
+			w.Write([]byte(`{"type":"ERROR","object":{"message":"too old resource version"}}` + "\n"))
+		}
+	}))
+	defer srv.Close()
+	url := srv.URL + "/api/v1/namespaces/consul/endpoints?watch=true&fieldSelector=metadata.name%3Dconsul-server"
+
+	// Events are coalesced if nobody is reading the channel.
+	changed := make(chan struct{}, 1)
+	if err := k8sWatchEndpoints(context.Background(), http.DefaultClient, url, "token", changed); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(changed) != 1 {
+		t.Fatalf("should have signalled a change")
+	}
+
+	err := k8sWatchEndpoints(context.Background(), http.DefaultClient, url+"&fail=1", "token", make(chan struct{}, 1))
+	if err == nil || !strings.Contains(err.Error(), "Watch of endpoints failed") {
+		t.Fatalf("got error %v", err)
+	}
+	err = k8sWatchEndpoints(context.Background(), http.DefaultClient, url, "bad", make(chan struct{}, 1))
+	if err == nil || !strings.Contains(err.Error(), "401") {
+		t.Fatalf("got error %v", err)
+	}
+}
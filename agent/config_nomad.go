@@ -0,0 +1,109 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-cleanhttp"
+)
+
+// nomadDefaultAddr is the address of the local Nomad agent's HTTP API.
+const nomadDefaultAddr = "http://127.0.0.1:4646"
+
+// nomadRequestTimeout is the timeout of the requests to the Nomad API.
+const nomadRequestTimeout = 10 * time.Second
+
+// nomadServiceRegistration is the part of a registration in Nomad's service
+// catalog with the address of an allocation.
+type nomadServiceRegistration struct {
+	Address string `json:"Address"`
+	Port    int    `json:"Port"`
+}
+
+// discoverNomadHosts returns the addresses of the allocations registered
+// for the Nomad service of retry_join_nomad. The service is queried on
+// every attempt so rescheduled allocations are picked up.
+func (c *Config) discoverNomadHosts(logger *log.Logger) ([]string, error) {
+	cfg := c.RetryJoinNomad
+	addr := cfg.Address
+	if addr == "" {
+		addr = os.Getenv("NOMAD_ADDR")
+	}
+	if addr == "" {
+		addr = nomadDefaultAddr
+	}
+	token := cfg.Token
+	if token == "" {
+		token = os.Getenv("NOMAD_TOKEN")
+	}
+	token, err := resolveDiscoverySecret("retry_join_nomad token", token)
+	if err != nil {
+		return nil, err
+	}
+
+	query := url.Values{}
+	if cfg.Namespace != "" {
+		query.Set("namespace", cfg.Namespace)
+	}
+	if cfg.Region != "" {
+		query.Set("region", cfg.Region)
+	}
+	u := fmt.Sprintf("%s/v1/service/%s", strings.TrimRight(addr, "/"), url.PathEscape(cfg.Service))
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	logger.Printf("[DEBUG] agent: Querying Nomad service %s", u)
+	client := &http.Client{Transport: cleanhttp.DefaultTransport(), Timeout: nomadRequestTimeout}
+	return nomadServiceAddrs(client, u, token)
+}
+
+// nomadServiceAddrs queries the registrations of a Nomad service at
+// endpoint and returns their addresses with the registered ports.
+func nomadServiceAddrs(client *http.Client, endpoint, token string) ([]string, error) {
+	req, err := http.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("X-Nomad-Token", token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		err := fmt.Errorf("Unexpected response code %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+		if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+			return nil, &permanentDiscoveryError{err}
+		}
+		return nil, err
+	}
+	var regs []nomadServiceRegistration
+	if err := json.NewDecoder(resp.Body).Decode(&regs); err != nil {
+		return nil, fmt.Errorf("Failed to decode service registrations: %v", err)
+	}
+
+	var servers []string
+	for _, reg := range regs {
+		if reg.Address == "" {
+			continue
+		}
+		if reg.Port == 0 {
+			servers = append(servers, reg.Address)
+			continue
+		}
+		servers = append(servers, net.JoinHostPort(reg.Address, strconv.Itoa(reg.Port)))
+	}
+	return servers, nil
+}
@@ -0,0 +1,54 @@
+package agent
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestNomadServiceAddrs(t *testing.T) {
+	t.Parallel()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/service/consul-server" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("X-Nomad-Token") != "token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if r.URL.Query().Get("namespace") != "infra" {
+			w.Write([]byte(`[]`))
+			return
+		}
+		w.Write([]byte(`[
+			{"ServiceName":"consul-server","Address":"10.0.0.1","Port":8301,"AllocID":"a"},
+			{"ServiceName":"consul-server","Address":"10.0.0.2","Port":0,"AllocID":"b"},
+			{"ServiceName":"consul-server","Address":"","Port":8301,"AllocID":"c"}
+		]`))
+	}))
+	defer srv.Close()
+
+	c := &Config{RetryJoinNomad: RetryJoinNomad{
+		Address:   srv.URL,
+		Service:   "consul-server",
+		Namespace: "infra",
+		Token:     "token",
+	}}
+	logger := log.New(ioutil.Discard, "", 0)
+	servers, err := c.discoverNomadHosts(logger)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if want := []string{"10.0.0.1:8301", "10.0.0.2"}; !reflect.DeepEqual(servers, want) {
+		t.Fatalf("got %v want %v", servers, want)
+	}
+
+	c.RetryJoinNomad.Token = "bad"
+	if _, err := c.discoverNomadHosts(logger); err == nil || !isPermanentDiscoveryError(err) {
+		t.Fatalf("got error %v want a permanent error", err)
+	}
+}
@@ -294,6 +294,10 @@ func TestDecodeConfig(t *testing.T) {
 			in: `{"disable_remote_exec":false}`,
 			c:  &Config{DisableRemoteExec: Bool(false)},
 		},
+		{
+			in: `{"disable_discovery_logs":true}`,
+			c:  &Config{DisableDiscoveryLogs: true},
+		},
 		{
 			in: `{"disable_update_check":true}`,
 			c:  &Config{DisableUpdateCheck: true},
@@ -306,6 +310,94 @@ func TestDecodeConfig(t *testing.T) {
 			in: `{"dogstatsd_tags":["a:b","c:d"]}`,
 			c:  &Config{Telemetry: Telemetry{DogStatsdTags: []string{"a:b", "c:d"}}},
 		},
+		{
+			in: `{"docker_config":{"allowed_container_names":["web-*"],"allowed_container_labels":["consul.check=true"]}}`,
+			c:  &Config{DockerConfig: DockerConfig{AllowedContainerNames: []string{"web-*"}, AllowedContainerLabels: []string{"consul.check=true"}}},
+		},
+		{
+			in: `{"docker_config":{"audit_log_dir":"/var/log/consul","audit_log_max_bytes":1024,"audit_redact":["password=\\S+"]}}`,
+			c:  &Config{DockerConfig: DockerConfig{AuditLogDir: "/var/log/consul", AuditLogMaxBytes: 1024, AuditRedact: []string{`password=\S+`}}},
+		},
+		{
+			in: `{"docker_config":{"breaker_error_rate":0.5,"breaker_cooldown":"1m"}}`,
+			c:  &Config{DockerConfig: DockerConfig{BreakerErrorRate: 0.5, BreakerCooldown: time.Minute, BreakerCooldownRaw: "1m"}},
+		},
+		{
+			in: `{"docker_config":{"ca_file":"/etc/docker/ca.pem","cert_file":"/etc/docker/cert.pem","key_file":"/etc/docker/key.pem"}}`,
+			c:  &Config{DockerConfig: DockerConfig{CAFile: "/etc/docker/ca.pem", CertFile: "/etc/docker/cert.pem", KeyFile: "/etc/docker/key.pem"}},
+		},
+		{
+			in: `{"docker_config":{"cert_path":"/etc/docker/certs","tls_skip_verify":true}}`,
+			c:  &Config{DockerConfig: DockerConfig{CertPath: "/etc/docker/certs", TLSSkipVerify: true}},
+		},
+		{
+			in: `{"docker_config":{"check_pressure":true}}`,
+			c:  &Config{DockerConfig: DockerConfig{CheckPressure: true}},
+		},
+		{
+			in: `{"docker_config":{"connect_timeout":"2s"}}`,
+			c:  &Config{DockerConfig: DockerConfig{ConnectTimeout: 2 * time.Second, ConnectTimeoutRaw: "2s"}},
+		},
+		{
+			in: `{"docker_config":{"container_runtime":"podman","podman_host":"unix:///run/podman/podman.sock","containerd_host":"unix:///run/k3s/containerd/containerd.sock"}}`,
+			c:  &Config{DockerConfig: DockerConfig{ContainerRuntime: "podman", PodmanHost: "unix:///run/podman/podman.sock", ContainerdHost: "unix:///run/k3s/containerd/containerd.sock"}},
+		},
+		{
+			in: `{"docker_config":{"context":"remote"}}`,
+			c:  &Config{DockerConfig: DockerConfig{Context: "remote"}},
+		},
+		{
+			in: `{"docker_config":{"exec_create_retries":3}}`,
+			c:  &Config{DockerConfig: DockerConfig{ExecCreateRetries: 3}},
+		},
+		{
+			in: `{"docker_config":{"exec_output_bytes":65536,"output_max_bytes":1024,"output_keep":"head"}}`,
+			c:  &Config{DockerConfig: DockerConfig{ExecOutputBytes: 65536, OutputMaxBytes: 1024, OutputKeep: "head"}},
+		},
+		{
+			in: `{"docker_config":{"exec_poll_interval":"50ms"}}`,
+			c:  &Config{DockerConfig: DockerConfig{ExecPollInterval: 50 * time.Millisecond, ExecPollIntervalRaw: "50ms"}},
+		},
+		{
+			in: `{"docker_config":{"headers":{"X-Token":"a"},"redact_headers":["X-Token"]}}`,
+			c:  &Config{DockerConfig: DockerConfig{Headers: map[string]string{"X-Token": "a"}, RedactHeaders: []string{"X-Token"}}},
+		},
+		{
+			in: `{"docker_config":{"host":"unix:///run/docker.sock"}}`,
+			c:  &Config{DockerConfig: DockerConfig{Host: "unix:///run/docker.sock"}},
+		},
+		{
+			in: `{"docker_config":{"infrastructure_status":"warning"}}`,
+			c:  &Config{DockerConfig: DockerConfig{InfrastructureStatus: "warning"}},
+		},
+		{
+			in: `{"docker_config":{"max_bytes_per_interval":1048576}}`,
+			c:  &Config{DockerConfig: DockerConfig{MaxBytesPerInterval: 1 << 20}},
+		},
+		{
+			in: `{"docker_config":{"max_concurrent_checks":8}}`,
+			c:  &Config{DockerConfig: DockerConfig{MaxConcurrentChecks: 8}},
+		},
+		{
+			in: `{"docker_config":{"register_services":true}}`,
+			c:  &Config{DockerConfig: DockerConfig{RegisterServices: true}},
+		},
+		{
+			in: `{"docker_config":{"tls_fingerprint":"sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"}}`,
+			c:  &Config{DockerConfig: DockerConfig{TLSFingerprint: "sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"}},
+		},
+		{
+			in:  `{"docker_config":{"tls_fingerprint":"abc"}}`,
+			err: errors.New("TLSFingerprint invalid: \"abc\" is not the hex encoded SHA-256 of a public key"),
+		},
+		{
+			in: `{"docker_config":{"token":"a","token_file":"b"}}`,
+			c:  &Config{DockerConfig: DockerConfig{Token: "a", TokenFile: "b"}},
+		},
+		{
+			in: `{"docker_config":{"use_agent_tls":true}}`,
+			c:  &Config{DockerConfig: DockerConfig{UseAgentTLS: true}},
+		},
 		{
 			in: `{"domain":"a"}`,
 			c:  &Config{Domain: "a"},
@@ -314,6 +406,10 @@ func TestDecodeConfig(t *testing.T) {
 			in: `{"enable_debug":true}`,
 			c:  &Config{EnableDebug: true},
 		},
+		{
+			in: `{"enable_privileged_docker_checks":true}`,
+			c:  &Config{EnablePrivilegedDockerChecks: true},
+		},
 		{
 			in: `{"enable_syslog":true}`,
 			c:  &Config{EnableSyslog: true},
@@ -446,10 +542,89 @@ func TestDecodeConfig(t *testing.T) {
 			in: `{"retry_interval_wan":"2s"}`,
 			c:  &Config{RetryIntervalWan: 2 * time.Second, RetryIntervalWanRaw: "2s"},
 		},
+		{
+			in: `{"retry_max_interval":"1m"}`,
+			c:  &Config{RetryMaxInterval: time.Minute, RetryMaxIntervalRaw: "1m"},
+		},
+		{
+			in: `{"retry_max_interval_wan":"2m"}`,
+			c:  &Config{RetryMaxIntervalWan: 2 * time.Minute, RetryMaxIntervalWanRaw: "2m"},
+		},
 		{
 			in: `{"retry_join":["a","b"]}`,
 			c:  &Config{RetryJoin: []string{"a", "b"}},
 		},
+		{
+			in: `{"retry_join_address_family":"ipv6"}`,
+			c:  &Config{RetryJoinAddressFamily: "ipv6"},
+		},
+		{
+			in: `{"retry_join_fail_fast":true}`,
+			c:  &Config{RetryJoinFailFast: true},
+		},
+		{
+			in: `{"retry_join_exclude":["10.0.0.1","10.1.0.0/16"]}`,
+			c:  &Config{RetryJoinExclude: []string{"10.0.0.1", "10.1.0.0/16"}},
+		},
+		{
+			in:  `{"retry_join_exclude":["10.1.0.0/33"]}`,
+			err: errors.New("RetryJoinExclude invalid: invalid CIDR \"10.1.0.0/33\""),
+		},
+		{
+			in: `{"retry_join_fallback":["10.0.0.1","10.0.0.2"],"retry_join_fallback_after":3}`,
+			c:  &Config{RetryJoinFallback: []string{"10.0.0.1", "10.0.0.2"}, RetryJoinFallbackAfter: 3},
+		},
+		{
+			in: `{"retry_join_seeds":["10.0.0.1"]}`,
+			c:  &Config{RetryJoinSeeds: []string{"10.0.0.1"}},
+		},
+		{
+			in: `{"retry_join_last_known":true}`,
+			c:  &Config{RetryJoinLastKnown: true},
+		},
+		{
+			in: `{"retry_join_min_agents":3}`,
+			c:  &Config{RetryJoinMinAgents: 3},
+		},
+		{
+			in: `{"retry_join_min_domains":2}`,
+			c:  &Config{RetryJoinMinDomains: 2},
+		},
+		{
+			in: `{"retry_join_provider_retry":{"ec2":{"interval":"5s","max_attempts":3},"k8s":{"max_attempts":1,"max_failures":2}}}`,
+			c: &Config{RetryJoinProviderRetry: map[string]RetryJoinProviderRetry{
+				"ec2": {Interval: 5 * time.Second, IntervalRaw: "5s", MaxAttempts: 3},
+				"k8s": {MaxAttempts: 1, MaxFailures: 2},
+			}},
+		},
+		{
+			in:  `{"retry_join_provider_retry":{"static":{"max_attempts":1}}}`,
+			err: errors.New("RetryJoinProviderRetry invalid: unknown provider \"static\""),
+		},
+		{
+			in: `{"retry_join_once":true}`,
+			c:  &Config{RetryJoinOnce: true},
+		},
+		{
+			in: `{"retry_join_order":"static"}`,
+			c:  &Config{RetryJoinOrder: "static"},
+		},
+		{
+			in: `{"retry_join_round_robin":true}`,
+			c:  &Config{RetryJoinRoundRobin: true},
+		},
+		{
+			in: `{"retry_join_skip_after":5}`,
+			c:  &Config{RetryJoinSkipAfter: 5},
+		},
+		{
+			in: `{"retry_join_tag_filter":["cluster=prod","role!=client","consul"]}`,
+			c:  &Config{RetryJoinTagFilter: []string{"cluster=prod", "role!=client", "consul"}},
+		},
+		{
+			in:  `{"retry_join_tag_filter":["=prod"]}`,
+			err: errors.New("RetryJoinTagFilter invalid: missing tag key in \"=prod\""),
+		},
 		{
 			in: `{"retry_join_azure":{"client_id":"a"}}`,
 			c:  &Config{RetryJoinAzure: RetryJoinAzure{ClientID: "a"}},
@@ -494,6 +669,18 @@ func TestDecodeConfig(t *testing.T) {
 			in: `{"retry_join_ec2":{"secret_access_key":"a"}}`,
 			c:  &Config{RetryJoinEC2: RetryJoinEC2{SecretAccessKey: "a"}},
 		},
+		{
+			in: `{"retry_join_exec":{"args":["a","b"]}}`,
+			c:  &Config{RetryJoinExec: RetryJoinExec{Args: []string{"a", "b"}}},
+		},
+		{
+			in: `{"retry_join_exec":{"command":"a"}}`,
+			c:  &Config{RetryJoinExec: RetryJoinExec{Command: "a"}},
+		},
+		{
+			in: `{"retry_join_exec":{"timeout":"5s"}}`,
+			c:  &Config{RetryJoinExec: RetryJoinExec{Timeout: 5 * time.Second, TimeoutRaw: "5s"}},
+		},
 		{
 			in: `{"retry_join_gce":{"credentials_file":"a"}}`,
 			c:  &Config{RetryJoinGCE: RetryJoinGCE{CredentialsFile: "a"}},
@@ -510,10 +697,30 @@ func TestDecodeConfig(t *testing.T) {
 			in: `{"retry_join_gce":{"zone_pattern":"a"}}`,
 			c:  &Config{RetryJoinGCE: RetryJoinGCE{ZonePattern: "a"}},
 		},
+		{
+			in: `{"retry_join_k8s":{"namespace":"a"}}`,
+			c:  &Config{RetryJoinK8s: RetryJoinK8s{Namespace: "a"}},
+		},
+		{
+			in: `{"retry_join_k8s":{"port_name":"a"}}`,
+			c:  &Config{RetryJoinK8s: RetryJoinK8s{PortName: "a"}},
+		},
+		{
+			in: `{"retry_join_k8s":{"service":"a"}}`,
+			c:  &Config{RetryJoinK8s: RetryJoinK8s{Service: "a"}},
+		},
+		{
+			in: `{"retry_join_nomad":{"address":"http://nomad:4646","service":"a","namespace":"b","region":"c","token":"d"}}`,
+			c:  &Config{RetryJoinNomad: RetryJoinNomad{Address: "http://nomad:4646", Service: "a", Namespace: "b", Region: "c", Token: "d"}},
+		},
 		{
 			in: `{"retry_join_wan":["a","b"]}`,
 			c:  &Config{RetryJoinWan: []string{"a", "b"}},
 		},
+		{
+			in: `{"retry_join_wan_discovery":true}`,
+			c:  &Config{RetryJoinWanDiscovery: true},
+		},
 		{
 			in: `{"retry_max":123}`,
 			c:  &Config{RetryMaxAttempts: 123},
@@ -1021,7 +1228,12 @@ func TestDecodeConfig(t *testing.T) {
 						"Header": {"a":["b"], "c":["d", "e"]},
 						"Method": "x",
 						"tcp": "g",
+						"grpc": "g:1/s",
+						"grpc_use_tls": true,
+						"tls_server_name": "s",
 						"docker_container_id": "h",
+						"container_runtime": "podman",
+						"privileged": true,
 						"tls_skip_verify": true,
 						"interval": "2s",
 						"timeout": "3s",
@@ -1044,7 +1256,12 @@ func TestDecodeConfig(t *testing.T) {
 						Header:            map[string][]string{"a": []string{"b"}, "c": []string{"d", "e"}},
 						Method:            "x",
 						TCP:               "g",
+						GRPC:              "g:1/s",
+						GRPCUseTLS:        true,
+						TLSServerName:     "s",
 						DockerContainerID: "h",
+						ContainerRuntime:  "podman",
+						Privileged:        true,
 						TLSSkipVerify:     true,
 						Interval:          2 * time.Second,
 						Timeout:           3 * time.Second,
@@ -1339,6 +1556,7 @@ func TestMergeConfig(t *testing.T) {
 			ServerStabilizationTime: Duration(time.Duration(100)),
 		},
 		EnableDebug:            true,
+		EnablePrivilegedDockerChecks: true,
 		VerifyIncoming:         true,
 		VerifyOutgoing:         true,
 		CAFile:                 "test/ca.pem",
@@ -1354,11 +1572,29 @@ func TestMergeConfig(t *testing.T) {
 		EnableSyslog:           true,
 		RejoinAfterLeave:       true,
 		RetryJoin:              []string{"1.1.1.1"},
+		RetryJoinAddressFamily: "ipv4",
+		RetryJoinExclude:       []string{"4.4.4.4"},
+		RetryJoinFailFast:      true,
+		RetryJoinFallback:      []string{"2.2.2.2"},
+		RetryJoinFallbackAfter: 3,
+		RetryJoinLastKnown:     true,
+		RetryJoinMinAgents:     2,
+		RetryJoinMinDomains:    2,
+		RetryJoinProviderRetry: map[string]RetryJoinProviderRetry{"ec2": {Interval: 5 * time.Second, MaxAttempts: 3}},
+		RetryJoinOnce:          true,
+		RetryJoinOrder:         "static",
+		RetryJoinRoundRobin:    true,
+		RetryJoinSeeds:         []string{"3.3.3.3"},
+		RetryJoinSkipAfter:     5,
+		RetryJoinTagFilter:     []string{"cluster=prod"},
 		RetryIntervalRaw:       "10s",
 		RetryInterval:          10 * time.Second,
+		RetryMaxInterval:       time.Minute,
 		RetryJoinWan:           []string{"1.1.1.1"},
+		RetryJoinWanDiscovery:  true,
 		RetryIntervalWanRaw:    "10s",
 		RetryIntervalWan:       10 * time.Second,
+		RetryMaxIntervalWan:    time.Minute,
 		ReconnectTimeoutLanRaw: "24h",
 		ReconnectTimeoutLan:    24 * time.Hour,
 		ReconnectTimeoutWanRaw: "36h",
@@ -1397,6 +1633,7 @@ func TestMergeConfig(t *testing.T) {
 		},
 		DisableUpdateCheck:        true,
 		DisableAnonymousSignature: true,
+		DisableDiscoveryLogs:      true,
 		HTTPConfig: HTTPConfig{
 			BlockEndpoints: []string{
 				"/v1/agent/self",
@@ -1406,6 +1643,44 @@ func TestMergeConfig(t *testing.T) {
 				"Access-Control-Allow-Origin": "*",
 			},
 		},
+		DockerConfig: DockerConfig{
+			Host:    "tcp://127.0.0.1:2375",
+			Context: "remote",
+			Headers: map[string]string{
+				"Authorization": "Basic Zm9vOmJhcg==",
+			},
+			RedactHeaders:          []string{"Authorization"},
+			Token:                  "abc",
+			TokenFile:              "/etc/consul/docker-token",
+			TLSFingerprint:         "2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae",
+			UseAgentTLS:            true,
+			CAFile:                 "/etc/docker/ca.pem",
+			CertFile:               "/etc/docker/cert.pem",
+			KeyFile:                "/etc/docker/key.pem",
+			CertPath:               "/etc/docker/certs",
+			TLSSkipVerify:          true,
+			ConnectTimeout:         2 * time.Second,
+			ExecCreateRetries:      2,
+			MaxConcurrentChecks:    4,
+			ExecPollInterval:       100 * time.Millisecond,
+			ExecOutputBytes:        1 << 16,
+			MaxBytesPerInterval:    1 << 20,
+			OutputMaxBytes:         1024,
+			OutputKeep:             "head",
+			InfrastructureStatus:   "warning",
+			CheckPressure:          true,
+			BreakerErrorRate:       0.5,
+			BreakerCooldown:        time.Minute,
+			AuditLogDir:            "/var/log/consul/checks",
+			AuditLogMaxBytes:       1 << 20,
+			AuditRedact:            []string{"secret"},
+			AllowedContainerNames:  []string{"web-*"},
+			AllowedContainerLabels: []string{"consul.check=true"},
+			RegisterServices:       true,
+			ContainerRuntime:       "containerd",
+			PodmanHost:             "unix:///run/podman/podman.sock",
+			ContainerdHost:         "unix:///run/containerd/containerd.sock",
+		},
 		UnixSockets: UnixSocketConfig{
 			UnixSocketPermissions{
 				Usr:   "500",
@@ -1420,6 +1695,23 @@ func TestMergeConfig(t *testing.T) {
 			AccessKeyID:     "foo",
 			SecretAccessKey: "bar",
 		},
+		RetryJoinExec: RetryJoinExec{
+			Command: "/usr/local/bin/discover",
+			Args:    []string{"-cluster", "prod"},
+			Timeout: 5 * time.Second,
+		},
+		RetryJoinK8s: RetryJoinK8s{
+			Service:   "consul-server",
+			Namespace: "consul",
+			PortName:  "serflan",
+		},
+		RetryJoinNomad: RetryJoinNomad{
+			Address:   "http://nomad.service:4646",
+			Service:   "consul-server",
+			Namespace: "infra",
+			Region:    "global",
+			Token:     "file:/run/secrets/nomad-token",
+		},
 		SessionTTLMinRaw: "1000s",
 		SessionTTLMin:    1000 * time.Second,
 		AdvertiseAddrs: AdvertiseAddrsConfig{
@@ -1531,6 +1823,7 @@ func TestCheckDefinitionToCheckType(t *testing.T) {
 		Interval:          1 * time.Second,
 		DockerContainerID: "abc123",
 		Shell:             "/bin/ksh",
+		Privileged:        true,
 		TLSSkipVerify:     true,
 		Timeout:           2 * time.Second,
 		TTL:               3 * time.Second,
@@ -1548,6 +1841,7 @@ func TestCheckDefinitionToCheckType(t *testing.T) {
 		Interval:          1 * time.Second,
 		DockerContainerID: "abc123",
 		Shell:             "/bin/ksh",
+		Privileged:        true,
 		TLSSkipVerify:     true,
 		Timeout:           2 * time.Second,
 		TTL:               3 * time.Second,
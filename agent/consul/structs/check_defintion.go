@@ -26,9 +26,30 @@ type CheckDefinition struct {
 	Header                         map[string][]string
 	Method                         string
 	TCP                            string
+	GRPC                           string
+	GRPCUseTLS                     bool
+	TLSServerName                  string
 	Interval                       time.Duration
 	DockerContainerID              string
+	DockerContainerLabels          []string
+	ContainerRuntime               string
 	Shell                          string
+	Privileged                     bool
+	JSONStatusField                string
+	ScriptTemplate                 bool
+	WarningExitCodes               []int
+	DiscardStderr                  bool
+	StartGracePeriod               time.Duration
+	KillSignal                     string
+	KillGracePeriod                time.Duration
+	Locale                         string
+	ConsoleWidth                   int
+	ConsoleHeight                  int
+	CheckContainerState            bool
+	OutputEncoding                 string
+	StdoutContains                 string
+	StdoutMatches                  string
+	StdoutNegate                   bool
 	TLSSkipVerify                  bool
 	Timeout                        time.Duration
 	TTL                            time.Duration
@@ -60,17 +81,38 @@ func (c *CheckDefinition) CheckType() *CheckType {
 		Status:  c.Status,
 		Notes:   c.Notes,
 
-		Script:            c.Script,
-		HTTP:              c.HTTP,
-		Header:            c.Header,
-		Method:            c.Method,
-		TCP:               c.TCP,
-		Interval:          c.Interval,
-		DockerContainerID: c.DockerContainerID,
-		Shell:             c.Shell,
-		TLSSkipVerify:     c.TLSSkipVerify,
-		Timeout:           c.Timeout,
-		TTL:               c.TTL,
+		Script:                         c.Script,
+		HTTP:                           c.HTTP,
+		Header:                         c.Header,
+		Method:                         c.Method,
+		TCP:                            c.TCP,
+		GRPC:                           c.GRPC,
+		GRPCUseTLS:                     c.GRPCUseTLS,
+		TLSServerName:                  c.TLSServerName,
+		Interval:                       c.Interval,
+		DockerContainerID:              c.DockerContainerID,
+		DockerContainerLabels:          c.DockerContainerLabels,
+		ContainerRuntime:               c.ContainerRuntime,
+		Shell:                          c.Shell,
+		Privileged:                     c.Privileged,
+		JSONStatusField:                c.JSONStatusField,
+		ScriptTemplate:                 c.ScriptTemplate,
+		WarningExitCodes:               c.WarningExitCodes,
+		DiscardStderr:                  c.DiscardStderr,
+		StartGracePeriod:               c.StartGracePeriod,
+		KillSignal:                     c.KillSignal,
+		KillGracePeriod:                c.KillGracePeriod,
+		Locale:                         c.Locale,
+		ConsoleWidth:                   c.ConsoleWidth,
+		ConsoleHeight:                  c.ConsoleHeight,
+		CheckContainerState:            c.CheckContainerState,
+		OutputEncoding:                 c.OutputEncoding,
+		StdoutContains:                 c.StdoutContains,
+		StdoutMatches:                  c.StdoutMatches,
+		StdoutNegate:                   c.StdoutNegate,
+		TLSSkipVerify:                  c.TLSSkipVerify,
+		Timeout:                        c.Timeout,
+		TTL:                            c.TTL,
 		DeregisterCriticalServiceAfter: c.DeregisterCriticalServiceAfter,
 	}
 }
@@ -1,16 +1,18 @@
 package structs
 
 import (
+	"fmt"
+	"regexp"
 	"time"
 
 	"github.com/hashicorp/consul/types"
 )
 
 // CheckType is used to create either the CheckMonitor or the CheckTTL.
-// Five types are supported: Script, HTTP, TCP, Docker and TTL. Script, HTTP,
-// Docker and TCP all require Interval. Only one of the types may to be
-// provided: TTL or Script/Interval or HTTP/Interval or TCP/Interval or
-// Docker/Interval.
+// Six types are supported: Script, HTTP, TCP, gRPC, Docker and TTL. Script,
+// HTTP, Docker, gRPC and TCP all require Interval. Only one of the types may
+// to be provided: TTL or Script/Interval or HTTP/Interval or TCP/Interval or
+// GRPC/Interval or Docker/Interval.
 type CheckType struct {
 	// fields already embedded in CheckDefinition
 	// Note: CheckType.CheckID == CheckDefinition.ID
@@ -23,17 +25,38 @@ type CheckType struct {
 	// fields copied to CheckDefinition
 	// Update CheckDefinition when adding fields here
 
-	Script            string
-	HTTP              string
-	Header            map[string][]string
-	Method            string
-	TCP               string
-	Interval          time.Duration
-	DockerContainerID string
-	Shell             string
-	TLSSkipVerify     bool
-	Timeout           time.Duration
-	TTL               time.Duration
+	Script                string
+	HTTP                  string
+	Header                map[string][]string
+	Method                string
+	TCP                   string
+	GRPC                  string
+	GRPCUseTLS            bool
+	TLSServerName         string
+	Interval              time.Duration
+	DockerContainerID     string
+	DockerContainerLabels []string
+	ContainerRuntime      string
+	Shell                 string
+	Privileged            bool
+	JSONStatusField       string
+	ScriptTemplate        bool
+	WarningExitCodes      []int
+	DiscardStderr         bool
+	StartGracePeriod      time.Duration
+	KillSignal            string
+	KillGracePeriod       time.Duration
+	Locale                string
+	ConsoleWidth          int
+	ConsoleHeight         int
+	CheckContainerState   bool
+	OutputEncoding        string
+	StdoutContains        string
+	StdoutMatches         string
+	StdoutNegate          bool
+	TLSSkipVerify         bool
+	Timeout               time.Duration
+	TTL                   time.Duration
 
 	// DeregisterCriticalServiceAfter, if >0, will cause the associated
 	// service, if any, to be deregistered if this check is critical for
@@ -44,7 +67,35 @@ type CheckTypes []*CheckType
 
 // Valid checks if the CheckType is valid
 func (c *CheckType) Valid() bool {
-	return c.IsTTL() || c.IsMonitor() || c.IsHTTP() || c.IsTCP() || c.IsDocker()
+	return c.IsTTL() || c.IsMonitor() || c.IsHTTP() || c.IsTCP() || c.IsGRPC() || c.IsDocker()
+}
+
+// Validate returns an error if the options of a Docker check conflict or
+// are malformed. The options which depend on the agent, like the kill
+// signal or whether privileged checks are enabled, are checked when the
+// agent adds the check.
+func (c *CheckType) Validate() error {
+	if !c.IsDocker() {
+		return nil
+	}
+	if c.DockerContainerID != "" && len(c.DockerContainerLabels) > 0 {
+		return fmt.Errorf("Can't have both a Docker container ID and container labels")
+	}
+	if c.ConsoleWidth < 0 || c.ConsoleHeight < 0 {
+		return fmt.Errorf("Invalid negative console_width or console_height")
+	}
+	if c.CheckContainerState && len(c.DockerContainerLabels) > 0 {
+		return fmt.Errorf("Can only use check_container_state with a Docker container ID")
+	}
+	if c.StdoutMatches != "" {
+		if _, err := regexp.Compile(c.StdoutMatches); err != nil {
+			return fmt.Errorf("Invalid stdout_matches: %v", err)
+		}
+	}
+	if (c.StdoutContains != "" || c.StdoutMatches != "") && c.JSONStatusField != "" {
+		return fmt.Errorf("Can't expect stdout with json_status_field")
+	}
+	return nil
 }
 
 // IsTTL checks if this is a TTL type
@@ -54,7 +105,7 @@ func (c *CheckType) IsTTL() bool {
 
 // IsMonitor checks if this is a Monitor type
 func (c *CheckType) IsMonitor() bool {
-	return c.Script != "" && c.DockerContainerID == "" && c.Interval != 0
+	return c.Script != "" && c.DockerContainerID == "" && len(c.DockerContainerLabels) == 0 && c.Interval != 0
 }
 
 // IsHTTP checks if this is a HTTP type
@@ -67,7 +118,13 @@ func (c *CheckType) IsTCP() bool {
 	return c.TCP != "" && c.Interval != 0
 }
 
-// IsDocker returns true when checking a docker container.
+// IsGRPC checks if this is a gRPC type
+func (c *CheckType) IsGRPC() bool {
+	return c.GRPC != "" && c.Interval != 0
+}
+
+// IsDocker returns true when checking a docker container, or the
+// containers with the labels.
 func (c *CheckType) IsDocker() bool {
-	return c.DockerContainerID != "" && c.Script != "" && c.Interval != 0
+	return (c.DockerContainerID != "" || len(c.DockerContainerLabels) > 0) && c.Script != "" && c.Interval != 0
 }
@@ -0,0 +1,40 @@
+package structs
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckType_Validate(t *testing.T) {
+	t.Parallel()
+	docker := func(f func(c *CheckType)) *CheckType {
+		c := &CheckType{Script: "/health.sh", DockerContainerID: "54432bad1fc7", Interval: time.Second}
+		f(c)
+		return c
+	}
+	for _, tc := range []struct {
+		check *CheckType
+		err   string
+	}{
+		{docker(func(c *CheckType) {}), ""},
+		{docker(func(c *CheckType) { c.DockerContainerLabels = []string{"app=web"} }), "both a Docker container ID and container labels"},
+		{docker(func(c *CheckType) { c.ConsoleWidth = -1 }), "negative console_width"},
+		{docker(func(c *CheckType) {
+			c.DockerContainerID, c.DockerContainerLabels, c.CheckContainerState = "", []string{"app=web"}, true
+		}), "check_container_state"},
+		{docker(func(c *CheckType) { c.StdoutMatches = "(" }), "Invalid stdout_matches"},
+		{docker(func(c *CheckType) { c.StdoutContains, c.JSONStatusField = "ok", "status" }), "json_status_field"},
+
+		// Only Docker checks are validated.
+		{&CheckType{HTTP: "http://localhost", Interval: time.Second, ConsoleWidth: -1}, ""},
+	} {
+		err := tc.check.Validate()
+		if tc.err == "" && err != nil {
+			t.Fatalf("%#v: err: %v", tc.check, err)
+		}
+		if tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+			t.Fatalf("%#v: got error %v want %q", tc.check, err, tc.err)
+		}
+	}
+}
@@ -490,9 +490,32 @@ type HealthCheck struct {
 	ServiceName string        // optional service name
 	ServiceTags []string      // optional service tags
 
+	// Exec is the last exec of a Docker check. It's only known to the
+	// agent running the check, so it's only set by its checks endpoint
+	// and is never sent to the servers.
+	Exec *CheckExec `json:",omitempty" codec:"-"`
+
 	RaftIndex
 }
 
+// CheckExec describes the last exec of a Docker check.
+type CheckExec struct {
+	// ExitCode is the exit code of the script. It's 0 if the exec
+	// failed, see Error.
+	ExitCode int
+
+	// Duration is how long the exec took, like "1.204s".
+	Duration string
+
+	// Truncated is set if the script wrote more output than was kept,
+	// OutputBytes are the bytes it wrote.
+	Truncated   bool
+	OutputBytes int64
+
+	// Error is the error running the exec, like a timeout, if any.
+	Error string `json:",omitempty"`
+}
+
 // IsSame checks if one HealthCheck is the same as another, without looking
 // at the Raft information (that's why we didn't call it IsEqual). This is
 // useful for seeing if an update would be idempotent for all the functional
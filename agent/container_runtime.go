@@ -0,0 +1,131 @@
+package agent
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// The container runtimes the execs of Docker checks can run with. They all
+// implement DockerClient, so the checks create, start and inspect execs
+// the same way with each of them.
+const (
+	// ContainerRuntimeDocker is the Docker Engine API.
+	ContainerRuntimeDocker = "docker"
+
+	// ContainerRuntimePodman is the Docker compatible API of Podman,
+	// which is served by the Docker client and supports everything the
+	// Docker Engine API does, like container labels and state.
+	ContainerRuntimePodman = "podman"
+
+	// ContainerRuntimeLibpod is the native API of Podman, which only
+	// runs execs.
+	ContainerRuntimeLibpod = "libpod"
+
+	// ContainerRuntimeContainerd is the CRI API of containerd, which
+	// only runs execs, without their environment, user or privileges.
+	ContainerRuntimeContainerd = "containerd"
+)
+
+// defaultContainerdHost is the socket of containerd if ContainerdHost
+// isn't set.
+const defaultContainerdHost = "unix:///run/containerd/containerd.sock"
+
+// runtimeConnectTimeout is how long connecting to the socket of Podman's
+// native API or containerd may take if ConnectTimeout isn't set.
+const runtimeConnectTimeout = 5 * time.Second
+
+// ParseContainerRuntime returns the container runtime with the given name,
+// which is the Docker runtime if the name is empty.
+func ParseContainerRuntime(name string) (string, error) {
+	switch strings.ToLower(name) {
+	case "", ContainerRuntimeDocker:
+		return ContainerRuntimeDocker, nil
+	case ContainerRuntimePodman:
+		return ContainerRuntimePodman, nil
+	case ContainerRuntimeLibpod:
+		return ContainerRuntimeLibpod, nil
+	case ContainerRuntimeContainerd:
+		return ContainerRuntimeContainerd, nil
+	}
+	return "", fmt.Errorf("Unknown container runtime %q, must be one of %q, %q, %q or %q", name,
+		ContainerRuntimeDocker, ContainerRuntimePodman, ContainerRuntimeLibpod, ContainerRuntimeContainerd)
+}
+
+// newRuntimeClient creates the client of Podman's native API or of
+// containerd. The rest of the Docker configuration, like the headers and
+// the TLS files, only applies to the Docker client.
+func newRuntimeClient(runtime string, cfg DockerConfig) (DockerClient, error) {
+	timeout := cfg.ConnectTimeout
+	if timeout <= 0 {
+		timeout = runtimeConnectTimeout
+	}
+	if runtime == ContainerRuntimeLibpod {
+		return newLibpodClient(podmanHost(cfg), timeout)
+	}
+	host := cfg.ContainerdHost
+	if host == "" {
+		host = defaultContainerdHost
+	}
+	return newCRIClient(host, timeout)
+}
+
+// podmanHost returns the socket of Podman: PodmanHost, CONTAINER_HOST,
+// which the Podman CLI uses too, or the socket of the user the agent runs
+// as, which is the system socket for root.
+func podmanHost(cfg DockerConfig) string {
+	if cfg.PodmanHost != "" {
+		return cfg.PodmanHost
+	}
+	if host := os.Getenv("CONTAINER_HOST"); host != "" {
+		return host
+	}
+	if uid := os.Geteuid(); uid > 0 {
+		dir := os.Getenv("XDG_RUNTIME_DIR")
+		if dir == "" {
+			dir = fmt.Sprintf("/run/user/%d", uid)
+		}
+		return "unix://" + dir + "/podman/podman.sock"
+	}
+	return "unix:///run/podman/podman.sock"
+}
+
+// isNamedPipeHost returns true for an npipe:// host, like the
+// npipe:////./pipe/docker_engine Docker listens on by default on Windows.
+func isNamedPipeHost(host string) bool {
+	return strings.HasPrefix(host, "npipe://")
+}
+
+// runtimeSocket returns the network and address of the socket of a
+// container runtime, which is a unix://, npipe:// or tcp:// URL. A bare
+// path is a Unix socket.
+func runtimeSocket(host string) (network, addr string, err error) {
+	if !strings.Contains(host, "://") {
+		return "unix", host, nil
+	}
+	u, err := url.Parse(host)
+	if err != nil {
+		return "", "", fmt.Errorf("Invalid container runtime host %q: %v", host, err)
+	}
+	switch u.Scheme {
+	case "unix":
+		return "unix", u.Path, nil
+	case "npipe":
+		return "npipe", u.Path, nil
+	case "tcp":
+		return "tcp", u.Host, nil
+	}
+	return "", "", fmt.Errorf("Invalid container runtime host %q, must be a unix://, npipe:// or tcp:// URL", host)
+}
+
+// dialRuntime connects to the socket of a container runtime. Named pipes
+// are only supported on Windows.
+func dialRuntime(network, addr string, timeout time.Duration) (net.Conn, error) {
+	if network == "npipe" {
+		return dialNamedPipe(addr, timeout)
+	}
+	return net.DialTimeout(network, addr, timeout)
+}
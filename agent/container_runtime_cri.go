@@ -0,0 +1,222 @@
+package agent
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// The ExecSync methods of the CRI runtime service. containerd serves
+// runtime.v1 since 1.7 and only runtime.v1alpha2 before, so the client
+// falls back to it.
+const (
+	criExecSyncMethod        = "/runtime.v1.RuntimeService/ExecSync"
+	criExecSyncMethodV1Alpha = "/runtime.v1alpha2.RuntimeService/ExecSync"
+)
+
+// criExecRetention is how long the result of an exec is kept for
+// InspectExec after it exited, and how long an exec which was created but
+// never started is kept for StartExec.
+const criExecRetention = time.Minute
+
+// criExecSyncRequest is runtime.v1.ExecSyncRequest, which is the same in
+// runtime.v1alpha2. The messages are declared here like protoc would
+// generate them since ExecSync is all the agent needs from the CRI API.
+type criExecSyncRequest struct {
+	ContainerID string   `protobuf:"bytes,1,opt,name=container_id,json=containerId" json:"container_id,omitempty"`
+	Cmd         []string `protobuf:"bytes,2,rep,name=cmd" json:"cmd,omitempty"`
+	Timeout     int64    `protobuf:"varint,3,opt,name=timeout" json:"timeout,omitempty"`
+}
+
+func (m *criExecSyncRequest) Reset()         { *m = criExecSyncRequest{} }
+func (m *criExecSyncRequest) String() string { return proto.CompactTextString(m) }
+func (*criExecSyncRequest) ProtoMessage()    {}
+
+// criExecSyncResponse is runtime.v1.ExecSyncResponse.
+type criExecSyncResponse struct {
+	Stdout   []byte `protobuf:"bytes,1,opt,name=stdout,proto3" json:"stdout,omitempty"`
+	Stderr   []byte `protobuf:"bytes,2,opt,name=stderr,proto3" json:"stderr,omitempty"`
+	ExitCode int32  `protobuf:"varint,3,opt,name=exit_code,json=exitCode" json:"exit_code,omitempty"`
+}
+
+func (m *criExecSyncResponse) Reset()         { *m = criExecSyncResponse{} }
+func (m *criExecSyncResponse) String() string { return proto.CompactTextString(m) }
+func (*criExecSyncResponse) ProtoMessage()    {}
+
+// criClient runs execs with the CRI API of containerd. The API runs a
+// command in one call, so creating an exec only keeps its options for
+// StartExec, which runs it, and InspectExec returns the exit code StartExec
+// got. Its errors are those of the Docker client so that they're handled
+// like the errors of the Docker daemon.
+type criClient struct {
+	conn *grpc.ClientConn
+
+	lock   sync.Mutex
+	method string
+	execs  map[string]*criExec
+	next   int
+}
+
+// criExec is an exec which was created with the CRI client.
+type criExec struct {
+	containerID string
+	cmd         []string
+	created     time.Time
+	started     bool
+	exited      time.Time
+	exitCode    int
+}
+
+func newCRIClient(host string, timeout time.Duration) (*criClient, error) {
+	network, addr, err := runtimeSocket(host)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := grpc.Dial(addr, grpc.WithInsecure(), grpc.WithDialer(func(string, time.Duration) (net.Conn, error) {
+		return dialRuntime(network, addr, timeout)
+	}))
+	if err != nil {
+		return nil, err
+	}
+	return &criClient{conn: conn, method: criExecSyncMethod, execs: make(map[string]*criExec)}, nil
+}
+
+func (c *criClient) CreateExec(opts docker.CreateExecOptions) (*docker.Exec, error) {
+	switch {
+	case len(opts.Env) > 0:
+		return nil, fmt.Errorf("The %s runtime doesn't support the environment of an exec", ContainerRuntimeContainerd)
+	case opts.User != "":
+		return nil, fmt.Errorf("The %s runtime doesn't support the user of an exec", ContainerRuntimeContainerd)
+	case opts.Privileged:
+		return nil, fmt.Errorf("The %s runtime doesn't support privileged execs", ContainerRuntimeContainerd)
+	case opts.Tty:
+		return nil, fmt.Errorf("The %s runtime doesn't support execs with a TTY", ContainerRuntimeContainerd)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	now := time.Now()
+	for id, exec := range c.execs {
+		switch {
+		case !exec.exited.IsZero() && now.Sub(exec.exited) > criExecRetention:
+			delete(c.execs, id)
+		case !exec.started && now.Sub(exec.created) > criExecRetention:
+			delete(c.execs, id)
+		}
+	}
+	c.next++
+	id := "cri-" + strconv.Itoa(c.next)
+	c.execs[id] = &criExec{containerID: opts.Container, cmd: opts.Cmd, created: now}
+	return &docker.Exec{ID: id}, nil
+}
+
+// StartExec runs the exec until it exits, or until the deadline of the
+// context, which is its timeout in containerd too.
+func (c *criClient) StartExec(id string, opts docker.StartExecOptions) error {
+	if opts.Detach {
+		return fmt.Errorf("The %s runtime doesn't support detached execs", ContainerRuntimeContainerd)
+	}
+	c.lock.Lock()
+	exec, ok := c.execs[id]
+	if ok && exec.started {
+		c.lock.Unlock()
+		return fmt.Errorf("Exec %s was already started", id)
+	}
+	if ok {
+		exec.started = true
+	}
+	method := c.method
+	c.lock.Unlock()
+	if !ok {
+		return &docker.NoSuchExec{ID: id}
+	}
+
+	ctx := opts.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	req := &criExecSyncRequest{ContainerID: exec.containerID, Cmd: exec.cmd}
+	if deadline, ok := ctx.Deadline(); ok {
+		// The timeout is in seconds, and 0 means none.
+		req.Timeout = int64((time.Until(deadline) + time.Second - 1) / time.Second)
+		if req.Timeout < 1 {
+			req.Timeout = 1
+		}
+	}
+	var resp criExecSyncResponse
+	err := grpc.Invoke(ctx, method, req, &resp, c.conn)
+	if grpc.Code(err) == codes.Unimplemented && method == criExecSyncMethod {
+		c.lock.Lock()
+		c.method = criExecSyncMethodV1Alpha
+		c.lock.Unlock()
+		err = grpc.Invoke(ctx, criExecSyncMethodV1Alpha, req, &resp, c.conn)
+	}
+	if err != nil {
+		c.lock.Lock()
+		delete(c.execs, id)
+		c.lock.Unlock()
+		return criError(err, exec.containerID)
+	}
+
+	c.lock.Lock()
+	exec.exited = time.Now()
+	exec.exitCode = int(resp.ExitCode)
+	c.lock.Unlock()
+
+	if opts.OutputStream != nil {
+		if _, err := opts.OutputStream.Write(resp.Stdout); err != nil {
+			return err
+		}
+	}
+	if opts.ErrorStream != nil {
+		if _, err := opts.ErrorStream.Write(resp.Stderr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// InspectExec returns whether the exec is still running and its exit code
+// once it exited.
+func (c *criClient) InspectExec(id string) (*docker.ExecInspect, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	exec, ok := c.execs[id]
+	if !ok {
+		return nil, &docker.NoSuchExec{ID: id}
+	}
+	return &docker.ExecInspect{
+		ID:          id,
+		ContainerID: exec.containerID,
+		Running:     exec.exited.IsZero(),
+		ExitCode:    exec.exitCode,
+	}, nil
+}
+
+// criError returns the error of a failed ExecSync call like the Docker
+// client would: a missing container is a *docker.NoSuchContainer and a
+// runtime which is unavailable or fails a *docker.Error with a server
+// error status.
+func criError(err error, containerID string) error {
+	switch grpc.Code(err) {
+	case codes.NotFound:
+		return &docker.NoSuchContainer{ID: containerID, Err: err}
+	case codes.Unavailable, codes.Internal, codes.Unknown:
+		return &docker.Error{Status: http.StatusServiceUnavailable, Message: grpc.ErrorDesc(err)}
+	}
+	return err
+}
+
+// Close closes the connection to containerd.
+func (c *criClient) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,172 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/docker/docker/pkg/stdcopy"
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/hashicorp/go-cleanhttp"
+	"golang.org/x/net/context"
+)
+
+// libpodAPIPrefix is the prefix of the paths of Podman's native API. Podman
+// serves every version of the API it supports under its own version.
+const libpodAPIPrefix = "/v3.0.0/libpod"
+
+// libpodClient runs execs with the native API of Podman. Its errors are
+// those of the Docker client so that they're handled like the errors of
+// the Docker daemon.
+type libpodClient struct {
+	client *http.Client
+	base   string
+}
+
+func newLibpodClient(host string, timeout time.Duration) (*libpodClient, error) {
+	network, addr, err := runtimeSocket(host)
+	if err != nil {
+		return nil, err
+	}
+	tr := cleanhttp.DefaultTransport()
+	tr.DialContext = nil
+	tr.Dial = func(_, _ string) (net.Conn, error) {
+		return dialRuntime(network, addr, timeout)
+	}
+	base := "http://podman"
+	if network == "tcp" {
+		base = "http://" + addr
+	}
+	return &libpodClient{client: &http.Client{Transport: tr}, base: base + libpodAPIPrefix}, nil
+}
+
+// do sends a request with body encoded as JSON. A response with an error
+// status is returned as a *docker.Error with the body as its message.
+func (c *libpodClient) do(ctx context.Context, method, path string, body interface{}) (*http.Response, error) {
+	var r io.Reader
+	if body != nil {
+		buf, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(buf)
+	}
+	req, err := http.NewRequest(method, c.base+path, r)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if ctx != nil {
+		req = req.WithContext(ctx)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 400 {
+		defer resp.Body.Close()
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return nil, &docker.Error{Status: resp.StatusCode, Message: string(msg)}
+	}
+	return resp, nil
+}
+
+// isNotFound returns true for a 404 response.
+func isNotFound(err error) bool {
+	derr, ok := err.(*docker.Error)
+	return ok && derr.Status == http.StatusNotFound
+}
+
+// libpodExecConfig is the body of creating an exec.
+type libpodExecConfig struct {
+	AttachStdout bool     `json:"AttachStdout"`
+	AttachStderr bool     `json:"AttachStderr"`
+	Tty          bool     `json:"Tty"`
+	Cmd          []string `json:"Cmd"`
+	Env          []string `json:"Env,omitempty"`
+	User         string   `json:"User,omitempty"`
+	Privileged   bool     `json:"Privileged"`
+}
+
+func (c *libpodClient) CreateExec(opts docker.CreateExecOptions) (*docker.Exec, error) {
+	resp, err := c.do(opts.Context, "POST", "/containers/"+url.PathEscape(opts.Container)+"/exec", libpodExecConfig{
+		AttachStdout: opts.AttachStdout,
+		AttachStderr: opts.AttachStderr,
+		Tty:          opts.Tty,
+		Cmd:          opts.Cmd,
+		Env:          opts.Env,
+		User:         opts.User,
+		Privileged:   opts.Privileged,
+	})
+	if isNotFound(err) {
+		return nil, &docker.NoSuchContainer{ID: opts.Container, Err: err}
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var exec struct {
+		ID string `json:"Id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&exec); err != nil {
+		return nil, err
+	}
+	return &docker.Exec{ID: exec.ID}, nil
+}
+
+// StartExec starts the exec and copies its output, which Podman frames
+// like the Docker daemon does, until it exits.
+func (c *libpodClient) StartExec(id string, opts docker.StartExecOptions) error {
+	resp, err := c.do(opts.Context, "POST", "/exec/"+url.PathEscape(id)+"/start", map[string]bool{
+		"Detach": opts.Detach,
+		"Tty":    opts.Tty,
+	})
+	if isNotFound(err) {
+		return &docker.NoSuchExec{ID: id}
+	}
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if opts.Detach {
+		return nil
+	}
+	stdout, stderr := opts.OutputStream, opts.ErrorStream
+	if stdout == nil {
+		stdout = ioutil.Discard
+	}
+	if stderr == nil {
+		stderr = ioutil.Discard
+	}
+	if opts.Tty {
+		_, err = io.Copy(stdout, resp.Body)
+		return err
+	}
+	_, err = stdcopy.StdCopy(stdout, stderr, resp.Body)
+	return err
+}
+
+// InspectExec returns the state of the exec, whose fields in Podman's
+// native API are those of the Docker Engine API.
+func (c *libpodClient) InspectExec(id string) (*docker.ExecInspect, error) {
+	resp, err := c.do(context.Background(), "GET", "/exec/"+url.PathEscape(id)+"/json", nil)
+	if isNotFound(err) {
+		return nil, &docker.NoSuchExec{ID: id}
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var info docker.ExecInspect
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
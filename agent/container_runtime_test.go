@@ -0,0 +1,441 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/pkg/stdcopy"
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/hashicorp/consul/agent/mock"
+	"github.com/hashicorp/consul/types"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+func TestParseContainerRuntime(t *testing.T) {
+	t.Parallel()
+	for in, want := range map[string]string{
+		"":           ContainerRuntimeDocker,
+		"docker":     ContainerRuntimeDocker,
+		"Podman":     ContainerRuntimePodman,
+		"libpod":     ContainerRuntimeLibpod,
+		"containerd": ContainerRuntimeContainerd,
+	} {
+		got, err := ParseContainerRuntime(in)
+		if err != nil || got != want {
+			t.Fatalf("%q: got %q, %v want %q", in, got, err, want)
+		}
+	}
+	if _, err := ParseContainerRuntime("rkt"); err == nil {
+		t.Fatal("should fail")
+	}
+}
+
+func TestRuntimeSocket(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		host, network, addr string
+	}{
+		{"unix:///run/podman/podman.sock", "unix", "/run/podman/podman.sock"},
+		{"/run/containerd/containerd.sock", "unix", "/run/containerd/containerd.sock"},
+		{"npipe:////./pipe/containerd-containerd", "npipe", "//./pipe/containerd-containerd"},
+		{"tcp://10.0.0.1:8888", "tcp", "10.0.0.1:8888"},
+	}
+	for _, tt := range tests {
+		network, addr, err := runtimeSocket(tt.host)
+		if err != nil || network != tt.network || addr != tt.addr {
+			t.Fatalf("%s: got %s %s, %v", tt.host, network, addr, err)
+		}
+	}
+	if _, _, err := runtimeSocket("ssh://core@host/run/podman/podman.sock"); err == nil {
+		t.Fatal("should fail")
+	}
+}
+
+func TestPodmanHost(t *testing.T) {
+	if got, want := podmanHost(DockerConfig{PodmanHost: "unix:///tmp/podman.sock"}), "unix:///tmp/podman.sock"; got != want {
+		t.Fatalf("got %q want %q", got, want)
+	}
+
+	os.Setenv("CONTAINER_HOST", "unix:///run/user/1000/podman/podman.sock")
+	got := podmanHost(DockerConfig{})
+	os.Unsetenv("CONTAINER_HOST")
+	if want := "unix:///run/user/1000/podman/podman.sock"; got != want {
+		t.Fatalf("got %q want %q", got, want)
+	}
+
+	want := "unix:///run/podman/podman.sock"
+	if uid := os.Geteuid(); uid > 0 {
+		dir := os.Getenv("XDG_RUNTIME_DIR")
+		if dir == "" {
+			dir = fmt.Sprintf("/run/user/%d", uid)
+		}
+		want = "unix://" + dir + "/podman/podman.sock"
+	}
+	if got := podmanHost(DockerConfig{}); got != want {
+		t.Fatalf("got %q want %q", got, want)
+	}
+}
+
+func TestNewDockerClient_Runtimes(t *testing.T) {
+	t.Parallel()
+	logger := log.New(ioutil.Discard, "", 0)
+	client, err := newDockerClient(DockerConfig{ContainerRuntime: "podman", PodmanHost: "unix:///run/podman/podman.sock"}, logger)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if dc, ok := client.(*docker.Client); !ok {
+		t.Fatalf("got client %#v", client)
+	} else if d, ok := dc.Dialer.(*dockerSocketDialer); !ok || d.network != "unix" || d.addr != "/run/podman/podman.sock" {
+		t.Fatalf("got dialer %#v", dc.Dialer)
+	}
+	if client, err := newDockerClient(DockerConfig{ContainerRuntime: "libpod"}, logger); err != nil {
+		t.Fatalf("err: %v", err)
+	} else if _, ok := client.(*libpodClient); !ok {
+		t.Fatalf("got client %#v", client)
+	}
+	if client, err := newDockerClient(DockerConfig{ContainerRuntime: "containerd"}, logger); err != nil {
+		t.Fatalf("err: %v", err)
+	} else if c, ok := client.(*criClient); !ok {
+		t.Fatalf("got client %#v", client)
+	} else {
+		c.Close()
+	}
+	if _, err := newDockerClient(DockerConfig{ContainerRuntime: "rkt"}, logger); err == nil {
+		t.Fatal("should fail")
+	}
+}
+
+func TestNewDockerClient_NamedPipe(t *testing.T) {
+	t.Parallel()
+	client, err := newDockerClient(DockerConfig{Host: "npipe:////./pipe/docker_engine", ConnectTimeout: time.Second},
+		log.New(ioutil.Discard, "", 0))
+	if runtime.GOOS != "windows" {
+		if err == nil || !strings.Contains(err.Error(), "only supported on Windows") {
+			t.Fatalf("got error %v", err)
+		}
+		return
+	}
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d, ok := client.(*docker.Client).Dialer.(*dockerSocketDialer); !ok || d.network != "npipe" || d.timeout != time.Second {
+		t.Fatalf("got dialer %#v", client.(*docker.Client).Dialer)
+	}
+}
+
+// fakePodman serves the exec endpoints of Podman's native API. The execs
+// echo their command to stdout and write "oops" to stderr, and exit with
+// the exit code in the EXIT_CODE environment variable.
+type fakePodman struct {
+	lock  sync.Mutex
+	execs map[string]libpodExecConfig
+}
+
+func (p *fakePodman) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	path := strings.TrimPrefix(r.URL.Path, libpodAPIPrefix)
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	switch {
+	case len(parts) == 3 && parts[0] == "containers" && parts[2] == "exec" && r.Method == "POST":
+		if parts[1] != "web" {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, `{"cause":"no such container","message":"no container with name or ID %q found: no such container","response":404}`, parts[1])
+			return
+		}
+		var cfg libpodExecConfig
+		if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		id := fmt.Sprintf("exec-%d", len(p.execs)+1)
+		p.execs[id] = cfg
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{"Id":%q}`, id)
+
+	case len(parts) == 3 && parts[0] == "exec" && parts[2] == "start" && r.Method == "POST":
+		cfg, ok := p.execs[parts[1]]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/vnd.docker.raw-stream")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintln(stdcopy.NewStdWriter(w, stdcopy.Stdout), strings.Join(cfg.Cmd, " "))
+		if cfg.AttachStderr {
+			fmt.Fprintln(stdcopy.NewStdWriter(w, stdcopy.Stderr), "oops")
+		}
+
+	case len(parts) == 3 && parts[0] == "exec" && parts[2] == "json" && r.Method == "GET":
+		cfg, ok := p.execs[parts[1]]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		code := "0"
+		for _, env := range cfg.Env {
+			if strings.HasPrefix(env, "EXIT_CODE=") {
+				code = strings.TrimPrefix(env, "EXIT_CODE=")
+			}
+		}
+		fmt.Fprintf(w, `{"ID":%q,"ContainerID":"4a7bd9c4f1e2aa00","Running":false,"ExitCode":%s,"ProcessConfig":{"entrypoint":%q,"privileged":%v}}`,
+			parts[1], code, cfg.Cmd[0], cfg.Privileged)
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestLibpodClient(t *testing.T) {
+	t.Parallel()
+	host, ln, cleanup := listenUnix(t, "podman")
+	defer cleanup()
+	go http.Serve(ln, &fakePodman{execs: make(map[string]libpodExecConfig)})
+
+	client, err := newLibpodClient(host, time.Second)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	res, err := Exec(client, ExecOptions{
+		ContainerID: "web",
+		Cmd:         []string{"/bin/check", "-v"},
+		Env:         []string{"EXIT_CODE=2"},
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if res.ExitCode != 2 || res.ContainerID != "4a7bd9c4f1e2aa00" {
+		t.Fatalf("got exit code %d, container %s", res.ExitCode, res.ContainerID)
+	}
+	if got, want := res.OutputString(), "/bin/check -v\noops\n"; got != want {
+		t.Fatalf("got output %q want %q", got, want)
+	}
+
+	res, err = Exec(client, ExecOptions{ContainerID: "web", Cmd: []string{"true"}, DiscardStderr: true})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if res.ExitCode != 0 || res.OutputString() != "true\n" {
+		t.Fatalf("got exit code %d, output %q", res.ExitCode, res.OutputString())
+	}
+
+	// Errors of Podman are those of the Docker client.
+	_, err = Exec(client, ExecOptions{ContainerID: "db", Cmd: []string{"true"}})
+	eerr, ok := err.(*ExecError)
+	if !ok || eerr.Op != ExecOpCreate {
+		t.Fatalf("got error %#v", err)
+	}
+	if _, ok := eerr.Err.(*docker.NoSuchContainer); !ok {
+		t.Fatalf("got error %v", eerr.Err)
+	}
+	_, err = Exec(client, ExecOptions{ContainerID: "web", Cmd: []string{"true"}, Env: []string{"EXIT_CODE=x"}})
+	if eerr, ok := err.(*ExecError); !ok || eerr.Op != ExecOpInspect {
+		t.Fatalf("got error %#v", err)
+	}
+	if _, err := client.InspectExec("exec-99"); err == nil {
+		t.Fatal("should fail")
+	} else if _, ok := err.(*docker.NoSuchExec); !ok {
+		t.Fatalf("got error %v", err)
+	}
+}
+
+// fakeCRIRuntime serves ExecSync of the CRI runtime service. The execs
+// echo their command to stdout and write "oops" to stderr, and exit with
+// the exit code of the command "exit <code>".
+type fakeCRIRuntime struct {
+	lock     sync.Mutex
+	requests []*criExecSyncRequest
+}
+
+func (r *fakeCRIRuntime) execSync(req *criExecSyncRequest) (*criExecSyncResponse, error) {
+	r.lock.Lock()
+	r.requests = append(r.requests, req)
+	r.lock.Unlock()
+	if req.ContainerID != "web" {
+		return nil, grpc.Errorf(codes.NotFound, "an error occurred when try to find container %q: not found", req.ContainerID)
+	}
+	resp := &criExecSyncResponse{
+		Stdout: []byte(strings.Join(req.Cmd, " ") + "\n"),
+		Stderr: []byte("oops\n"),
+	}
+	if len(req.Cmd) == 2 && req.Cmd[0] == "exit" {
+		fmt.Sscan(req.Cmd[1], &resp.ExitCode)
+	}
+	return resp, nil
+}
+
+// startCRIServer serves the fake runtime on a Unix socket with the CRI
+// runtime service of the given version.
+func startCRIServer(t *testing.T, version string, r *fakeCRIRuntime) (string, func()) {
+	host, ln, cleanup := listenUnix(t, "containerd")
+	srv := grpc.NewServer()
+	srv.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "runtime." + version + ".RuntimeService",
+		HandlerType: (*interface{})(nil),
+		Methods: []grpc.MethodDesc{{
+			MethodName: "ExecSync",
+			Handler: func(s interface{}, ctx context.Context, dec func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) {
+				var req criExecSyncRequest
+				if err := dec(&req); err != nil {
+					return nil, err
+				}
+				return s.(*fakeCRIRuntime).execSync(&req)
+			},
+		}},
+	}, r)
+	go srv.Serve(ln)
+	return host, func() {
+		srv.Stop()
+		cleanup()
+	}
+}
+
+func TestCRIClient(t *testing.T) {
+	t.Parallel()
+	for _, version := range []string{"v1", "v1alpha2"} {
+		r := &fakeCRIRuntime{}
+		host, stop := startCRIServer(t, version, r)
+		defer stop()
+		client, err := newCRIClient(host, time.Second)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer client.Close()
+
+		res, err := ExecWithTimeout(client, ExecOptions{ContainerID: "web", Cmd: []string{"exit", "2"}}, 10*time.Second)
+		if err != nil {
+			t.Fatalf("%s: err: %v", version, err)
+		}
+		if res.ExitCode != 2 || res.ContainerID != "web" {
+			t.Fatalf("%s: got exit code %d, container %s", version, res.ExitCode, res.ContainerID)
+		}
+		if got, want := res.OutputString(), "exit 2\noops\n"; got != want {
+			t.Fatalf("%s: got output %q want %q", version, got, want)
+		}
+		r.lock.Lock()
+		timeout := r.requests[len(r.requests)-1].Timeout
+		r.lock.Unlock()
+		if timeout != 10 {
+			t.Fatalf("%s: got timeout %d", version, timeout)
+		}
+
+		res, err = Exec(client, ExecOptions{ContainerID: "web", Cmd: []string{"true"}, DiscardStderr: true})
+		if err != nil {
+			t.Fatalf("%s: err: %v", version, err)
+		}
+		if res.ExitCode != 0 || res.OutputString() != "true\n" {
+			t.Fatalf("%s: got exit code %d, output %q", version, res.ExitCode, res.OutputString())
+		}
+		r.lock.Lock()
+		timeout = r.requests[len(r.requests)-1].Timeout
+		r.lock.Unlock()
+		if timeout != 0 {
+			t.Fatalf("%s: got timeout %d", version, timeout)
+		}
+
+		_, err = Exec(client, ExecOptions{ContainerID: "db", Cmd: []string{"true"}})
+		eerr, ok := err.(*ExecError)
+		if !ok || eerr.Op != ExecOpStart {
+			t.Fatalf("%s: got error %#v", version, err)
+		}
+		if _, ok := eerr.Err.(*docker.NoSuchContainer); !ok {
+			t.Fatalf("%s: got error %v", version, eerr.Err)
+		}
+	}
+}
+
+func TestCRIClient_ExpiresExecs(t *testing.T) {
+	t.Parallel()
+	client, err := newCRIClient("unix:///nonexistent/containerd.sock", time.Second)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer client.Close()
+
+	// An exec which exited and one which was never started are both
+	// dropped once they're older than the retention.
+	old := time.Now().Add(-2 * criExecRetention)
+	client.execs["cri-exited"] = &criExec{created: old, started: true, exited: old}
+	client.execs["cri-created"] = &criExec{created: old}
+	client.execs["cri-running"] = &criExec{created: old, started: true}
+	exec, err := client.CreateExec(docker.CreateExecOptions{Container: "web", Cmd: []string{"true"}})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for _, id := range []string{"cri-exited", "cri-created"} {
+		if _, err := client.InspectExec(id); err == nil {
+			t.Fatalf("%s should be expired", id)
+		}
+	}
+	for _, id := range []string{"cri-running", exec.ID} {
+		if _, err := client.InspectExec(id); err != nil {
+			t.Fatalf("%s: err: %v", id, err)
+		}
+	}
+}
+
+func TestDockerCheck_StopClosesCRIClient(t *testing.T) {
+	t.Parallel()
+	check := &CheckDocker{
+		Notify:            mock.NewNotify(),
+		CheckID:           types.CheckID("foo"),
+		Script:            "/health.sh",
+		DockerContainerID: "web",
+		Shell:             "/bin/sh",
+		Interval:          time.Hour,
+		ClientConfig:      DockerConfig{ContainerRuntime: "containerd", ContainerdHost: "unix:///nonexistent/containerd.sock"},
+		Logger:            log.New(ioutil.Discard, UniqueID(), log.LstdFlags),
+	}
+	if err := check.Init(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	check.Start()
+	check.Stop()
+	if err := check.dockerClient.(*criClient).Close(); err != grpc.ErrClientConnClosing {
+		t.Fatalf("got error %v", err)
+	}
+}
+
+func TestCRIClient_Unsupported(t *testing.T) {
+	t.Parallel()
+	client, err := newCRIClient("unix:///nonexistent/containerd.sock", time.Second)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer client.Close()
+	for _, opts := range []docker.CreateExecOptions{
+		{Container: "web", Cmd: []string{"true"}, Env: []string{"LANG=C"}},
+		{Container: "web", Cmd: []string{"true"}, User: "nobody"},
+		{Container: "web", Cmd: []string{"true"}, Privileged: true},
+	} {
+		if _, err := client.CreateExec(opts); err == nil || !strings.Contains(err.Error(), "containerd runtime doesn't support") {
+			t.Fatalf("%#v: got error %v", opts, err)
+		}
+	}
+
+	// A runtime which can't be reached is an infrastructure error.
+	exec, err := client.CreateExec(docker.CreateExecOptions{Container: "web", Cmd: []string{"true"}})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = client.StartExec(exec.ID, docker.StartExecOptions{Context: ctx})
+	if !isDockerInfrastructureError(err) {
+		t.Fatalf("got error %v", err)
+	}
+	if _, err := client.InspectExec(exec.ID); err == nil {
+		t.Fatal("should fail")
+	}
+}
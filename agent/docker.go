@@ -0,0 +1,2661 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"path"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"github.com/armon/circbuf"
+	"github.com/armon/go-metrics"
+	"github.com/docker/docker/pkg/stdcopy"
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/consul/types"
+	"golang.org/x/net/context"
+)
+
+// ExecResult contains the result of running a command in a Docker
+// container.
+type ExecResult struct {
+	// ContainerID is the ID of the container the command ran in. For
+	// execs it is the full ID as reported by the daemon.
+	ContainerID string
+
+	// ExitCode is the exit code of the command.
+	ExitCode int
+
+	// Duration is the time it took to run the command.
+	Duration time.Duration
+
+	// Output is the combined stdout and stderr of the command. Only the
+	// last ExecOptions.MaxOutputBytes bytes are kept. It's empty, like
+	// TotalWritten, if the output went to the writer of ExecOptions.Output.
+	Output []byte
+
+	// TotalWritten is the number of bytes written by the command. It is
+	// larger than the length of Output if the output was truncated.
+	TotalWritten int64
+
+	// LineCount is the number of lines written by the command, counted
+	// as the output is read, including those which were truncated. A
+	// last line without a newline counts too.
+	LineCount int64
+
+	// Warnings describe failures of the PreCmd and PostCmd of the exec.
+	// They don't affect the exit code.
+	Warnings []string
+
+	// ContentType is the MIME type of the output so consumers can render
+	// it, either ExecOptions.ContentType or sniffed from the output. It's
+	// empty if nothing was captured.
+	ContentType string
+
+	// SuccessExitCodes are the exit codes which Failed doesn't count as a
+	// failure, from ExecOptions.SuccessExitCodes. Only 0 is a success if
+	// it's empty.
+	SuccessExitCodes []int
+
+	// OutputEncoding is the encoding OutputString decodes the output
+	// from, from ExecOptions.OutputEncoding.
+	OutputEncoding string
+
+	// Stdout and Stderr are the last bytes of stdout and stderr on their
+	// own, which are only captured if ExecOptions.SeparateStreams is set.
+	// Stdout is also captured for ExecOptions.Expect.
+	Stdout []byte
+	Stderr []byte
+
+	// ExpectationFailure describes how stdout didn't meet the expectation
+	// of ExecOptions.Expect, which makes the command a failure whatever
+	// its exit code. It's empty if it did or there is none.
+	ExpectationFailure string
+}
+
+// outputBuffer is a buffer that captures the output of a command.
+type outputBuffer interface {
+	Bytes() []byte
+	TotalWritten() int64
+	Lines() int64
+}
+
+// newExecResult creates an ExecResult from the exit code and the buffer
+// the output was captured in.
+func newExecResult(containerID string, exitCode int, duration time.Duration, output outputBuffer) *ExecResult {
+	return &ExecResult{
+		ContainerID:  containerID,
+		ExitCode:     exitCode,
+		Duration:     duration,
+		Output:       output.Bytes(),
+		TotalWritten: output.TotalWritten(),
+		LineCount:    output.Lines(),
+	}
+}
+
+// Truncated returns true if the command wrote more output than was
+// captured.
+func (r *ExecResult) Truncated() bool {
+	return r.TotalWritten > int64(len(r.Output))
+}
+
+// OutputString returns the captured output as UTF-8 with a message about
+// truncation, if any. The output is decoded from its OutputEncoding.
+func (r *ExecResult) OutputString() string {
+	output := decodeOutput(r.Output, r.OutputEncoding)
+	if r.Truncated() {
+		return fmt.Sprintf("Captured %d of %d bytes\n...\n%s",
+			len(r.Output), r.TotalWritten, output)
+	}
+	return output
+}
+
+// The encodings the output of an exec can be decoded from.
+const (
+	OutputEncodingUTF8   = "utf-8"
+	OutputEncodingLatin1 = "iso-8859-1"
+	OutputEncodingBinary = "binary"
+)
+
+// outputEncodings maps the accepted names of the output encodings to
+// their canonical names.
+var outputEncodings = map[string]string{
+	"utf-8":      OutputEncodingUTF8,
+	"utf8":       OutputEncodingUTF8,
+	"iso-8859-1": OutputEncodingLatin1,
+	"latin1":     OutputEncodingLatin1,
+	"latin-1":    OutputEncodingLatin1,
+	"binary":     OutputEncodingBinary,
+	"base64":     OutputEncodingBinary,
+}
+
+// ParseOutputEncoding returns the canonical name of an output encoding,
+// like "iso-8859-1" for "Latin1". An empty name is UTF-8.
+func ParseOutputEncoding(name string) (string, error) {
+	if name == "" {
+		return OutputEncodingUTF8, nil
+	}
+	encoding, ok := outputEncodings[strings.ToLower(name)]
+	if !ok {
+		return "", fmt.Errorf("Invalid output encoding %q, must be one of utf-8, iso-8859-1 or binary", name)
+	}
+	return encoding, nil
+}
+
+// decodeOutput returns the output as UTF-8. Invalid UTF-8 sequences are
+// replaced with U+FFFD, ISO-8859-1 maps every byte to the code point of
+// the same value and binary output is base64 encoded.
+func decodeOutput(output []byte, encoding string) string {
+	switch encoding {
+	case OutputEncodingLatin1:
+		runes := make([]rune, len(output))
+		for i, b := range output {
+			runes[i] = rune(b)
+		}
+		return string(runes)
+	case OutputEncodingBinary:
+		return base64.StdEncoding.EncodeToString(output)
+	default:
+		if utf8.Valid(output) {
+			return string(output)
+		}
+		var buf bytes.Buffer
+		for len(output) > 0 {
+			r, size := utf8.DecodeRune(output)
+			buf.WriteRune(r)
+			output = output[size:]
+		}
+		return buf.String()
+	}
+}
+
+// Failed returns true if stdout didn't meet the expectation of the
+// command, even if it exited with 0, or if the exit code isn't one of its
+// SuccessExitCodes, or isn't 0 if there are none.
+func (r *ExecResult) Failed() bool {
+	if r.ExpectationFailure != "" {
+		return true
+	}
+	if len(r.SuccessExitCodes) == 0 {
+		return r.ExitCode != 0
+	}
+	for _, code := range r.SuccessExitCodes {
+		if r.ExitCode == code {
+			return false
+		}
+	}
+	return true
+}
+
+// DefaultWarningExitCodes are the exit codes which are classified as a
+// warning if none are given, following the convention of script checks.
+var DefaultWarningExitCodes = []int{1}
+
+// Status classifies the exit code of the command as a health status. A
+// command which didn't fail is passing, one which exited with one of
+// warningExitCodes is a warning and any other is critical.
+// DefaultWarningExitCodes are used if warningExitCodes is empty.
+func (r *ExecResult) Status(warningExitCodes []int) string {
+	if !r.Failed() {
+		return api.HealthPassing
+	}
+	if len(warningExitCodes) == 0 {
+		warningExitCodes = DefaultWarningExitCodes
+	}
+	for _, code := range warningExitCodes {
+		if r.ExitCode == code {
+			return api.HealthWarning
+		}
+	}
+	return api.HealthCritical
+}
+
+// JSONOutput is the output of a script which prints a JSON object.
+type JSONOutput struct {
+	// Status is the value of the status field.
+	Status string
+
+	// Fields is the rest of the object, without the status field.
+	Fields map[string]interface{}
+}
+
+// JSONOutput parses the captured output as a JSON object and returns the
+// value of the given status field along with the rest of the object.
+// Nested fields are separated by dots, for example "health.status", and a
+// leading dot is ignored.
+func (r *ExecResult) JSONOutput(field string) (*JSONOutput, error) {
+	var doc map[string]interface{}
+	if err := json.Unmarshal(r.Output, &doc); err != nil {
+		return nil, fmt.Errorf("Unable to parse output as JSON: %s", err)
+	}
+
+	path := strings.Split(strings.TrimPrefix(field, "."), ".")
+	parent := doc
+	for _, key := range path[:len(path)-1] {
+		child, ok := parent[key].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("Field %q not found in output", field)
+		}
+		parent = child
+	}
+	key := path[len(path)-1]
+	status, ok := parent[key].(string)
+	if !ok {
+		return nil, fmt.Errorf("Field %q not found in output or not a string", field)
+	}
+	delete(parent, key)
+	return &JSONOutput{Status: status, Fields: doc}, nil
+}
+
+// DockerClient defines an interface for a docker client
+// which is used for injecting a fake client during tests.
+// The clients of the other container runtimes implement
+// it too, see ParseContainerRuntime.
+type DockerClient interface {
+	CreateExec(docker.CreateExecOptions) (*docker.Exec, error)
+	StartExec(string, docker.StartExecOptions) error
+	InspectExec(string) (*docker.ExecInspect, error)
+}
+
+// redactedValue replaces redacted header values and output in logs.
+const redactedValue = "<hidden>"
+
+// newDockerClient creates a Docker client for the agent's configured Docker
+// host, falling back to the environment and then to the default host of
+// the Docker client library, and applies the rest of the agent's Docker
+// configuration to it. For the Podman runtime the host is the Podman
+// socket, and the other runtimes get their own clients.
+func newDockerClient(cfg DockerConfig, logger *log.Logger) (DockerClient, error) {
+	if cfg.Host != "" && cfg.Context != "" {
+		return nil, fmt.Errorf("Only one of the Docker host and context can be set")
+	}
+	runtime, err := ParseContainerRuntime(cfg.ContainerRuntime)
+	if err != nil {
+		return nil, err
+	}
+	switch runtime {
+	case ContainerRuntimePodman:
+		cfg.Host, cfg.Context = podmanHost(cfg), ""
+	case ContainerRuntimeLibpod, ContainerRuntimeContainerd:
+		return newRuntimeClient(runtime, cfg)
+	}
+
+	var client *docker.Client
+	switch {
+	case cfg.UseAgentTLS:
+		client, err = newAgentTLSDockerClient(cfg)
+	case cfg.TLSEnabled(), isTCPDockerHost(cfg.Host) && dockerEnvCertPath() != "":
+		client, err = newTLSDockerClient(cfg)
+	case cfg.Host != "":
+		client, err = docker.NewClient(cfg.Host)
+		if client != nil {
+			client.SkipServerVersionCheck = true
+		}
+	case cfg.Context != "":
+		client, err = newDockerContextClient(cfg.Context)
+	default:
+		client, err = docker.NewClientFromEnv()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if isNamedPipeHost(client.Endpoint()) && !namedPipesSupported {
+		return nil, fmt.Errorf("Docker host %s is a named pipe, which is only supported on Windows", client.Endpoint())
+	}
+	if cfg.TLSFingerprint != "" {
+		if client, err = pinDockerClient(client, cfg.TLSFingerprint); err != nil {
+			return nil, err
+		}
+	}
+	if client, err = socketDockerClient(client); err != nil {
+		return nil, err
+	}
+	keepDockerConnsAlive(client)
+	if cfg.Token != "" && cfg.TokenFile != "" {
+		return nil, fmt.Errorf("Only one of the Docker token and token file can be set")
+	}
+	if cfg.ConnectTimeout > 0 {
+		setDockerConnectTimeout(client, cfg.ConnectTimeout)
+	}
+
+	transport := client.HTTPClient.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	transport = &resetRetryTransport{base: transport}
+	if cfg.UseAgentTLS {
+		transport = &agentTLSTransport{base: transport}
+	}
+	transport = &connTraceTransport{base: transport}
+	transport = &latencyTransport{base: transport}
+	if cfg.breaker != nil {
+		transport = &breakerTransport{breaker: cfg.breaker, base: transport}
+	}
+	if len(cfg.Headers) > 0 {
+		headers := make(http.Header)
+		for field, value := range cfg.Headers {
+			headers.Set(field, value)
+		}
+		transport = &headerTransport{headers: headers, base: transport}
+		logger.Printf("[DEBUG] agent: Docker client sends headers %s",
+			redactHeaders(headers, cfg.RedactHeaders))
+	}
+	switch {
+	case cfg.Token != "":
+		transport = &bearerTransport{tokens: StaticDockerToken(cfg.Token), base: transport}
+	case cfg.TokenFile != "":
+		transport = &bearerTransport{tokens: dockerTokenFile(cfg.TokenFile), base: transport}
+	}
+	client.HTTPClient.Transport = transport
+
+	// Reload the client certificate when TLS is set up through the
+	// environment or for Docker so rotated certificates are picked up.
+	var certs *certReloader
+	if certFile, keyFile, ok := dockerClientCertFiles(cfg); ok && client.TLSConfig != nil {
+		if certs, err = newCertReloader(certFile, keyFile); err != nil {
+			return nil, err
+		}
+	}
+
+	// The connection the Docker client library attaches to the output of
+	// an exec with doesn't go through the transport, so the exec is
+	// started with a request which does when a gateway needs the token or
+	// the headers.
+	if cfg.Token != "" || cfg.TokenFile != "" || len(cfg.Headers) > 0 {
+		if certs != nil {
+			client.TLSConfig.GetClientCertificate = certs.GetClientCertificate
+		}
+		return &transportExecClient{Client: client}, nil
+	}
+	if certs != nil {
+		return newTLSReloadingClient(client, certs), nil
+	}
+	return client, nil
+}
+
+// checkDockerAPIVersion makes the client look up the API version of the
+// daemon, which it otherwise skips. The Docker client library refuses to
+// send the environment of an exec until it knows the version. Other
+// clients are left as they are.
+func checkDockerAPIVersion(client DockerClient) error {
+	var c *docker.Client
+	switch dc := client.(type) {
+	case *docker.Client:
+		c = dc
+	case *tlsReloadingClient:
+		c = dc.Client
+	case *transportExecClient:
+		c = dc.Client
+	default:
+		return nil
+	}
+	c.SkipServerVersionCheck = false
+	return c.Ping()
+}
+
+// closeDockerClient closes a client which holds a connection to the
+// container runtime, like the CRI client does. The other clients only
+// keep idle connections, which time out.
+func closeDockerClient(client DockerClient) {
+	if c, ok := client.(io.Closer); ok {
+		c.Close()
+	}
+}
+
+// dockerMaxIdleConns is how many idle connections a client keeps open to
+// the Docker daemon between the runs of its check.
+const dockerMaxIdleConns = 2
+
+// keepDockerConnsAlive makes the client keep its connections to the daemon
+// open between requests. The Docker client library disables keep-alives
+// on the transports it creates, so every run of a check would otherwise
+// dial the daemon again.
+func keepDockerConnsAlive(client *docker.Client) {
+	if tr, ok := client.HTTPClient.Transport.(*http.Transport); ok {
+		tr.DisableKeepAlives = false
+		tr.MaxIdleConnsPerHost = dockerMaxIdleConns
+	}
+}
+
+// setDockerConnectTimeout limits how long connecting to the daemon may
+// take. The dialer of the client is used for the connections which attach
+// to the output of an exec, and the transport of its HTTP client for the
+// other requests. The dialer of a client of a socket dials both.
+func setDockerConnectTimeout(client *docker.Client, timeout time.Duration) {
+	if d, ok := client.Dialer.(*dockerSocketDialer); ok {
+		d.timeout = timeout
+		return
+	}
+	dialer := &net.Dialer{Timeout: timeout}
+	client.Dialer = dialer
+	if tr, ok := client.HTTPClient.Transport.(*http.Transport); ok {
+		tr.DialContext = dialer.DialContext
+	}
+}
+
+// DockerTokenProvider provides the bearer token used to authenticate with
+// a gateway in front of the Docker daemon.
+type DockerTokenProvider interface {
+	// Token returns the token to send. If refresh is true the previous
+	// token was rejected and a new one should be fetched.
+	Token(refresh bool) (string, error)
+}
+
+// StaticDockerToken is a DockerTokenProvider which always returns the same
+// token.
+type StaticDockerToken string
+
+// Token returns the token.
+func (t StaticDockerToken) Token(refresh bool) (string, error) {
+	return string(t), nil
+}
+
+// DockerTokenFunc adapts a function to a DockerTokenProvider so tokens can
+// be fetched and refreshed on demand.
+type DockerTokenFunc func(refresh bool) (string, error)
+
+// Token calls f(refresh).
+func (f DockerTokenFunc) Token(refresh bool) (string, error) {
+	return f(refresh)
+}
+
+// dockerTokenFile returns a DockerTokenProvider which reads the token from
+// a file. The token is cached until it is rejected.
+func dockerTokenFile(path string) DockerTokenProvider {
+	var lock sync.Mutex
+	var token string
+	return DockerTokenFunc(func(refresh bool) (string, error) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		if token != "" && !refresh {
+			return token, nil
+		}
+		buf, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("Unable to read Docker token: %s", err)
+		}
+		token = strings.TrimSpace(string(buf))
+		return token, nil
+	})
+}
+
+// bearerTransport is an http.RoundTripper which authenticates requests
+// with a bearer token. If the token is rejected it is refreshed and the
+// request is retried once.
+type bearerTransport struct {
+	tokens DockerTokenProvider
+	base   http.RoundTripper
+}
+
+func (t *bearerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.roundTrip(req, false)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+
+	// The body has been consumed so the request can only be retried if
+	// it can be rewound.
+	if req.Body != nil && req.GetBody == nil {
+		return resp, nil
+	}
+	retry := req
+	if req.Body != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return resp, nil
+		}
+		retry = new(http.Request)
+		*retry = *req
+		retry.Body = body
+	}
+	resp.Body.Close()
+	return t.roundTrip(retry, true)
+}
+
+// roundTrip sends the request with the Authorization header set on a copy
+// of it.
+func (t *bearerTransport) roundTrip(req *http.Request, refresh bool) (*http.Response, error) {
+	token, err := t.tokens.Token(refresh)
+	if err != nil {
+		return nil, err
+	}
+	clone := new(http.Request)
+	*clone = *req
+	clone.Header = make(http.Header, len(req.Header)+1)
+	for field, values := range req.Header {
+		clone.Header[field] = values
+	}
+	clone.Header.Set("Authorization", "Bearer "+token)
+	return t.base.RoundTrip(clone)
+}
+
+// transportExecClient is a Docker client which starts execs with a request
+// sent through the transport of its HTTP client, like all of its other
+// requests, instead of the connection the Docker client library dials
+// itself to attach to the output. The daemon streams the output in the
+// body of the response then.
+type transportExecClient struct {
+	*docker.Client
+}
+
+func (c *transportExecClient) StartExec(id string, opts docker.StartExecOptions) error {
+	if id == "" {
+		return &docker.NoSuchExec{ID: id}
+	}
+	if opts.Detach {
+		return c.Client.StartExec(id, opts)
+	}
+	body, err := json.Marshal(map[string]bool{"Detach": false, "Tty": opts.Tty})
+	if err != nil {
+		return err
+	}
+	u, err := dockerRequestURL(c.Client, "/exec/"+url.PathEscape(id)+"/start")
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if opts.Context != nil {
+		req = req.WithContext(opts.Context)
+	}
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return &docker.NoSuchExec{ID: id}
+	}
+	if resp.StatusCode >= 400 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return &docker.Error{Status: resp.StatusCode, Message: string(msg)}
+	}
+
+	stdout, stderr := opts.OutputStream, opts.ErrorStream
+	if stdout == nil {
+		stdout = ioutil.Discard
+	}
+	if stderr == nil {
+		stderr = ioutil.Discard
+	}
+	if opts.Tty || opts.RawTerminal {
+		_, err = io.Copy(stdout, resp.Body)
+		return err
+	}
+	_, err = stdcopy.StdCopy(stdout, stderr, resp.Body)
+	return err
+}
+
+// dockerRequestURL returns the URL of a request to the daemon of the
+// client, which the Docker client library only builds internally. The
+// clients of Unix sockets and named pipes have an http:// endpoint whose
+// connections are dialed by the transport, see socketDockerClient.
+func dockerRequestURL(client *docker.Client, path string) (string, error) {
+	endpoint := client.Endpoint()
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "tcp://" + endpoint
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", fmt.Errorf("Invalid Docker endpoint %q: %v", client.Endpoint(), err)
+	}
+	switch u.Scheme {
+	case "tcp", "http", "https":
+		scheme := "http"
+		if client.TLSConfig != nil || u.Scheme == "https" {
+			scheme = "https"
+		}
+		return scheme + "://" + u.Host + path, nil
+	}
+	return "", fmt.Errorf("Invalid Docker endpoint %q", client.Endpoint())
+}
+
+// resetRetryTransport is an http.RoundTripper which handles the Docker
+// daemon restarting. When a request fails because the connection was
+// reset or closed, the idle connections, which are most likely stale too,
+// are closed. Idempotent requests which were sent on a reused connection
+// are then retried once on a fresh one. A request which fails on a new
+// connection is not retried since the daemon is really unavailable.
+type resetRetryTransport struct {
+	base http.RoundTripper
+}
+
+func (t *resetRetryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var reused bool
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			reused = info.Reused
+		},
+	}
+	resp, err := t.base.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+	if err == nil || !isConnReset(err) {
+		return resp, err
+	}
+
+	if tr, ok := t.base.(interface {
+		CloseIdleConnections()
+	}); ok {
+		tr.CloseIdleConnections()
+	}
+	if !reused || (req.Method != "GET" && req.Method != "HEAD") || req.Body != nil {
+		return resp, err
+	}
+	return t.base.RoundTrip(req)
+}
+
+// isConnReset returns true if the error means the connection was closed
+// or reset by the other end.
+func isConnReset(err error) bool {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) {
+		return false
+	}
+	return errors.Is(opErr.Err, syscall.ECONNRESET) || errors.Is(opErr.Err, syscall.EPIPE)
+}
+
+// connTraceTransport is an http.RoundTripper which counts whether the
+// requests to the Docker daemon got a new or a reused connection, to show
+// if the connection pool is effective. The counters are emitted as
+// metrics unless gotConn is set.
+type connTraceTransport struct {
+	base    http.RoundTripper
+	gotConn func(reused bool)
+}
+
+func (t *connTraceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	gotConn := t.gotConn
+	if gotConn == nil {
+		gotConn = dockerConnMetrics
+	}
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			gotConn(info.Reused)
+		},
+	}
+	return t.base.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+}
+
+// dockerConnMetrics counts a connection to the Docker daemon.
+func dockerConnMetrics(reused bool) {
+	if reused {
+		metrics.IncrCounter([]string{"consul", "agent", "docker", "conn", "reused"}, 1)
+		return
+	}
+	metrics.IncrCounter([]string{"consul", "agent", "docker", "conn", "new"}, 1)
+}
+
+// latencyTransport is an http.RoundTripper which times the requests to the
+// Docker daemon by the API call they're for, so a slow daemon can be told
+// apart from a slow check. The round trips are emitted as timer metrics,
+// which sinks summarize with percentiles, unless observe is set. Starting
+// an exec happens on a hijacked connection and isn't timed since it lasts
+// as long as the command.
+type latencyTransport struct {
+	base    http.RoundTripper
+	observe func(call string, start time.Time)
+}
+
+func (t *latencyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	observe := t.observe
+	if observe == nil {
+		observe = dockerLatencyMetrics
+	}
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	observe(dockerAPICall(req.Method, req.URL.Path), start)
+	return resp, err
+}
+
+// dockerLatencyMetrics records the round trip of a Docker API call.
+func dockerLatencyMetrics(call string, start time.Time) {
+	metrics.MeasureSince([]string{"consul", "agent", "docker", "api", call}, start)
+}
+
+// dockerAPIVersionPrefix matches the API version the client prefixes its
+// request paths with, like "/v1.24".
+var dockerAPIVersionPrefix = regexp.MustCompile(`^/v[0-9.]+/`)
+
+// dockerAPICall names the API call of a request to the Docker daemon, like
+// "inspect_exec", from its method and path. Calls the agent doesn't make
+// are "other".
+func dockerAPICall(method, path string) string {
+	path = dockerAPIVersionPrefix.ReplaceAllString(path, "/")
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "_ping":
+		return "ping"
+	case len(parts) == 1 && parts[0] == "version":
+		return "version"
+	case len(parts) == 2 && parts[0] == "containers" && parts[1] == "json":
+		return "list_containers"
+	case len(parts) == 3 && parts[0] == "containers" && parts[2] == "json":
+		return "inspect_container"
+	case len(parts) == 3 && parts[0] == "containers" && parts[2] == "exec" && method == "POST":
+		return "create_exec"
+	case len(parts) == 3 && parts[0] == "exec" && parts[2] == "json":
+		return "inspect_exec"
+	case len(parts) == 3 && parts[0] == "exec" && parts[2] == "start":
+		return "start_exec"
+	case len(parts) == 3 && parts[0] == "exec" && parts[2] == "resize":
+		return "resize_exec"
+	}
+	return "other"
+}
+
+// headerTransport is an http.RoundTripper which adds a static set of
+// headers to every request.
+type headerTransport struct {
+	headers http.Header
+	base    http.RoundTripper
+}
+
+// RoundTrip sets the headers on a copy of the request since a RoundTripper
+// must not modify the request it is given.
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	clone := new(http.Request)
+	*clone = *req
+	clone.Header = make(http.Header, len(req.Header)+len(t.headers))
+	for field, values := range req.Header {
+		clone.Header[field] = values
+	}
+	for field, values := range t.headers {
+		clone.Header[field] = values
+	}
+	return t.base.RoundTrip(clone)
+}
+
+// redactHeaders formats the headers for logging with the values of the
+// headers in redact hidden.
+func redactHeaders(headers http.Header, redact []string) string {
+	hidden := make(map[string]bool)
+	for _, field := range redact {
+		hidden[http.CanonicalHeaderKey(field)] = true
+	}
+
+	var fields []string
+	for field, values := range headers {
+		value := strings.Join(values, ",")
+		if hidden[http.CanonicalHeaderKey(field)] {
+			value = redactedValue
+		}
+		fields = append(fields, field+": "+value)
+	}
+	sort.Strings(fields)
+	return "[" + strings.Join(fields, ", ") + "]"
+}
+
+// ExecOptions configures a command run by Exec.
+type ExecOptions struct {
+	// ContainerID is the container the command is run in.
+	ContainerID string
+
+	// Cmd is the command and its arguments.
+	Cmd []string
+
+	// Privileged runs the command with extended privileges.
+	Privileged bool
+
+	// CreateRetries is the number of times creating the exec is retried
+	// if it fails.
+	CreateRetries int
+
+	// PollInterval is the time to wait before polling the running exec
+	// for the first time. Zero uses a default of 10ms.
+	PollInterval time.Duration
+
+	// DiscardStderr doesn't attach stderr so that only stdout is captured
+	// in the output.
+	DiscardStderr bool
+
+	// SeparateStreams captures stdout and stderr on their own as well,
+	// each limited to MaxOutputBytes, for commands which print different
+	// things on them. The output still has both in the order they were
+	// written.
+	SeparateStreams bool
+
+	// Tracker, if set, tracks the exec while it runs so that it can be
+	// cancelled with the tracker's CancelAll.
+	Tracker *ExecTracker
+
+	// MaxOutputBytes is the number of bytes of the output which are
+	// captured. Only the last bytes are kept. Zero uses CheckBufSize.
+	MaxOutputBytes int64
+
+	// Output, if set, receives the output as it's read from the daemon
+	// instead of it being captured in a buffer of MaxOutputBytes bytes, so
+	// the writer has to limit its own size. The exec may still write to it
+	// after Exec returns on a timeout or cancellation.
+	Output io.Writer
+
+	// ContentType, if set, is the MIME type of the output of the command,
+	// like "application/json". Otherwise it's sniffed from the output.
+	ContentType string
+
+	// PreCmd and PostCmd, if set, are run as separate execs with the same
+	// options before and after Cmd, for example to set up and clean up a
+	// probe file. Their failures are returned as warnings of the result
+	// and their output is only included in the warnings. PostCmd runs
+	// even if Cmd fails, but not once the exec timed out or was cancelled.
+	PreCmd  []string
+	PostCmd []string
+
+	// Budget, if set, limits the bytes of output read from the daemon
+	// for this exec and the others sharing the budget. The exec fails
+	// with a ByteBudgetError once it's used up.
+	Budget *ByteBudget
+
+	// SuccessExitCodes are the exit codes of the command which aren't a
+	// failure, for example 0 and 1 for a command which only fails above
+	// 1. They're set on the result for ExecResult.Failed. Only 0 is a
+	// success if it's empty.
+	SuccessExitCodes []int
+
+	// KillSignal and KillGracePeriod are how the command is killed in
+	// its container when it times out or is cancelled, see KillOptions.
+	KillSignal      string
+	KillGracePeriod time.Duration
+
+	// Env are environment variables of the command, as "KEY=value", in
+	// addition to those of the container. They need API version 1.25.
+	Env []string
+
+	// OutputEncoding is the encoding of the output of the command, see
+	// ParseOutputEncoding. It's set on the result for OutputString.
+	// Empty is UTF-8.
+	OutputEncoding string
+
+	// Expect, if set, is an expectation on the stdout of the command which
+	// has to hold for it to succeed, in addition to its exit code. Stdout
+	// is decoded with OutputEncoding before it's matched.
+	Expect *OutputExpectation
+
+	// breaker is checked before creating the exec, so that no exec is
+	// left in the container while it is open. The Docker client library
+	// also attaches to the exec without the transport of the client,
+	// which has the breaker.
+	breaker *dockerBreaker
+}
+
+// OutputExpectation is an expectation on the stdout of a command, for
+// commands which exit with 0 even when they fail.
+type OutputExpectation struct {
+	// Contains, if set, is a string stdout has to contain.
+	Contains string
+
+	// Matches, if set, is a regular expression stdout has to match.
+	Matches *regexp.Regexp
+
+	// Negate inverts the expectation, failing the command if stdout
+	// contains Contains or matches Matches, for example "ERROR".
+	Negate bool
+}
+
+// Check returns why stdout doesn't meet the expectation, or an empty
+// string if it does.
+func (e *OutputExpectation) Check(stdout string) string {
+	if e.Negate {
+		switch {
+		case e.Contains != "" && strings.Contains(stdout, e.Contains):
+			return fmt.Sprintf("Output contains %q", e.Contains)
+		case e.Matches != nil && e.Matches.MatchString(stdout):
+			return fmt.Sprintf("Output matches %q", e.Matches)
+		}
+		return ""
+	}
+	switch {
+	case e.Contains != "" && !strings.Contains(stdout, e.Contains):
+		return fmt.Sprintf("Output doesn't contain %q", e.Contains)
+	case e.Matches != nil && !e.Matches.MatchString(stdout):
+		return fmt.Sprintf("Output doesn't match %q", e.Matches)
+	}
+	return ""
+}
+
+// The operations on an exec an ExecError can be for.
+const (
+	ExecOpCreate  = "create"
+	ExecOpStart   = "start"
+	ExecOpInspect = "inspect"
+)
+
+// ExecError is returned when a request to the Docker daemon for an exec
+// fails. It records which operation failed on which exec so that callers
+// can tell the failures apart without parsing the message.
+type ExecError struct {
+	// Op is the operation which failed, one of the ExecOp constants.
+	Op string
+
+	// ContainerID is the container the exec runs in, if known.
+	ContainerID string
+
+	// ExecID is the ID of the exec. It's empty if creating it failed.
+	ExecID string
+
+	// StatusCode is the HTTP status code of the daemon's response, or 0
+	// if the request didn't get one.
+	StatusCode int
+
+	// DaemonMessage is the message of the daemon's error response, like
+	// "Container 54432bad1fc7 is not running", decoded from the JSON body
+	// the daemon answers with. It's empty if the request didn't get one.
+	DaemonMessage string
+
+	// Err is the error of the request.
+	Err error
+}
+
+func newExecError(op, containerID, execID string, err error) *ExecError {
+	e := &ExecError{Op: op, ContainerID: containerID, ExecID: execID, Err: dockerTimeoutError(err)}
+	if derr, ok := err.(*docker.Error); ok {
+		e.StatusCode = derr.Status
+		e.DaemonMessage = daemonMessage(derr.Message)
+	}
+	return e
+}
+
+func (e *ExecError) Error() string {
+	var reason interface{} = e.Err
+	if e.StatusCode != 0 && e.DaemonMessage != "" {
+		reason = fmt.Sprintf("API error (%d): %s", e.StatusCode, e.DaemonMessage)
+	}
+	if e.Op == ExecOpCreate {
+		return fmt.Sprintf("Unable to create Exec, error: %s", reason)
+	}
+	return fmt.Sprintf("Unable to %s Exec: %s", e.Op, reason)
+}
+
+// daemonMessage returns the message of the body of an error response of
+// the Docker daemon, which is a JSON object like {"message": "..."}. Other
+// bodies are returned as they are, without surrounding whitespace.
+func daemonMessage(body string) string {
+	var resp struct {
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal([]byte(body), &resp); err == nil && resp.Message != "" {
+		return resp.Message
+	}
+	return strings.TrimSpace(body)
+}
+
+// The phases of a request a DockerTimeoutError can be for.
+const (
+	DockerTimeoutConnect  = "connect"
+	DockerTimeoutResponse = "response"
+)
+
+// DockerTimeoutError is the error of a request to the Docker daemon which
+// timed out, telling apart a daemon which couldn't be connected to from
+// one which accepted the connection but was slow to respond.
+type DockerTimeoutError struct {
+	// Phase is the phase of the request which timed out, one of the
+	// DockerTimeout constants.
+	Phase string
+
+	// Err is the error of the request.
+	Err error
+}
+
+func (e *DockerTimeoutError) Error() string {
+	if e.Phase == DockerTimeoutConnect {
+		return fmt.Sprintf("Timed out connecting to the Docker daemon: %s", e.Err)
+	}
+	return fmt.Sprintf("Timed out waiting for the Docker daemon to respond: %s", e.Err)
+}
+
+// Timeout and Temporary make a DockerTimeoutError a net.Error like the
+// error it wraps.
+func (e *DockerTimeoutError) Timeout() bool   { return true }
+func (e *DockerTimeoutError) Temporary() bool { return true }
+
+// dockerTimeoutError wraps the error of a request to the Docker daemon in
+// a DockerTimeoutError if it timed out. Other errors are returned as they
+// are.
+func dockerTimeoutError(err error) error {
+	nerr, ok := err.(net.Error)
+	if !ok || !nerr.Timeout() {
+		return err
+	}
+	if _, ok := err.(*DockerTimeoutError); ok {
+		return err
+	}
+	inner := err
+	if uerr, ok := inner.(*url.Error); ok {
+		inner = uerr.Err
+	}
+	if operr, ok := inner.(*net.OpError); ok && operr.Op == "dial" {
+		return &DockerTimeoutError{Phase: DockerTimeoutConnect, Err: err}
+	}
+	return &DockerTimeoutError{Phase: DockerTimeoutResponse, Err: err}
+}
+
+// isDockerInfrastructureError returns true if the error means the Docker
+// daemon couldn't be reached or failed to handle a request, rather than
+// that the script or its container failed.
+func isDockerInfrastructureError(err error) bool {
+	if eerr, ok := err.(*ExecError); ok {
+		if eerr.StatusCode != 0 {
+			return eerr.StatusCode >= 500
+		}
+		err = eerr.Err
+	}
+	if derr, ok := err.(*docker.Error); ok {
+		return derr.Status >= 500
+	}
+	if err == docker.ErrConnectionRefused || isConnReset(err) {
+		return true
+	}
+	_, ok := err.(net.Error)
+	return ok
+}
+
+// ErrExecCancelled is returned for an exec which was cancelled with
+// ExecTracker.CancelAll.
+var ErrExecCancelled = errors.New("Exec was cancelled")
+
+// execKillTimeout is how long killing a cancelled exec may take, on top of
+// its kill grace period.
+var execKillTimeout = 5 * time.Second
+
+// execKillPollInterval is how often a signaled exec is inspected during its
+// kill grace period to see whether it has exited.
+var execKillPollInterval = 100 * time.Millisecond
+
+// CheckSemaphore limits the number of Docker checks of an agent which run
+// at the same time so that a storm of checks doesn't overwhelm the host.
+// A nil CheckSemaphore doesn't limit them.
+type CheckSemaphore struct {
+	slots chan struct{}
+}
+
+// NewCheckSemaphore creates a CheckSemaphore for n checks at a time. It
+// returns nil if n isn't positive.
+func NewCheckSemaphore(n int) *CheckSemaphore {
+	if n <= 0 {
+		return nil
+	}
+	return &CheckSemaphore{slots: make(chan struct{}, n)}
+}
+
+// Acquire waits up to timeout for a free slot and returns whether it got
+// one. It gives up early when stopCh is closed.
+func (s *CheckSemaphore) Acquire(timeout time.Duration, stopCh <-chan struct{}) bool {
+	if s == nil {
+		return true
+	}
+	select {
+	case s.slots <- struct{}{}:
+		return true
+	default:
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case s.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-stopCh:
+		return false
+	}
+}
+
+// Release frees a slot taken by Acquire.
+func (s *CheckSemaphore) Release() {
+	if s == nil {
+		return
+	}
+	<-s.slots
+}
+
+// CheckPause suspends the Docker checks of an agent, for example during
+// maintenance of the Docker daemon. Paused checks keep their last status
+// and don't make any requests to the daemon. A nil CheckPause is never
+// paused.
+type CheckPause struct {
+	paused bool
+	reason string
+	lock   sync.RWMutex
+}
+
+// Pause pauses the checks for the given reason.
+func (p *CheckPause) Pause(reason string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.paused = true
+	p.reason = reason
+}
+
+// Resume lets the checks run again.
+func (p *CheckPause) Resume() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.paused = false
+	p.reason = ""
+}
+
+// Paused returns whether the checks are paused and why.
+func (p *CheckPause) Paused() (bool, string) {
+	if p == nil {
+		return false, ""
+	}
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.paused, p.reason
+}
+
+// DockerResultHandler is passed the result of every run of a Docker check,
+// for example to forward it to an external system. The result is nil if
+// the script couldn't be started, and err is the error of the run.
+type DockerResultHandler interface {
+	HandleResult(checkID types.CheckID, res *ExecResult, err error)
+}
+
+// DockerResultHandlerFunc adapts a function to a DockerResultHandler.
+type DockerResultHandlerFunc func(checkID types.CheckID, res *ExecResult, err error)
+
+// HandleResult calls f(checkID, res, err).
+func (f DockerResultHandlerFunc) HandleResult(checkID types.CheckID, res *ExecResult, err error) {
+	f(checkID, res, err)
+}
+
+// dockerResultQueueSize is the number of results a DockerResultQueue holds
+// for its handler before it drops them.
+const dockerResultQueueSize = 128
+
+// DockerResultQueue passes the results of the Docker checks of an agent on
+// to a DockerResultHandler from a single goroutine, so that a slow handler
+// can't hold up the checks. Results which arrive while the queue is full
+// are dropped. A nil DockerResultQueue drops every result.
+type DockerResultQueue struct {
+	ch      chan dockerResult
+	stopCh  chan struct{}
+	handler DockerResultHandler
+	running bool
+	stopped bool
+	lock    sync.RWMutex
+}
+
+// dockerResult is a result waiting in a DockerResultQueue.
+type dockerResult struct {
+	checkID types.CheckID
+	res     *ExecResult
+	err     error
+}
+
+// NewDockerResultQueue creates a DockerResultQueue of size results, or of
+// dockerResultQueueSize if size isn't positive. Results are only queued
+// once a handler is set.
+func NewDockerResultQueue(size int) *DockerResultQueue {
+	if size <= 0 {
+		size = dockerResultQueueSize
+	}
+	return &DockerResultQueue{
+		ch:     make(chan dockerResult, size),
+		stopCh: make(chan struct{}),
+	}
+}
+
+// SetHandler sets the handler the results are passed to. The goroutine
+// calling it is started with the first handler.
+func (q *DockerResultQueue) SetHandler(h DockerResultHandler) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.stopped {
+		return
+	}
+	if !q.running && h != nil {
+		q.running = true
+		go q.run()
+	}
+	q.handler = h
+}
+
+// Stop stops passing results to the handler. Queued results are dropped.
+func (q *DockerResultQueue) Stop() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if !q.stopped {
+		q.stopped = true
+		close(q.stopCh)
+	}
+}
+
+// push queues a result for the handler without blocking.
+func (q *DockerResultQueue) push(checkID types.CheckID, res *ExecResult, err error) {
+	if q == nil {
+		return
+	}
+	q.lock.RLock()
+	ready := q.handler != nil && !q.stopped
+	q.lock.RUnlock()
+	if !ready {
+		return
+	}
+	select {
+	case q.ch <- dockerResult{checkID: checkID, res: res, err: err}:
+	default:
+		metrics.IncrCounter([]string{"consul", "agent", "check", "docker", "results_dropped"}, 1)
+	}
+}
+
+func (q *DockerResultQueue) run() {
+	for {
+		select {
+		case r := <-q.ch:
+			q.lock.RLock()
+			h := q.handler
+			q.lock.RUnlock()
+			if h != nil {
+				h.HandleResult(r.checkID, r.res, r.err)
+			}
+		case <-q.stopCh:
+			return
+		}
+	}
+}
+
+// ExecTracker tracks the running execs of a set of checks, such as those of
+// an agent, so that they can all be cancelled at once when the checks are
+// reloaded.
+type ExecTracker struct {
+	execs map[*trackedExec]struct{}
+	lock  sync.Mutex
+}
+
+// trackedExec is an exec registered with an ExecTracker.
+type trackedExec struct {
+	cancel    context.CancelFunc
+	cancelled bool
+}
+
+// NewExecTracker returns an ExecTracker without any execs.
+func NewExecTracker() *ExecTracker {
+	return &ExecTracker{execs: make(map[*trackedExec]struct{})}
+}
+
+// track returns a context for an exec which is cancelled by CancelAll and
+// a function to call once the exec is done.
+func (t *ExecTracker) track(ctx context.Context) (context.Context, *trackedExec, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	e := &trackedExec{cancel: cancel}
+	t.lock.Lock()
+	t.execs[e] = struct{}{}
+	t.lock.Unlock()
+	return ctx, e, func() {
+		t.lock.Lock()
+		delete(t.execs, e)
+		t.lock.Unlock()
+		cancel()
+	}
+}
+
+// wasCancelled returns true if CancelAll cancelled the exec.
+func (t *ExecTracker) wasCancelled(e *trackedExec) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return e.cancelled
+}
+
+// CancelAll cancels the running execs and returns how many there were.
+// Their callers get ErrExecCancelled back and the commands are killed in
+// their containers where possible, see KillExec.
+func (t *ExecTracker) CancelAll() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for e := range t.execs {
+		e.cancelled = true
+		e.cancel()
+	}
+	return len(t.execs)
+}
+
+// execCreateRetryInterval is the time to wait between attempts to create
+// an exec.
+var execCreateRetryInterval = 250 * time.Millisecond
+
+// execCreates tracks the execs which are being created, keyed by container
+// and command. Docker has no idempotency keys, so creates of the same
+// command in the same container are made one at a time. An exec of the
+// command which shows up in the container while its create is in flight
+// can then only have been made by that create.
+var execCreates = &inFlightCreates{creates: make(map[string]chan struct{})}
+
+// inFlightCreates is a set of keys which are held by one caller at a time.
+type inFlightCreates struct {
+	lock    sync.Mutex
+	creates map[string]chan struct{}
+}
+
+// acquire waits until no other caller holds the key, or until ctx is done,
+// and returns a function which releases it.
+func (c *inFlightCreates) acquire(ctx context.Context, key string) (func(), error) {
+	for {
+		c.lock.Lock()
+		done, ok := c.creates[key]
+		if !ok {
+			done = make(chan struct{})
+			c.creates[key] = done
+			c.lock.Unlock()
+			return func() {
+				c.lock.Lock()
+				delete(c.creates, key)
+				c.lock.Unlock()
+				close(done)
+			}, nil
+		}
+		c.lock.Unlock()
+
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// createExec creates the exec, retrying up to opts.CreateRetries times.
+// It waits for any other create of the same command in the container
+// first. A create which failed may still have created the exec, for
+// example when the connection broke before the response arrived, so the
+// execs of the container are listed before each attempt. If a single
+// exec of the command was added by a failed attempt it is used instead
+// of creating another one. Nothing else in the agent can have created it
+// or started it, since the command is only created by one caller at a
+// time and the exec was never returned to anyone.
+func createExec(ctx context.Context, client DockerClient, opts ExecOptions, execOpts docker.CreateExecOptions) (*docker.Exec, error) {
+	release, err := execCreates.acquire(ctx, opts.ContainerID+"\x00"+strings.Join(execOpts.Cmd, "\x00"))
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	inspect, _ := client.(DockerInspectClient)
+	execsBefore := func() map[string]bool {
+		if opts.CreateRetries <= 0 || inspect == nil {
+			return nil
+		}
+		// Without the execs the container already had a matching exec
+		// can't be told apart from the ones of earlier runs, so none is
+		// reused then.
+		ids, err := containerExecIDs(ctx, inspect, opts.ContainerID)
+		if err != nil {
+			return nil
+		}
+		before := make(map[string]bool, len(ids))
+		for _, id := range ids {
+			before[id] = true
+		}
+		return before
+	}
+
+	before := execsBefore()
+	exec, err := client.CreateExec(execOpts)
+	for attempt := 1; err != nil && attempt <= opts.CreateRetries; attempt++ {
+		select {
+		case <-time.After(execCreateRetryInterval):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if before != nil {
+			var ok bool
+			if exec, ok, err = unacknowledgedExec(ctx, client, inspect, execOpts, before); ok || err != nil {
+				continue
+			}
+		}
+		before = execsBefore()
+		exec, err = client.CreateExec(execOpts)
+	}
+	return exec, err
+}
+
+// containerExecIDs returns the IDs of the execs of the container.
+func containerExecIDs(ctx context.Context, client DockerInspectClient, containerID string) ([]string, error) {
+	container, err := client.InspectContainerWithContext(containerID, ctx)
+	if err != nil {
+		return nil, err
+	}
+	return container.ExecIDs, nil
+}
+
+// unacknowledgedExec returns the exec of the command of execOpts which was
+// added to the container since before, if there is exactly one and it
+// isn't running. An error means the execs couldn't be listed, which is a
+// failed attempt too.
+func unacknowledgedExec(ctx context.Context, client DockerClient, inspect DockerInspectClient, execOpts docker.CreateExecOptions, before map[string]bool) (*docker.Exec, bool, error) {
+	ids, err := containerExecIDs(ctx, inspect, execOpts.Container)
+	if err != nil {
+		return nil, false, err
+	}
+	var found []string
+	for _, id := range ids {
+		if before[id] {
+			continue
+		}
+		info, err := client.InspectExec(id)
+		if err != nil || info.ProcessConfig.Privileged != execOpts.Privileged {
+			continue
+		}
+		cmd := append([]string{info.ProcessConfig.EntryPoint}, info.ProcessConfig.Arguments...)
+		if !reflect.DeepEqual(cmd, execOpts.Cmd) {
+			continue
+		}
+		if info.Running {
+			return nil, false, nil
+		}
+		found = append(found, id)
+	}
+	if len(found) != 1 {
+		return nil, false, nil
+	}
+	return &docker.Exec{ID: found[0]}, true, nil
+}
+
+// lockedBuffer is a circbuf.Buffer which can be read while a command is
+// still writing to it.
+type lockedBuffer struct {
+	lock sync.Mutex
+	buf  *circbuf.Buffer
+
+	// lines counts the newlines written and partial is set if the last
+	// line written has no newline yet.
+	lines   int64
+	partial bool
+}
+
+// writerOutput passes the output of an exec on to the writer of
+// ExecOptions.Output. Nothing is captured for the result.
+type writerOutput struct {
+	lock sync.Mutex
+	w    io.Writer
+}
+
+func (o *writerOutput) Write(p []byte) (int, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return o.w.Write(p)
+}
+
+func (o *writerOutput) Bytes() []byte       { return nil }
+func (o *writerOutput) TotalWritten() int64 { return 0 }
+func (o *writerOutput) Lines() int64        { return 0 }
+
+// ByteBudget limits the bytes of output read from the Docker daemon by the
+// execs of one run of a check, including its hooks and the runs in every
+// container with its labels. A nil ByteBudget doesn't limit them.
+type ByteBudget struct {
+	limit int64
+	read  int64
+}
+
+// NewByteBudget creates a ByteBudget of limit bytes. It returns nil if limit
+// isn't positive.
+func NewByteBudget(limit int64) *ByteBudget {
+	if limit <= 0 {
+		return nil
+	}
+	return &ByteBudget{limit: limit}
+}
+
+// use takes n bytes from the budget and returns a ByteBudgetError if that
+// exceeds it.
+func (b *ByteBudget) use(n int) error {
+	if b == nil {
+		return nil
+	}
+	if atomic.AddInt64(&b.read, int64(n)) > b.limit {
+		return &ByteBudgetError{Limit: b.limit}
+	}
+	return nil
+}
+
+// ByteBudgetError is returned for an exec which read more output than its
+// ByteBudget allows.
+type ByteBudgetError struct {
+	Limit int64
+}
+
+func (e *ByteBudgetError) Error() string {
+	return fmt.Sprintf("Read more than %d bytes of output from the Docker daemon in one run of the check", e.Limit)
+}
+
+// budgetWriter takes the bytes written to w from a ByteBudget and fails
+// the write once it's used up, which ends the stream of the exec.
+type budgetWriter struct {
+	budget *ByteBudget
+	w      io.Writer
+}
+
+func (w *budgetWriter) Write(p []byte) (int, error) {
+	if err := w.budget.use(len(p)); err != nil {
+		return 0, err
+	}
+	return w.w.Write(p)
+}
+
+// newLockedBuffer creates a lockedBuffer of size bytes. An invalid size
+// falls back to CheckBufSize so that a sizing error loses output instead
+// of failing the check.
+func newLockedBuffer(size int64) *lockedBuffer {
+	buf, err := circbuf.NewBuffer(size)
+	if err != nil {
+		buf, _ = circbuf.NewBuffer(CheckBufSize)
+	}
+	return &lockedBuffer{buf: buf}
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if len(p) > 0 {
+		b.lines += int64(bytes.Count(p, []byte{'\n'}))
+		b.partial = p[len(p)-1] != '\n'
+	}
+	return b.buf.Write(p)
+}
+
+// Bytes returns a copy of the captured output since the buffer may still
+// be written to.
+func (b *lockedBuffer) Bytes() []byte {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return append([]byte(nil), b.buf.Bytes()...)
+}
+
+func (b *lockedBuffer) TotalWritten() int64 {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.TotalWritten()
+}
+
+// Lines returns the number of lines written, counting a last line
+// without a newline.
+func (b *lockedBuffer) Lines() int64 {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.partial {
+		return b.lines + 1
+	}
+	return b.lines
+}
+
+// Exec runs a command in a container and returns its exit code and
+// output. The exit code is only set if the command ran to completion but
+// the output captured so far is returned together with any error which
+// occurs after the exec has been created.
+func Exec(client DockerClient, opts ExecOptions) (*ExecResult, error) {
+	return execContext(context.Background(), client, opts)
+}
+
+// ExecWithTimeout runs a command like Exec but stops waiting for it after
+// timeout. On timeout the output captured so far is returned together with
+// an error and the exit code is not set. Docker has no way to cancel an
+// exec so the command is killed in the container with KillExecWithOptions.
+func ExecWithTimeout(client DockerClient, opts ExecOptions, timeout time.Duration) (*ExecResult, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	res, err := execContext(ctx, client, opts)
+	if err == context.DeadlineExceeded {
+		err = fmt.Errorf("Timed out running Exec after %s", timeout)
+	}
+	return res, err
+}
+
+// execContext runs a command in a container, between its PreCmd and
+// PostCmd, until it finishes or the context is done, in which case the
+// context's error is returned.
+func execContext(ctx context.Context, client DockerClient, opts ExecOptions) (*ExecResult, error) {
+	var warnings []string
+	if len(opts.PreCmd) > 0 {
+		if warning := runHookExec(ctx, client, opts, "Pre", opts.PreCmd); warning != "" {
+			warnings = append(warnings, warning)
+		}
+	}
+	res, err := execOne(ctx, client, opts)
+	if res != nil && len(res.Output) > 0 {
+		res.ContentType = opts.ContentType
+		if res.ContentType == "" {
+			res.ContentType = sniffContentType(res.Output)
+		}
+	}
+	if len(opts.PostCmd) > 0 && ctx.Err() == nil && err != ErrExecCancelled {
+		if warning := runHookExec(ctx, client, opts, "Post", opts.PostCmd); warning != "" {
+			warnings = append(warnings, warning)
+		}
+	}
+	if res != nil {
+		res.Warnings = warnings
+		res.SuccessExitCodes = opts.SuccessExitCodes
+		res.OutputEncoding = opts.OutputEncoding
+		if opts.Expect != nil && err == nil {
+			res.ExpectationFailure = opts.Expect.Check(decodeOutput(res.Stdout, opts.OutputEncoding))
+		}
+	}
+	return res, err
+}
+
+// sniffContentType returns the MIME type of the output of a command. JSON
+// is recognized since checks often print it, other types are sniffed like
+// HTTP responses.
+func sniffContentType(output []byte) string {
+	trimmed := bytes.TrimSpace(output)
+	if len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[') {
+		var v interface{}
+		if json.Unmarshal(trimmed, &v) == nil {
+			return "application/json"
+		}
+	}
+	return http.DetectContentType(output)
+}
+
+// runHookExec runs the PreCmd or PostCmd of an exec with the options of
+// the exec and returns a warning if it failed.
+func runHookExec(ctx context.Context, client DockerClient, opts ExecOptions, kind string, cmd []string) string {
+	opts.Cmd = cmd
+	opts.Output = nil
+	opts.Expect = nil
+	res, err := execOne(ctx, client, opts)
+	switch {
+	case err != nil:
+		return fmt.Sprintf("%s command %v failed: %s", kind, cmd, err)
+	case res.Failed():
+		return fmt.Sprintf("%s command %v exited with %d: %s", kind, cmd, res.ExitCode,
+			strings.TrimSpace(res.OutputString()))
+	}
+	return ""
+}
+
+// execOne runs a single command of execContext. A command which times out
+// or is cancelled is killed in its container.
+func execOne(ctx context.Context, client DockerClient, opts ExecOptions) (*ExecResult, error) {
+	var kill bool
+	var res *ExecResult
+	var execID string
+	var err error
+	started := time.Now()
+	if opts.Tracker == nil {
+		res, execID, err = runExec(ctx, client, opts)
+	} else {
+		var e *trackedExec
+		var done func()
+		ctx, e, done = opts.Tracker.track(ctx)
+		res, execID, err = runExec(ctx, client, opts)
+		done()
+		if err == context.Canceled && opts.Tracker.wasCancelled(e) {
+			err = ErrExecCancelled
+			kill = true
+		}
+	}
+	if err == context.DeadlineExceeded {
+		kill = true
+	}
+	if kill && execID != "" {
+		killCtx, cancel := context.WithTimeout(context.Background(), execKillTimeout+opts.KillGracePeriod)
+		KillExecWithOptions(killCtx, client, execID, KillOptions{
+			Signal:      opts.KillSignal,
+			GracePeriod: opts.KillGracePeriod,
+			StartedAt:   started,
+		})
+		cancel()
+	}
+	return res, err
+}
+
+// runExec does the work of execContext. It also returns the ID of the exec
+// once it has been created.
+func runExec(ctx context.Context, client DockerClient, opts ExecOptions) (*ExecResult, string, error) {
+	// Without a TTY and stdin the daemon doesn't process detach keys, so
+	// control sequences in the output of a check are passed through as-is.
+	execOpts := docker.CreateExecOptions{
+		AttachStdin:  false,
+		AttachStdout: true,
+		AttachStderr: !opts.DiscardStderr,
+		Tty:          false,
+		Cmd:          opts.Cmd,
+		Env:          opts.Env,
+		Container:    opts.ContainerID,
+		Privileged:   opts.Privileged,
+	}
+	if opts.breaker != nil {
+		if err := opts.breaker.check(); err != nil {
+			return nil, "", newExecError(ExecOpCreate, opts.ContainerID, "", err)
+		}
+	}
+	start := time.Now()
+	exec, err := createExec(ctx, client, opts, execOpts)
+	if err != nil {
+		return nil, "", newExecError(ExecOpCreate, opts.ContainerID, "", err)
+	}
+
+	// The attached connection StartExec uses can't be interrupted so the
+	// exec is started in the background and abandoned if ctx is done. The
+	// clients of the other runtimes stop with the context.
+	size := opts.MaxOutputBytes
+	if size <= 0 {
+		size = CheckBufSize
+	}
+	var output interface {
+		io.Writer
+		outputBuffer
+	}
+	if opts.Output != nil {
+		output = &writerOutput{w: opts.Output}
+	} else {
+		output = newLockedBuffer(size)
+	}
+	startOpts := docker.StartExecOptions{
+		Detach:       false,
+		Tty:          false,
+		OutputStream: output,
+		ErrorStream:  output,
+		Context:      ctx,
+	}
+
+	if opts.DiscardStderr {
+		// The daemon only sends stdout frames then, but make sure any
+		// stray stderr frame doesn't end up in the output.
+		startOpts.ErrorStream = ioutil.Discard
+	}
+
+	// The client demultiplexes the frames of the daemon, so the streams
+	// can be captured on their own too. stdout is captured for the
+	// expectation on it.
+	var stdout, stderr *lockedBuffer
+	if opts.SeparateStreams || opts.Expect != nil {
+		stdout = newLockedBuffer(size)
+		startOpts.OutputStream = io.MultiWriter(startOpts.OutputStream, stdout)
+	}
+	if opts.SeparateStreams && !opts.DiscardStderr {
+		stderr = newLockedBuffer(size)
+		startOpts.ErrorStream = io.MultiWriter(startOpts.ErrorStream, stderr)
+	}
+	result := func(containerID string, exitCode int, duration time.Duration) *ExecResult {
+		res := newExecResult(containerID, exitCode, duration, output)
+		if stdout != nil {
+			res.Stdout = stdout.Bytes()
+		}
+		if stderr != nil {
+			res.Stderr = stderr.Bytes()
+		}
+		return res
+	}
+	if opts.Budget != nil {
+		startOpts.OutputStream = &budgetWriter{budget: opts.Budget, w: startOpts.OutputStream}
+		startOpts.ErrorStream = &budgetWriter{budget: opts.Budget, w: startOpts.ErrorStream}
+	}
+	startCh := make(chan error, 1)
+	go func() {
+		startCh <- client.StartExec(exec.ID, startOpts)
+	}()
+	select {
+	case err := <-startCh:
+		if err != nil {
+			return result(opts.ContainerID, 0, time.Since(start)), exec.ID,
+				newExecError(ExecOpStart, opts.ContainerID, exec.ID, err)
+		}
+	case <-ctx.Done():
+		return result(opts.ContainerID, 0, time.Since(start)), exec.ID, ctx.Err()
+	}
+	duration := time.Since(start)
+
+	execInfo, err := waitExec(ctx, client, exec.ID, opts.PollInterval)
+	if err == context.DeadlineExceeded || err == context.Canceled {
+		return result(opts.ContainerID, 0, time.Since(start)), exec.ID, err
+	}
+	if err != nil {
+		return result(opts.ContainerID, 0, duration), exec.ID,
+			newExecError(ExecOpInspect, opts.ContainerID, exec.ID, err)
+	}
+
+	// The daemon reports the full ID of the container while the check
+	// may have been configured with a short ID.
+	containerID := execInfo.ContainerID
+	if containerID == "" {
+		containerID = opts.ContainerID
+	}
+	return result(containerID, execInfo.ExitCode, duration), exec.ID, nil
+}
+
+// Limits for the backoff between polls of a running exec in WaitExec.
+// Checks usually finish quickly so by default the first poll happens soon.
+// A larger initial interval is kept as is, even past the max.
+var (
+	execPollMinInterval = 10 * time.Millisecond
+	execPollMaxInterval = time.Second
+)
+
+// WaitExec blocks until the exec is no longer running and returns its exit
+// code. The exec is polled with a capped exponential backoff starting at
+// interval, or at a default of 10ms if interval is zero.
+func WaitExec(ctx context.Context, client DockerClient, execID string, interval time.Duration) (int, error) {
+	execInfo, err := waitExec(ctx, client, execID, interval)
+	if err != nil {
+		return 0, err
+	}
+	return execInfo.ExitCode, nil
+}
+
+// waitExec polls the exec until it is no longer running and returns the
+// last result of inspecting it.
+func waitExec(ctx context.Context, client DockerClient, execID string, interval time.Duration) (*docker.ExecInspect, error) {
+	wait := interval
+	if wait <= 0 {
+		wait = execPollMinInterval
+	}
+	for {
+		execInfo, err := client.InspectExec(execID)
+		if err != nil {
+			return nil, err
+		}
+		if !execInfo.Running {
+			return execInfo, nil
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if wait < execPollMaxInterval {
+			wait *= 2
+			if wait > execPollMaxInterval {
+				wait = execPollMaxInterval
+			}
+		}
+	}
+}
+
+// ErrKillExecUnsupported is returned by KillExec when the container doesn't
+// have the shell tools needed to find and signal the process of an exec.
+var ErrKillExecUnsupported = errors.New("Killing an Exec is not supported by the container")
+
+// killExecScript sends the signal $2 to the processes of execs in the
+// container whose command line is $3 and which started at most $1 seconds
+// ago, or at any time if $1 is 0, and to all of their descendants. It
+// exits with 1 if there was none. Docker has no API to signal an exec and
+// the Pid it reports is in the host's namespace, so the process is found
+// by its command line instead. The processes of execs are those whose
+// parent is outside of the container, which leaves out the application,
+// the processes it started and the runs of the command which started
+// before the exec.
+const killExecScript = `hz=$(getconf CLK_TCK 2>/dev/null) || hz=100
+[ -n "$hz" ] || hz=100
+read up _ < /proc/uptime
+up=${up%.*}
+procstat() {
+	s=$(cat "/proc/$1/stat" 2>/dev/null) || return 1
+	set -- ${s##*") "}
+	ppid=$2 start=${20}
+}
+roots=
+for p in /proc/[0-9]*; do
+	pid=${p#/proc/}
+	[ "$pid" != 1 ] && procstat "$pid" && [ "$ppid" = 0 ] || continue
+	[ "$1" = 0 ] || [ $((up - start / hz)) -le "$1" ] || continue
+	[ "$(tr '\0' ' ' < "$p/cmdline" 2>/dev/null)" = "$3" ] && roots="$roots$pid "
+done
+[ -n "$roots" ] || exit 1
+all=" $roots"
+more=1
+while [ -n "$more" ]; do
+	more=
+	for p in /proc/[0-9]*; do
+		pid=${p#/proc/}
+		case "$all" in *" $pid "*) continue ;; esac
+		procstat "$pid" || continue
+		case "$all" in *" $ppid "*) all="$all$pid " more=1 ;; esac
+	done
+done
+for pid in $all; do
+	kill -s "$2" "$pid" 2>/dev/null
+done
+exit 0`
+
+// defaultKillSignal is the signal an exec is killed with if none is set.
+const defaultKillSignal = "TERM"
+
+// killSignals are the signals an exec can be killed with.
+var killSignals = map[string]bool{
+	"ABRT": true,
+	"HUP":  true,
+	"INT":  true,
+	"KILL": true,
+	"QUIT": true,
+	"TERM": true,
+	"USR1": true,
+	"USR2": true,
+}
+
+// ParseKillSignal returns the name of a signal an exec can be killed with,
+// like "TERM", from a name with or without the "SIG" prefix in any case.
+// An empty name is TERM.
+func ParseKillSignal(name string) (string, error) {
+	if name == "" {
+		return defaultKillSignal, nil
+	}
+	signal := strings.TrimPrefix(strings.ToUpper(name), "SIG")
+	if !killSignals[signal] {
+		return "", fmt.Errorf("Invalid kill signal %q", name)
+	}
+	return signal, nil
+}
+
+// errNoExecProcess is returned by signalExec when no process in the
+// container runs the command of the exec.
+var errNoExecProcess = errors.New("No process found")
+
+// KillOptions configure how KillExecWithOptions terminates an exec.
+type KillOptions struct {
+	// Signal is the signal sent to the process first, see
+	// ParseKillSignal. Empty is TERM.
+	Signal string
+
+	// GracePeriod, if positive, is how long the process has to exit after
+	// Signal before it's sent KILL.
+	GracePeriod time.Duration
+
+	// StartedAt, if set, is when the exec was started. Runs of the same
+	// command which started before are left alone.
+	StartedAt time.Time
+}
+
+// KillExec makes a best-effort attempt to terminate the process of a
+// running exec with SIGTERM, see KillExecWithOptions. Without a start time
+// every exec running the same command in the container is signaled.
+func KillExec(ctx context.Context, client DockerClient, execID string) error {
+	return KillExecWithOptions(ctx, client, execID, KillOptions{})
+}
+
+// KillExecWithOptions makes a best-effort attempt to terminate the process
+// of a running exec by running kill through another exec in the same
+// container. The process is found by the command of the exec, so every
+// other exec running the same command in the container is signaled too,
+// unless it started before opts.StartedAt. Processes started by the
+// application aren't signaled, even if they run the same command. The
+// descendants of the signaled processes are signaled too, and all of them
+// are sent KILL if the exec is still running once the grace period is
+// over. It returns ErrKillExecUnsupported if the daemon doesn't report the
+// command of the exec or the container has no /bin/sh.
+func KillExecWithOptions(ctx context.Context, client DockerClient, execID string, opts KillOptions) error {
+	signal, err := ParseKillSignal(opts.Signal)
+	if err != nil {
+		return err
+	}
+	execInfo, err := client.InspectExec(execID)
+	if err != nil {
+		return newExecError(ExecOpInspect, "", execID, err)
+	}
+	if !execInfo.Running {
+		return nil
+	}
+	if err := signalExec(ctx, client, execID, execInfo, signal, opts.StartedAt); err != nil {
+		if err == errNoExecProcess {
+			return fmt.Errorf("No process found for Exec %s", execID)
+		}
+		return err
+	}
+	if opts.GracePeriod <= 0 || signal == "KILL" {
+		return nil
+	}
+
+	deadline := time.Now().Add(opts.GracePeriod)
+	for time.Now().Before(deadline) {
+		select {
+		case <-time.After(execKillPollInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		execInfo, err = client.InspectExec(execID)
+		if err != nil {
+			return newExecError(ExecOpInspect, "", execID, err)
+		}
+		if !execInfo.Running {
+			return nil
+		}
+	}
+	if err := signalExec(ctx, client, execID, execInfo, "KILL", opts.StartedAt); err != nil && err != errNoExecProcess {
+		return err
+	}
+	return nil
+}
+
+// signalExec sends the signal to the processes of execs running the
+// command of the exec which started since startedAt, if it's set.
+func signalExec(ctx context.Context, client DockerClient, execID string, execInfo *docker.ExecInspect, signal string, startedAt time.Time) error {
+	proc := execInfo.ProcessConfig
+	if proc.EntryPoint == "" {
+		return ErrKillExecUnsupported
+	}
+
+	// The age is rounded up and has a second to spare since the start
+	// time of a process is only known to the tick in the container.
+	maxAge := 0
+	if !startedAt.IsZero() {
+		maxAge = int(time.Since(startedAt)/time.Second) + 2
+	}
+
+	// /proc/<pid>/cmdline has a NUL after every argument, which the
+	// script turns into spaces.
+	cmdline := strings.Join(append([]string{proc.EntryPoint}, proc.Arguments...), " ") + " "
+	// The kill exec is run directly so that it isn't killed itself if it
+	// times out.
+	res, _, err := runExec(ctx, client, ExecOptions{
+		ContainerID: execInfo.ContainerID,
+		Cmd:         []string{"/bin/sh", "-c", killExecScript, "sh", strconv.Itoa(maxAge), signal, cmdline},
+		Privileged:  proc.Privileged,
+	})
+	if err != nil {
+		return err
+	}
+	switch res.ExitCode {
+	case 0:
+		return nil
+	case 1:
+		return errNoExecProcess
+	case 126, 127:
+		return ErrKillExecUnsupported
+	default:
+		return fmt.Errorf("Unable to kill Exec %s, exit code %d: %s", execID, res.ExitCode, res.OutputString())
+	}
+}
+
+// DockerInspectClient defines the operations of a docker client which are
+// needed to query the state of a container. It is used for injecting a
+// fake client during tests.
+type DockerInspectClient interface {
+	InspectContainerWithContext(string, context.Context) (*docker.Container, error)
+}
+
+// ContainerInfo is the subset of a container's state that checks care
+// about.
+type ContainerInfo struct {
+	ID   string
+	Name string
+
+	// State is one of "created", "running", "paused", "restarting",
+	// "exited" or "dead".
+	State string
+
+	// Health is the status reported by the container's own health
+	// check, or empty if the image doesn't define one.
+	Health string
+
+	RestartCount int
+	Pid          int
+
+	// StartedAt is when the container was last started, or the zero time
+	// if it never was.
+	StartedAt time.Time
+
+	// Ports maps the published ports of the container, such as
+	// "8080/tcp", to the host addresses they are mapped to.
+	Ports map[string][]string
+
+	// Labels are the labels of the container.
+	Labels map[string]string
+}
+
+// InspectContainer returns the state of the given container.
+func InspectContainer(ctx context.Context, client DockerInspectClient, containerID string) (ContainerInfo, error) {
+	container, err := client.InspectContainerWithContext(containerID, ctx)
+	if err != nil {
+		return ContainerInfo{}, fmt.Errorf("Unable to inspect container: %s", err)
+	}
+	info := ContainerInfo{
+		ID:           container.ID,
+		Name:         strings.TrimPrefix(container.Name, "/"),
+		State:        container.State.StateString(),
+		Health:       container.State.Health.Status,
+		RestartCount: container.RestartCount,
+		Pid:          container.State.Pid,
+		StartedAt:    container.State.StartedAt,
+	}
+	if container.Config != nil {
+		info.Labels = container.Config.Labels
+	}
+	if container.NetworkSettings != nil {
+		for port, bindings := range container.NetworkSettings.Ports {
+			if len(bindings) == 0 {
+				continue
+			}
+			if info.Ports == nil {
+				info.Ports = make(map[string][]string)
+			}
+			for _, b := range bindings {
+				info.Ports[string(port)] = append(info.Ports[string(port)], net.JoinHostPort(b.HostIP, b.HostPort))
+			}
+		}
+	}
+	return info, nil
+}
+
+// ContainerPortAddress returns the host address a port of the container
+// is published on, so that an HTTP or TCP check can probe it without
+// hardcoding the mapped port. The port is given as "8080/tcp", or just
+// "8080" for TCP. A port published on all interfaces is returned with the
+// loopback address, which assumes the Docker daemon is on the agent's host.
+func ContainerPortAddress(ctx context.Context, client DockerInspectClient, containerID, port string) (string, error) {
+	if !strings.Contains(port, "/") {
+		port += "/tcp"
+	}
+	info, err := InspectContainer(ctx, client, containerID)
+	if err != nil {
+		return "", err
+	}
+	host, hostPort, err := info.PublishedAddress(port)
+	if err != nil {
+		return "", err
+	}
+	switch host {
+	case "", "0.0.0.0":
+		host = "127.0.0.1"
+	case "::":
+		host = "::1"
+	}
+	return net.JoinHostPort(host, hostPort), nil
+}
+
+// PublishedAddress returns the host IP and port the port of the container,
+// such as "8080/tcp", is published on. The IP is unspecified for a port
+// published on all interfaces.
+func (info ContainerInfo) PublishedAddress(port string) (host, hostPort string, err error) {
+	addrs := info.Ports[port]
+	if len(addrs) == 0 {
+		return "", "", fmt.Errorf("Port %s of container %s is not published", port, info.ID)
+	}
+	return net.SplitHostPort(addrs[0])
+}
+
+// ContainerRestartCount returns the number of times the daemon restarted
+// the container. A count that goes up between two runs of a check means
+// the container is crash looping, even if the check passes while it's up.
+func ContainerRestartCount(client DockerInspectClient, containerID string) (int, error) {
+	info, err := InspectContainer(context.Background(), client, containerID)
+	if err != nil {
+		return 0, err
+	}
+	return info.RestartCount, nil
+}
+
+// A container which restarted dockerRestartLoopCount times within
+// dockerRestartLoopWindow is considered to be in a restart loop.
+const (
+	dockerRestartLoopCount  = 3
+	dockerRestartLoopWindow = time.Minute
+)
+
+// restartTracker keeps the restart counts of a container seen over the
+// last dockerRestartLoopWindow to tell how often it restarted.
+type restartTracker struct {
+	samples []restartSample
+}
+
+type restartSample struct {
+	at    time.Time
+	count int
+}
+
+// observe records the restart count of the container at now and returns
+// how many times it restarted within the window. A count lower than
+// before, as for a recreated container, starts over.
+func (r *restartTracker) observe(now time.Time, count int) int {
+	keep := r.samples[:0]
+	for _, s := range r.samples {
+		if now.Sub(s.at) <= dockerRestartLoopWindow && s.count <= count {
+			keep = append(keep, s)
+		}
+	}
+	r.samples = append(keep, restartSample{at: now, count: count})
+	return count - r.samples[0].count
+}
+
+// containerVerdict judges the state of a container which restarted the
+// given number of times within dockerRestartLoopWindow. It returns the
+// status and a summary of the state, and whether the container is in a
+// state to be probed at all. A container which isn't running, is
+// restarting in a loop or is unhealthy by its own health check is
+// critical without a probe.
+func containerVerdict(info ContainerInfo, restarts int) (string, string, bool) {
+	switch {
+	case info.State != "running":
+		if restarts > 0 {
+			return api.HealthCritical, fmt.Sprintf("container %s, restarted %dx in %v",
+				info.State, restarts, dockerRestartLoopWindow), false
+		}
+		return api.HealthCritical, "container " + info.State, false
+	case restarts >= dockerRestartLoopCount:
+		return api.HealthCritical, fmt.Sprintf("container restarting %dx in %v", restarts, dockerRestartLoopWindow), false
+	case info.Health == "unhealthy":
+		return api.HealthCritical, "container unhealthy", false
+	case info.Health == "":
+		return api.HealthPassing, "container running", true
+	default:
+		return api.HealthPassing, "container " + info.Health, true
+	}
+}
+
+// DockerLogsClient defines the operation of a docker client which reads
+// the logs of a container. It is used for injecting a fake client during
+// tests.
+type DockerLogsClient interface {
+	Logs(docker.LogsOptions) error
+}
+
+// ContainerLogs returns the last tail lines the container logged to stdout
+// and stderr, oldest first, so that a check can look for errors in them
+// instead of running a probe. Only the last maxBytes of the logs are kept,
+// or CheckBufSize if it isn't positive, and a line cut off by that limit
+// is dropped. A tail of zero or less returns all of the logs.
+func ContainerLogs(ctx context.Context, client DockerLogsClient, containerID string, tail int, maxBytes int64) ([]string, error) {
+	if maxBytes <= 0 {
+		maxBytes = CheckBufSize
+	}
+	tailOpt := "all"
+	if tail > 0 {
+		tailOpt = strconv.Itoa(tail)
+	}
+
+	// The logs of a container without a TTY use the same multiplexed
+	// framing as the output of an exec, which the client demuxes.
+	output := newLockedBuffer(maxBytes)
+	err := client.Logs(docker.LogsOptions{
+		Context:      ctx,
+		Container:    containerID,
+		OutputStream: output,
+		ErrorStream:  output,
+		Tail:         tailOpt,
+		Stdout:       true,
+		Stderr:       true,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read container logs: %s", err)
+	}
+
+	logs := string(output.Bytes())
+	if output.TotalWritten() > maxBytes {
+		if i := strings.IndexByte(logs, '\n'); i >= 0 {
+			logs = logs[i+1:]
+		} else {
+			logs = ""
+		}
+	}
+	logs = strings.TrimSuffix(logs, "\n")
+	if logs == "" {
+		return nil, nil
+	}
+	return strings.Split(logs, "\n"), nil
+}
+
+// DockerListClient defines the operation of a docker client which lists
+// containers. It is used for injecting a fake client during tests.
+type DockerListClient interface {
+	ListContainers(docker.ListContainersOptions) ([]docker.APIContainers, error)
+}
+
+// ResolveContainers returns the IDs of the running containers which have
+// all of the labels, each given as "key=value" or as "key" for a label
+// with any value. The IDs are sorted so a check probes the containers in
+// the same order on every run.
+func ResolveContainers(client DockerListClient, labels []string) ([]string, error) {
+	ids, _, err := ResolveAllowedContainers(client, labels, nil)
+	return ids, err
+}
+
+// ResolveAllowedContainers resolves the containers with the labels like
+// ResolveContainers and returns the containers the policy doesn't allow
+// separately, sorted by ID too.
+func ResolveAllowedContainers(client DockerListClient, labels []string, policy *ContainerPolicy) ([]string, []*ContainerPolicyError, error) {
+	containers, err := client.ListContainers(docker.ListContainersOptions{
+		Filters: map[string][]string{
+			"label":  labels,
+			"status": {"running"},
+		},
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("Unable to list containers: %s", err)
+	}
+	sort.Slice(containers, func(i, j int) bool { return containers[i].ID < containers[j].ID })
+	ids := make([]string, 0, len(containers))
+	var denied []*ContainerPolicyError
+	for _, container := range containers {
+		if !policy.allowsListed(container) {
+			name := ""
+			if len(container.Names) > 0 {
+				name = strings.TrimPrefix(container.Names[0], "/")
+			}
+			denied = append(denied, &ContainerPolicyError{ContainerID: container.ID, Name: name})
+			continue
+		}
+		ids = append(ids, container.ID)
+	}
+	return ids, denied, nil
+}
+
+// ContainerPolicy limits the containers Docker checks may run in. A nil
+// ContainerPolicy allows every container.
+type ContainerPolicy struct {
+	names  []string
+	labels []string
+}
+
+// NewContainerPolicy returns the policy which allows the containers whose
+// name matches one of the patterns of names, as in path.Match, or which
+// have one of the labels, each "key=value" or just "key" for a label with
+// any value. It returns nil if both are empty.
+func NewContainerPolicy(names, labels []string) (*ContainerPolicy, error) {
+	if len(names) == 0 && len(labels) == 0 {
+		return nil, nil
+	}
+	for _, pattern := range names {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("Invalid allowed container name %q: %v", pattern, err)
+		}
+	}
+	for _, label := range labels {
+		if label == "" || strings.HasPrefix(label, "=") {
+			return nil, fmt.Errorf("Invalid allowed container label %q", label)
+		}
+	}
+	return &ContainerPolicy{names: names, labels: labels}, nil
+}
+
+// ContainerPolicyError is returned for a container which a check targets
+// but the ContainerPolicy doesn't allow.
+type ContainerPolicyError struct {
+	ContainerID string
+	Name        string
+}
+
+func (e *ContainerPolicyError) Error() string {
+	name := e.ContainerID
+	if e.Name != "" {
+		name = e.Name
+	}
+	return fmt.Sprintf("Container %q is not allowed by the allowed_container_names and allowed_container_labels of docker_config", name)
+}
+
+// Allows returns whether a container with the name and labels is allowed.
+func (p *ContainerPolicy) Allows(name string, labels map[string]string) bool {
+	if p == nil {
+		return true
+	}
+	name = strings.TrimPrefix(name, "/")
+	for _, pattern := range p.names {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	for _, label := range p.labels {
+		key, value, any := splitLabel(label)
+		if v, ok := labels[key]; ok && (any || v == value) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsListed returns whether a listed container is allowed under any of
+// its names.
+func (p *ContainerPolicy) allowsListed(container docker.APIContainers) bool {
+	if p == nil {
+		return true
+	}
+	if len(container.Names) == 0 {
+		return p.Allows("", container.Labels)
+	}
+	for _, name := range container.Names {
+		if p.Allows(name, container.Labels) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsSelector returns whether every container with the labels of a
+// label selector, as in ResolveContainers, is allowed because the
+// selector requires one of the allowed labels. A selector which doesn't
+// may still find containers which are allowed by their name.
+func (p *ContainerPolicy) AllowsSelector(selector []string) bool {
+	if p == nil {
+		return true
+	}
+	for _, label := range p.labels {
+		key, value, any := splitLabel(label)
+		for _, s := range selector {
+			k, v, sAny := splitLabel(s)
+			if k == key && (any || (!sAny && v == value)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// MatchesNames returns whether the policy allows containers by name, so
+// containers can't be ruled out before their names are known.
+func (p *ContainerPolicy) MatchesNames() bool {
+	return p != nil && len(p.names) > 0
+}
+
+// CheckContainer inspects the container and returns a
+// *ContainerPolicyError if the policy doesn't allow it.
+func (p *ContainerPolicy) CheckContainer(ctx context.Context, client DockerClient, containerID string) error {
+	if p == nil {
+		return nil
+	}
+	inspect, ok := client.(DockerInspectClient)
+	if !ok {
+		return fmt.Errorf("Docker client does not support inspecting containers")
+	}
+	info, err := InspectContainer(ctx, inspect, containerID)
+	if err != nil {
+		return err
+	}
+	return p.checkContainer(containerID, &info)
+}
+
+// checkContainer is CheckContainer for a container which was already
+// inspected, or which couldn't be since the client can't inspect if info
+// is nil.
+func (p *ContainerPolicy) checkContainer(containerID string, info *ContainerInfo) error {
+	if p == nil {
+		return nil
+	}
+	if info == nil {
+		return fmt.Errorf("Docker client does not support inspecting containers")
+	}
+	if !p.Allows(info.Name, info.Labels) {
+		return &ContainerPolicyError{ContainerID: containerID, Name: info.Name}
+	}
+	return nil
+}
+
+// splitLabel splits a label given as "key=value", or as "key" for any
+// value, in which case any is true.
+func splitLabel(label string) (key, value string, any bool) {
+	i := strings.Index(label, "=")
+	if i < 0 {
+		return label, "", true
+	}
+	return label[:i], label[i+1:], false
+}
+
+// ContainerResult is the result of running a command in one of several
+// containers. Result may be nil if the command could not be started.
+type ContainerResult struct {
+	ContainerID string
+	Result      *ExecResult
+	Err         error
+}
+
+// status returns the status of the run, using the exit codes like
+// ExecResult.Status.
+func (r ContainerResult) status(warningExitCodes []int) string {
+	if r.Err != nil {
+		return api.HealthCritical
+	}
+	return r.Result.Status(warningExitCodes)
+}
+
+// AggregateResults combines the results of a command run in several
+// containers. The status is passing if the command passed in every
+// container and the worst status otherwise. The output starts with the
+// containers which didn't pass, followed by the output of every run.
+func AggregateResults(results []ContainerResult, warningExitCodes []int) (string, string) {
+	status := api.HealthPassing
+	var failing []string
+	var sections []string
+	for _, r := range results {
+		s := r.status(warningExitCodes)
+		switch {
+		case s == api.HealthCritical:
+			status = api.HealthCritical
+		case s == api.HealthWarning && status == api.HealthPassing:
+			status = api.HealthWarning
+		}
+		if s != api.HealthPassing {
+			failing = append(failing, r.ContainerID)
+		}
+
+		var out []string
+		if r.Err != nil {
+			out = append(out, r.Err.Error())
+		}
+		if r.Result != nil && len(r.Result.Output) > 0 {
+			out = append(out, r.Result.OutputString())
+		}
+		sections = append(sections, fmt.Sprintf("Container %s: %s\n%s", r.ContainerID, s, strings.Join(out, "\n")))
+	}
+
+	output := strings.Join(sections, "\n")
+	if len(failing) > 0 {
+		output = fmt.Sprintf("%d of %d containers are failing: %s\n%s",
+			len(failing), len(results), strings.Join(failing, ", "), output)
+	}
+	return status, output
+}
+
+// DockerContainerClient defines the container operations of a docker
+// client which are needed to run one-off containers. It is used for
+// injecting a fake client during tests.
+type DockerContainerClient interface {
+	CreateContainer(docker.CreateContainerOptions) (*docker.Container, error)
+	StartContainerWithContext(string, *docker.HostConfig, context.Context) error
+	WaitContainerWithContext(string, context.Context) (int, error)
+	Logs(docker.LogsOptions) error
+	RemoveContainer(docker.RemoveContainerOptions) error
+}
+
+// RunContainerOptions configures the one-off container started by
+// RunContainer.
+type RunContainerOptions struct {
+	// Image is the image the container is created from.
+	Image string
+
+	// Cmd is the command to run. The default command of the image is
+	// used when empty.
+	Cmd []string
+
+	// Memory is the memory limit of the container in bytes. Zero means
+	// no limit.
+	Memory int64
+
+	// CPUShares is the relative CPU weight of the container. Zero means
+	// the daemon default.
+	CPUShares int64
+
+	// PidsLimit is the maximum number of processes in the container.
+	// Zero means no limit.
+	PidsLimit int64
+
+	// AutoRemove removes the container once its output has been
+	// collected.
+	AutoRemove bool
+
+	// PidContainerID, if set, joins the container to the PID namespace of
+	// that container so that a diagnostic image can probe the processes
+	// of an application container without the tools being in its image.
+	PidContainerID string
+}
+
+// RunContainer creates and starts a container, waits until it exits and
+// returns its exit code and output. The daemon side AutoRemove flag is
+// not used since the logs can only be read after the container has
+// exited. Instead, the container is removed by RunContainer when
+// opts.AutoRemove is set, even if running it failed.
+func RunContainer(ctx context.Context, client DockerContainerClient, opts RunContainerOptions) (*ExecResult, error) {
+	hostConfig := &docker.HostConfig{
+		Memory:    opts.Memory,
+		CPUShares: opts.CPUShares,
+		PidsLimit: opts.PidsLimit,
+	}
+	if opts.PidContainerID != "" {
+		hostConfig.PidMode = "container:" + opts.PidContainerID
+	}
+	container, err := client.CreateContainer(docker.CreateContainerOptions{
+		Config: &docker.Config{
+			Image:        opts.Image,
+			Cmd:          opts.Cmd,
+			AttachStdout: true,
+			AttachStderr: true,
+		},
+		HostConfig: hostConfig,
+		Context:    ctx,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create container: %s", err)
+	}
+	if opts.AutoRemove {
+		defer client.RemoveContainer(docker.RemoveContainerOptions{ID: container.ID, Force: true})
+	}
+
+	start := time.Now()
+	if err := client.StartContainerWithContext(container.ID, hostConfig, ctx); err != nil {
+		return nil, fmt.Errorf("Unable to start container: %s", err)
+	}
+
+	exitCode, err := client.WaitContainerWithContext(container.ID, ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to wait for container: %s", err)
+	}
+
+	duration := time.Since(start)
+
+	output := newLockedBuffer(CheckBufSize)
+	err = client.Logs(docker.LogsOptions{
+		Context:      ctx,
+		Container:    container.ID,
+		OutputStream: output,
+		ErrorStream:  output,
+		Stdout:       true,
+		Stderr:       true,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read container logs: %s", err)
+	}
+	return newExecResult(container.ID, exitCode, duration, output), nil
+}
@@ -0,0 +1,143 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/types"
+)
+
+// defaultDockerAuditLogMaxBytes is the size an audit log of a Docker check
+// is rotated at if no size is configured.
+const defaultDockerAuditLogMaxBytes = 10 * 1024 * 1024
+
+// dockerAuditRecord is a line of the audit log of a Docker check.
+type dockerAuditRecord struct {
+	Time        time.Time
+	CheckID     types.CheckID
+	ContainerID string
+	Cmd         []string
+	ExitCode    int
+	Duration    string
+	Output      string
+	Error       string `json:",omitempty"`
+}
+
+// dockerAuditLog is an append-only log of the runs of a Docker check. When
+// the file grows past maxBytes it's renamed with a ".1" suffix, replacing
+// the previous one, and a new file is started.
+type dockerAuditLog struct {
+	path     string
+	checkID  types.CheckID
+	maxBytes int64
+	redact   []*regexp.Regexp
+
+	lock sync.Mutex
+}
+
+// newDockerAuditLog returns the audit log of the check in dir. The file is
+// named after the hash of the check ID, like the persisted checks.
+func newDockerAuditLog(dir string, checkID types.CheckID, maxBytes int64, redact []string) (*dockerAuditLog, error) {
+	if maxBytes <= 0 {
+		maxBytes = defaultDockerAuditLogMaxBytes
+	}
+	l := &dockerAuditLog{
+		path:     filepath.Join(dir, checkIDHash(checkID)+".log"),
+		checkID:  checkID,
+		maxBytes: maxBytes,
+	}
+	var err error
+	if l.redact, err = compileRedactions(redact); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// compileRedactions compiles the audit_redact regular expressions.
+func compileRedactions(exprs []string) ([]*regexp.Regexp, error) {
+	var redact []*regexp.Regexp
+	for _, expr := range exprs {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid audit redaction %q: %v", expr, err)
+		}
+		redact = append(redact, re)
+	}
+	return redact, nil
+}
+
+// redactString replaces the matches of the redaction rules in s.
+func redactString(redact []*regexp.Regexp, s string) string {
+	for _, re := range redact {
+		s = re.ReplaceAllString(s, redactedValue)
+	}
+	return s
+}
+
+// redactArgs returns a copy of the command with the redaction rules
+// applied to each argument.
+func redactArgs(redact []*regexp.Regexp, cmd []string) []string {
+	if cmd == nil {
+		return nil
+	}
+	args := make([]string, len(cmd))
+	for i, arg := range cmd {
+		args[i] = redactString(redact, arg)
+	}
+	return args
+}
+
+// redactString replaces the matches of the redaction rules.
+func (l *dockerAuditLog) redactString(s string) string {
+	return redactString(l.redact, s)
+}
+
+// Write appends a record of a run of the check. The result may be nil if
+// the exec could not be created.
+func (l *dockerAuditLog) Write(containerID string, cmd []string, res *ExecResult, execErr error) error {
+	rec := dockerAuditRecord{
+		Time:        time.Now().UTC(),
+		CheckID:     l.checkID,
+		ContainerID: containerID,
+	}
+	rec.Cmd = redactArgs(l.redact, cmd)
+	if res != nil {
+		rec.ContainerID = res.ContainerID
+		rec.ExitCode = res.ExitCode
+		rec.Duration = res.Duration.String()
+		rec.Output = l.redactString(res.OutputString())
+	}
+	if execErr != nil {
+		rec.Error = l.redactString(execErr.Error())
+	}
+	buf, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	buf = append(buf, '\n')
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if fi, err := os.Stat(l.path); err == nil && fi.Size()+int64(len(buf)) > l.maxBytes {
+		if err := os.Rename(l.path, l.path+".1"); err != nil {
+			return err
+		}
+	}
+	fh, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := fh.Write(buf); err != nil {
+		fh.Close()
+		return err
+	}
+	return fh.Close()
+}
@@ -0,0 +1,73 @@
+package agent
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/consul/testutil"
+)
+
+func TestDockerAuditLog(t *testing.T) {
+	t.Parallel()
+	dir := testutil.TempDir(t, "docker-audit")
+	defer os.RemoveAll(dir)
+
+	l, err := newDockerAuditLog(dir, "foo", 0, []string{`password=\S+`})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	res := &ExecResult{ContainerID: "54432bad1fc7", ExitCode: 1, Output: []byte("login password=hunter2 failed")}
+	if err := l.Write("54432bad1fc7", []string{"login", "password=hunter2"}, res, nil); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := l.Write("54432bad1fc7", []string{"login"}, nil, fmt.Errorf("no such container")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	fh, err := os.Open(l.path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer fh.Close()
+	var recs []dockerAuditRecord
+	scanner := bufio.NewScanner(fh)
+	for scanner.Scan() {
+		var rec dockerAuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		recs = append(recs, rec)
+	}
+	if len(recs) != 2 {
+		t.Fatalf("got %d records", len(recs))
+	}
+	if got, want := recs[0].Cmd[1], "<hidden>"; got != want {
+		t.Fatalf("got cmd arg %q want %q", got, want)
+	}
+	if got, want := recs[0].Output, "login <hidden> failed"; got != want {
+		t.Fatalf("got output %q want %q", got, want)
+	}
+	if recs[0].CheckID != "foo" || recs[0].ExitCode != 1 {
+		t.Fatalf("bad record: %#v", recs[0])
+	}
+	if got, want := recs[1].Error, "no such container"; got != want {
+		t.Fatalf("got error %q want %q", got, want)
+	}
+
+	// A write past the size limit rotates the log.
+	l.maxBytes = 1
+	if err := l.Write("54432bad1fc7", []string{"date"}, res, nil); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := os.Stat(l.path + ".1"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if _, err := newDockerAuditLog(dir, "foo", 0, []string{"("}); err == nil || !strings.Contains(err.Error(), "Invalid audit redaction") {
+		t.Fatalf("got error %v", err)
+	}
+}
@@ -0,0 +1,159 @@
+package agent
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// dockerBreakerWindow is the number of the last requests to the Docker
+	// daemon whose error rate is tracked by the breaker.
+	dockerBreakerWindow = 20
+
+	// dockerBreakerMinRequests is the number of requests the breaker
+	// needs to have tracked before it opens, so that a single error of
+	// an idle agent doesn't open it.
+	dockerBreakerMinRequests = 10
+
+	// dockerBreakerDefaultCooldown is how long the breaker stays open if
+	// BreakerCooldown isn't set.
+	dockerBreakerDefaultCooldown = 30 * time.Second
+)
+
+// DockerUnavailableError is returned for the requests to the Docker daemon
+// which aren't sent because the breaker is open.
+type DockerUnavailableError struct {
+	Until time.Time
+}
+
+func (e *DockerUnavailableError) Error() string {
+	return fmt.Sprintf("Docker daemon is unavailable after repeated errors, not sending requests until %s",
+		e.Until.Format(time.RFC3339))
+}
+
+// Timeout and Temporary make the error a net.Error, so checks failing with
+// it get the InfrastructureStatus.
+func (e *DockerUnavailableError) Timeout() bool   { return false }
+func (e *DockerUnavailableError) Temporary() bool { return true }
+
+// dockerBreaker tracks the error rate of the last requests to the Docker
+// daemon. Once it reaches rate the breaker opens and requests fail right
+// away for the cooldown. Then a single request is let through to probe the
+// daemon, which closes the breaker if it succeeds and opens it again if it
+// fails.
+type dockerBreaker struct {
+	rate     float64
+	cooldown time.Duration
+	logger   *log.Logger
+	now      func() time.Time
+
+	lock      sync.Mutex
+	outcomes  []bool
+	next      int
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+func newDockerBreaker(rate float64, cooldown time.Duration, logger *log.Logger) *dockerBreaker {
+	if cooldown <= 0 {
+		cooldown = dockerBreakerDefaultCooldown
+	}
+	return &dockerBreaker{rate: rate, cooldown: cooldown, logger: logger, now: time.Now}
+}
+
+// allow returns whether a request may be sent and whether it's the probe
+// of an open breaker.
+func (b *dockerBreaker) allow() (probe bool, err error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.openUntil.IsZero() {
+		return false, nil
+	}
+	if b.probing || b.now().Before(b.openUntil) {
+		return false, &DockerUnavailableError{Until: b.openUntil}
+	}
+	b.probing = true
+	return true, nil
+}
+
+// check returns an error while the breaker is open, like allow, without
+// taking the probe of an open breaker whose cooldown is over. It's for
+// requests the breaker doesn't see the outcome of.
+func (b *dockerBreaker) check() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.openUntil.IsZero() {
+		return nil
+	}
+	if b.probing || b.now().Before(b.openUntil) {
+		return &DockerUnavailableError{Until: b.openUntil}
+	}
+	return nil
+}
+
+// record tracks the outcome of a request which was sent.
+func (b *dockerBreaker) record(failed, probe bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if probe {
+		b.probing = false
+		if failed {
+			b.open()
+			return
+		}
+		b.logger.Printf("[INFO] agent: Docker daemon responded again, closing the circuit breaker")
+		b.openUntil = time.Time{}
+		b.outcomes, b.next, b.failures = nil, 0, 0
+		return
+	}
+	if !b.openUntil.IsZero() {
+		return
+	}
+
+	if len(b.outcomes) < dockerBreakerWindow {
+		b.outcomes = append(b.outcomes, failed)
+	} else {
+		if b.outcomes[b.next] {
+			b.failures--
+		}
+		b.outcomes[b.next] = failed
+		b.next = (b.next + 1) % dockerBreakerWindow
+	}
+	if failed {
+		b.failures++
+	}
+	if len(b.outcomes) >= dockerBreakerMinRequests && float64(b.failures) >= b.rate*float64(len(b.outcomes)) {
+		b.logger.Printf("[WARN] agent: %d of the last %d requests to the Docker daemon failed, opening the circuit breaker for %s",
+			b.failures, len(b.outcomes), b.cooldown)
+		b.open()
+	}
+}
+
+func (b *dockerBreaker) open() {
+	b.openUntil = b.now().Add(b.cooldown)
+}
+
+// breakerTransport fails the requests to the Docker daemon while the
+// breaker is open. Errors and server errors of the daemon count as
+// failures.
+type breakerTransport struct {
+	breaker *dockerBreaker
+	base    http.RoundTripper
+}
+
+func (t *breakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	probe, err := t.breaker.allow()
+	if err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	resp, err := t.base.RoundTrip(req)
+	t.breaker.record(err != nil || resp.StatusCode >= 500, probe)
+	return resp, err
+}
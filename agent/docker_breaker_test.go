@@ -0,0 +1,242 @@
+package agent
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// fakeBreakerTransport fails its requests while failing is set.
+type fakeBreakerTransport struct {
+	failing bool
+	status  int
+	calls   int
+}
+
+func (t *fakeBreakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.calls++
+	if t.failing {
+		return nil, errors.New("connection refused")
+	}
+	status := t.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	return &http.Response{StatusCode: status, Body: http.NoBody}, nil
+}
+
+func TestBreakerTransport(t *testing.T) {
+	t.Parallel()
+	now := time.Unix(1000, 0)
+	breaker := newDockerBreaker(0.5, time.Minute, log.New(ioutil.Discard, "", 0))
+	breaker.now = func() time.Time { return now }
+	base := &fakeBreakerTransport{}
+	tr := &breakerTransport{breaker: breaker, base: base}
+	req, _ := http.NewRequest("GET", "http://docker/exec/123/json", nil)
+
+	// Half of the requests fail, the breaker opens on the tenth.
+	for i := 0; i < 10; i++ {
+		base.failing = i%2 == 0
+		tr.RoundTrip(req)
+	}
+	if base.calls != 10 {
+		t.Fatalf("got %d calls", base.calls)
+	}
+	_, err := tr.RoundTrip(req)
+	if _, ok := err.(*DockerUnavailableError); !ok {
+		t.Fatalf("got error %v", err)
+	}
+	if base.calls != 10 {
+		t.Fatalf("got %d calls", base.calls)
+	}
+	// The error of the client is handled like any other daemon error.
+	if !isDockerInfrastructureError(&url.Error{Op: "Get", URL: req.URL.String(), Err: err}) {
+		t.Fatal("should be an infrastructure error")
+	}
+
+	// After the cooldown a failing probe opens the breaker again.
+	now = now.Add(time.Minute)
+	base.failing = true
+	if _, err := tr.RoundTrip(req); err == nil || base.calls != 11 {
+		t.Fatalf("got %d calls, %v", base.calls, err)
+	}
+	if _, err := tr.RoundTrip(req); err == nil || base.calls != 11 {
+		t.Fatalf("got %d calls, %v", base.calls, err)
+	}
+
+	// A successful probe closes it.
+	now = now.Add(time.Minute)
+	base.failing = false
+	for i := 0; i < 10; i++ {
+		if _, err := tr.RoundTrip(req); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	if base.calls != 21 {
+		t.Fatalf("got %d calls", base.calls)
+	}
+}
+
+func TestDockerBreaker_Window(t *testing.T) {
+	t.Parallel()
+	breaker := newDockerBreaker(0.5, 0, log.New(ioutil.Discard, "", 0))
+	if breaker.cooldown != dockerBreakerDefaultCooldown {
+		t.Fatalf("got cooldown %s", breaker.cooldown)
+	}
+
+	// Server errors count too, and only the last requests do.
+	base := &fakeBreakerTransport{}
+	tr := &breakerTransport{breaker: breaker, base: base}
+	req, _ := http.NewRequest("GET", "http://docker/exec/123/json", nil)
+	for i := 0; i < dockerBreakerWindow; i++ {
+		tr.RoundTrip(req)
+	}
+	base.status = http.StatusInternalServerError
+	for i := 0; i < 9; i++ {
+		tr.RoundTrip(req)
+	}
+	if breaker.failures != 9 || !breaker.openUntil.IsZero() {
+		t.Fatalf("got %d failures", breaker.failures)
+	}
+	base.status = http.StatusOK
+	for i := 0; i < dockerBreakerWindow; i++ {
+		if _, err := tr.RoundTrip(req); err != nil {
+			t.Fatalf("%d: err: %v", i, err)
+		}
+	}
+	if breaker.failures != 0 || !breaker.openUntil.IsZero() {
+		t.Fatalf("got %d failures", breaker.failures)
+	}
+}
+
+func TestAgent_DockerBreakerShared(t *testing.T) {
+	t.Parallel()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	cfg := TestConfig()
+	cfg.DockerConfig.Host = "tcp://" + srv.Listener.Addr().String()
+	cfg.DockerConfig.BreakerErrorRate = 0.5
+	a := NewTestAgent(t.Name(), cfg)
+	defer a.Shutdown()
+
+	// The errors of the clients of different checks add up, so neither
+	// needs enough errors of its own to open the breaker.
+	var clients []DockerClient
+	for i := 0; i < 2; i++ {
+		client, err := newDockerClient(a.dockerClientConfig(), a.logger)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		clients = append(clients, client)
+	}
+	for i := 0; i < dockerBreakerMinRequests/2; i++ {
+		for _, client := range clients {
+			client.InspectExec("123")
+		}
+	}
+	for _, client := range clients {
+		_, err := client.InspectExec("123")
+		if uerr, ok := err.(*url.Error); !ok || !isDockerUnavailable(uerr.Err) {
+			t.Fatalf("got error %v", err)
+		}
+	}
+}
+
+func TestNewDockerClient_BreakerOnUnixSocket(t *testing.T) {
+	t.Parallel()
+	host, ln, cleanup := listenUnix(t, "docker")
+	defer cleanup()
+	var lock sync.Mutex
+	var requests int
+	go http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		requests++
+		lock.Unlock()
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+
+	cfg := DockerConfig{Host: host, breaker: newDockerBreaker(0.5, time.Minute, log.New(ioutil.Discard, "", 0))}
+	client, err := newDockerClient(cfg, log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for i := 0; i < dockerBreakerMinRequests; i++ {
+		client.InspectExec("123")
+	}
+	_, err = client.InspectExec("123")
+	if uerr, ok := err.(*url.Error); !ok || !isDockerUnavailable(uerr.Err) {
+		t.Fatalf("got error %v", err)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if requests != dockerBreakerMinRequests {
+		t.Fatalf("got %d requests want %d", requests, dockerBreakerMinRequests)
+	}
+}
+
+func isDockerUnavailable(err error) bool {
+	_, ok := err.(*DockerUnavailableError)
+	return ok
+}
+
+// A fake docker client which records whether an exec was created and
+// started
+type fakeDockerClientRecordingStart struct {
+	fakeDockerClientWithNoErrors
+	created bool
+	started bool
+}
+
+func (d *fakeDockerClientRecordingStart) CreateExec(opts docker.CreateExecOptions) (*docker.Exec, error) {
+	d.created = true
+	return d.fakeDockerClientWithNoErrors.CreateExec(opts)
+}
+
+func (d *fakeDockerClientRecordingStart) StartExec(id string, opts docker.StartExecOptions) error {
+	d.started = true
+	return nil
+}
+
+func TestExec_BreakerOpenBeforeCreate(t *testing.T) {
+	t.Parallel()
+	now := time.Unix(1000, 0)
+	breaker := newDockerBreaker(0.5, time.Minute, log.New(ioutil.Discard, "", 0))
+	breaker.now = func() time.Time { return now }
+	breaker.open()
+
+	client := &fakeDockerClientRecordingStart{}
+	opts := ExecOptions{ContainerID: "54432bad1fc7", Cmd: []string{"/health.sh"}, breaker: breaker}
+	_, err := Exec(client, opts)
+	eerr, ok := err.(*ExecError)
+	if !ok || eerr.Op != ExecOpCreate || !isDockerUnavailable(eerr.Err) {
+		t.Fatalf("got error %v", err)
+	}
+	if client.created || client.started {
+		t.Fatal("should not create the exec")
+	}
+	if !isDockerInfrastructureError(err) {
+		t.Fatal("should be an infrastructure error")
+	}
+
+	// Once the cooldown is over the exec starts, and the breaker is left
+	// for a request whose outcome it sees to probe the daemon.
+	now = now.Add(time.Minute)
+	if _, err := Exec(client, opts); err != nil || !client.started {
+		t.Fatalf("got started %v, %v", client.started, err)
+	}
+	if probe, err := breaker.allow(); !probe || err != nil {
+		t.Fatalf("got probe %v, %v", probe, err)
+	}
+}
@@ -0,0 +1,105 @@
+package agent
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// dockerContextEndpoint is the Docker endpoint of a context in the contexts
+// store of the Docker CLI.
+type dockerContextEndpoint struct {
+	Host          string
+	SkipTLSVerify bool
+
+	// CAFile, CertFile and KeyFile are the TLS material of the context.
+	// They are empty if the context doesn't have them.
+	CAFile   string
+	CertFile string
+	KeyFile  string
+}
+
+// dockerConfigDir returns the directory of the Docker CLI's configuration,
+// which holds the contexts store.
+func dockerConfigDir() string {
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return dir
+	}
+	return filepath.Join(os.Getenv("HOME"), ".docker")
+}
+
+// loadDockerContext reads the Docker endpoint of the named context from the
+// contexts store in configDir. The store keeps each context in a directory
+// named after the SHA-256 of its name.
+func loadDockerContext(configDir, name string) (*dockerContextEndpoint, error) {
+	sum := sha256.Sum256([]byte(name))
+	id := hex.EncodeToString(sum[:])
+
+	buf, err := ioutil.ReadFile(filepath.Join(configDir, "contexts", "meta", id, "meta.json"))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("Docker context %q not found in %s", name, configDir)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var meta struct {
+		Endpoints map[string]struct {
+			Host          string
+			SkipTLSVerify bool
+		}
+	}
+	if err := json.Unmarshal(buf, &meta); err != nil {
+		return nil, fmt.Errorf("Failed to decode Docker context %q: %v", name, err)
+	}
+	endpoint, ok := meta.Endpoints["docker"]
+	if !ok || endpoint.Host == "" {
+		return nil, fmt.Errorf("Docker context %q has no Docker endpoint", name)
+	}
+
+	ep := &dockerContextEndpoint{Host: endpoint.Host, SkipTLSVerify: endpoint.SkipTLSVerify}
+	tlsDir := filepath.Join(configDir, "contexts", "tls", id, "docker")
+	for file, path := range map[string]*string{
+		"ca.pem":   &ep.CAFile,
+		"cert.pem": &ep.CertFile,
+		"key.pem":  &ep.KeyFile,
+	} {
+		if _, err := os.Stat(filepath.Join(tlsDir, file)); err == nil {
+			*path = filepath.Join(tlsDir, file)
+		}
+	}
+	return ep, nil
+}
+
+// newDockerContextClient returns a client for the endpoint of the named
+// Docker context.
+func newDockerContextClient(name string) (*docker.Client, error) {
+	ep, err := loadDockerContext(dockerConfigDir(), name)
+	if err != nil {
+		return nil, err
+	}
+
+	if ep.CAFile == "" && ep.CertFile == "" && !ep.SkipTLSVerify {
+		client, err := docker.NewClient(ep.Host)
+		if err != nil {
+			return nil, err
+		}
+		client.SkipServerVersionCheck = true
+		return client, nil
+	}
+
+	client, err := docker.NewTLSClient(ep.Host, ep.CertFile, ep.KeyFile, ep.CAFile)
+	if err != nil {
+		return nil, err
+	}
+	// The client library skips verification when there is no CA while the
+	// Docker CLI falls back to the system roots, so only skip it if the
+	// context asks for it.
+	client.TLSConfig.InsecureSkipVerify = ep.SkipTLSVerify
+	return client, nil
+}
@@ -0,0 +1,57 @@
+package agent
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/consul/testutil"
+)
+
+func TestLoadDockerContext(t *testing.T) {
+	t.Parallel()
+	dir := testutil.TempDir(t, "docker-config")
+	defer os.RemoveAll(dir)
+
+	// The store names the directories of the "remote" context after the
+	// SHA-256 of its name.
+	id := "b71199ebd070b36beab7317920c2c2f1d777df8d05e5527d8458fda57cb17a7a"
+	writeFile := func(path, contents string) {
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	writeFile(filepath.Join(dir, "contexts", "meta", id, "meta.json"),
+		`{"Name":"remote","Metadata":{},"Endpoints":{"docker":{"Host":"tcp://10.0.0.1:2376","SkipTLSVerify":false}}}`)
+	tlsDir := filepath.Join(dir, "contexts", "tls", id, "docker")
+	writeFile(filepath.Join(tlsDir, "ca.pem"), "ca")
+	writeFile(filepath.Join(tlsDir, "cert.pem"), "cert")
+
+	ep, err := loadDockerContext(dir, "remote")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	want := &dockerContextEndpoint{
+		Host:     "tcp://10.0.0.1:2376",
+		CAFile:   filepath.Join(tlsDir, "ca.pem"),
+		CertFile: filepath.Join(tlsDir, "cert.pem"),
+	}
+	if !reflect.DeepEqual(ep, want) {
+		t.Fatalf("got %#v want %#v", ep, want)
+	}
+
+	if _, err := loadDockerContext(dir, "missing"); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Fatalf("got error %v", err)
+	}
+
+	writeFile(filepath.Join(dir, "contexts", "meta", id, "meta.json"), `{"Name":"remote","Endpoints":{}}`)
+	if _, err := loadDockerContext(dir, "remote"); err == nil || !strings.Contains(err.Error(), "no Docker endpoint") {
+		t.Fatalf("got error %v", err)
+	}
+}
@@ -0,0 +1,158 @@
+package agent
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/go-units"
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// dockerPressureFreeRatio is the share of a storage resource of the Docker
+// daemon below which it is considered to be under pressure.
+const dockerPressureFreeRatio = 0.05
+
+// dockerPressureTTL is how long the pressure of a daemon is cached for.
+const dockerPressureTTL = 10 * time.Second
+
+// DockerInfoClient defines the operation of a docker client which reports
+// the system-wide information of the daemon. It is used for injecting a
+// fake client during tests.
+type DockerInfoClient interface {
+	Info() (*docker.DockerInfo, error)
+}
+
+// DaemonResource is a storage resource of the Docker daemon, in bytes.
+type DaemonResource struct {
+	Name      string
+	Available int64
+	Total     int64
+}
+
+// Low returns true if less than dockerPressureFreeRatio of the resource
+// is available.
+func (r DaemonResource) Low() bool {
+	return r.Total > 0 && float64(r.Available) < dockerPressureFreeRatio*float64(r.Total)
+}
+
+// DaemonResources are the storage resources the /info endpoint of the
+// Docker daemon reports. Only storage drivers with a pool of their own,
+// like devicemapper, report them, so they're empty for the others.
+type DaemonResources struct {
+	Driver    string
+	Resources []DaemonResource
+}
+
+// Pressure returns a message about the resources which are low, or an
+// empty string if none are.
+func (r DaemonResources) Pressure() string {
+	var low []string
+	for _, res := range r.Resources {
+		if res.Low() {
+			low = append(low, fmt.Sprintf("%s %s of %s free", res.Name,
+				units.HumanSize(float64(res.Available)), units.HumanSize(float64(res.Total))))
+		}
+	}
+	if len(low) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("Docker daemon is low on %s", strings.Join(low, ", "))
+}
+
+// dockerDriverSpaces are the resources in the status of a storage driver,
+// by the prefix of their "Available" and "Total" keys.
+var dockerDriverSpaces = []struct {
+	prefix string
+	name   string
+}{
+	{"Data Space", "data space"},
+	{"Metadata Space", "metadata space"},
+}
+
+// DockerDaemonResources queries the storage resources of the daemon.
+func DockerDaemonResources(client DockerInfoClient) (DaemonResources, error) {
+	info, err := client.Info()
+	if err != nil {
+		return DaemonResources{}, fmt.Errorf("Unable to query Docker info: %s", err)
+	}
+	status := make(map[string]string)
+	for _, kv := range info.DriverStatus {
+		status[kv[0]] = kv[1]
+	}
+
+	res := DaemonResources{Driver: info.Driver}
+	for _, space := range dockerDriverSpaces {
+		available, okAvailable := status[space.prefix+" Available"]
+		total, okTotal := status[space.prefix+" Total"]
+		if !okAvailable || !okTotal {
+			continue
+		}
+		a, err := units.FromHumanSize(available)
+		if err != nil {
+			return DaemonResources{}, fmt.Errorf("Invalid %s Available %q: %s", space.prefix, available, err)
+		}
+		t, err := units.FromHumanSize(total)
+		if err != nil {
+			return DaemonResources{}, fmt.Errorf("Invalid %s Total %q: %s", space.prefix, total, err)
+		}
+		res.Resources = append(res.Resources, DaemonResource{Name: space.name, Available: a, Total: t})
+	}
+	return res, nil
+}
+
+// PressureCache caches the pressure of the Docker daemons the checks of an
+// agent run on, so that when a daemon fails many checks at once /info is
+// queried once per TTL rather than by every failing run. The daemons are
+// told apart by key. A nil PressureCache queries the daemon every time.
+type PressureCache struct {
+	ttl     time.Duration
+	lock    sync.Mutex
+	entries map[string]pressureEntry
+}
+
+// pressureEntry is the cached pressure of a daemon. Errors are cached too
+// so that a daemon which can't be queried isn't asked again by every run.
+type pressureEntry struct {
+	pressure string
+	err      error
+	expires  time.Time
+}
+
+// NewPressureCache returns a cache which keeps the pressure for ttl.
+func NewPressureCache(ttl time.Duration) *PressureCache {
+	return &PressureCache{ttl: ttl, entries: make(map[string]pressureEntry)}
+}
+
+// Get returns the pressure of the daemon with the key, querying it with
+// the client unless it is cached. Concurrent runs wait for the query of
+// the first one instead of making their own.
+func (c *PressureCache) Get(key string, client DockerInfoClient) (string, error) {
+	if c == nil {
+		return queryPressure(client)
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	now := time.Now()
+	if e, ok := c.entries[key]; ok && now.Before(e.expires) {
+		return e.pressure, e.err
+	}
+	for k, e := range c.entries {
+		if !now.Before(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+	pressure, err := queryPressure(client)
+	c.entries[key] = pressureEntry{pressure: pressure, err: err, expires: time.Now().Add(c.ttl)}
+	return pressure, err
+}
+
+// queryPressure returns the pressure the daemon reports.
+func queryPressure(client DockerInfoClient) (string, error) {
+	res, err := DockerDaemonResources(client)
+	if err != nil {
+		return "", err
+	}
+	return res.Pressure(), nil
+}
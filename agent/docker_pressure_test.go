@@ -0,0 +1,157 @@
+package agent
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/hashicorp/consul/agent/mock"
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/consul/types"
+)
+
+type fakeDockerInfoClient struct {
+	info  *docker.DockerInfo
+	err   error
+	calls int
+}
+
+func (d *fakeDockerInfoClient) Info() (*docker.DockerInfo, error) {
+	d.calls++
+	return d.info, d.err
+}
+
+func devicemapperInfo(dataAvailable string) *docker.DockerInfo {
+	return &docker.DockerInfo{
+		Driver: "devicemapper",
+		DriverStatus: [][2]string{
+			{"Pool Name", "docker-thinpool"},
+			{"Data Space Used", "95 GB"},
+			{"Data Space Total", "100 GB"},
+			{"Data Space Available", dataAvailable},
+			{"Metadata Space Used", "10 MB"},
+			{"Metadata Space Total", "1 GB"},
+			{"Metadata Space Available", "990 MB"},
+		},
+	}
+}
+
+func TestDockerDaemonResources(t *testing.T) {
+	t.Parallel()
+	client := &fakeDockerInfoClient{info: devicemapperInfo("1.5 GB")}
+	res, err := DockerDaemonResources(client)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	want := DaemonResources{Driver: "devicemapper", Resources: []DaemonResource{
+		{Name: "data space", Available: 1500000000, Total: 100000000000},
+		{Name: "metadata space", Available: 990000000, Total: 1000000000},
+	}}
+	if !reflect.DeepEqual(res, want) {
+		t.Fatalf("got %#v want %#v", res, want)
+	}
+	if got, want := res.Pressure(), "Docker daemon is low on data space 1.5 GB of 100 GB free"; got != want {
+		t.Fatalf("got %q want %q", got, want)
+	}
+
+	// Drivers which don't report their space are never under pressure.
+	client.info = &docker.DockerInfo{Driver: "overlay2", DriverStatus: [][2]string{{"Backing Filesystem", "extfs"}}}
+	if res, err := DockerDaemonResources(client); err != nil || res.Pressure() != "" {
+		t.Fatalf("got %#v, %v", res, err)
+	}
+
+	client.info = devicemapperInfo("lots")
+	if _, err := DockerDaemonResources(client); err == nil || !strings.Contains(err.Error(), "Invalid Data Space Available") {
+		t.Fatalf("got error %v", err)
+	}
+	client.err = errors.New("connection refused")
+	if _, err := DockerDaemonResources(client); err == nil {
+		t.Fatal("should fail")
+	}
+}
+
+// A fake docker client whose exec fails on a daemon that reports its
+// storage
+type fakeDockerClientWithPressure struct {
+	fakeDockerClientWithExecNonZeroExitCode
+	fakeDockerInfoClient
+}
+
+func TestDockerCheck_Pressure(t *testing.T) {
+	t.Parallel()
+	client := &fakeDockerClientWithPressure{}
+	client.info = devicemapperInfo("1 GB")
+	notif := mock.NewNotify()
+	check := &CheckDocker{
+		Notify:            notif,
+		CheckID:           types.CheckID("foo"),
+		Script:            "/health.sh",
+		DockerContainerID: "54432bad1fc7",
+		Shell:             "/bin/sh",
+		ClientConfig:      DockerConfig{CheckPressure: true, InfrastructureStatus: api.HealthWarning},
+		Logger:            log.New(ioutil.Discard, UniqueID(), log.LstdFlags),
+		dockerClient:      client,
+	}
+	check.cmd = []string{check.Shell, "-c", check.Script}
+	check.check()
+	if got := notif.State("foo"); got != api.HealthWarning {
+		t.Fatalf("got status %q", got)
+	}
+	if got := notif.Output("foo"); !strings.HasPrefix(got, "Docker daemon is low on data space 1 GB of 100 GB free\n") {
+		t.Fatalf("got output %q", got)
+	}
+
+	// Without pressure the failure is the application's.
+	client.info = devicemapperInfo("50 GB")
+	check.check()
+	if got := notif.State("foo"); got != api.HealthCritical {
+		t.Fatalf("got status %q", got)
+	}
+}
+
+func TestPressureCache(t *testing.T) {
+	t.Parallel()
+	cache := NewPressureCache(time.Hour)
+	client := &fakeDockerInfoClient{info: devicemapperInfo("1 GB")}
+	for i := 0; i < 3; i++ {
+		pressure, err := cache.Get("docker", client)
+		if err != nil || !strings.Contains(pressure, "low on data space") {
+			t.Fatalf("got %q, %v", pressure, err)
+		}
+	}
+	if client.calls != 1 {
+		t.Fatalf("got %d queries", client.calls)
+	}
+
+	// Other daemons are queried on their own, and errors are cached too.
+	other := &fakeDockerInfoClient{err: errors.New("connection refused")}
+	for i := 0; i < 2; i++ {
+		if _, err := cache.Get("podman", other); err == nil {
+			t.Fatal("should fail")
+		}
+	}
+	if other.calls != 1 {
+		t.Fatalf("got %d queries", other.calls)
+	}
+
+	// The daemon is queried again once the pressure expired.
+	cache = NewPressureCache(time.Nanosecond)
+	cache.Get("docker", client)
+	time.Sleep(time.Millisecond)
+	cache.Get("docker", client)
+	if client.calls != 3 {
+		t.Fatalf("got %d queries", client.calls)
+	}
+
+	// A nil cache queries the daemon every time.
+	var none *PressureCache
+	none.Get("docker", client)
+	if client.calls != 4 {
+		t.Fatalf("got %d queries", client.calls)
+	}
+}
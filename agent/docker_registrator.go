@@ -0,0 +1,385 @@
+package agent
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/hashicorp/consul/agent/consul/structs"
+	"golang.org/x/net/context"
+)
+
+// The container labels a service is registered from.
+const (
+	dockerLabelServiceName   = "consul.service.name"
+	dockerLabelServiceID     = "consul.service.id"
+	dockerLabelServicePort   = "consul.service.port"
+	dockerLabelServiceTags   = "consul.service.tags"
+	dockerLabelCheckScript   = "consul.check.script"
+	dockerLabelCheckShell    = "consul.check.shell"
+	dockerLabelCheckHTTP     = "consul.check.http"
+	dockerLabelCheckTCP      = "consul.check.tcp"
+	dockerLabelCheckInterval = "consul.check.interval"
+	dockerLabelCheckTimeout  = "consul.check.timeout"
+)
+
+const (
+	// dockerRegistratorCheckInterval is the interval of the checks of a
+	// container without the consul.check.interval label.
+	dockerRegistratorCheckInterval = 10 * time.Second
+
+	// dockerRegistratorInspectTimeout is how long inspecting a container
+	// which started may take.
+	dockerRegistratorInspectTimeout = 10 * time.Second
+
+	// dockerRegistratorMaxWait is the longest wait before reconnecting to
+	// the events of the Docker daemon. The wait starts at a second and
+	// doubles up to this.
+	dockerRegistratorMaxWait = 30 * time.Second
+)
+
+// ContainerService returns the service and checks the labels of the
+// container define. The service is registered with consul.service.name,
+// and the optional consul.service.id, consul.service.tags, a comma
+// separated list, and consul.service.port, the port of the container
+// whose published address and port are those of the service. The checks
+// are a Docker check running consul.check.script in the container with
+// consul.check.shell, an HTTP check of the path in consul.check.http and
+// a TCP check if consul.check.tcp is "true", every consul.check.interval
+// with consul.check.timeout. The HTTP and TCP checks probe the published
+// port. A nil service is returned for a container without a service name.
+func ContainerService(info ContainerInfo) (*structs.NodeService, []*structs.CheckType, error) {
+	labels := info.Labels
+	name := labels[dockerLabelServiceName]
+	if name == "" {
+		return nil, nil, nil
+	}
+	service := &structs.NodeService{
+		ID:      labels[dockerLabelServiceID],
+		Service: name,
+	}
+	if service.ID == "" {
+		id := info.ID
+		if len(id) > 12 {
+			id = id[:12]
+		}
+		service.ID = name + "-" + id
+	}
+	for _, tag := range strings.Split(labels[dockerLabelServiceTags], ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			service.Tags = append(service.Tags, tag)
+		}
+	}
+
+	// The checks probe the loopback address for a port published on all
+	// interfaces, which is also the address of the agent.
+	var probe string
+	if port := labels[dockerLabelServicePort]; port != "" {
+		if !strings.Contains(port, "/") {
+			port += "/tcp"
+		}
+		host, hostPort, err := info.PublishedAddress(port)
+		if err != nil {
+			return nil, nil, err
+		}
+		if service.Port, err = strconv.Atoi(hostPort); err != nil {
+			return nil, nil, fmt.Errorf("Invalid published port %q of container %s", hostPort, info.ID)
+		}
+		probe = net.JoinHostPort("127.0.0.1", hostPort)
+		if host != "" && host != "0.0.0.0" && host != "::" {
+			service.Address = host
+			probe = net.JoinHostPort(host, hostPort)
+		}
+	}
+
+	interval := dockerRegistratorCheckInterval
+	if raw := labels[dockerLabelCheckInterval]; raw != "" {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Invalid %s label of container %s: %v", dockerLabelCheckInterval, info.ID, err)
+		}
+		interval = d
+	}
+	var timeout time.Duration
+	if raw := labels[dockerLabelCheckTimeout]; raw != "" {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Invalid %s label of container %s: %v", dockerLabelCheckTimeout, info.ID, err)
+		}
+		timeout = d
+	}
+
+	var checks []*structs.CheckType
+	if script := labels[dockerLabelCheckScript]; script != "" {
+		checks = append(checks, &structs.CheckType{
+			Script:            script,
+			DockerContainerID: info.ID,
+			Shell:             labels[dockerLabelCheckShell],
+			Interval:          interval,
+			Timeout:           timeout,
+		})
+	}
+	if path := labels[dockerLabelCheckHTTP]; path != "" {
+		if probe == "" {
+			return nil, nil, fmt.Errorf("The %s label of container %s requires %s", dockerLabelCheckHTTP, info.ID, dockerLabelServicePort)
+		}
+		if !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+		checks = append(checks, &structs.CheckType{
+			HTTP:     "http://" + probe + path,
+			Interval: interval,
+			Timeout:  timeout,
+		})
+	}
+	if labels[dockerLabelCheckTCP] == "true" {
+		if probe == "" {
+			return nil, nil, fmt.Errorf("The %s label of container %s requires %s", dockerLabelCheckTCP, info.ID, dockerLabelServicePort)
+		}
+		checks = append(checks, &structs.CheckType{
+			TCP:      probe,
+			Interval: interval,
+			Timeout:  timeout,
+		})
+	}
+	return service, checks, nil
+}
+
+// DockerRegistratorClient defines the operations of a docker client which
+// are needed to register the services of containers. It is used for
+// injecting a fake client during tests.
+type DockerRegistratorClient interface {
+	DockerListClient
+	DockerInspectClient
+	AddEventListener(chan<- *docker.APIEvents) error
+	RemoveEventListener(chan *docker.APIEvents) error
+}
+
+// dockerServiceRegistry is the part of the agent the services of the
+// containers are registered with.
+type dockerServiceRegistry interface {
+	AddService(*structs.NodeService, []*structs.CheckType, bool, string) error
+	RemoveService(string, bool) error
+}
+
+// DockerRegistrator registers the services of the running containers with
+// a consul.service.name label with the agent, like registrator does
+// outside of it. It follows the events of the Docker daemon to register
+// the services of containers which start and deregister those of
+// containers which stop. Whenever it connects to the events, which it
+// does again if they fail, the services are reconciled with the running
+// containers since events may have been missed in between. The services
+// aren't persisted, so they're registered again when the agent restarts.
+type DockerRegistrator struct {
+	Client   DockerRegistratorClient
+	Registry dockerServiceRegistry
+	Logger   *log.Logger
+
+	// services maps the IDs of the containers to the IDs of their
+	// services. It's only used by the goroutine of Run until it's done.
+	services map[string]string
+
+	resyncCh chan struct{}
+	stopCh   chan struct{}
+	doneCh   chan struct{}
+}
+
+// NewDockerRegistrator creates a registrator which is started with Run.
+func NewDockerRegistrator(client DockerRegistratorClient, registry dockerServiceRegistry, logger *log.Logger) *DockerRegistrator {
+	return &DockerRegistrator{
+		Client:   client,
+		Registry: registry,
+		Logger:   logger,
+		services: make(map[string]string),
+		resyncCh: make(chan struct{}, 1),
+		stopCh:   make(chan struct{}),
+		doneCh:   make(chan struct{}),
+	}
+}
+
+// Run follows the events of the Docker daemon until Stop is called. The
+// wait between attempts to connect doubles after every failure up to
+// dockerRegistratorMaxWait and is reset once an event is received.
+func (r *DockerRegistrator) Run(after func(time.Duration) <-chan time.Time) {
+	defer close(r.doneCh)
+	wait := time.Second
+	for {
+		events := make(chan *docker.APIEvents, 64)
+		err := r.Client.AddEventListener(events)
+		if err == nil {
+			// The listener is added before listing the containers so
+			// that none which start in between is missed.
+			r.reconcile()
+			var received bool
+			received, err = r.follow(events)
+			r.Client.RemoveEventListener(events)
+			if received {
+				wait = time.Second
+			}
+		}
+		if err == nil {
+			return
+		}
+
+		r.Logger.Printf("[WARN] agent: Docker events failed: %v, reconnecting in %v", err, wait)
+		timer := after(wait)
+	WAIT:
+		for {
+			select {
+			case <-timer:
+				break WAIT
+			case <-r.resyncCh:
+				// The services are registered again when the events
+				// reconnect.
+				r.services = make(map[string]string)
+			case <-r.stopCh:
+				return
+			}
+		}
+		if wait *= 2; wait > dockerRegistratorMaxWait {
+			wait = dockerRegistratorMaxWait
+		}
+	}
+}
+
+// follow handles the container events until the events are closed, which
+// is an error, or Stop is called.
+func (r *DockerRegistrator) follow(events chan *docker.APIEvents) (received bool, err error) {
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				return received, fmt.Errorf("Docker events stream closed")
+			}
+			received = true
+			r.handle(ev)
+		case <-r.resyncCh:
+			r.services = make(map[string]string)
+			r.reconcile()
+		case <-r.stopCh:
+			return received, nil
+		}
+	}
+}
+
+// handle registers the service of a container which started and
+// deregisters the one of a container which stopped.
+func (r *DockerRegistrator) handle(ev *docker.APIEvents) {
+	if ev.Type != "" && ev.Type != "container" {
+		return
+	}
+	id := ev.Actor.ID
+	if id == "" {
+		id = ev.ID
+	}
+	action := ev.Action
+	if action == "" {
+		action = ev.Status
+	}
+	switch action {
+	case "start", "unpause":
+		r.register(id)
+	case "die", "destroy", "pause":
+		r.deregister(id)
+	}
+}
+
+// reconcile registers the services of the running containers which
+// aren't registered yet and deregisters those of the containers which
+// aren't running anymore.
+func (r *DockerRegistrator) reconcile() {
+	containers, err := r.Client.ListContainers(docker.ListContainersOptions{
+		Filters: map[string][]string{
+			"label":  {dockerLabelServiceName},
+			"status": {"running"},
+		},
+	})
+	if err != nil {
+		r.Logger.Printf("[WARN] agent: Unable to list the containers to register: %s", err)
+		return
+	}
+	running := make(map[string]bool)
+	for _, c := range containers {
+		running[c.ID] = true
+		if _, ok := r.services[c.ID]; !ok {
+			r.register(c.ID)
+		}
+	}
+	for id := range r.services {
+		if !running[id] {
+			r.deregister(id)
+		}
+	}
+}
+
+// register registers the service of the container, if it has one.
+func (r *DockerRegistrator) register(id string) {
+	ctx, cancel := context.WithTimeout(context.Background(), dockerRegistratorInspectTimeout)
+	defer cancel()
+	info, err := InspectContainer(ctx, r.Client, id)
+	if err != nil {
+		r.Logger.Printf("[WARN] agent: Unable to register the service of container %s: %s", id, err)
+		return
+	}
+	service, checks, err := ContainerService(info)
+	if err != nil {
+		r.Logger.Printf("[WARN] agent: Unable to register the service of container %s: %s", id, err)
+		return
+	}
+	if service == nil {
+		return
+	}
+	if old, ok := r.services[id]; ok && old != service.ID {
+		r.deregister(id)
+	}
+	if err := r.Registry.AddService(service, checks, false, ""); err != nil {
+		r.Logger.Printf("[WARN] agent: Unable to register service %q of container %s: %s", service.ID, id, err)
+		return
+	}
+	r.services[id] = service.ID
+	r.Logger.Printf("[INFO] agent: Registered service %q of container %s", service.ID, id)
+}
+
+// deregister deregisters the service of the container, if it has one.
+func (r *DockerRegistrator) deregister(id string) {
+	serviceID, ok := r.services[id]
+	if !ok {
+		return
+	}
+	delete(r.services, id)
+	if err := r.Registry.RemoveService(serviceID, false); err != nil {
+		r.Logger.Printf("[WARN] agent: Unable to deregister service %q of container %s: %s", serviceID, id, err)
+		return
+	}
+	r.Logger.Printf("[INFO] agent: Deregistered service %q of container %s", serviceID, id)
+}
+
+// Resync registers the services of the running containers again after
+// they were removed from the agent without the registrator, like when the
+// configuration is reloaded. The services are registered by the goroutine
+// of Run, so Resync doesn't wait for them.
+func (r *DockerRegistrator) Resync() {
+	select {
+	case r.resyncCh <- struct{}{}:
+	default:
+	}
+}
+
+// Stop stops following the events and deregisters the services of all of
+// the containers.
+func (r *DockerRegistrator) Stop() {
+	select {
+	case <-r.stopCh:
+		return
+	default:
+	}
+	close(r.stopCh)
+	<-r.doneCh
+	for id := range r.services {
+		r.deregister(id)
+	}
+}
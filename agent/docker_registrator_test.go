@@ -0,0 +1,320 @@
+package agent
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/hashicorp/consul/agent/consul/structs"
+	"github.com/hashicorp/consul/testutil/retry"
+	"golang.org/x/net/context"
+)
+
+func TestContainerService(t *testing.T) {
+	t.Parallel()
+	info := ContainerInfo{
+		ID:    "4a7bd9c4f1e2aa00",
+		Ports: map[string][]string{"8080/tcp": {"0.0.0.0:32768"}, "9090/tcp": {"10.0.0.5:9090"}},
+		Labels: map[string]string{
+			dockerLabelServiceName:   "web",
+			dockerLabelServicePort:   "8080",
+			dockerLabelServiceTags:   "v1, primary,",
+			dockerLabelCheckScript:   "/health.sh",
+			dockerLabelCheckHTTP:     "health",
+			dockerLabelCheckTCP:      "true",
+			dockerLabelCheckInterval: "5s",
+			dockerLabelCheckTimeout:  "1s",
+		},
+	}
+	service, checks, err := ContainerService(info)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	want := &structs.NodeService{ID: "web-4a7bd9c4f1e2", Service: "web", Tags: []string{"v1", "primary"}, Port: 32768}
+	if !reflect.DeepEqual(service, want) {
+		t.Fatalf("got %#v want %#v", service, want)
+	}
+	wantChecks := []*structs.CheckType{
+		{Script: "/health.sh", DockerContainerID: info.ID, Interval: 5 * time.Second, Timeout: time.Second},
+		{HTTP: "http://127.0.0.1:32768/health", Interval: 5 * time.Second, Timeout: time.Second},
+		{TCP: "127.0.0.1:32768", Interval: 5 * time.Second, Timeout: time.Second},
+	}
+	if !reflect.DeepEqual(checks, wantChecks) {
+		t.Fatalf("got %#v want %#v", checks, wantChecks)
+	}
+
+	// A port published on a single interface is the service address.
+	info.Labels = map[string]string{
+		dockerLabelServiceName: "metrics",
+		dockerLabelServiceID:   "metrics-1",
+		dockerLabelServicePort: "9090/tcp",
+		dockerLabelCheckHTTP:   "/metrics",
+	}
+	service, checks, err = ContainerService(info)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	want = &structs.NodeService{ID: "metrics-1", Service: "metrics", Address: "10.0.0.5", Port: 9090}
+	if !reflect.DeepEqual(service, want) {
+		t.Fatalf("got %#v want %#v", service, want)
+	}
+	if len(checks) != 1 || checks[0].HTTP != "http://10.0.0.5:9090/metrics" || checks[0].Interval != dockerRegistratorCheckInterval {
+		t.Fatalf("got checks %#v", checks)
+	}
+
+	// Containers without a service name aren't registered.
+	info.Labels = map[string]string{dockerLabelCheckScript: "/health.sh"}
+	if service, checks, err := ContainerService(info); service != nil || checks != nil || err != nil {
+		t.Fatalf("got %#v, %#v, %v", service, checks, err)
+	}
+
+	for _, labels := range []map[string]string{
+		{dockerLabelServiceName: "web", dockerLabelServicePort: "8081"},
+		{dockerLabelServiceName: "web", dockerLabelCheckInterval: "often"},
+		{dockerLabelServiceName: "web", dockerLabelCheckTimeout: "1"},
+		{dockerLabelServiceName: "web", dockerLabelCheckHTTP: "/health"},
+		{dockerLabelServiceName: "web", dockerLabelCheckTCP: "true"},
+	} {
+		info.Labels = labels
+		if _, _, err := ContainerService(info); err == nil {
+			t.Fatalf("%v: should fail", labels)
+		}
+	}
+}
+
+// fakeRegistratorClient serves the containers it has and passes events to
+// the listeners added to it.
+type fakeRegistratorClient struct {
+	lock       sync.Mutex
+	containers map[string]*docker.Container
+	listeners  []chan<- *docker.APIEvents
+	added      int
+	addErr     error
+}
+
+func (c *fakeRegistratorClient) ListContainers(opts docker.ListContainersOptions) ([]docker.APIContainers, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	var out []docker.APIContainers
+	for id, container := range c.containers {
+		if container.State.Running && container.Config.Labels[dockerLabelServiceName] != "" {
+			out = append(out, docker.APIContainers{ID: id, Labels: container.Config.Labels})
+		}
+	}
+	return out, nil
+}
+
+func (c *fakeRegistratorClient) InspectContainerWithContext(id string, ctx context.Context) (*docker.Container, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	container, ok := c.containers[id]
+	if !ok {
+		return nil, &docker.NoSuchContainer{ID: id}
+	}
+	return container, nil
+}
+
+func (c *fakeRegistratorClient) AddEventListener(listener chan<- *docker.APIEvents) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.addErr != nil {
+		err := c.addErr
+		c.addErr = nil
+		return err
+	}
+	c.listeners = append(c.listeners, listener)
+	c.added++
+	return nil
+}
+
+func (c *fakeRegistratorClient) RemoveEventListener(listener chan *docker.APIEvents) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for i, l := range c.listeners {
+		if l == listener {
+			c.listeners = append(c.listeners[:i], c.listeners[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (c *fakeRegistratorClient) run(id string, labels map[string]string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.containers == nil {
+		c.containers = make(map[string]*docker.Container)
+	}
+	c.containers[id] = &docker.Container{
+		ID:     id,
+		Config: &docker.Config{Labels: labels},
+		State:  docker.State{Running: true},
+	}
+}
+
+func (c *fakeRegistratorClient) send(ev *docker.APIEvents) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if ev.Action == "die" {
+		c.containers[ev.Actor.ID].State.Running = false
+	}
+	for _, l := range c.listeners {
+		l <- ev
+	}
+}
+
+// closeEvents closes the listeners like the Docker client does once it
+// gives up reconnecting to the events.
+func (c *fakeRegistratorClient) closeEvents() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, l := range c.listeners {
+		close(l)
+	}
+	c.listeners = nil
+}
+
+func (c *fakeRegistratorClient) listening() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.added
+}
+
+// fakeServiceRegistry records the services registered with it.
+type fakeServiceRegistry struct {
+	lock     sync.Mutex
+	services map[string]*structs.NodeService
+	checks   map[string][]*structs.CheckType
+}
+
+func (r *fakeServiceRegistry) AddService(service *structs.NodeService, checks []*structs.CheckType, persist bool, token string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if persist {
+		return errors.New("should not persist")
+	}
+	if r.services == nil {
+		r.services = make(map[string]*structs.NodeService)
+		r.checks = make(map[string][]*structs.CheckType)
+	}
+	r.services[service.ID] = service
+	r.checks[service.ID] = checks
+	return nil
+}
+
+func (r *fakeServiceRegistry) RemoveService(id string, persist bool) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.services, id)
+	delete(r.checks, id)
+	return nil
+}
+
+func (r *fakeServiceRegistry) ids() string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var ids []string
+	for id := range r.services {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return strings.Join(ids, ",")
+}
+
+func TestDockerRegistrator(t *testing.T) {
+	t.Parallel()
+	client := &fakeRegistratorClient{}
+	client.run("aaaa", map[string]string{dockerLabelServiceName: "web", dockerLabelCheckScript: "/health.sh"})
+	client.run("bbbb", map[string]string{"other": "label"})
+	client.addErr = errors.New("connection refused")
+	registry := &fakeServiceRegistry{}
+	clock := &fakeClock{}
+	r := NewDockerRegistrator(client, registry, log.New(ioutil.Discard, "", 0))
+	go r.Run(clock.after)
+
+	// The running containers are registered once the events are
+	// followed, after a failed attempt.
+	retry.Run(t, func(r *retry.R) {
+		if got, want := registry.ids(), "web-aaaa"; got != want {
+			r.Fatalf("got services %q want %q", got, want)
+		}
+	})
+	clock.lock.Lock()
+	waits := clock.waits
+	clock.lock.Unlock()
+	if len(waits) != 1 || waits[0] != time.Second {
+		t.Fatalf("got waits %v", waits)
+	}
+	registry.lock.Lock()
+	checks := registry.checks["web-aaaa"]
+	registry.lock.Unlock()
+	if len(checks) != 1 || checks[0].DockerContainerID != "aaaa" {
+		t.Fatalf("got checks %#v", checks)
+	}
+
+	// Containers which start and stop are registered and deregistered.
+	client.run("cccc", map[string]string{dockerLabelServiceName: "api", dockerLabelServiceID: "api-1"})
+	client.send(&docker.APIEvents{Type: "container", Action: "start", Actor: docker.APIActor{ID: "cccc"}})
+	client.send(&docker.APIEvents{Type: "container", Action: "start", Actor: docker.APIActor{ID: "bbbb"}})
+	client.send(&docker.APIEvents{Type: "container", Action: "die", Actor: docker.APIActor{ID: "aaaa"}})
+	retry.Run(t, func(r *retry.R) {
+		if got, want := registry.ids(), "api-1"; got != want {
+			r.Fatalf("got services %q want %q", got, want)
+		}
+	})
+
+	// A container which started while the events were down is
+	// registered when they reconnect.
+	client.run("dddd", map[string]string{dockerLabelServiceName: "worker"})
+	client.closeEvents()
+	retry.Run(t, func(r *retry.R) {
+		if got, want := registry.ids(), "api-1,worker-dddd"; got != want {
+			r.Fatalf("got services %q want %q", got, want)
+		}
+	})
+	if got := client.listening(); got != 2 {
+		t.Fatalf("got %d listeners", got)
+	}
+
+	// Stopping deregisters the services.
+	r.Stop()
+	if got := registry.ids(); got != "" {
+		t.Fatalf("got services %q", got)
+	}
+}
+
+func TestAgent_ReloadConfig_DockerRegistrator(t *testing.T) {
+	t.Parallel()
+	a := NewTestAgent(t.Name(), nil)
+	defer a.Shutdown()
+
+	client := &fakeRegistratorClient{}
+	client.run("aaaa", map[string]string{dockerLabelServiceName: "web"})
+	a.dockerRegistrator = NewDockerRegistrator(client, a, a.logger)
+	go a.dockerRegistrator.Run(time.After)
+	retry.Run(t, func(r *retry.R) {
+		if _, ok := a.state.Services()["web-aaaa"]; !ok {
+			r.Fatal("missing service web-aaaa")
+		}
+	})
+
+	// The service of the container is registered again after it was
+	// unloaded by the reload.
+	cfg := TestConfig()
+	cfg.ACLEnforceVersion8 = Bool(false)
+	if err := a.ReloadConfig(cfg); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	retry.Run(t, func(r *retry.R) {
+		if _, ok := a.state.Services()["web-aaaa"]; !ok {
+			r.Fatal("missing service web-aaaa after the reload")
+		}
+	})
+}
@@ -0,0 +1,88 @@
+package agent
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/hashicorp/go-cleanhttp"
+)
+
+// dockerSocketHost is the endpoint of the clients of a Docker daemon on a
+// Unix socket or a named pipe. Its host is never resolved since all of
+// their connections are dialed by a dockerSocketDialer.
+const dockerSocketHost = "http://docker"
+
+// socketDockerClient recreates a client of a Docker daemon on a Unix socket
+// or a named pipe as a client of dockerSocketHost whose connections go to
+// the socket. The Docker client library sends the requests to a socket
+// with an HTTP client of its own, so the transport of HTTPClient, which
+// adds the headers, the token, the retries and the metrics, would
+// otherwise only be used for TCP. Other clients are returned as they are.
+func socketDockerClient(client *docker.Client) (*docker.Client, error) {
+	endpoint := client.Endpoint()
+	if !strings.HasPrefix(endpoint, "unix://") && !isNamedPipeHost(endpoint) {
+		return client, nil
+	}
+	network, addr, err := runtimeSocket(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	socket, err := docker.NewClient(dockerSocketHost)
+	if err != nil {
+		return nil, err
+	}
+	socket.SkipServerVersionCheck = client.SkipServerVersionCheck
+
+	dialer := &dockerSocketDialer{network: network, addr: addr}
+	tr := cleanhttp.DefaultTransport()
+	tr.Proxy = nil
+	tr.DialContext = dialer.DialContext
+	socket.Dialer = dialer
+	socket.HTTPClient = &http.Client{Transport: tr}
+	return socket, nil
+}
+
+// dockerSocketDialer dials the Unix socket or the named pipe of a Docker
+// daemon, whatever the address it is asked for. The Docker client library
+// has its own dialers for both, but they are only reachable through its
+// unexported socket client, and they ignore the context of the request,
+// so a stuck daemon would hold a check past its timeout. This dialer is
+// what the transport of HTTPClient and the hijacked connections of the
+// execs use instead.
+type dockerSocketDialer struct {
+	network string
+	addr    string
+	timeout time.Duration
+}
+
+func (d *dockerSocketDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// DialContext dials the socket until the context is done, so the deadline
+// of a request limits connecting to the daemon too. Named pipes can't be
+// cancelled, so they are only dialed until the deadline.
+func (d *dockerSocketDialer) DialContext(ctx context.Context, _, _ string) (net.Conn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if d.network != "npipe" {
+		dialer := &net.Dialer{Timeout: d.timeout}
+		return dialer.DialContext(ctx, d.network, d.addr)
+	}
+	timeout := d.timeout
+	if deadline, ok := ctx.Deadline(); ok {
+		left := time.Until(deadline)
+		if left <= 0 {
+			return nil, context.DeadlineExceeded
+		}
+		if timeout <= 0 || left < timeout {
+			timeout = left
+		}
+	}
+	return dialNamedPipe(d.addr, timeout)
+}
@@ -0,0 +1,61 @@
+package agent
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/testutil"
+)
+
+func TestDockerSocketDialer_Context(t *testing.T) {
+	t.Parallel()
+	host, ln, cleanup := listenUnix(t, "docker")
+	defer cleanup()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	d := &dockerSocketDialer{network: "unix", addr: strings.TrimPrefix(host, "unix://"), timeout: time.Second}
+	conn, err := d.DialContext(context.Background(), "tcp", "docker:80")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	conn.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := d.DialContext(ctx, "tcp", "docker:80"); err != context.Canceled {
+		t.Fatalf("got error %v", err)
+	}
+	ctx, cancel = context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	if _, err := d.DialContext(ctx, "tcp", "docker:80"); err != context.DeadlineExceeded {
+		t.Fatalf("got error %v", err)
+	}
+}
+
+// listenUnix listens on a Unix socket in a temporary directory.
+func listenUnix(t *testing.T, name string) (string, net.Listener, func()) {
+	dir := testutil.TempDir(t, name)
+	path := filepath.Join(dir, name+".sock")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("err: %v", err)
+	}
+	return "unix://" + path, ln, func() {
+		ln.Close()
+		os.RemoveAll(dir)
+	}
+}
@@ -0,0 +1,3267 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/url"
+	"os"
+	"os/exec"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/hashicorp/consul/agent/mock"
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/consul/testutil"
+	"github.com/hashicorp/consul/testutil/retry"
+	"github.com/hashicorp/consul/types"
+	"golang.org/x/net/context"
+)
+
+// A fake docker client which fails to inspect the exec after the
+// command has written its output
+type fakeDockerClientWithOutputAndExecInfoErrors struct {
+}
+
+func (d *fakeDockerClientWithOutputAndExecInfoErrors) CreateExec(opts docker.CreateExecOptions) (*docker.Exec, error) {
+	return &docker.Exec{ID: "123"}, nil
+}
+
+func (d *fakeDockerClientWithOutputAndExecInfoErrors) StartExec(id string, opts docker.StartExecOptions) error {
+	fmt.Fprint(opts.OutputStream, "partial output")
+	return nil
+}
+
+func (d *fakeDockerClientWithOutputAndExecInfoErrors) InspectExec(id string) (*docker.ExecInspect, error) {
+	return nil, errors.New("Unable to query exec info")
+}
+
+func TestExec(t *testing.T) {
+	t.Parallel()
+	res, err := Exec(&fakeDockerClientWithExecExitCodeOne{}, ExecOptions{ContainerID: "54432bad1fc7", Cmd: []string{"/bin/sh", "-c", "/health.sh"}})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if res.ExitCode != 1 || res.OutputString() != "output" {
+		t.Fatalf("got exit code %d output %q", res.ExitCode, res.OutputString())
+	}
+
+	res, err = Exec(&fakeDockerClientWithOutputAndExecInfoErrors{}, ExecOptions{ContainerID: "54432bad1fc7", Cmd: []string{"/bin/sh", "-c", "/health.sh"}})
+	if err == nil || err.Error() != "Unable to inspect Exec: Unable to query exec info" {
+		t.Fatalf("got error %v", err)
+	}
+	if res == nil || res.OutputString() != "partial output" {
+		t.Fatalf("output should be returned with the error: %#v", res)
+	}
+
+	res, err = Exec(&fakeDockerClientWithCreateExecFailure{}, ExecOptions{ContainerID: "54432bad1fc7", Cmd: []string{"/bin/sh", "-c", "/health.sh"}})
+	if err == nil || res != nil {
+		t.Fatalf("got result %#v error %v", res, err)
+	}
+}
+
+// A fake docker client whose daemon fails to create the exec
+type fakeDockerClientWithCreateExecStatus struct {
+	fakeDockerClientWithNoErrors
+}
+
+func (d *fakeDockerClientWithCreateExecStatus) CreateExec(opts docker.CreateExecOptions) (*docker.Exec, error) {
+	return nil, &docker.Error{Status: 500, Message: "server error"}
+}
+
+func TestExec_ExecError(t *testing.T) {
+	t.Parallel()
+	opts := ExecOptions{ContainerID: "54432bad1fc7", Cmd: []string{"/bin/sh", "-c", "/health.sh"}}
+	_, err := Exec(&fakeDockerClientWithOutputAndExecInfoErrors{}, opts)
+	e, ok := err.(*ExecError)
+	if !ok {
+		t.Fatalf("got error %#v", err)
+	}
+	if e.Op != ExecOpInspect || e.ContainerID != "54432bad1fc7" || e.ExecID != "123" || e.StatusCode != 0 {
+		t.Fatalf("bad error: %#v", e)
+	}
+
+	_, err = Exec(&fakeDockerClientWithCreateExecStatus{}, opts)
+	e, ok = err.(*ExecError)
+	if !ok {
+		t.Fatalf("got error %#v", err)
+	}
+	if e.Op != ExecOpCreate || e.ExecID != "" || e.StatusCode != 500 {
+		t.Fatalf("bad error: %#v", e)
+	}
+	if got, want := e.Error(), "Unable to create Exec, error: API error (500): server error"; got != want {
+		t.Fatalf("got %q want %q", got, want)
+	}
+}
+
+// A fake docker client which reports the full ID of the container the
+// exec ran in
+type fakeDockerClientWithFullContainerID struct {
+	fakeDockerClientWithNoErrors
+}
+
+func (d *fakeDockerClientWithFullContainerID) InspectExec(id string) (*docker.ExecInspect, error) {
+	return &docker.ExecInspect{
+		ID:          "123",
+		ContainerID: "54432bad1fc7e3c5b9a4f1d2",
+		ExitCode:    1,
+	}, nil
+}
+
+func TestExec_ContainerID(t *testing.T) {
+	t.Parallel()
+	res, err := Exec(&fakeDockerClientWithFullContainerID{}, ExecOptions{ContainerID: "54432bad1fc7", Cmd: []string{"/health.sh"}})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if got, want := res.ContainerID, "54432bad1fc7e3c5b9a4f1d2"; got != want {
+		t.Fatalf("got container ID %q want %q", got, want)
+	}
+
+	res, err = Exec(&fakeDockerClientWithNoErrors{}, ExecOptions{ContainerID: "54432bad1fc7", Cmd: []string{"/health.sh"}})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if got, want := res.ContainerID, "54432bad1fc7"; got != want {
+		t.Fatalf("got container ID %q want %q", got, want)
+	}
+}
+
+// A fake docker client which writes to both streams of the exec, if
+// stderr is attached.
+type fakeDockerClientWithStderr struct {
+	fakeDockerClientWithNoErrors
+	attachStderr bool
+}
+
+func (d *fakeDockerClientWithStderr) CreateExec(opts docker.CreateExecOptions) (*docker.Exec, error) {
+	d.attachStderr = opts.AttachStderr
+	return &docker.Exec{ID: "123"}, nil
+}
+
+func (d *fakeDockerClientWithStderr) StartExec(id string, opts docker.StartExecOptions) error {
+	fmt.Fprint(opts.OutputStream, "out;")
+	fmt.Fprint(opts.ErrorStream, "err;")
+	return nil
+}
+
+func TestExec_DiscardStderr(t *testing.T) {
+	t.Parallel()
+	for _, discard := range []bool{false, true} {
+		client := &fakeDockerClientWithStderr{}
+		res, err := Exec(client, ExecOptions{ContainerID: "54432bad1fc7", Cmd: []string{"/health.sh"}, DiscardStderr: discard})
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		want := "out;err;"
+		if discard {
+			want = "out;"
+		}
+		if got := string(res.Output); got != want {
+			t.Fatalf("discard %v: got output %q want %q", discard, got, want)
+		}
+		if client.attachStderr == discard {
+			t.Fatalf("discard %v: stderr attached %v", discard, client.attachStderr)
+		}
+	}
+}
+
+func TestExec_Output(t *testing.T) {
+	t.Parallel()
+	var out bytes.Buffer
+	res, err := Exec(&fakeDockerClientWithStderr{}, ExecOptions{ContainerID: "54432bad1fc7", Cmd: []string{"/health.sh"}, Output: &out})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if got, want := out.String(), "out;err;"; got != want {
+		t.Fatalf("got output %q want %q", got, want)
+	}
+	if len(res.Output) != 0 || res.Truncated() {
+		t.Fatalf("output should not be captured: %#v", res)
+	}
+}
+
+// A fake docker client which runs the exec of each command with the
+// exit code given for it and records the commands in the order they ran.
+type fakeDockerClientWithCommands struct {
+	fakeDockerClientWithNoErrors
+	exitCodes map[string]int
+
+	lock       sync.Mutex
+	cmds       []string
+	privileged []bool
+	env        [][]string
+}
+
+func (d *fakeDockerClientWithCommands) CreateExec(opts docker.CreateExecOptions) (*docker.Exec, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.cmds = append(d.cmds, strings.Join(opts.Cmd, " "))
+	d.privileged = append(d.privileged, opts.Privileged)
+	d.env = append(d.env, opts.Env)
+	return &docker.Exec{ID: strings.Join(opts.Cmd, " ")}, nil
+}
+
+func (d *fakeDockerClientWithCommands) StartExec(id string, opts docker.StartExecOptions) error {
+	fmt.Fprintf(opts.OutputStream, "%s;", id)
+	return nil
+}
+
+func (d *fakeDockerClientWithCommands) InspectExec(id string) (*docker.ExecInspect, error) {
+	return &docker.ExecInspect{ID: id, ExitCode: d.exitCodes[id]}, nil
+}
+
+func TestExec_PreAndPostCmd(t *testing.T) {
+	t.Parallel()
+	client := &fakeDockerClientWithCommands{}
+	var out bytes.Buffer
+	res, err := Exec(client, ExecOptions{
+		ContainerID: "54432bad1fc7",
+		Cmd:         []string{"/health.sh"},
+		PreCmd:      []string{"touch", "/tmp/probe"},
+		PostCmd:     []string{"rm", "/tmp/probe"},
+		Privileged:  true,
+		Output:      &out,
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if got, want := client.cmds, []string{"touch /tmp/probe", "/health.sh", "rm /tmp/probe"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got commands %v want %v", got, want)
+	}
+	if got, want := client.privileged, []bool{true, true, true}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got privileged %v want %v", got, want)
+	}
+	if got, want := out.String(), "/health.sh;"; got != want {
+		t.Fatalf("got output %q want %q", got, want)
+	}
+	if res.ExitCode != 0 || len(res.Warnings) != 0 {
+		t.Fatalf("bad: %#v", res)
+	}
+
+	// Failures of the setup and teardown are warnings and don't change
+	// the exit code of the main command, and teardown runs even if the
+	// main command fails.
+	client = &fakeDockerClientWithCommands{exitCodes: map[string]int{
+		"touch /tmp/probe": 1,
+		"/health.sh":       2,
+		"rm /tmp/probe":    3,
+	}}
+	res, err = Exec(client, ExecOptions{
+		ContainerID: "54432bad1fc7",
+		Cmd:         []string{"/health.sh"},
+		PreCmd:      []string{"touch", "/tmp/probe"},
+		PostCmd:     []string{"rm", "/tmp/probe"},
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if res.ExitCode != 2 || string(res.Output) != "/health.sh;" {
+		t.Fatalf("bad: %#v", res)
+	}
+	want := []string{
+		"Pre command [touch /tmp/probe] exited with 1: touch /tmp/probe;",
+		"Post command [rm /tmp/probe] exited with 3: rm /tmp/probe;",
+	}
+	if !reflect.DeepEqual(res.Warnings, want) {
+		t.Fatalf("got warnings %q want %q", res.Warnings, want)
+	}
+}
+
+func TestDockerCheck_LastResult(t *testing.T) {
+	t.Parallel()
+	check := &CheckDocker{
+		Notify:            mock.NewNotify(),
+		CheckID:           types.CheckID("foo"),
+		Script:            "/health.sh",
+		DockerContainerID: "54432bad1fc7",
+		Shell:             "/bin/sh",
+		Interval:          25 * time.Millisecond,
+		Logger:            log.New(ioutil.Discard, UniqueID(), log.LstdFlags),
+		dockerClient:      &fakeDockerClientWithFullContainerID{},
+	}
+	if res := check.LastResult(); res != nil {
+		t.Fatalf("should not have a result before running: %#v", res)
+	}
+	check.Start()
+	defer check.Stop()
+
+	retry.Run(t, func(r *retry.R) {
+		res := check.LastResult()
+		if res == nil {
+			r.Fatal("no result")
+		}
+		if res.ContainerID != "54432bad1fc7e3c5b9a4f1d2" || res.ExitCode != 1 || res.Truncated() {
+			r.Fatalf("bad: %#v", res)
+		}
+	})
+}
+
+func TestDockerCheck_Command(t *testing.T) {
+	t.Parallel()
+	check := &CheckDocker{
+		Notify:            mock.NewNotify(),
+		CheckID:           types.CheckID("foo"),
+		Script:            "/health.sh --password=hunter2",
+		DockerContainerID: "54432bad1fc7",
+		Shell:             "/bin/sh",
+		Interval:          25 * time.Millisecond,
+		ClientConfig:      DockerConfig{AuditRedact: []string{`password=\S+`}},
+		Logger:            log.New(ioutil.Discard, UniqueID(), log.LstdFlags),
+	}
+	if err := check.Init(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	want := []string{"/bin/sh", "-c", "/health.sh --<hidden>"}
+	if got := check.Command(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q want %q", got, want)
+	}
+
+	check.dockerClient = &fakeDockerClientWithFullContainerID{}
+	check.Start()
+	defer check.Stop()
+	retry.Run(t, func(r *retry.R) {
+		if check.LastResult() == nil {
+			r.Fatal("no result")
+		}
+	})
+	if got := check.Command(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q want %q", got, want)
+	}
+	if check.cmd[2] != "/health.sh --password=hunter2" {
+		t.Fatalf("the command run should not be redacted: %q", check.cmd)
+	}
+}
+
+func TestDockerCheckWhenExecInfoFailsAfterOutput(t *testing.T) {
+	t.Parallel()
+	expectDockerCheckStatus(t, &fakeDockerClientWithOutputAndExecInfoErrors{}, api.HealthCritical, "Unable to inspect Exec: Unable to query exec info\npartial output")
+}
+
+type fakeDockerContainerClient struct {
+	createOpts docker.CreateContainerOptions
+	exitCode   int
+	output     string
+	startErr   error
+	removed    []string
+}
+
+func (d *fakeDockerContainerClient) CreateContainer(opts docker.CreateContainerOptions) (*docker.Container, error) {
+	d.createOpts = opts
+	return &docker.Container{ID: "123"}, nil
+}
+
+func (d *fakeDockerContainerClient) StartContainerWithContext(id string, hostConfig *docker.HostConfig, ctx context.Context) error {
+	return d.startErr
+}
+
+func (d *fakeDockerContainerClient) WaitContainerWithContext(id string, ctx context.Context) (int, error) {
+	return d.exitCode, nil
+}
+
+func (d *fakeDockerContainerClient) Logs(opts docker.LogsOptions) error {
+	_, err := opts.OutputStream.Write([]byte(d.output))
+	return err
+}
+
+func (d *fakeDockerContainerClient) RemoveContainer(opts docker.RemoveContainerOptions) error {
+	d.removed = append(d.removed, opts.ID)
+	return nil
+}
+
+func TestRunContainer(t *testing.T) {
+	t.Parallel()
+	client := &fakeDockerContainerClient{exitCode: 2, output: "probe failed"}
+	opts := RunContainerOptions{
+		Image:      "probe",
+		Cmd:        []string{"check", "--all"},
+		Memory:     64 * 1024 * 1024,
+		PidsLimit:  10,
+		AutoRemove: true,
+	}
+	res, err := RunContainer(context.Background(), client, opts)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if got, want := res.ExitCode, 2; got != want {
+		t.Fatalf("got exit code %d want %d", got, want)
+	}
+	if got, want := res.OutputString(), "probe failed"; got != want {
+		t.Fatalf("got output %q want %q", got, want)
+	}
+	if got, want := client.createOpts.Config.Cmd, opts.Cmd; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got cmd %v want %v", got, want)
+	}
+	if got, want := client.createOpts.HostConfig.Memory, opts.Memory; got != want {
+		t.Fatalf("got memory limit %d want %d", got, want)
+	}
+	if got := client.createOpts.HostConfig.PidMode; got != "" {
+		t.Fatalf("got pid mode %q", got)
+	}
+	if got, want := client.removed, []string{"123"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got removed %v want %v", got, want)
+	}
+}
+
+func TestRunContainer_PidNamespace(t *testing.T) {
+	t.Parallel()
+	client := &fakeDockerContainerClient{}
+	opts := RunContainerOptions{Image: "probe", PidContainerID: "54432bad1fc7"}
+	if _, err := RunContainer(context.Background(), client, opts); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if got, want := client.createOpts.HostConfig.PidMode, "container:54432bad1fc7"; got != want {
+		t.Fatalf("got pid mode %q want %q", got, want)
+	}
+}
+
+func TestRunContainer_RemovesOnError(t *testing.T) {
+	t.Parallel()
+	client := &fakeDockerContainerClient{startErr: errors.New("no such image")}
+	_, err := RunContainer(context.Background(), client, RunContainerOptions{Image: "probe", AutoRemove: true})
+	if err == nil || !strings.Contains(err.Error(), "no such image") {
+		t.Fatalf("got error %v", err)
+	}
+	if got, want := client.removed, []string{"123"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got removed %v want %v", got, want)
+	}
+
+	client = &fakeDockerContainerClient{}
+	if _, err := RunContainer(context.Background(), client, RunContainerOptions{Image: "probe"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(client.removed) != 0 {
+		t.Fatalf("container should not be removed: %v", client.removed)
+	}
+}
+
+func TestExecResult_Truncated(t *testing.T) {
+	t.Parallel()
+	res := &ExecResult{Output: []byte("tail"), TotalWritten: 10}
+	if !res.Truncated() {
+		t.Fatal("should be truncated")
+	}
+	if got, want := res.OutputString(), "Captured 4 of 10 bytes\n...\ntail"; got != want {
+		t.Fatalf("got %q want %q", got, want)
+	}
+	res = &ExecResult{Output: bytes.Repeat([]byte("x"), 4), TotalWritten: 4}
+	if res.Truncated() {
+		t.Fatal("should not be truncated")
+	}
+}
+
+func TestExecResult_OutputEncoding(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		encoding string
+		output   []byte
+		want     string
+	}{
+		{"", []byte("caf\xc3\xa9"), "caf\u00e9"},
+		{OutputEncodingUTF8, []byte("caf\xe9!"), "caf\ufffd!"},
+		{OutputEncodingLatin1, []byte("caf\xe9"), "caf\u00e9"},
+		{OutputEncodingBinary, []byte{0, 1, 0xff}, "AAH/"},
+	}
+	for _, tt := range tests {
+		res := &ExecResult{Output: tt.output, OutputEncoding: tt.encoding}
+		if got := res.OutputString(); got != tt.want {
+			t.Fatalf("%q: got %q want %q", tt.encoding, got, tt.want)
+		}
+	}
+}
+
+func TestParseOutputEncoding(t *testing.T) {
+	t.Parallel()
+	for name, want := range map[string]string{
+		"":       OutputEncodingUTF8,
+		"UTF8":   OutputEncodingUTF8,
+		"Latin1": OutputEncodingLatin1,
+		"base64": OutputEncodingBinary,
+	} {
+		if got, err := ParseOutputEncoding(name); err != nil || got != want {
+			t.Fatalf("%q: got %q, %v want %q", name, got, err, want)
+		}
+	}
+	if _, err := ParseOutputEncoding("ebcdic"); err == nil {
+		t.Fatal("should fail")
+	}
+}
+
+func TestExecResult_Status(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		exitCode int
+		warning  []int
+		status   string
+	}{
+		{0, nil, api.HealthPassing},
+		{1, nil, api.HealthWarning},
+		{2, nil, api.HealthCritical},
+		{0, []int{2}, api.HealthPassing},
+		{1, []int{2}, api.HealthCritical},
+		{2, []int{2, 3}, api.HealthWarning},
+		{3, []int{2, 3}, api.HealthWarning},
+	}
+	for _, tt := range tests {
+		res := &ExecResult{ExitCode: tt.exitCode}
+		if got := res.Status(tt.warning); got != tt.status {
+			t.Fatalf("exit code %d with %v: got %q want %q", tt.exitCode, tt.warning, got, tt.status)
+		}
+	}
+}
+
+func TestExecResult_Failed(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		exitCode int
+		success  []int
+		failed   bool
+	}{
+		{0, nil, false},
+		{1, nil, true},
+		{1, []int{0, 1}, false},
+		{2, []int{0, 1}, true},
+		{0, []int{3}, true},
+		{3, []int{3}, false},
+	}
+	for _, tt := range tests {
+		res := &ExecResult{ExitCode: tt.exitCode, SuccessExitCodes: tt.success}
+		if got := res.Failed(); got != tt.failed {
+			t.Fatalf("exit code %d with %v: got %v want %v", tt.exitCode, tt.success, got, tt.failed)
+		}
+	}
+
+	res := &ExecResult{ExitCode: 1, SuccessExitCodes: []int{0, 1}}
+	if got := res.Status(nil); got != api.HealthPassing {
+		t.Fatalf("got %q want passing", got)
+	}
+}
+
+func TestExec_SuccessExitCodes(t *testing.T) {
+	t.Parallel()
+	opts := ExecOptions{ContainerID: "54432bad1fc7", Cmd: []string{"/bin/sh", "-c", "/health.sh"}, SuccessExitCodes: []int{0, 1}}
+	res, err := Exec(&fakeDockerClientWithExecExitCodeOne{}, opts)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !reflect.DeepEqual(res.SuccessExitCodes, []int{0, 1}) || res.Failed() {
+		t.Fatalf("bad: %#v", res)
+	}
+}
+
+func TestExecResult_JSONOutput(t *testing.T) {
+	t.Parallel()
+	res := &ExecResult{Output: []byte(`{"health":{"status":"warning","disk":"90%"},"version":"1.2"}`)}
+	out, err := res.JSONOutput(".health.status")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	want := &JSONOutput{
+		Status: "warning",
+		Fields: map[string]interface{}{
+			"health":  map[string]interface{}{"disk": "90%"},
+			"version": "1.2",
+		},
+	}
+	if !reflect.DeepEqual(out, want) {
+		t.Fatalf("got %#v want %#v", out, want)
+	}
+
+	for _, field := range []string{"status", "version.status", "health"} {
+		if _, err := res.JSONOutput(field); err == nil || !strings.Contains(err.Error(), "not found") {
+			t.Fatalf("field %q: got error %v", field, err)
+		}
+	}
+
+	res = &ExecResult{Output: []byte("OK")}
+	if _, err := res.JSONOutput("status"); err == nil || !strings.Contains(err.Error(), "Unable to parse output as JSON") {
+		t.Fatalf("got error %v", err)
+	}
+}
+
+// A fake docker client which prints the given output
+type fakeDockerClientWithOutput struct {
+	fakeDockerClientWithNoErrors
+	output string
+}
+
+func (d *fakeDockerClientWithOutput) StartExec(id string, opts docker.StartExecOptions) error {
+	fmt.Fprint(opts.OutputStream, d.output)
+	return nil
+}
+
+func TestDockerCheck_JSONStatusField(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		output string
+		status string
+	}{
+		{`{"status":"passing"}`, api.HealthPassing},
+		{`{"status":"warning","reason":"slow"}`, api.HealthWarning},
+		{`{"status":"critical"}`, api.HealthCritical},
+		{`{"status":"ok"}`, api.HealthCritical},
+		{`not json`, api.HealthCritical},
+	}
+	for _, tc := range cases {
+		notif := mock.NewNotify()
+		check := &CheckDocker{
+			Notify:            notif,
+			CheckID:           types.CheckID("foo"),
+			DockerContainerID: "54432bad1fc7",
+			JSONStatusField:   "status",
+			Logger:            log.New(ioutil.Discard, UniqueID(), log.LstdFlags),
+			dockerClient:      &fakeDockerClientWithOutput{output: tc.output},
+		}
+		check.check()
+		if got := notif.State("foo"); got != tc.status {
+			t.Fatalf("output %s: got status %q want %q", tc.output, got, tc.status)
+		}
+		if !strings.Contains(notif.Output("foo"), tc.output) {
+			t.Fatalf("output %s: got notes %q", tc.output, notif.Output("foo"))
+		}
+	}
+
+	notif := mock.NewNotify()
+	check := &CheckDocker{
+		Notify:            notif,
+		CheckID:           types.CheckID("foo"),
+		DockerContainerID: "54432bad1fc7",
+		JSONStatusField:   "status",
+		Logger:            log.New(ioutil.Discard, UniqueID(), log.LstdFlags),
+		dockerClient:      &fakeDockerClientWithOutput{output: `{"status":"warning","reason":"slow"}`},
+	}
+	check.check()
+	out := check.LastJSONOutput()
+	if out == nil || !reflect.DeepEqual(out.Fields, map[string]interface{}{"reason": "slow"}) {
+		t.Fatalf("got %#v", out)
+	}
+}
+
+func TestDockerCheck_LastExec(t *testing.T) {
+	t.Parallel()
+	check := &CheckDocker{
+		Notify:            mock.NewNotify(),
+		CheckID:           types.CheckID("foo"),
+		Script:            "/health.sh",
+		DockerContainerID: "54432bad1fc7",
+		Shell:             "/bin/sh",
+		Logger:            log.New(ioutil.Discard, UniqueID(), log.LstdFlags),
+		dockerClient:      &fakeDockerClientWithOutput{output: "all good"},
+	}
+	if exec := check.LastExec(); exec != nil {
+		t.Fatalf("got %#v before the first run", exec)
+	}
+	check.check()
+	exec := check.LastExec()
+	if exec == nil || exec.ExitCode != 0 || exec.Truncated || exec.OutputBytes != 8 || exec.Error != "" || exec.Duration == "" {
+		t.Fatalf("got %#v", exec)
+	}
+
+	check.dockerClient = &fakeDockerClientWithOutputAndExecInfoErrors{}
+	check.check()
+	exec = check.LastExec()
+	if exec == nil || !strings.Contains(exec.Error, "Unable to query exec info") {
+		t.Fatalf("got %#v", exec)
+	}
+}
+
+// A fake docker client which records the command of the exec and can
+// inspect containers
+type fakeDockerClientWithInspect struct {
+	fakeDockerClientWithNoErrors
+	cmd []string
+}
+
+func (d *fakeDockerClientWithInspect) CreateExec(opts docker.CreateExecOptions) (*docker.Exec, error) {
+	d.cmd = opts.Cmd
+	return &docker.Exec{ID: "123"}, nil
+}
+
+func (d *fakeDockerClientWithInspect) InspectContainerWithContext(id string, ctx context.Context) (*docker.Container, error) {
+	return &docker.Container{ID: id, Name: "/web"}, nil
+}
+
+func TestDockerCheck_ScriptTemplate(t *testing.T) {
+	t.Parallel()
+	client := &fakeDockerClientWithInspect{}
+	check := &CheckDocker{
+		Notify:            mock.NewNotify(),
+		CheckID:           types.CheckID("foo"),
+		Script:            "/health.sh {{.Node}} {{.ContainerName}} {{.ContainerID}}",
+		ScriptTemplate:    true,
+		NodeName:          "node1",
+		DockerContainerID: "54432bad1fc7",
+		Shell:             "/bin/sh",
+		Logger:            log.New(ioutil.Discard, UniqueID(), log.LstdFlags),
+		dockerClient:      client,
+	}
+	if err := check.parseTemplate(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	check.check()
+	want := []string{"/bin/sh", "-c", "/health.sh node1 web 54432bad1fc7"}
+	if !reflect.DeepEqual(client.cmd, want) {
+		t.Fatalf("got %v want %v", client.cmd, want)
+	}
+
+	check.Script = "/health.sh {{.Datacenter}}"
+	if err := check.parseTemplate(); err == nil || !strings.Contains(err.Error(), "Invalid script template") {
+		t.Fatalf("got error %v", err)
+	}
+}
+
+func TestHeaderTransport(t *testing.T) {
+	t.Parallel()
+	var got http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header
+	}))
+	defer srv.Close()
+
+	headers := make(http.Header)
+	headers.Set("X-Gateway-Token", "secret")
+	headers.Set("Content-Type", "text/plain")
+	client := &http.Client{Transport: &headerTransport{headers: headers, base: http.DefaultTransport}}
+
+	req, err := http.NewRequest("POST", srv.URL, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp.Body.Close()
+
+	if got.Get("X-Gateway-Token") != "secret" || got.Get("Content-Type") != "text/plain" {
+		t.Fatalf("bad: %v", got)
+	}
+	if req.Header.Get("X-Gateway-Token") != "" {
+		t.Fatalf("request should not be modified: %v", req.Header)
+	}
+}
+
+func TestDockerClient_HeadersOnUnixSocket(t *testing.T) {
+	host, ln, cleanup := listenUnix(t, "docker")
+	defer cleanup()
+	var lock sync.Mutex
+	var got []string
+	go http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		got = append(got, r.Header.Get("X-Gateway-Route"))
+		lock.Unlock()
+		fmt.Fprint(w, `{"ID":"123","ContainerID":"54432bad1fc7","Running":false,"ExitCode":1}`)
+	}))
+
+	defer setDockerHost(host)()
+	logger := log.New(ioutil.Discard, "", 0)
+	client, err := newDockerClient(DockerConfig{Headers: map[string]string{"X-Gateway-Route": "a"}}, logger)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := client.InspectExec("123"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if want := []string{"a"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v want %v", got, want)
+	}
+}
+
+func TestConnTraceTransport(t *testing.T) {
+	t.Parallel()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	var lock sync.Mutex
+	var got []bool
+	client := &http.Client{Transport: &connTraceTransport{
+		base: &http.Transport{},
+		gotConn: func(reused bool) {
+			lock.Lock()
+			defer lock.Unlock()
+			got = append(got, reused)
+		},
+	}}
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(srv.URL)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if want := []bool{false, true}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v want %v", got, want)
+	}
+}
+
+func TestDockerClient_ConnTraceReusesConns(t *testing.T) {
+	t.Parallel()
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"ID":"123","Running":false,"ExitCode":0}`)
+	})
+	socket, ln, cleanup := listenUnix(t, "docker")
+	defer cleanup()
+	go http.Serve(ln, handler)
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	for _, host := range []string{socket, "tcp://" + srv.Listener.Addr().String()} {
+		client, err := newDockerClient(DockerConfig{Host: host}, log.New(ioutil.Discard, "", 0))
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		var lock sync.Mutex
+		var got []bool
+		client.(*docker.Client).HTTPClient.Transport.(*latencyTransport).base.(*connTraceTransport).gotConn = func(reused bool) {
+			lock.Lock()
+			defer lock.Unlock()
+			got = append(got, reused)
+		}
+		for i := 0; i < 2; i++ {
+			if _, err := client.InspectExec("123"); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+		}
+
+		lock.Lock()
+		if want := []bool{false, true}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("%s: got %v want %v", host, got, want)
+		}
+		lock.Unlock()
+	}
+}
+
+func TestLatencyTransport(t *testing.T) {
+	t.Parallel()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	var lock sync.Mutex
+	var got []string
+	client := &http.Client{Transport: &latencyTransport{
+		base: &http.Transport{},
+		observe: func(call string, start time.Time) {
+			lock.Lock()
+			defer lock.Unlock()
+			got = append(got, call)
+		},
+	}}
+	for _, path := range []string{"/v1.24/exec/123/json", "/containers/54432bad1fc7/json"} {
+		resp, err := client.Get(srv.URL + path)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		resp.Body.Close()
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if want := []string{"inspect_exec", "inspect_container"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v want %v", got, want)
+	}
+}
+
+func TestDockerClient_LatencyOnUnixSocket(t *testing.T) {
+	t.Parallel()
+	host, ln, cleanup := listenUnix(t, "docker")
+	defer cleanup()
+	go http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/exec"):
+			fmt.Fprint(w, `{"Id":"123"}`)
+		default:
+			fmt.Fprint(w, `{"ID":"123","Running":false,"ExitCode":0}`)
+		}
+	}))
+
+	client, err := newDockerClient(DockerConfig{Host: host}, log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var lock sync.Mutex
+	var got []string
+	client.(*docker.Client).HTTPClient.Transport.(*latencyTransport).observe = func(call string, start time.Time) {
+		lock.Lock()
+		defer lock.Unlock()
+		got = append(got, call)
+	}
+	if _, err := client.CreateExec(docker.CreateExecOptions{Container: "54432bad1fc7", Cmd: []string{"/health.sh"}}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := client.InspectExec("123"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if want := []string{"create_exec", "inspect_exec"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v want %v", got, want)
+	}
+}
+
+func TestDockerAPICall(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		method, path, call string
+	}{
+		{"GET", "/_ping", "ping"},
+		{"GET", "/v1.24/version", "version"},
+		{"GET", "/containers/json", "list_containers"},
+		{"GET", "/v1.24/containers/54432bad1fc7/json", "inspect_container"},
+		{"POST", "/containers/54432bad1fc7/exec", "create_exec"},
+		{"GET", "/exec/123/json", "inspect_exec"},
+		{"POST", "/exec/123/start", "start_exec"},
+		{"POST", "/exec/123/resize", "resize_exec"},
+		{"GET", "/images/json", "other"},
+	}
+	for _, tt := range cases {
+		if got := dockerAPICall(tt.method, tt.path); got != tt.call {
+			t.Fatalf("%s %s: got %q want %q", tt.method, tt.path, got, tt.call)
+		}
+	}
+}
+
+func TestRedactHeaders(t *testing.T) {
+	t.Parallel()
+	headers := make(http.Header)
+	headers.Set("Authorization", "Basic Zm9vOmJhcg==")
+	headers.Set("X-Route", "a")
+	got := redactHeaders(headers, []string{"authorization"})
+	if want := "[Authorization: <hidden>, X-Route: a]"; got != want {
+		t.Fatalf("got %q want %q", got, want)
+	}
+}
+
+func TestBearerTransport_Refresh(t *testing.T) {
+	t.Parallel()
+	var bodies []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		if r.Header.Get("Authorization") != "Bearer fresh" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer srv.Close()
+
+	var refreshes int
+	tokens := DockerTokenFunc(func(refresh bool) (string, error) {
+		if refresh {
+			refreshes++
+			return "fresh", nil
+		}
+		return "stale", nil
+	})
+	client := &http.Client{Transport: &bearerTransport{tokens: tokens, base: http.DefaultTransport}}
+
+	resp, err := client.Post(srv.URL, "application/json", bytes.NewBufferString(`{"a":1}`))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d", resp.StatusCode)
+	}
+	if refreshes != 1 {
+		t.Fatalf("got %d refreshes want 1", refreshes)
+	}
+	if got, want := bodies, []string{`{"a":1}`, `{"a":1}`}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got bodies %v want %v", got, want)
+	}
+}
+
+func TestBearerTransport_RetriesOnce(t *testing.T) {
+	t.Parallel()
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer srv.Close()
+
+	client := &http.Client{Transport: &bearerTransport{tokens: StaticDockerToken("a"), base: http.DefaultTransport}}
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("got status %d", resp.StatusCode)
+	}
+	if requests != 2 {
+		t.Fatalf("got %d requests want 2", requests)
+	}
+}
+
+func TestDockerTokenFile(t *testing.T) {
+	t.Parallel()
+	f := testutil.TempFile(t, "docker-token")
+	defer os.Remove(f.Name())
+	if err := ioutil.WriteFile(f.Name(), []byte("a\n"), 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	tokens := dockerTokenFile(f.Name())
+	if token, err := tokens.Token(false); err != nil || token != "a" {
+		t.Fatalf("got token %q err %v", token, err)
+	}
+	if err := ioutil.WriteFile(f.Name(), []byte("b\n"), 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if token, err := tokens.Token(false); err != nil || token != "a" {
+		t.Fatalf("token should be cached, got %q err %v", token, err)
+	}
+	if token, err := tokens.Token(true); err != nil || token != "b" {
+		t.Fatalf("got token %q err %v", token, err)
+	}
+}
+
+// setDockerHost points newDockerClient at a fake daemon through the
+// environment until the returned func is called. The environment is
+// shared by the whole process so tests which use it can't run in parallel.
+func setDockerHost(host string) func() {
+	old, ok := os.LookupEnv("DOCKER_HOST")
+	os.Setenv("DOCKER_HOST", host)
+	return func() {
+		if ok {
+			os.Setenv("DOCKER_HOST", old)
+		} else {
+			os.Unsetenv("DOCKER_HOST")
+		}
+	}
+}
+
+// dockerLogFrame frames a chunk of the output of an exec the way the
+// daemon multiplexes stdout and stderr.
+func dockerLogFrame(stream byte, chunk string) []byte {
+	frame := []byte{stream, 0, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(frame[4:], uint32(len(chunk)))
+	return append(frame, chunk...)
+}
+
+// dockerExecHandler serves the API calls of an exec of a Docker check,
+// like the Docker daemon. The exec writes to stdout and stderr and exits
+// with 1. Requests which accept returns false for are rejected as
+// unauthorized.
+func dockerExecHandler(accept func(r *http.Request) bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !accept(r) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch {
+		case r.Method == "POST" && strings.HasSuffix(r.URL.Path, "/containers/54432bad1fc7/exec"):
+			fmt.Fprint(w, `{"Id":"123"}`)
+		case r.Method == "POST" && strings.HasSuffix(r.URL.Path, "/exec/123/start"):
+			w.Header().Set("Content-Type", "application/vnd.docker.raw-stream")
+			w.Write(dockerLogFrame(1, "healthy\n"))
+			w.Write(dockerLogFrame(2, "slow disk\n"))
+		case r.Method == "GET" && strings.HasSuffix(r.URL.Path, "/exec/123/json"):
+			fmt.Fprint(w, `{"ID":"123","ContainerID":"54432bad1fc7","Running":false,"ExitCode":1}`)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
+// serveDockerExec serves the API calls of an exec on a Unix socket, like
+// the local Docker daemon, see dockerExecHandler.
+func serveDockerExec(t *testing.T, accept func(r *http.Request) bool) (string, func()) {
+	host, ln, cleanup := listenUnix(t, "docker")
+	go http.Serve(ln, dockerExecHandler(accept))
+	return host, cleanup
+}
+
+// testDockerTokenExec runs an exec through a gateway on host which only
+// accepts requests with the token, and checks that all of the API calls of
+// the exec, its start included, got through.
+func testDockerTokenExec(t *testing.T, host string, calls func() []string) {
+	defer setDockerHost(host)()
+	logger := log.New(ioutil.Discard, "", 0)
+	client, err := newDockerClient(DockerConfig{Token: "secret"}, logger)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	res, err := Exec(client, ExecOptions{ContainerID: "54432bad1fc7", Cmd: []string{"/health.sh"}})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if got, want := string(res.Output), "healthy\nslow disk\n"; got != want || res.ExitCode != 1 {
+		t.Fatalf("got output %q and exit code %d", got, res.ExitCode)
+	}
+	want := []string{
+		"POST /containers/54432bad1fc7/exec",
+		"POST /exec/123/start",
+		"GET /exec/123/json",
+	}
+	if got := calls(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v want %v", got, want)
+	}
+}
+
+// dockerCalls records the API calls a fake daemon gets and accepts those
+// with the token.
+type dockerCalls struct {
+	lock  sync.Mutex
+	calls []string
+}
+
+func (c *dockerCalls) accept(r *http.Request) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.calls = append(c.calls, r.Method+" "+r.URL.Path)
+	return r.Header.Get("Authorization") == "Bearer secret"
+}
+
+func (c *dockerCalls) get() []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.calls
+}
+
+func TestDockerClient_TokenStartsExecThroughGateway(t *testing.T) {
+	var calls dockerCalls
+	srv := httptest.NewServer(dockerExecHandler(calls.accept))
+	defer srv.Close()
+	testDockerTokenExec(t, "tcp://"+srv.Listener.Addr().String(), calls.get)
+}
+
+func TestDockerClient_TokenOnUnixSocket(t *testing.T) {
+	var calls dockerCalls
+	host, cleanup := serveDockerExec(t, calls.accept)
+	defer cleanup()
+	testDockerTokenExec(t, host, calls.get)
+}
+
+// A fake docker client which fails to create a number of execs before
+// succeeding
+type fakeDockerClientWithFlakyCreateExec struct {
+	fakeDockerClientWithNoErrors
+	failures int
+	creates  int
+}
+
+func (d *fakeDockerClientWithFlakyCreateExec) CreateExec(opts docker.CreateExecOptions) (*docker.Exec, error) {
+	d.creates++
+	if d.creates <= d.failures {
+		return nil, errors.New("connection reset by peer")
+	}
+	return &docker.Exec{ID: "123"}, nil
+}
+
+func TestExec_CreateRetries(t *testing.T) {
+	old := execCreateRetryInterval
+	execCreateRetryInterval = time.Millisecond
+	defer func() { execCreateRetryInterval = old }()
+
+	client := &fakeDockerClientWithFlakyCreateExec{failures: 2}
+	opts := ExecOptions{ContainerID: "54432bad1fc7", Cmd: []string{"/health.sh"}, CreateRetries: 2}
+	if _, err := Exec(client, opts); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if client.creates != 3 {
+		t.Fatalf("got %d creates want 3", client.creates)
+	}
+
+	client = &fakeDockerClientWithFlakyCreateExec{failures: 2}
+	opts.CreateRetries = 1
+	if _, err := Exec(client, opts); err == nil || !strings.Contains(err.Error(), "connection reset") {
+		t.Fatalf("got error %v", err)
+	}
+	if client.creates != 2 {
+		t.Fatalf("got %d creates want 2", client.creates)
+	}
+}
+
+// A fake docker client whose first number of creates create the exec but
+// fail before the response is received, or fail without creating it if
+// dropped is set
+type fakeDockerClientWithLostCreateExec struct {
+	fakeDockerClientWithNoErrors
+	lost    int
+	dropped bool
+	creates int
+	execIDs []string
+	execs   map[string]*docker.ExecInspect
+	started []string
+}
+
+func (d *fakeDockerClientWithLostCreateExec) CreateExec(opts docker.CreateExecOptions) (*docker.Exec, error) {
+	d.creates++
+	id := fmt.Sprintf("exec-%d", d.creates)
+	if d.creates <= d.lost {
+		if !d.dropped {
+			d.add(id, opts.Cmd)
+		}
+		return nil, errors.New("read tcp 127.0.0.1:2375: read: connection reset by peer")
+	}
+	d.add(id, opts.Cmd)
+	return &docker.Exec{ID: id}, nil
+}
+
+func (d *fakeDockerClientWithLostCreateExec) add(id string, cmd []string) {
+	if d.execs == nil {
+		d.execs = make(map[string]*docker.ExecInspect)
+	}
+	d.execIDs = append(d.execIDs, id)
+	d.execs[id] = &docker.ExecInspect{
+		ID:            id,
+		ProcessConfig: docker.ExecProcessConfig{EntryPoint: cmd[0], Arguments: cmd[1:]},
+	}
+}
+
+func (d *fakeDockerClientWithLostCreateExec) StartExec(id string, opts docker.StartExecOptions) error {
+	d.started = append(d.started, id)
+	return nil
+}
+
+func (d *fakeDockerClientWithLostCreateExec) InspectExec(id string) (*docker.ExecInspect, error) {
+	info, ok := d.execs[id]
+	if !ok {
+		return nil, &docker.NoSuchExec{ID: id}
+	}
+	return info, nil
+}
+
+func (d *fakeDockerClientWithLostCreateExec) InspectContainerWithContext(id string, ctx context.Context) (*docker.Container, error) {
+	return &docker.Container{ID: id, ExecIDs: d.execIDs}, nil
+}
+
+func TestExec_CreateReusesUnacknowledgedExec(t *testing.T) {
+	old := execCreateRetryInterval
+	execCreateRetryInterval = time.Millisecond
+	defer func() { execCreateRetryInterval = old }()
+
+	// The idle exec of the same command which the container already had
+	// may be another caller's, so only the one the lost create made is
+	// used.
+	client := &fakeDockerClientWithLostCreateExec{lost: 1}
+	client.add("other", []string{"/bin/sh", "-c", "/health.sh"})
+	client.add("different", []string{"/bin/sh", "-c", "/other.sh"})
+	opts := ExecOptions{ContainerID: "54432bad1fc7", Cmd: []string{"/bin/sh", "-c", "/health.sh"}, CreateRetries: 2}
+	if _, err := Exec(client, opts); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if client.creates != 1 {
+		t.Fatalf("got %d creates want 1", client.creates)
+	}
+	if want := []string{"exec-1"}; !reflect.DeepEqual(client.started, want) {
+		t.Fatalf("got started %v want %v", client.started, want)
+	}
+
+	// Without a matching exec the create is retried.
+	client = &fakeDockerClientWithLostCreateExec{lost: 1, dropped: true}
+	client.add("other", []string{"/bin/sh", "-c", "/health.sh"})
+	if _, err := Exec(client, opts); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if client.creates != 2 {
+		t.Fatalf("got %d creates want 2", client.creates)
+	}
+	if want := []string{"exec-2"}; !reflect.DeepEqual(client.started, want) {
+		t.Fatalf("got started %v want %v", client.started, want)
+	}
+
+	// An exec another check created and hasn't started yet isn't used
+	// either.
+	client = &fakeDockerClientWithLostCreateExec{}
+	if _, err := createExec(context.Background(), client, opts, docker.CreateExecOptions{Container: opts.ContainerID, Cmd: opts.Cmd}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	client.lost, client.dropped = 2, true
+	if _, err := Exec(client, opts); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if want := []string{"exec-3"}; !reflect.DeepEqual(client.started, want) {
+		t.Fatalf("got started %v want %v", client.started, want)
+	}
+}
+
+func TestExec_CreateWaitsForInFlightCreate(t *testing.T) {
+	t.Parallel()
+	opts := ExecOptions{ContainerID: "in-flight", Cmd: []string{"/health.sh"}}
+	release, err := execCreates.acquire(context.Background(), opts.ContainerID+"\x00/health.sh")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	client := &fakeDockerClientWithFlakyCreateExec{}
+	if _, err := ExecWithTimeout(client, opts, 50*time.Millisecond); err == nil {
+		t.Fatal("should fail")
+	}
+	if client.creates != 0 {
+		t.Fatalf("should wait for the create in flight")
+	}
+
+	release()
+	if _, err := Exec(client, opts); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if client.creates != 1 {
+		t.Fatalf("got %d creates want 1", client.creates)
+	}
+}
+
+func TestExec_CreateConcurrent(t *testing.T) {
+	t.Parallel()
+	client := &fakeDockerClientWithNoErrors{}
+	opts := ExecOptions{ContainerID: "54432bad1fc7", Cmd: []string{"/health.sh"}, CreateRetries: 1}
+	errCh := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := Exec(client, opts)
+			errCh <- err
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-errCh; err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+}
+
+func TestExec_CreateRetryStopsWithContext(t *testing.T) {
+	old := execCreateRetryInterval
+	execCreateRetryInterval = time.Hour
+	defer func() { execCreateRetryInterval = old }()
+
+	client := &fakeDockerClientWithFlakyCreateExec{failures: 5}
+	opts := ExecOptions{ContainerID: "54432bad1fc7", Cmd: []string{"/health.sh"}, CreateRetries: 3}
+	start := time.Now()
+	if _, err := ExecWithTimeout(client, opts, 50*time.Millisecond); err == nil {
+		t.Fatalf("should fail")
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Fatalf("retry didn't stop with the context, took %v", d)
+	}
+	if client.creates != 1 {
+		t.Fatalf("got %d creates want 1", client.creates)
+	}
+}
+
+// A fake docker client which reports the exec as running for a number of
+// inspects
+type fakeDockerClientWithRunningExec struct {
+	fakeDockerClientWithNoErrors
+	running  int
+	inspects int
+}
+
+func (d *fakeDockerClientWithRunningExec) InspectExec(id string) (*docker.ExecInspect, error) {
+	d.inspects++
+	if d.inspects <= d.running {
+		return &docker.ExecInspect{ID: id, Running: true}, nil
+	}
+	return &docker.ExecInspect{ID: id, ExitCode: 2}, nil
+}
+
+func TestWaitExec(t *testing.T) {
+	t.Parallel()
+	client := &fakeDockerClientWithRunningExec{running: 3}
+	code, err := WaitExec(context.Background(), client, "123", 0)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if code != 2 || client.inspects != 4 {
+		t.Fatalf("got exit code %d after %d inspects", code, client.inspects)
+	}
+
+	_, err = WaitExec(context.Background(), &fakeDockerClientWithExecInfoErrors{}, "123", 0)
+	if err == nil {
+		t.Fatal("should fail")
+	}
+}
+
+func TestWaitExec_Cancel(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	client := &fakeDockerClientWithRunningExec{running: 1 << 30}
+	if _, err := WaitExec(ctx, client, "123", 0); err != context.DeadlineExceeded {
+		t.Fatalf("got error %v", err)
+	}
+}
+
+func TestWaitExec_Interval(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	client := &fakeDockerClientWithRunningExec{running: 1}
+	if _, err := WaitExec(ctx, client, "123", time.Second); err != context.DeadlineExceeded {
+		t.Fatalf("got error %v", err)
+	}
+	if client.inspects != 1 {
+		t.Fatalf("got %d inspects want 1", client.inspects)
+	}
+}
+
+func TestDockerCheck_TruncationWarning(t *testing.T) {
+	t.Parallel()
+	var logs bytes.Buffer
+	check := &CheckDocker{
+		Notify:            mock.NewNotify(),
+		CheckID:           types.CheckID("foo"),
+		Script:            "/health.sh",
+		DockerContainerID: "54432bad1fc7",
+		Logger:            log.New(&logs, "", 0),
+		dockerClient:      &fakeDockerClientWithLongOutput{},
+		cmd:               []string{"/bin/sh", "-c", "/health.sh"},
+	}
+	warnings := func() int {
+		return strings.Count(logs.String(), "[WARN] agent: Output of check 'foo' was truncated")
+	}
+
+	for i := 0; i < dockerTruncationWarnRuns-1; i++ {
+		check.check()
+	}
+	if n := warnings(); n != 0 {
+		t.Fatalf("got %d warnings before the threshold", n)
+	}
+	check.check()
+	if n := warnings(); n != 1 {
+		t.Fatalf("got %d warnings want 1", n)
+	}
+
+	// Further truncated runs are rate limited.
+	for i := 0; i < dockerTruncationWarnRuns; i++ {
+		check.check()
+	}
+	if n := warnings(); n != 1 {
+		t.Fatalf("got %d warnings want 1", n)
+	}
+}
+
+func TestNewDockerClient_Host(t *testing.T) {
+	t.Parallel()
+	logger := log.New(ioutil.Discard, "", 0)
+	client, err := newDockerClient(DockerConfig{Host: "tcp://127.0.0.1:2375"}, logger)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if got, want := client.(*docker.Client).Endpoint(), "tcp://127.0.0.1:2375"; got != want {
+		t.Fatalf("got endpoint %q want %q", got, want)
+	}
+
+	if _, err := newDockerClient(DockerConfig{Host: "bogus://"}, logger); err == nil {
+		t.Fatal("should fail")
+	}
+}
+
+// A fake docker client whose exec writes some output and then hangs until
+// released
+type fakeDockerClientWithHangingExec struct {
+	fakeDockerClientWithNoErrors
+	release chan struct{}
+}
+
+func (d *fakeDockerClientWithHangingExec) StartExec(id string, opts docker.StartExecOptions) error {
+	fmt.Fprint(opts.OutputStream, "partial output")
+	<-d.release
+	return nil
+}
+
+func TestExecWithTimeout(t *testing.T) {
+	t.Parallel()
+	client := &fakeDockerClientWithHangingExec{release: make(chan struct{})}
+	defer close(client.release)
+
+	opts := ExecOptions{ContainerID: "54432bad1fc7", Cmd: []string{"/health.sh"}}
+	res, err := ExecWithTimeout(client, opts, 50*time.Millisecond)
+	if err == nil || err.Error() != "Timed out running Exec after 50ms" {
+		t.Fatalf("got error %v", err)
+	}
+	if res == nil || res.OutputString() != "partial output" {
+		t.Fatalf("partial output should be returned: %#v", res)
+	}
+
+	res, err = ExecWithTimeout(&fakeDockerClientWithExecExitCodeOne{}, opts, time.Second)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if res.ExitCode != 1 || res.OutputString() != "output" {
+		t.Fatalf("got exit code %d output %q", res.ExitCode, res.OutputString())
+	}
+}
+
+// A fake docker client which reports a running exec and records the exec
+// created to kill it
+type fakeDockerClientForKill struct {
+	running    bool
+	entryPoint string
+	exitCode   int
+	killOpts   *docker.CreateExecOptions
+
+	// signals are the signals sent, and the exec stops running once it
+	// gets exitOn.
+	signals []string
+	exitOn  string
+}
+
+func (d *fakeDockerClientForKill) CreateExec(opts docker.CreateExecOptions) (*docker.Exec, error) {
+	d.killOpts = &opts
+	signal := opts.Cmd[len(opts.Cmd)-2]
+	d.signals = append(d.signals, signal)
+	if signal == d.exitOn {
+		d.running = false
+	}
+	return &docker.Exec{ID: "kill"}, nil
+}
+
+func (d *fakeDockerClientForKill) StartExec(id string, opts docker.StartExecOptions) error {
+	return nil
+}
+
+func (d *fakeDockerClientForKill) InspectExec(id string) (*docker.ExecInspect, error) {
+	if id == "kill" {
+		return &docker.ExecInspect{ID: id, ExitCode: d.exitCode}, nil
+	}
+	return &docker.ExecInspect{
+		ID:          id,
+		Running:     d.running,
+		ContainerID: "54432bad1fc7",
+		ProcessConfig: docker.ExecProcessConfig{
+			EntryPoint: d.entryPoint,
+			Arguments:  []string{"-c", "/health.sh"},
+		},
+	}, nil
+}
+
+// A fake docker client whose exec runs until it is killed.
+type fakeDockerClientWithKillableExec struct {
+	lock   sync.Mutex
+	killed bool
+}
+
+func (d *fakeDockerClientWithKillableExec) CreateExec(opts docker.CreateExecOptions) (*docker.Exec, error) {
+	if opts.Cmd[0] == "/health.sh" {
+		return &docker.Exec{ID: "123"}, nil
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.killed = true
+	return &docker.Exec{ID: "kill"}, nil
+}
+
+func (d *fakeDockerClientWithKillableExec) StartExec(id string, opts docker.StartExecOptions) error {
+	return nil
+}
+
+func (d *fakeDockerClientWithKillableExec) InspectExec(id string) (*docker.ExecInspect, error) {
+	if id == "kill" {
+		return &docker.ExecInspect{ID: id}, nil
+	}
+	return &docker.ExecInspect{
+		ID:            id,
+		Running:       true,
+		ProcessConfig: docker.ExecProcessConfig{EntryPoint: "/health.sh"},
+	}, nil
+}
+
+func TestExecTracker_CancelAll(t *testing.T) {
+	t.Parallel()
+	tracker := NewExecTracker()
+	client := &fakeDockerClientWithKillableExec{}
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := Exec(client, ExecOptions{ContainerID: "54432bad1fc7", Cmd: []string{"/health.sh"}, Tracker: tracker})
+		errCh <- err
+	}()
+
+	retry.Run(t, func(r *retry.R) {
+		tracker.lock.Lock()
+		defer tracker.lock.Unlock()
+		if len(tracker.execs) != 1 {
+			r.Fatalf("got %d execs", len(tracker.execs))
+		}
+	})
+	if n := tracker.CancelAll(); n != 1 {
+		t.Fatalf("cancelled %d execs", n)
+	}
+	select {
+	case err := <-errCh:
+		if err != ErrExecCancelled {
+			t.Fatalf("got error %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("exec was not cancelled")
+	}
+
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	if !client.killed {
+		t.Fatal("exec should be killed")
+	}
+	if n := tracker.CancelAll(); n != 0 {
+		t.Fatalf("cancelled %d execs", n)
+	}
+}
+
+func TestKillExec(t *testing.T) {
+	t.Parallel()
+	client := &fakeDockerClientForKill{running: true, entryPoint: "/bin/sh"}
+	if err := KillExec(context.Background(), client, "123"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if client.killOpts == nil || client.killOpts.Container != "54432bad1fc7" {
+		t.Fatalf("bad: %#v", client.killOpts)
+	}
+	if got, want := client.killOpts.Cmd[len(client.killOpts.Cmd)-1], "/bin/sh -c /health.sh "; got != want {
+		t.Fatalf("got %q want %q", got, want)
+	}
+
+	if got, want := client.killOpts.Cmd[len(client.killOpts.Cmd)-3], "0"; got != want {
+		t.Fatalf("got max age %q want %q", got, want)
+	}
+
+	client = &fakeDockerClientForKill{entryPoint: "/bin/sh"}
+	if err := KillExec(context.Background(), client, "123"); err != nil || client.killOpts != nil {
+		t.Fatalf("should not kill a finished exec: %v %#v", err, client.killOpts)
+	}
+
+	for _, client := range []*fakeDockerClientForKill{
+		{running: true},
+		{running: true, entryPoint: "/bin/sh", exitCode: 127},
+	} {
+		if err := KillExec(context.Background(), client, "123"); err != ErrKillExecUnsupported {
+			t.Fatalf("got error %v", err)
+		}
+	}
+
+	client = &fakeDockerClientForKill{running: true, entryPoint: "/bin/sh", exitCode: 1}
+	if err := KillExec(context.Background(), client, "123"); err == nil || !strings.Contains(err.Error(), "No process found") {
+		t.Fatalf("got error %v", err)
+	}
+}
+
+func TestKillExecWithOptions(t *testing.T) {
+	t.Parallel()
+	client := &fakeDockerClientForKill{running: true, entryPoint: "/bin/sh", exitOn: "INT"}
+	opts := KillOptions{Signal: "sigint", GracePeriod: time.Second}
+	if err := KillExecWithOptions(context.Background(), client, "123", opts); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if want := []string{"INT"}; !reflect.DeepEqual(client.signals, want) {
+		t.Fatalf("got signals %v want %v", client.signals, want)
+	}
+
+	// Only the processes which started since the exec are signaled.
+	client = &fakeDockerClientForKill{running: true, entryPoint: "/bin/sh", exitOn: "TERM"}
+	opts = KillOptions{StartedAt: time.Now().Add(-30 * time.Second)}
+	if err := KillExecWithOptions(context.Background(), client, "123", opts); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if got, want := client.killOpts.Cmd[len(client.killOpts.Cmd)-3], "32"; got != want {
+		t.Fatalf("got max age %q want %q", got, want)
+	}
+
+	// An exec which ignores the signal is sent KILL after the grace period.
+	client = &fakeDockerClientForKill{running: true, entryPoint: "/bin/sh", exitOn: "KILL"}
+	opts = KillOptions{GracePeriod: 10 * time.Millisecond}
+	if err := KillExecWithOptions(context.Background(), client, "123", opts); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if want := []string{"TERM", "KILL"}; !reflect.DeepEqual(client.signals, want) {
+		t.Fatalf("got signals %v want %v", client.signals, want)
+	}
+
+	if err := KillExecWithOptions(context.Background(), client, "123", KillOptions{Signal: "STOP"}); err == nil {
+		t.Fatal("should reject the signal")
+	}
+}
+
+func TestKillExecScript_SkipsApplication(t *testing.T) {
+	t.Parallel()
+	if _, err := os.Stat("/proc/uptime"); err != nil {
+		t.Skip("no /proc")
+	}
+
+	// A process started by the application has its parent in the
+	// container, so it isn't signaled even though it runs the command.
+	app := exec.Command("sleep", "37")
+	if err := app.Start(); err != nil {
+		t.Skipf("can't start sleep: %v", err)
+	}
+	defer app.Process.Kill()
+	done := make(chan error, 1)
+	go func() { done <- app.Wait() }()
+
+	kill := exec.Command("/bin/sh", "-c", killExecScript, "sh", "0", "TERM", "sleep 37 ")
+	if err := kill.Run(); err == nil {
+		t.Fatal("should find no process")
+	} else if e, ok := err.(*exec.ExitError); !ok || !strings.Contains(e.Error(), "exit status 1") {
+		t.Fatalf("err: %v", err)
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("should not be killed: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestParseKillSignal(t *testing.T) {
+	t.Parallel()
+	for in, want := range map[string]string{"": "TERM", "kill": "KILL", "SIGQUIT": "QUIT", "sigusr1": "USR1"} {
+		got, err := ParseKillSignal(in)
+		if err != nil || got != want {
+			t.Fatalf("%q: got %q, %v want %q", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"STOP", "9", "TERM; rm -rf /"} {
+		if _, err := ParseKillSignal(in); err == nil {
+			t.Fatalf("%q should be invalid", in)
+		}
+	}
+}
+
+func TestExecWithTimeout_Kills(t *testing.T) {
+	t.Parallel()
+	client := &fakeDockerClientWithKillableExec{}
+	opts := ExecOptions{ContainerID: "54432bad1fc7", Cmd: []string{"/health.sh"}}
+	if _, err := ExecWithTimeout(client, opts, 50*time.Millisecond); err == nil {
+		t.Fatal("should time out")
+	}
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	if !client.killed {
+		t.Fatal("exec should be killed")
+	}
+}
+
+type fakeDockerInspectClient struct {
+	container *docker.Container
+	err       error
+}
+
+func (d *fakeDockerInspectClient) InspectContainerWithContext(id string, ctx context.Context) (*docker.Container, error) {
+	return d.container, d.err
+}
+
+func TestContainerPortAddress(t *testing.T) {
+	t.Parallel()
+	client := &fakeDockerInspectClient{container: &docker.Container{
+		ID: "123",
+		NetworkSettings: &docker.NetworkSettings{
+			Ports: map[docker.Port][]docker.PortBinding{
+				"8080/tcp": {{HostIP: "0.0.0.0", HostPort: "32768"}},
+				"53/udp":   {{HostIP: "10.0.0.1", HostPort: "5353"}},
+				"9090/tcp": {{HostIP: "::", HostPort: "32769"}},
+				"9000/tcp": nil,
+			},
+		},
+	}}
+	cases := map[string]string{
+		"8080":     "127.0.0.1:32768",
+		"8080/tcp": "127.0.0.1:32768",
+		"53/udp":   "10.0.0.1:5353",
+		"9090":     "[::1]:32769",
+	}
+	for port, want := range cases {
+		addr, err := ContainerPortAddress(context.Background(), client, "123", port)
+		if err != nil {
+			t.Fatalf("port %s: err: %v", port, err)
+		}
+		if addr != want {
+			t.Fatalf("port %s: got %q want %q", port, addr, want)
+		}
+	}
+
+	for _, port := range []string{"9000", "53"} {
+		if _, err := ContainerPortAddress(context.Background(), client, "123", port); err == nil || !strings.Contains(err.Error(), "not published") {
+			t.Fatalf("port %s: got error %v", port, err)
+		}
+	}
+}
+
+func TestInspectContainer(t *testing.T) {
+	t.Parallel()
+	client := &fakeDockerInspectClient{container: &docker.Container{
+		ID:           "123",
+		Name:         "/web",
+		RestartCount: 2,
+		State: docker.State{
+			Running:   true,
+			Paused:    true,
+			Pid:       42,
+			Health:    docker.Health{Status: "healthy"},
+			StartedAt: time.Date(2017, 7, 10, 14, 2, 37, 0, time.UTC),
+		},
+	}}
+	info, err := InspectContainer(context.Background(), client, "123")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	want := ContainerInfo{ID: "123", Name: "web", State: "paused", Health: "healthy", RestartCount: 2, Pid: 42,
+		StartedAt: time.Date(2017, 7, 10, 14, 2, 37, 0, time.UTC)}
+	if !reflect.DeepEqual(info, want) {
+		t.Fatalf("got %#v want %#v", info, want)
+	}
+
+	client = &fakeDockerInspectClient{err: errors.New("No such container: 123")}
+	if _, err := InspectContainer(context.Background(), client, "123"); err == nil || !strings.Contains(err.Error(), "No such container") {
+		t.Fatalf("got error %v", err)
+	}
+}
+
+// A fake docker client whose exec fails in a container that can be
+// inspected
+type fakeDockerClientWithStartedContainer struct {
+	fakeDockerClientWithExecNonZeroExitCode
+	fakeDockerInspectClient
+}
+
+func TestDockerCheck_StartGracePeriod(t *testing.T) {
+	t.Parallel()
+	client := &fakeDockerClientWithStartedContainer{}
+	client.container = &docker.Container{ID: "54432bad1fc7", State: docker.State{StartedAt: time.Now()}}
+	notif := mock.NewNotify()
+	check := &CheckDocker{
+		Notify:            notif,
+		CheckID:           types.CheckID("foo"),
+		Script:            "/health.sh",
+		DockerContainerID: "54432bad1fc7",
+		Shell:             "/bin/sh",
+		StartGracePeriod:  time.Minute,
+		Logger:            log.New(ioutil.Discard, UniqueID(), log.LstdFlags),
+		dockerClient:      client,
+	}
+	check.cmd = []string{check.Shell, "-c", check.Script}
+	check.check()
+	if n := notif.Updates("foo"); n != 0 {
+		t.Fatalf("got %d updates during the grace period", n)
+	}
+
+	client.container.State.StartedAt = time.Now().Add(-2 * time.Minute)
+	check.check()
+	if got, want := notif.State("foo"), api.HealthCritical; got != want {
+		t.Fatalf("got status %q want %q", got, want)
+	}
+}
+
+// A fake docker client which counts the inspects of the container, and
+// stalls them until their context is done if stall is set
+type fakeDockerClientCountingInspects struct {
+	fakeDockerClientWithNoErrors
+	container *docker.Container
+	stall     bool
+
+	lock     sync.Mutex
+	inspects int
+}
+
+func (d *fakeDockerClientCountingInspects) InspectContainerWithContext(id string, ctx context.Context) (*docker.Container, error) {
+	d.lock.Lock()
+	d.inspects++
+	d.lock.Unlock()
+	if d.stall {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return d.container, nil
+}
+
+func TestDockerCheck_InspectsOncePerRun(t *testing.T) {
+	t.Parallel()
+	policy, err := NewContainerPolicy([]string{"web*"}, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	client := &fakeDockerClientCountingInspects{container: &docker.Container{
+		ID:    "54432bad1fc7",
+		Name:  "/web",
+		State: docker.State{Running: true, StartedAt: time.Now().Add(-time.Hour)},
+	}}
+	notif := mock.NewNotify()
+	check := &CheckDocker{
+		Notify:              notif,
+		CheckID:             types.CheckID("foo"),
+		Script:              "/health.sh {{.ContainerName}}",
+		ScriptTemplate:      true,
+		DockerContainerID:   "54432bad1fc7",
+		Shell:               "/bin/sh",
+		StartGracePeriod:    time.Minute,
+		CheckContainerState: true,
+		Logger:              log.New(ioutil.Discard, UniqueID(), log.LstdFlags),
+		dockerClient:        client,
+		policy:              policy,
+	}
+	if err := check.parseTemplate(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	check.check()
+	if got, want := notif.State("foo"), api.HealthPassing; got != want {
+		t.Fatalf("got status %q want %q: %s", got, want, notif.Output("foo"))
+	}
+	if client.inspects != 1 {
+		t.Fatalf("got %d inspects want 1", client.inspects)
+	}
+}
+
+func TestDockerCheck_InspectStalls(t *testing.T) {
+	t.Parallel()
+	client := &fakeDockerClientCountingInspects{stall: true}
+	notif := mock.NewNotify()
+	check := &CheckDocker{
+		Notify:              notif,
+		CheckID:             types.CheckID("foo"),
+		Script:              "/health.sh",
+		DockerContainerID:   "54432bad1fc7",
+		Shell:               "/bin/sh",
+		CheckContainerState: true,
+		Timeout:             50 * time.Millisecond,
+		Logger:              log.New(ioutil.Discard, UniqueID(), log.LstdFlags),
+		dockerClient:        client,
+	}
+
+	// The inspect ends with the timeout of the check.
+	check.check()
+	if got, want := notif.State("foo"), api.HealthCritical; got != want {
+		t.Fatalf("got status %q want %q", got, want)
+	}
+
+	// Without a timeout stopping the check ends it.
+	check.Timeout = 0
+	check.stopCh = make(chan struct{})
+	doneCh := make(chan struct{})
+	go func() {
+		check.check()
+		close(doneCh)
+	}()
+	retry.Run(t, func(r *retry.R) {
+		client.lock.Lock()
+		defer client.lock.Unlock()
+		if client.inspects != 2 {
+			r.Fatalf("got %d inspects", client.inspects)
+		}
+	})
+	close(check.stopCh)
+	select {
+	case <-doneCh:
+	case <-time.After(5 * time.Second):
+		t.Fatal("check didn't stop")
+	}
+}
+
+func TestRestartTracker(t *testing.T) {
+	t.Parallel()
+	var r restartTracker
+	now := time.Now()
+	steps := []struct {
+		after time.Duration
+		count int
+		want  int
+	}{
+		{0, 2, 0},
+		{10 * time.Second, 4, 2},
+		{20 * time.Second, 7, 5},
+		// The sample of the first step is out of the window.
+		{70 * time.Second, 7, 3},
+		// A recreated container starts over.
+		{80 * time.Second, 0, 0},
+	}
+	for i, s := range steps {
+		if got := r.observe(now.Add(s.after), s.count); got != s.want {
+			t.Fatalf("step %d: got %d restarts want %d", i, got, s.want)
+		}
+	}
+}
+
+func TestContainerVerdict(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		info     ContainerInfo
+		restarts int
+		status   string
+		summary  string
+		probe    bool
+	}{
+		{ContainerInfo{State: "running"}, 0, api.HealthPassing, "container running", true},
+		{ContainerInfo{State: "running", Health: "healthy"}, 1, api.HealthPassing, "container healthy", true},
+		{ContainerInfo{State: "running", Health: "starting"}, 0, api.HealthPassing, "container starting", true},
+		{ContainerInfo{State: "running", Health: "unhealthy"}, 0, api.HealthCritical, "container unhealthy", false},
+		{ContainerInfo{State: "running", Health: "healthy"}, 5, api.HealthCritical, "container restarting 5x in 1m0s", false},
+		{ContainerInfo{State: "restarting"}, 2, api.HealthCritical, "container restarting, restarted 2x in 1m0s", false},
+		{ContainerInfo{State: "exited"}, 0, api.HealthCritical, "container exited", false},
+	}
+	for _, c := range cases {
+		status, summary, probe := containerVerdict(c.info, c.restarts)
+		if status != c.status || summary != c.summary || probe != c.probe {
+			t.Fatalf("%+v: got %q %q %v", c.info, status, summary, probe)
+		}
+	}
+}
+
+// A fake docker client which runs execs that print output in a container
+// that can be inspected
+type fakeDockerClientWithContainerState struct {
+	fakeDockerClientWithNoErrors
+	fakeDockerInspectClient
+	execs int
+}
+
+func (d *fakeDockerClientWithContainerState) CreateExec(opts docker.CreateExecOptions) (*docker.Exec, error) {
+	d.execs++
+	return d.fakeDockerClientWithNoErrors.CreateExec(opts)
+}
+
+func TestDockerCheck_ContainerState(t *testing.T) {
+	t.Parallel()
+	client := &fakeDockerClientWithContainerState{}
+	client.container = &docker.Container{
+		ID:    "54432bad1fc7",
+		State: docker.State{Running: true, Health: docker.Health{Status: "healthy"}},
+	}
+	notif := mock.NewNotify()
+	check := &CheckDocker{
+		Notify:              notif,
+		CheckID:             types.CheckID("foo"),
+		Script:              "/health.sh",
+		DockerContainerID:   "54432bad1fc7",
+		Shell:               "/bin/sh",
+		CheckContainerState: true,
+		Logger:              log.New(ioutil.Discard, UniqueID(), log.LstdFlags),
+		dockerClient:        client,
+	}
+	check.cmd = []string{check.Shell, "-c", check.Script}
+	check.check()
+	if got, want := notif.Output("foo"), "container healthy, probe exit 0\noutput"; got != want {
+		t.Fatalf("got output %q want %q", got, want)
+	}
+	if got := notif.State("foo"); got != api.HealthPassing {
+		t.Fatalf("got status %q", got)
+	}
+
+	// The script isn't run in a container which restarts in a loop.
+	client.container.RestartCount = 3
+	check.check()
+	if got, want := notif.Output("foo"), "container restarting 3x in 1m0s"; got != want {
+		t.Fatalf("got output %q want %q", got, want)
+	}
+	if got := notif.State("foo"); got != api.HealthCritical || client.execs != 1 {
+		t.Fatalf("got status %q after %d execs", got, client.execs)
+	}
+}
+
+// A fake docker client which lists the containers with labels and runs
+// execs which fail in some of them
+type fakeDockerClientWithLabeledContainers struct {
+	fakeDockerClientWithNoErrors
+	filters  map[string][]string
+	exitCode map[string]int
+	execs    []string
+}
+
+func (d *fakeDockerClientWithLabeledContainers) ListContainers(opts docker.ListContainersOptions) ([]docker.APIContainers, error) {
+	d.filters = opts.Filters
+	var containers []docker.APIContainers
+	for id := range d.exitCode {
+		containers = append(containers, docker.APIContainers{ID: id})
+	}
+	return containers, nil
+}
+
+func (d *fakeDockerClientWithLabeledContainers) CreateExec(opts docker.CreateExecOptions) (*docker.Exec, error) {
+	d.execs = append(d.execs, opts.Container)
+	return &docker.Exec{ID: opts.Container}, nil
+}
+
+func (d *fakeDockerClientWithLabeledContainers) InspectExec(id string) (*docker.ExecInspect, error) {
+	return &docker.ExecInspect{ID: id, ContainerID: id, ExitCode: d.exitCode[id]}, nil
+}
+
+func TestResolveContainers(t *testing.T) {
+	t.Parallel()
+	client := &fakeDockerClientWithLabeledContainers{exitCode: map[string]int{"b": 0, "a": 0}}
+	ids, err := ResolveContainers(client, []string{"app=web", "canary"})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if want := []string{"a", "b"}; !reflect.DeepEqual(ids, want) {
+		t.Fatalf("got %v want %v", ids, want)
+	}
+	want := map[string][]string{"label": {"app=web", "canary"}, "status": {"running"}}
+	if !reflect.DeepEqual(client.filters, want) {
+		t.Fatalf("got filters %v want %v", client.filters, want)
+	}
+}
+
+// A fake docker client which lists the given containers
+type fakeDockerListClient struct {
+	containers []docker.APIContainers
+}
+
+func (d *fakeDockerListClient) ListContainers(opts docker.ListContainersOptions) ([]docker.APIContainers, error) {
+	return d.containers, nil
+}
+
+func TestResolveAllowedContainers(t *testing.T) {
+	t.Parallel()
+	client := &fakeDockerListClient{containers: []docker.APIContainers{
+		{ID: "c", Names: []string{"/db"}},
+		{ID: "b", Names: []string{"/web-2"}},
+		{ID: "a", Names: []string{"/other"}, Labels: map[string]string{"consul.check": "true"}},
+	}}
+	policy, err := NewContainerPolicy([]string{"web-*"}, []string{"consul.check=true"})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	ids, denied, err := ResolveAllowedContainers(client, []string{"app"}, policy)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if want := []string{"a", "b"}; !reflect.DeepEqual(ids, want) {
+		t.Fatalf("got %v want %v", ids, want)
+	}
+	if len(denied) != 1 || denied[0].ContainerID != "c" || denied[0].Name != "db" {
+		t.Fatalf("got denied %#v", denied)
+	}
+}
+
+func TestContainerPolicy(t *testing.T) {
+	t.Parallel()
+	if p, err := NewContainerPolicy(nil, nil); p != nil || err != nil {
+		t.Fatalf("got %v, %v", p, err)
+	}
+	if _, err := NewContainerPolicy([]string{"web-["}, nil); err == nil {
+		t.Fatal("should reject the pattern")
+	}
+	if _, err := NewContainerPolicy(nil, []string{"=true"}); err == nil {
+		t.Fatal("should reject the label")
+	}
+
+	var nilPolicy *ContainerPolicy
+	if !nilPolicy.Allows("db", nil) || !nilPolicy.AllowsSelector(nil) {
+		t.Fatal("a nil policy should allow everything")
+	}
+
+	p, err := NewContainerPolicy([]string{"web-*"}, []string{"team=payments", "consul.check"})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	allows := []struct {
+		name   string
+		labels map[string]string
+		ok     bool
+	}{
+		{"/web-1", nil, true},
+		{"db", nil, false},
+		{"db", map[string]string{"team": "payments"}, true},
+		{"db", map[string]string{"team": "search"}, false},
+		{"db", map[string]string{"consul.check": ""}, true},
+	}
+	for _, tt := range allows {
+		if got := p.Allows(tt.name, tt.labels); got != tt.ok {
+			t.Fatalf("%s %v: got %v want %v", tt.name, tt.labels, got, tt.ok)
+		}
+	}
+	selectors := []struct {
+		selector []string
+		ok       bool
+	}{
+		{[]string{"app=web", "team=payments"}, true},
+		{[]string{"team"}, false},
+		{[]string{"consul.check=yes"}, true},
+		{[]string{"app=web"}, false},
+	}
+	for _, tt := range selectors {
+		if got := p.AllowsSelector(tt.selector); got != tt.ok {
+			t.Fatalf("%v: got %v want %v", tt.selector, got, tt.ok)
+		}
+	}
+}
+
+func TestDockerCheck_ContainerPolicy(t *testing.T) {
+	t.Parallel()
+	notif := mock.NewNotify()
+	check := &CheckDocker{
+		Notify:            notif,
+		CheckID:           types.CheckID("foo"),
+		Script:            "/health.sh",
+		DockerContainerID: "54432bad1fc7",
+		Shell:             "/bin/sh",
+		Logger:            log.New(ioutil.Discard, UniqueID(), log.LstdFlags),
+		dockerClient:      &fakeDockerClientWithInspect{},
+	}
+	var err error
+	if check.policy, err = NewContainerPolicy([]string{"api-*"}, nil); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := check.checkPolicy(); err == nil || !strings.Contains(err.Error(), `Container "web" is not allowed`) {
+		t.Fatalf("got error %v", err)
+	}
+	check.check()
+	if got, want := notif.State("foo"), api.HealthCritical; got != want {
+		t.Fatalf("got status %q want %q", got, want)
+	}
+	if got := notif.Output("foo"); !strings.Contains(got, "is not allowed") {
+		t.Fatalf("got output %q", got)
+	}
+
+	if check.policy, err = NewContainerPolicy([]string{"web"}, nil); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := check.checkPolicy(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	check.check()
+	if got, want := notif.State("foo"), api.HealthPassing; got != want {
+		t.Fatalf("got status %q want %q", got, want)
+	}
+
+	// A check by labels the policy can't allow is rejected at registration.
+	check.DockerContainerLabels = []string{"app=web"}
+	if check.policy, err = NewContainerPolicy(nil, []string{"consul.check=true"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := check.checkPolicy(); err == nil || !strings.Contains(err.Error(), "are not allowed") {
+		t.Fatalf("got error %v", err)
+	}
+}
+
+func TestAggregateResults(t *testing.T) {
+	t.Parallel()
+	results := []ContainerResult{
+		{ContainerID: "a", Result: &ExecResult{ExitCode: 0, Output: []byte("ok")}},
+		{ContainerID: "b", Result: &ExecResult{ExitCode: 1, Output: []byte("slow")}},
+	}
+	status, output := AggregateResults(results, nil)
+	if status != api.HealthWarning {
+		t.Fatalf("got status %q", status)
+	}
+	if want := "1 of 2 containers are failing: b\nContainer a: passing\nok\nContainer b: warning\nslow"; output != want {
+		t.Fatalf("got output %q want %q", output, want)
+	}
+
+	results = append(results, ContainerResult{ContainerID: "c", Err: errors.New("Unable to start Exec")})
+	if status, _ := AggregateResults(results, nil); status != api.HealthCritical {
+		t.Fatalf("got status %q", status)
+	}
+
+	status, output = AggregateResults(results[:1], nil)
+	if status != api.HealthPassing || output != "Container a: passing\nok" {
+		t.Fatalf("got status %q output %q", status, output)
+	}
+}
+
+func TestDockerCheck_Labels(t *testing.T) {
+	t.Parallel()
+	client := &fakeDockerClientWithLabeledContainers{exitCode: map[string]int{"a": 0, "b": 2}}
+	notif := mock.NewNotify()
+	check := &CheckDocker{
+		Notify:                notif,
+		CheckID:               types.CheckID("foo"),
+		Script:                "/health.sh",
+		DockerContainerLabels: []string{"app=web"},
+		Shell:                 "/bin/sh",
+		Logger:                log.New(ioutil.Discard, UniqueID(), log.LstdFlags),
+		dockerClient:          client,
+	}
+	check.cmd = []string{check.Shell, "-c", check.Script}
+	check.check()
+	if got, want := notif.State("foo"), api.HealthCritical; got != want {
+		t.Fatalf("got status %q want %q", got, want)
+	}
+	if got := notif.Output("foo"); !strings.HasPrefix(got, "1 of 2 containers are failing: b\n") {
+		t.Fatalf("bad output %q", got)
+	}
+	if want := []string{"a", "b"}; !reflect.DeepEqual(client.execs, want) {
+		t.Fatalf("got execs in %v want %v", client.execs, want)
+	}
+
+	client.exitCode = nil
+	check.check()
+	if got, want := notif.Output("foo"), "No running container has the labels [app=web]"; got != want {
+		t.Fatalf("got output %q want %q", got, want)
+	}
+}
+
+func TestDockerCheck_OutputTransformer(t *testing.T) {
+	t.Parallel()
+	notif := mock.NewNotify()
+	check := &CheckDocker{
+		Notify:            notif,
+		CheckID:           types.CheckID("foo"),
+		Script:            "/health.sh",
+		DockerContainerID: "54432bad1fc7",
+		Shell:             "/bin/sh",
+		OutputTransformer: OutputTransformerFunc(strings.ToUpper),
+		Logger:            log.New(ioutil.Discard, UniqueID(), log.LstdFlags),
+		dockerClient:      &fakeDockerClientWithStderr{},
+	}
+	check.cmd = []string{check.Shell, "-c", check.Script}
+	check.check()
+	if got, want := notif.Output("foo"), "OUT;ERR;"; got != want {
+		t.Fatalf("got output %q want %q", got, want)
+	}
+}
+
+func TestCheckSemaphore(t *testing.T) {
+	t.Parallel()
+	if NewCheckSemaphore(0) != nil {
+		t.Fatal("should not limit checks")
+	}
+	var unlimited *CheckSemaphore
+	if !unlimited.Acquire(0, nil) {
+		t.Fatal("should acquire without a limit")
+	}
+	unlimited.Release()
+
+	s := NewCheckSemaphore(1)
+	if !s.Acquire(time.Second, nil) {
+		t.Fatal("should acquire a free slot")
+	}
+	if s.Acquire(10*time.Millisecond, nil) {
+		t.Fatal("should time out")
+	}
+	stopCh := make(chan struct{})
+	close(stopCh)
+	if s.Acquire(time.Minute, stopCh) {
+		t.Fatal("should give up when stopped")
+	}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		s.Release()
+	}()
+	if !s.Acquire(time.Second, nil) {
+		t.Fatal("should acquire a released slot")
+	}
+}
+
+func TestDockerCheck_Deferred(t *testing.T) {
+	t.Parallel()
+	slots := NewCheckSemaphore(1)
+	notif := mock.NewNotify()
+	check := &CheckDocker{
+		Notify:            notif,
+		CheckID:           types.CheckID("foo"),
+		Script:            "/health.sh",
+		DockerContainerID: "54432bad1fc7",
+		Shell:             "/bin/sh",
+		Interval:          10 * time.Millisecond,
+		Slots:             slots,
+		Logger:            log.New(ioutil.Discard, UniqueID(), log.LstdFlags),
+		dockerClient:      &fakeDockerClientWithNoErrors{},
+	}
+	check.cmd = []string{check.Shell, "-c", check.Script}
+
+	// The check is deferred while another one holds the only slot.
+	slots.Acquire(0, nil)
+	check.check()
+	if n := notif.Updates("foo"); n != 0 {
+		t.Fatalf("should not update a deferred check, got %d updates", n)
+	}
+
+	slots.Release()
+	check.check()
+	if got, want := notif.State("foo"), api.HealthPassing; got != want {
+		t.Fatalf("got status %q want %q", got, want)
+	}
+	if !slots.Acquire(0, nil) {
+		t.Fatal("the check should release its slot")
+	}
+}
+
+func TestDockerCheck_Paused(t *testing.T) {
+	t.Parallel()
+	pause := &CheckPause{}
+	notif := mock.NewNotify()
+	client := &fakeDockerClientWithCommands{}
+	check := &CheckDocker{
+		Notify:            notif,
+		CheckID:           types.CheckID("foo"),
+		Script:            "/health.sh",
+		DockerContainerID: "54432bad1fc7",
+		Shell:             "/bin/sh",
+		Pause:             pause,
+		Logger:            log.New(ioutil.Discard, UniqueID(), log.LstdFlags),
+		dockerClient:      client,
+	}
+	check.cmd = []string{check.Shell, "-c", check.Script}
+
+	pause.Pause("daemon upgrade")
+	check.check()
+	if n := notif.Updates("foo"); n != 0 || len(client.cmds) != 0 {
+		t.Fatalf("a paused check should not run, got %d updates and commands %v", n, client.cmds)
+	}
+
+	pause.Resume()
+	check.check()
+	if got, want := notif.State("foo"), api.HealthPassing; got != want {
+		t.Fatalf("got status %q want %q", got, want)
+	}
+}
+
+func TestDockerCheck_Env(t *testing.T) {
+	t.Parallel()
+	client := &fakeDockerClientWithCommands{}
+	check := &CheckDocker{
+		Notify:            mock.NewNotify(),
+		CheckID:           types.CheckID("foo"),
+		Script:            "/health.sh",
+		DockerContainerID: "54432bad1fc7",
+		Shell:             "/bin/sh",
+		Locale:            "C.UTF-8",
+		ConsoleWidth:      200,
+		ConsoleHeight:     50,
+		Logger:            log.New(ioutil.Discard, UniqueID(), log.LstdFlags),
+		dockerClient:      client,
+	}
+	check.cmd = []string{check.Shell, "-c", check.Script}
+	check.check()
+	want := [][]string{{"LANG=C.UTF-8", "LC_ALL=C.UTF-8", "COLUMNS=200", "LINES=50"}}
+	if !reflect.DeepEqual(client.env, want) {
+		t.Fatalf("got env %v want %v", client.env, want)
+	}
+}
+
+func TestCheckDockerAPIVersion(t *testing.T) {
+	t.Parallel()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/version":
+			w.Write([]byte(`{"ApiVersion":"1.30"}`))
+		case strings.HasSuffix(r.URL.Path, "/_ping"):
+			w.Write([]byte("OK"))
+		case strings.HasSuffix(r.URL.Path, "/exec"):
+			w.Write([]byte(`{"Id":"abc"}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	opts := docker.CreateExecOptions{Container: "123", Cmd: []string{"true"}, Env: []string{"LANG=C"}}
+
+	client, err := docker.NewClient("tcp://" + srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := client.CreateExec(opts); err == nil {
+		t.Fatal("should fail without the API version")
+	}
+	if err := checkDockerAPIVersion(client); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	exec, err := client.CreateExec(opts)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if exec.ID != "abc" {
+		t.Fatalf("bad: %#v", exec)
+	}
+}
+
+func TestDockerResultQueue(t *testing.T) {
+	t.Parallel()
+	var none *DockerResultQueue
+	none.push("foo", &ExecResult{}, nil)
+
+	q := NewDockerResultQueue(1)
+	defer q.Stop()
+	q.push("foo", &ExecResult{}, nil)
+	if len(q.ch) != 0 {
+		t.Fatal("should not queue results without a handler")
+	}
+
+	// A handler which doesn't keep up doesn't block the checks.
+	release := make(chan struct{})
+	got := make(chan types.CheckID, 10)
+	q.SetHandler(DockerResultHandlerFunc(func(checkID types.CheckID, res *ExecResult, err error) {
+		got <- checkID
+		<-release
+	}))
+	q.push("a", &ExecResult{}, nil)
+	if id := <-got; id != "a" {
+		t.Fatalf("got %q", id)
+	}
+	q.push("b", &ExecResult{}, nil)
+	q.push("c", &ExecResult{}, nil)
+	close(release)
+	if id := <-got; id != "b" {
+		t.Fatalf("got %q", id)
+	}
+	select {
+	case id := <-got:
+		t.Fatalf("should have dropped %q", id)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestDockerCheck_Results(t *testing.T) {
+	t.Parallel()
+	q := NewDockerResultQueue(0)
+	defer q.Stop()
+	type result struct {
+		checkID types.CheckID
+		res     *ExecResult
+	}
+	got := make(chan result, 1)
+	q.SetHandler(DockerResultHandlerFunc(func(checkID types.CheckID, res *ExecResult, err error) {
+		got <- result{checkID, res}
+	}))
+	check := &CheckDocker{
+		Notify:            mock.NewNotify(),
+		CheckID:           types.CheckID("foo"),
+		Script:            "/health.sh",
+		DockerContainerID: "54432bad1fc7",
+		Shell:             "/bin/sh",
+		Results:           q,
+		Logger:            log.New(ioutil.Discard, UniqueID(), log.LstdFlags),
+		dockerClient:      &fakeDockerClientWithNoErrors{},
+	}
+	check.cmd = []string{check.Shell, "-c", check.Script}
+	check.check()
+
+	select {
+	case r := <-got:
+		if r.checkID != "foo" || r.res == nil || r.res.ExitCode != 0 {
+			t.Fatalf("got %#v", r)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("should pass the result to the handler")
+	}
+}
+
+// timeoutError is a net.Error which timed out.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestDockerTimeoutError(t *testing.T) {
+	t.Parallel()
+	dial := &net.OpError{Op: "dial", Net: "tcp", Err: timeoutError{}}
+	read := &net.OpError{Op: "read", Net: "tcp", Err: timeoutError{}}
+	cases := []struct {
+		err   error
+		phase string
+	}{
+		{dial, DockerTimeoutConnect},
+		{&url.Error{Op: "Post", URL: "http://127.0.0.1:2375/exec", Err: dial}, DockerTimeoutConnect},
+		{read, DockerTimeoutResponse},
+		{&url.Error{Op: "Get", URL: "http://127.0.0.1:2375/exec", Err: read}, DockerTimeoutResponse},
+		{&net.OpError{Op: "dial", Net: "unix", Err: errors.New("no such file or directory")}, ""},
+		{errors.New("Exec Creation Failed"), ""},
+	}
+	for _, tc := range cases {
+		err := dockerTimeoutError(tc.err)
+		terr, ok := err.(*DockerTimeoutError)
+		if tc.phase == "" {
+			if ok || err != tc.err {
+				t.Fatalf("%v: should not be a timeout, got %#v", tc.err, err)
+			}
+			continue
+		}
+		if !ok || terr.Phase != tc.phase || terr.Err != tc.err {
+			t.Fatalf("%v: got %#v want phase %s", tc.err, err, tc.phase)
+		}
+		if !isDockerInfrastructureError(err) {
+			t.Fatalf("%v: should be an infrastructure error", err)
+		}
+	}
+
+	e := newExecError(ExecOpStart, "54432bad1fc7", "123", dial)
+	if got, want := e.Error(), "Unable to start Exec: Timed out connecting to the Docker daemon: dial tcp: i/o timeout"; got != want {
+		t.Fatalf("got %q want %q", got, want)
+	}
+	e = newExecError(ExecOpInspect, "54432bad1fc7", "123", read)
+	if got, want := e.Error(), "Unable to inspect Exec: Timed out waiting for the Docker daemon to respond: read tcp: i/o timeout"; got != want {
+		t.Fatalf("got %q want %q", got, want)
+	}
+}
+
+func TestSetDockerConnectTimeout(t *testing.T) {
+	t.Parallel()
+	for _, host := range []string{"tcp://127.0.0.1:2375", "unix:///var/run/docker.sock"} {
+		client, err := docker.NewClient(host)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		setDockerConnectTimeout(client, 3*time.Second)
+		if d, ok := client.Dialer.(*net.Dialer); !ok || d.Timeout != 3*time.Second {
+			t.Fatalf("%s: got dialer %#v", host, client.Dialer)
+		}
+		if tr, ok := client.HTTPClient.Transport.(*http.Transport); ok && tr.DialContext == nil {
+			t.Fatalf("%s: should set the dial of the transport", host)
+		}
+	}
+}
+
+// A fake docker client whose exec streams its output in many frames until
+// the output stream fails
+type fakeDockerClientWithFrames struct {
+	fakeDockerClientWithNoErrors
+	frames int
+}
+
+func (d *fakeDockerClientWithFrames) StartExec(id string, opts docker.StartExecOptions) error {
+	frame := bytes.Repeat([]byte("x"), 1024)
+	for i := 0; i < d.frames; i++ {
+		if _, err := opts.OutputStream.Write(frame); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestExec_ByteBudget(t *testing.T) {
+	t.Parallel()
+	opts := ExecOptions{ContainerID: "54432bad1fc7", Cmd: []string{"/bin/sh", "-c", "/health.sh"}}
+
+	// The budget is shared by the execs using it.
+	opts.Budget = NewByteBudget(3 * 1024)
+	if _, err := Exec(&fakeDockerClientWithFrames{frames: 2}, opts); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, err := Exec(&fakeDockerClientWithFrames{frames: 2}, opts)
+	e, ok := err.(*ExecError)
+	if !ok || e.Op != ExecOpStart {
+		t.Fatalf("got error %#v", err)
+	}
+	if berr, ok := e.Err.(*ByteBudgetError); !ok || berr.Limit != 3*1024 {
+		t.Fatalf("got error %#v", e.Err)
+	}
+
+	if NewByteBudget(0) != nil {
+		t.Fatal("a zero budget should not limit the execs")
+	}
+	opts.Budget = nil
+	if _, err := Exec(&fakeDockerClientWithFrames{frames: 100}, opts); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestDockerCheck_ByteBudget(t *testing.T) {
+	t.Parallel()
+	notif := mock.NewNotify()
+	check := &CheckDocker{
+		Notify:            notif,
+		CheckID:           types.CheckID("foo"),
+		Script:            "/health.sh",
+		DockerContainerID: "54432bad1fc7",
+		Shell:             "/bin/sh",
+		ClientConfig:      DockerConfig{MaxBytesPerInterval: 2048},
+		Logger:            log.New(ioutil.Discard, UniqueID(), log.LstdFlags),
+		dockerClient:      &fakeDockerClientWithFrames{frames: 100},
+	}
+	check.cmd = []string{check.Shell, "-c", check.Script}
+
+	// Every run gets a budget of its own.
+	for i := 0; i < 2; i++ {
+		check.check()
+		if got, want := notif.State("foo"), api.HealthCritical; got != want {
+			t.Fatalf("got status %q want %q", got, want)
+		}
+		if out := notif.Output("foo"); !strings.HasPrefix(out, "Unable to start Exec: Read more than 2048 bytes") {
+			t.Fatalf("got output %q", out)
+		}
+	}
+	check.dockerClient = &fakeDockerClientWithFrames{frames: 2}
+	check.check()
+	if got, want := notif.State("foo"), api.HealthPassing; got != want {
+		t.Fatalf("got status %q want %q", got, want)
+	}
+}
+
+func TestExecError_DaemonMessage(t *testing.T) {
+	t.Parallel()
+	body := `{"message":"Container 54432bad1fc7 is not running"}` + "\n"
+	e := newExecError(ExecOpStart, "54432bad1fc7", "123", &docker.Error{Status: 409, Message: body})
+	if got, want := e.DaemonMessage, "Container 54432bad1fc7 is not running"; got != want {
+		t.Fatalf("got message %q want %q", got, want)
+	}
+	if got, want := e.Error(), "Unable to start Exec: API error (409): Container 54432bad1fc7 is not running"; got != want {
+		t.Fatalf("got %q want %q", got, want)
+	}
+
+	e = newExecError(ExecOpStart, "54432bad1fc7", "123", &docker.Error{Status: 502, Message: "bad gateway\n"})
+	if got, want := e.DaemonMessage, "bad gateway"; got != want {
+		t.Fatalf("got message %q want %q", got, want)
+	}
+
+	e = newExecError(ExecOpStart, "54432bad1fc7", "123", errors.New("connection refused"))
+	if e.DaemonMessage != "" || e.Error() != "Unable to start Exec: connection refused" {
+		t.Fatalf("bad: %#v %q", e, e.Error())
+	}
+}
+
+func TestIsDockerInfrastructureError(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		err  error
+		want bool
+	}{
+		{docker.ErrConnectionRefused, true},
+		{&net.OpError{Op: "dial", Net: "unix", Err: errors.New("no such file or directory")}, true},
+		{newExecError(ExecOpCreate, "54432bad1fc7", "", &docker.Error{Status: 500, Message: "server error"}), true},
+		{newExecError(ExecOpStart, "54432bad1fc7", "123", io.ErrUnexpectedEOF), true},
+		{newExecError(ExecOpCreate, "54432bad1fc7", "", &docker.Error{Status: 409, Message: "container is not running"}), false},
+		{newExecError(ExecOpCreate, "54432bad1fc7", "", errors.New("Exec Creation Failed")), false},
+		{errors.New("template: bad"), false},
+	}
+	for _, tc := range cases {
+		if got := isDockerInfrastructureError(tc.err); got != tc.want {
+			t.Errorf("%v: got %v want %v", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestDockerCheck_InfrastructureStatus(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		client DockerClient
+		status string
+		want   string
+	}{
+		{&fakeDockerClientWithCreateExecStatus{}, "", api.HealthCritical},
+		{&fakeDockerClientWithCreateExecStatus{}, api.HealthWarning, api.HealthWarning},
+		{&fakeDockerClientWithCreateExecFailure{}, api.HealthWarning, api.HealthCritical},
+		{&fakeDockerClientWithExecNonZeroExitCode{}, api.HealthWarning, api.HealthCritical},
+	}
+	for i, tc := range cases {
+		notif := mock.NewNotify()
+		check := &CheckDocker{
+			Notify:            notif,
+			CheckID:           types.CheckID("foo"),
+			Script:            "/health.sh",
+			DockerContainerID: "54432bad1fc7",
+			Shell:             "/bin/sh",
+			ClientConfig:      DockerConfig{InfrastructureStatus: tc.status},
+			Logger:            log.New(ioutil.Discard, UniqueID(), log.LstdFlags),
+			dockerClient:      tc.client,
+		}
+		check.cmd = []string{check.Shell, "-c", check.Script}
+		check.check()
+		if got := notif.State("foo"); got != tc.want {
+			t.Errorf("%d: got status %q want %q", i, got, tc.want)
+		}
+	}
+}
+
+func TestLimitOutput(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		output string
+		max    int
+		keep   string
+		want   string
+	}{
+		{"abcdef", 6, "", "abcdef"},
+		{"abcdef", 4, "", "Kept 4 of 6 bytes\n...\ncdef"},
+		{"abcdef", 4, "tail", "Kept 4 of 6 bytes\n...\ncdef"},
+		{"abcdef", 4, "head", "abcd\n...\nKept 4 of 6 bytes"},
+		{"abcdef", 0, "", "abcdef"},
+		{"abc\u00e9", 4, "head", "abc\n...\nKept 3 of 5 bytes"},
+		{"\u00e9abc", 4, "", "Kept 3 of 5 bytes\n...\nabc"},
+		{"ab\u00e9f", 4, "head", "ab\u00e9\n...\nKept 4 of 5 bytes"},
+	}
+	for _, tc := range cases {
+		if got := limitOutput(tc.output, tc.max, tc.keep); got != tc.want {
+			t.Fatalf("%q %d %q: got %q want %q", tc.output, tc.max, tc.keep, got, tc.want)
+		}
+	}
+	long := strings.Repeat("a", CheckBufSize+1)
+	if got := limitOutput(long, 0, ""); len(got) <= CheckBufSize || !strings.HasPrefix(got, "Kept 4096 of 4097 bytes") {
+		t.Fatalf("got %q", got)
+	}
+}
+
+func TestDockerCheck_OutputLimits(t *testing.T) {
+	t.Parallel()
+	// The whole output has to be read to parse the status, which is more
+	// than is stored.
+	output := `{"status":"warning","pad":"` + strings.Repeat("x", 2*CheckBufSize) + `"}`
+	notif := mock.NewNotify()
+	check := &CheckDocker{
+		Notify:            notif,
+		CheckID:           types.CheckID("foo"),
+		DockerContainerID: "54432bad1fc7",
+		JSONStatusField:   "status",
+		ClientConfig:      DockerConfig{ExecOutputBytes: 4 * CheckBufSize, OutputMaxBytes: 10, OutputKeep: "head"},
+		Logger:            log.New(ioutil.Discard, UniqueID(), log.LstdFlags),
+		dockerClient:      &fakeDockerClientWithOutput{output: output},
+	}
+	check.check()
+	if got, want := notif.State("foo"), api.HealthWarning; got != want {
+		t.Fatalf("got status %q want %q", got, want)
+	}
+	if got := check.LastResult(); got.Truncated() || len(got.Output) != len(output) {
+		t.Fatalf("output should not be truncated: %d of %d bytes", len(got.Output), got.TotalWritten)
+	}
+	want := fmt.Sprintf(`{"status":`+"\n...\nKept 10 of %d bytes", len(output))
+	if got := notif.Output("foo"); got != want {
+		t.Fatalf("got output %q want %q", got, want)
+	}
+}
+
+func TestNewLockedBuffer_InvalidSize(t *testing.T) {
+	t.Parallel()
+	for _, size := range []int64{0, -1} {
+		buf := newLockedBuffer(size)
+		if _, err := buf.Write([]byte("output")); err != nil {
+			t.Fatalf("size %d: err: %v", size, err)
+		}
+		if got := string(buf.Bytes()); got != "output" {
+			t.Fatalf("size %d: got %q", size, got)
+		}
+	}
+}
+
+func TestExec_ContentType(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		output      string
+		contentType string
+		want        string
+	}{
+		{`{"status":"passing"}`, "", "application/json"},
+		{" [1, 2]\n", "", "application/json"},
+		{`{"truncated":`, "", "text/plain; charset=utf-8"},
+		{"all good", "", "text/plain; charset=utf-8"},
+		{"<html><body>ok</body></html>", "", "text/html; charset=utf-8"},
+		{"| a | b |", "text/markdown", "text/markdown"},
+		{"", "text/markdown", ""},
+	}
+	for _, tc := range cases {
+		client := &fakeDockerClientWithOutput{output: tc.output}
+		res, err := Exec(client, ExecOptions{ContainerID: "54432bad1fc7", Cmd: []string{"/health.sh"}, ContentType: tc.contentType})
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if res.ContentType != tc.want {
+			t.Fatalf("output %q: got content type %q want %q", tc.output, res.ContentType, tc.want)
+		}
+	}
+}
+
+func TestExec_MaxOutputBytes(t *testing.T) {
+	t.Parallel()
+	client := &fakeDockerClientWithOutput{output: "abcdef"}
+	res, err := Exec(client, ExecOptions{ContainerID: "54432bad1fc7", Cmd: []string{"/health.sh"}, MaxOutputBytes: 4})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(res.Output) != "cdef" || res.TotalWritten != 6 {
+		t.Fatalf("bad: %#v", res)
+	}
+}
+
+func TestLockedBuffer_Lines(t *testing.T) {
+	t.Parallel()
+	buf := newLockedBuffer(4)
+	for _, p := range []string{"one\ntw", "o\n", "", "three"} {
+		buf.Write([]byte(p))
+	}
+	if got := buf.Lines(); got != 3 {
+		t.Fatalf("got %d lines", got)
+	}
+	buf.Write([]byte("\n"))
+	if got := buf.Lines(); got != 3 {
+		t.Fatalf("got %d lines", got)
+	}
+}
+
+// A fake docker client which prints the given output on stdout and stderr
+type fakeDockerClientWithStreams struct {
+	fakeDockerClientWithNoErrors
+	stdout string
+	stderr string
+}
+
+func (d *fakeDockerClientWithStreams) StartExec(id string, opts docker.StartExecOptions) error {
+	fmt.Fprint(opts.OutputStream, d.stdout)
+	fmt.Fprint(opts.ErrorStream, d.stderr)
+	return nil
+}
+
+func TestOutputExpectation(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		expect OutputExpectation
+		stdout string
+		want   string
+	}{
+		{OutputExpectation{Contains: "OK"}, "status: OK", ""},
+		{OutputExpectation{Contains: "OK"}, "status: down", `Output doesn't contain "OK"`},
+		{OutputExpectation{Matches: regexp.MustCompile(`^up \d+`)}, "up 3 days", ""},
+		{OutputExpectation{Matches: regexp.MustCompile(`^up \d+`)}, "down", "Output doesn't match \"^up \\\\d+\""},
+		{OutputExpectation{Contains: "ERROR", Negate: true}, "all good", ""},
+		{OutputExpectation{Contains: "ERROR", Negate: true}, "ERROR: disk", `Output contains "ERROR"`},
+		{OutputExpectation{Matches: regexp.MustCompile(`(?i)fail`), Negate: true}, "Failed", `Output matches "(?i)fail"`},
+	}
+	for _, tc := range cases {
+		if got := tc.expect.Check(tc.stdout); got != tc.want {
+			t.Fatalf("%#v on %q: got %q want %q", tc.expect, tc.stdout, got, tc.want)
+		}
+	}
+}
+
+func TestExec_Expect(t *testing.T) {
+	t.Parallel()
+	// Only stdout is matched, though stderr is in the output.
+	client := &fakeDockerClientWithStreams{stdout: "status: ok\n", stderr: "ERROR: retrying\n"}
+	opts := ExecOptions{
+		ContainerID: "54432bad1fc7",
+		Cmd:         []string{"/health.sh"},
+		Expect:      &OutputExpectation{Contains: "ERROR", Negate: true},
+	}
+	res, err := Exec(client, opts)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(res.Stdout) != "status: ok\n" || res.ExpectationFailure != "" || res.Failed() {
+		t.Fatalf("bad: %#v", res)
+	}
+	if got, want := res.OutputString(), "status: ok\nERROR: retrying\n"; got != want {
+		t.Fatalf("got output %q want %q", got, want)
+	}
+
+	client.stdout = "ERROR: disk full\n"
+	res, err = Exec(client, opts)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if res.ExitCode != 0 || !res.Failed() || res.Status(nil) != api.HealthCritical {
+		t.Fatalf("bad: %#v", res)
+	}
+
+	// Without an expectation stdout isn't captured on its own.
+	opts.Expect = nil
+	if res, err := Exec(client, opts); err != nil || res.Stdout != nil || res.Failed() {
+		t.Fatalf("got %#v, %v", res, err)
+	}
+}
+
+func TestDockerCheck_Expect(t *testing.T) {
+	t.Parallel()
+	notif := mock.NewNotify()
+	check := &CheckDocker{
+		Notify:            notif,
+		CheckID:           types.CheckID("foo"),
+		DockerContainerID: "54432bad1fc7",
+		Expect:            &OutputExpectation{Contains: "ERROR", Negate: true},
+		Logger:            log.New(ioutil.Discard, UniqueID(), log.LstdFlags),
+		dockerClient:      &fakeDockerClientWithOutput{output: "ERROR: disk full"},
+	}
+	check.check()
+	if got := notif.State("foo"); got != api.HealthCritical {
+		t.Fatalf("got status %q", got)
+	}
+	if got, want := notif.Output("foo"), "Output contains \"ERROR\"\nERROR: disk full"; got != want {
+		t.Fatalf("got output %q want %q", got, want)
+	}
+}
+
+// newFakeExecDaemon starts a Docker daemon which runs every exec by writing
+// the raw stream to the attached connection and returns a client for it.
+func newFakeExecDaemon(t *testing.T, stream []byte) (*docker.Client, func()) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/exec") && r.Method == "POST":
+			fmt.Fprint(w, `{"Id":"e1"}`)
+		case strings.HasSuffix(r.URL.Path, "/exec/e1/start"):
+			conn, buf, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				t.Errorf("err: %v", err)
+				return
+			}
+			defer conn.Close()
+			buf.WriteString("HTTP/1.1 200 OK\r\nContent-Type: application/vnd.docker.raw-stream\r\n\r\n")
+			buf.Write(stream)
+			buf.Flush()
+		case strings.HasSuffix(r.URL.Path, "/exec/e1/json"):
+			fmt.Fprint(w, `{"ID":"e1","Running":false,"ExitCode":0}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	client, err := docker.NewClient(srv.URL)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	client.SkipServerVersionCheck = true
+	return client, srv.Close
+}
+
+func TestExec_SeparateStreams(t *testing.T) {
+	t.Parallel()
+	var stream []byte
+	stream = append(stream, dockerLogFrame(1, "status: ok\n")...)
+	stream = append(stream, dockerLogFrame(2, strings.Repeat("x", 10000))...)
+	stream = append(stream, dockerLogFrame(1, "done\n")...)
+	client, stop := newFakeExecDaemon(t, stream)
+	defer stop()
+
+	opts := ExecOptions{ContainerID: "123", Cmd: []string{"/health.sh"}, MaxOutputBytes: 64, SeparateStreams: true}
+	res, err := Exec(client, opts)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if got, want := string(res.Stdout), "status: ok\ndone\n"; got != want {
+		t.Fatalf("got stdout %q want %q", got, want)
+	}
+	if got, want := string(res.Stderr), strings.Repeat("x", 64); got != want {
+		t.Fatalf("got stderr %q want %q", got, want)
+	}
+	// The frames of a stream are kept in order without their headers,
+	// though the buffer cut one of them.
+	if got, want := string(res.Output), strings.Repeat("x", 59)+"done\n"; got != want {
+		t.Fatalf("got output %q want %q", got, want)
+	}
+	if res.TotalWritten != 10016 {
+		t.Fatalf("got %d bytes written", res.TotalWritten)
+	}
+
+	// Only the output is captured without the option.
+	opts.SeparateStreams = false
+	if res, err := Exec(client, opts); err != nil || res.Stdout != nil || res.Stderr != nil {
+		t.Fatalf("got %#v, %v", res, err)
+	}
+}
+
+func TestExec_TruncatedFrame(t *testing.T) {
+	t.Parallel()
+	// The stream ends within a frame which declares more than it has.
+	stream := append(dockerLogFrame(1, "status: ok\n"), dockerLogFrame(2, strings.Repeat("x", 100))[:20]...)
+	client, stop := newFakeExecDaemon(t, stream)
+	defer stop()
+
+	// The incomplete frame is dropped rather than leaking into the output.
+	res, err := Exec(client, ExecOptions{ContainerID: "123", Cmd: []string{"/health.sh"}, SeparateStreams: true})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(res.Output) != "status: ok\n" || string(res.Stdout) != "status: ok\n" || len(res.Stderr) != 0 {
+		t.Fatalf("bad: %#v", res)
+	}
+}
+
+func TestExec_LineCount(t *testing.T) {
+	t.Parallel()
+	client := &fakeDockerClientWithOutput{output: "error 1\nerror 2\nerror 3\n"}
+	res, err := Exec(client, ExecOptions{ContainerID: "54432bad1fc7", Cmd: []string{"/health.sh"}, MaxOutputBytes: 4})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if res.LineCount != 3 || res.TotalWritten != 24 {
+		t.Fatalf("bad: %#v", res)
+	}
+}
+
+func TestContainerRestartCount(t *testing.T) {
+	t.Parallel()
+	client := &fakeDockerInspectClient{container: &docker.Container{ID: "123", RestartCount: 7}}
+	n, err := ContainerRestartCount(client, "123")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if n != 7 {
+		t.Fatalf("got restart count %d want 7", n)
+	}
+
+	client = &fakeDockerInspectClient{err: errors.New("No such container: 123")}
+	if _, err := ContainerRestartCount(client, "123"); err == nil || !strings.Contains(err.Error(), "No such container") {
+		t.Fatalf("got error %v", err)
+	}
+}
+
+func TestContainerLogs(t *testing.T) {
+	t.Parallel()
+	var query url.Values
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/containers/123/logs") {
+			http.NotFound(w, r)
+			return
+		}
+		query = r.URL.Query()
+		w.Write(dockerLogFrame(1, "starting\nlisten"))
+		w.Write(dockerLogFrame(1, "ing on :8080\n"))
+		w.Write(dockerLogFrame(2, "error: db unreachable\n"))
+	}))
+	defer srv.Close()
+	client, err := docker.NewClient("tcp://" + srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	client.SkipServerVersionCheck = true
+
+	lines, err := ContainerLogs(context.Background(), client, "123", 3, 0)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	want := []string{"starting", "listening on :8080", "error: db unreachable"}
+	if !reflect.DeepEqual(lines, want) {
+		t.Fatalf("got %q want %q", lines, want)
+	}
+	if query.Get("tail") != "3" || query.Get("stdout") != "1" || query.Get("stderr") != "1" {
+		t.Fatalf("bad query: %v", query)
+	}
+
+	// The line cut off by the limit is dropped.
+	lines, err = ContainerLogs(context.Background(), client, "123", 0, 30)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if want := []string{"error: db unreachable"}; !reflect.DeepEqual(lines, want) {
+		t.Fatalf("got %q want %q", lines, want)
+	}
+	if query.Get("tail") != "all" {
+		t.Fatalf("bad query: %v", query)
+	}
+
+	if _, err := ContainerLogs(context.Background(), client, "456", 3, 0); err == nil || !strings.Contains(err.Error(), "Unable to read container logs") {
+		t.Fatalf("got error %v", err)
+	}
+}
+
+// fakeResetTransport fails the first number of requests with a connection
+// reset.
+type fakeResetTransport struct {
+	resets int
+	fresh  bool
+	calls  int
+	closed int
+}
+
+func (t *fakeResetTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.calls++
+	if trace := httptrace.ContextClientTrace(req.Context()); trace != nil && trace.GotConn != nil {
+		trace.GotConn(httptrace.GotConnInfo{Reused: !t.fresh})
+	}
+	if t.calls <= t.resets {
+		return nil, &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}
+	}
+	return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+}
+
+func (t *fakeResetTransport) CloseIdleConnections() {
+	t.closed++
+}
+
+func TestResetRetryTransport(t *testing.T) {
+	t.Parallel()
+	base := &fakeResetTransport{resets: 1}
+	tr := &resetRetryTransport{base: base}
+	req, _ := http.NewRequest("GET", "http://docker/exec/123/json", nil)
+	if _, err := tr.RoundTrip(req); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if base.calls != 2 || base.closed != 1 {
+		t.Fatalf("got %d calls and %d closes", base.calls, base.closed)
+	}
+
+	// Only one retry is made.
+	base = &fakeResetTransport{resets: 2}
+	tr = &resetRetryTransport{base: base}
+	if _, err := tr.RoundTrip(req); err == nil {
+		t.Fatal("should fail")
+	}
+	if base.calls != 2 {
+		t.Fatalf("got %d calls", base.calls)
+	}
+
+	// A request which fails on a new connection is not retried.
+	base = &fakeResetTransport{resets: 1, fresh: true}
+	tr = &resetRetryTransport{base: base}
+	if _, err := tr.RoundTrip(req); err == nil {
+		t.Fatal("should fail")
+	}
+	if base.calls != 1 || base.closed != 1 {
+		t.Fatalf("got %d calls and %d closes", base.calls, base.closed)
+	}
+
+	// Creating an exec is not idempotent so is not retried, but the idle
+	// connections are still closed.
+	base = &fakeResetTransport{resets: 1}
+	tr = &resetRetryTransport{base: base}
+	req, _ = http.NewRequest("POST", "http://docker/containers/123/exec", strings.NewReader("{}"))
+	if _, err := tr.RoundTrip(req); err == nil {
+		t.Fatal("should fail")
+	}
+	if base.calls != 1 || base.closed != 1 {
+		t.Fatalf("got %d calls and %d closes", base.calls, base.closed)
+	}
+}
+
+func TestDockerClient_RetriesResetOnUnixSocket(t *testing.T) {
+	t.Parallel()
+	host, ln, cleanup := listenUnix(t, "docker")
+	defer cleanup()
+	path := strings.TrimPrefix(host, "unix://")
+
+	// The daemon answers the first request and keeps the connection
+	// alive, then restarts while it handles the second request on that
+	// connection, closing it without a response.
+	restarted := make(chan net.Listener, 1)
+	errCh := make(chan error, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			errCh <- err
+			return
+		}
+		r := bufio.NewReader(conn)
+		if _, err := http.ReadRequest(r); err != nil {
+			errCh <- err
+			return
+		}
+		body := `{"ID":"123","Running":false,"ExitCode":0}`
+		fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nContent-Type: application/json\r\nContent-Length: %d\r\n\r\n%s", len(body), body)
+		if _, err := http.ReadRequest(r); err != nil {
+			errCh <- err
+			return
+		}
+		ln.Close()
+		ln, err := net.Listen("unix", path)
+		if err != nil {
+			errCh <- err
+			return
+		}
+		restarted <- ln
+		go http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, `{"ID":"123","Running":false,"ExitCode":0}`)
+		}))
+		conn.Close()
+		errCh <- nil
+	}()
+
+	client, err := newDockerClient(DockerConfig{Host: host}, log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		info, err := client.InspectExec("123")
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if info.ID != "123" {
+			t.Fatalf("got %#v", info)
+		}
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	(<-restarted).Close()
+}
@@ -0,0 +1,366 @@
+package agent
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// certReloader loads a client certificate from disk and loads it again
+// whenever the certificate or key file changes, so that long-lived Docker
+// clients pick up rotated certificates.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	lock    sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+// newCertReloader creates a certReloader and loads the certificate.
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := r.certificate(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// certificate returns the current certificate, loading it again if one of
+// the files has changed. If a changed certificate can't be loaded, for
+// example because only one of the files has been replaced yet, the
+// previous certificate is returned.
+func (r *certReloader) certificate() (*tls.Certificate, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	modTime, err := latestModTime(r.certFile, r.keyFile)
+	if err == nil && r.cert != nil && !modTime.After(r.modTime) {
+		return r.cert, nil
+	}
+	if err != nil {
+		if r.cert != nil {
+			return r.cert, nil
+		}
+		return nil, err
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		if r.cert != nil {
+			return r.cert, nil
+		}
+		return nil, err
+	}
+	r.cert, r.modTime = &cert, modTime
+	return r.cert, nil
+}
+
+// GetClientCertificate can be used as the tls.Config callback of the same
+// name.
+func (r *certReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return r.certificate()
+}
+
+// latestModTime returns the most recent modification time of the files.
+func latestModTime(files ...string) (time.Time, error) {
+	var latest time.Time
+	for _, file := range files {
+		fi, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// dockerEnvCertFiles returns the client certificate and key used by the
+// Docker client when TLS is enabled through the environment, following
+// the same rules as the Docker client library.
+func dockerEnvCertFiles() (certFile, keyFile string, ok bool) {
+	certPath := dockerEnvCertPath()
+	if certPath == "" {
+		return "", "", false
+	}
+	return filepath.Join(certPath, "cert.pem"), filepath.Join(certPath, "key.pem"), true
+}
+
+// dockerEnvCertPath returns the directory of the TLS files of the Docker
+// client when TLS is enabled through the environment, or an empty string
+// if it isn't.
+func dockerEnvCertPath() string {
+	if os.Getenv("DOCKER_TLS_VERIFY") == "" {
+		return ""
+	}
+	if certPath := os.Getenv("DOCKER_CERT_PATH"); certPath != "" {
+		return certPath
+	}
+	if home := os.Getenv("HOME"); home != "" {
+		return filepath.Join(home, ".docker")
+	}
+	return ""
+}
+
+// TLSEnabled returns true if TLS is set up for the Docker daemon with
+// ca_file, cert_file, key_file, cert_path or tls_skip_verify.
+func (c DockerConfig) TLSEnabled() bool {
+	return c.CAFile != "" || c.CertFile != "" || c.KeyFile != "" || c.CertPath != "" || c.TLSSkipVerify
+}
+
+// dockerTLSFiles returns the CA, certificate and key files of a client
+// with TLS set up for Docker. The files which aren't set are taken from
+// cert_path if they exist there, or from the cert path of the environment
+// if TLS isn't set up in the configuration, so that a configured host
+// uses DOCKER_TLS_VERIFY and DOCKER_CERT_PATH like the Docker CLI does.
+func dockerTLSFiles(cfg DockerConfig) (caFile, certFile, keyFile string) {
+	caFile, certFile, keyFile = cfg.CAFile, cfg.CertFile, cfg.KeyFile
+	certPath := cfg.CertPath
+	if !cfg.TLSEnabled() {
+		certPath = dockerEnvCertPath()
+	}
+	if certPath == "" {
+		return
+	}
+	for _, f := range []struct {
+		file *string
+		name string
+	}{{&caFile, "ca.pem"}, {&certFile, "cert.pem"}, {&keyFile, "key.pem"}} {
+		if *f.file != "" {
+			continue
+		}
+		if path := filepath.Join(certPath, f.name); fileExists(path) {
+			*f.file = path
+		}
+	}
+	return
+}
+
+// fileExists returns true if a file exists at path.
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// isTCPDockerHost returns true if the Docker host is reached over TCP.
+func isTCPDockerHost(host string) bool {
+	return strings.HasPrefix(host, "tcp://") || strings.HasPrefix(host, "https://")
+}
+
+// newTLSDockerClient creates a client for a Docker daemon reached over TCP
+// with TLS set up for Docker. Unlike the Docker client library, which
+// silently skips the verification of the daemon when it has no CA, the
+// daemon's certificate is verified against the system's roots without a
+// CA, and a configured file which can't be read is an error. Only
+// tls_skip_verify turns the verification off.
+func newTLSDockerClient(cfg DockerConfig) (*docker.Client, error) {
+	if cfg.Context != "" {
+		return nil, fmt.Errorf("Docker TLS files can't be used with a Docker context")
+	}
+	if !isTCPDockerHost(cfg.Host) {
+		return nil, fmt.Errorf("Docker TLS requires a tcp:// Docker host, got %q", cfg.Host)
+	}
+	caFile, certFile, keyFile := dockerTLSFiles(cfg)
+	if (certFile == "") != (keyFile == "") {
+		return nil, fmt.Errorf("Docker TLS requires both a cert_file and a key_file, or neither")
+	}
+	var pems [3][]byte
+	for i, file := range []string{certFile, keyFile, caFile} {
+		if file == "" {
+			continue
+		}
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read Docker TLS file: %v", err)
+		}
+		pems[i] = b
+	}
+	client, err := docker.NewTLSClientFromBytes(cfg.Host, pems[0], pems[1], pems[2])
+	if err != nil {
+		return nil, err
+	}
+	client.TLSConfig.InsecureSkipVerify = cfg.TLSSkipVerify
+	return client, nil
+}
+
+// dockerClientCertFiles returns the client certificate and key which are
+// reloaded when they change, for TLS set up through the environment or
+// for Docker in the configuration.
+func dockerClientCertFiles(cfg DockerConfig) (certFile, keyFile string, ok bool) {
+	switch {
+	case cfg.UseAgentTLS || cfg.Context != "":
+		return "", "", false
+	case cfg.Host == "":
+		return dockerEnvCertFiles()
+	case cfg.TLSEnabled() || (isTCPDockerHost(cfg.Host) && dockerEnvCertPath() != ""):
+		_, certFile, keyFile = dockerTLSFiles(cfg)
+		return certFile, keyFile, certFile != ""
+	}
+	return "", "", false
+}
+
+// tlsReloadingClient is a Docker client whose client certificate is
+// reloaded from disk when it changes. HTTP requests get the certificate
+// through the GetClientCertificate callback. The connection StartExec
+// hijacks is dialed with a copy of the certificates of the TLS config so
+// those are refreshed before every exec. This is safe since each Docker
+// check has its own client which is only used from the check's goroutine.
+type tlsReloadingClient struct {
+	*docker.Client
+	certs *certReloader
+}
+
+// newTLSReloadingClient sets up certificate reloading for the client. The
+// Docker client library shares its TLS config with its HTTP transport.
+func newTLSReloadingClient(client *docker.Client, certs *certReloader) *tlsReloadingClient {
+	client.TLSConfig.GetClientCertificate = certs.GetClientCertificate
+	return &tlsReloadingClient{Client: client, certs: certs}
+}
+
+func (c *tlsReloadingClient) StartExec(id string, opts docker.StartExecOptions) error {
+	cert, err := c.certs.certificate()
+	if err != nil {
+		return err
+	}
+	c.TLSConfig.Certificates = []tls.Certificate{*cert}
+	return c.Client.StartExec(id, opts)
+}
+
+// parseDockerFingerprint parses the SHA-256 fingerprint of the public key
+// of a Docker daemon's certificate. It is hex encoded, optionally with a
+// "sha256:" prefix and colons between the bytes.
+func parseDockerFingerprint(s string) ([]byte, error) {
+	raw := strings.TrimPrefix(strings.ToLower(strings.TrimSpace(s)), "sha256:")
+	fp, err := hex.DecodeString(strings.Replace(raw, ":", "", -1))
+	if err != nil || len(fp) != sha256.Size {
+		return nil, fmt.Errorf("%q is not the hex encoded SHA-256 of a public key", s)
+	}
+	return fp, nil
+}
+
+// verifyDockerFingerprint returns a function for tls.Config's
+// VerifyPeerCertificate which only accepts a daemon whose certificate has
+// a public key with the given SHA-256 fingerprint.
+func verifyDockerFingerprint(fp []byte) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return fmt.Errorf("Docker daemon didn't send a certificate")
+		}
+		cert, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return fmt.Errorf("Unable to parse the Docker daemon's certificate: %s", err)
+		}
+		sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		if subtle.ConstantTimeCompare(sum[:], fp) != 1 {
+			return fmt.Errorf("Docker daemon's certificate has fingerprint sha256:%x which doesn't match the configured TLS fingerprint", sum)
+		}
+		return nil
+	}
+}
+
+// pinDockerClient makes the client only trust a Docker daemon whose
+// certificate has a public key with the given fingerprint. Clients without
+// TLS are recreated with it. Unless a CA is configured the certificate
+// chain isn't verified, so a self-signed daemon can be trusted without
+// distributing a CA, but unlike skipping verification any other daemon
+// is rejected.
+func pinDockerClient(client *docker.Client, fingerprint string) (*docker.Client, error) {
+	fp, err := parseDockerFingerprint(fingerprint)
+	if err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(client.Endpoint())
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "unix" || u.Scheme == "npipe" {
+		return nil, fmt.Errorf("A TLS fingerprint can't be used with the Docker host %s", client.Endpoint())
+	}
+
+	if client.TLSConfig == nil {
+		pinned, err := docker.NewTLSClientFromBytes(client.Endpoint(), nil, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		pinned.SkipServerVersionCheck = client.SkipServerVersionCheck
+		client = pinned
+	}
+	if client.TLSConfig.RootCAs == nil {
+		client.TLSConfig.InsecureSkipVerify = true
+	}
+	client.TLSConfig.VerifyPeerCertificate = verifyDockerFingerprint(fp)
+
+	// The Docker client copies the TLS config for hijacked connections
+	// when it has no server name, and the copy doesn't keep the
+	// verification function.
+	if client.TLSConfig.ServerName == "" {
+		client.TLSConfig.ServerName = u.Hostname()
+	}
+	return client, nil
+}
+
+// newAgentTLSDockerClient creates a client for a Docker daemon reached
+// over TCP which is verified with the agent's CA and authenticated with
+// the agent's certificate, for use_agent_tls.
+func newAgentTLSDockerClient(cfg DockerConfig) (*docker.Client, error) {
+	if cfg.Context != "" {
+		return nil, fmt.Errorf("use_agent_tls can't be used with a Docker context")
+	}
+	if cfg.TLSEnabled() {
+		return nil, fmt.Errorf("use_agent_tls can't be used with Docker TLS files")
+	}
+	if !isTCPDockerHost(cfg.Host) {
+		return nil, fmt.Errorf("use_agent_tls requires a tcp:// Docker host, got %q", cfg.Host)
+	}
+	if cfg.TLSCAFile == "" {
+		return nil, fmt.Errorf("use_agent_tls requires the agent's ca_file to be set")
+	}
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		return nil, fmt.Errorf("use_agent_tls requires both the agent's cert_file and key_file, or neither")
+	}
+	return docker.NewTLSClient(cfg.Host, cfg.TLSCertFile, cfg.TLSKeyFile, cfg.TLSCAFile)
+}
+
+// agentTLSTransport explains failed TLS handshakes with a Docker daemon
+// which is verified with the agent's certificates, since the daemon's CA
+// often differs from the one of the cluster.
+type agentTLSTransport struct {
+	base http.RoundTripper
+}
+
+func (t *agentTLSTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, agentTLSError(err)
+	}
+	return resp, nil
+}
+
+// agentTLSError rewrites the error of a TLS handshake which failed because
+// the agent's certificates don't validate against the Docker daemon.
+func agentTLSError(err error) error {
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "x509: "):
+		return fmt.Errorf("The Docker daemon's certificate isn't valid for the agent's ca_file (use_agent_tls): %v", err)
+	case strings.Contains(msg, "remote error: tls: "):
+		return fmt.Errorf("The Docker daemon rejected the agent's cert_file (use_agent_tls): %v", err)
+	}
+	return err
+}
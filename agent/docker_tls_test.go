@@ -0,0 +1,281 @@
+package agent
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/hashicorp/consul/testutil"
+)
+
+func copyFile(t *testing.T, src, dst string) {
+	buf, err := ioutil.ReadFile(src)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := ioutil.WriteFile(dst, buf, 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	t.Parallel()
+	dir := testutil.TempDir(t, "docker-tls")
+	defer os.RemoveAll(dir)
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+
+	if _, err := newCertReloader(certFile, keyFile); err == nil {
+		t.Fatal("should fail without certificate")
+	}
+
+	copyFile(t, "../test/key/ourdomain.cer", certFile)
+	copyFile(t, "../test/key/ourdomain.key", keyFile)
+	r, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	first, err := r.GetClientCertificate(&tls.CertificateRequestInfo{})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Rotate the certificate. The modification time is moved forward
+	// since the file system may not have a fine enough resolution.
+	copyFile(t, "../test/key/ssl-cert-snakeoil.pem", certFile)
+	copyFile(t, "../test/key/ssl-cert-snakeoil.key", keyFile)
+	later := time.Now().Add(time.Minute)
+	for _, f := range []string{certFile, keyFile} {
+		if err := os.Chtimes(f, later, later); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	second, err := r.GetClientCertificate(&tls.CertificateRequestInfo{})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if reflect.DeepEqual(first.Certificate, second.Certificate) {
+		t.Fatal("certificate should have been reloaded")
+	}
+
+	// A half written rotation keeps the previous certificate.
+	if err := ioutil.WriteFile(keyFile, []byte("garbage"), 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	later = later.Add(time.Minute)
+	if err := os.Chtimes(keyFile, later, later); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	third, err := r.GetClientCertificate(&tls.CertificateRequestInfo{})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !reflect.DeepEqual(second.Certificate, third.Certificate) {
+		t.Fatal("previous certificate should be kept")
+	}
+}
+
+func TestParseDockerFingerprint(t *testing.T) {
+	t.Parallel()
+	sum := sha256.Sum256([]byte("key"))
+	hexed := hex.EncodeToString(sum[:])
+	var colons []string
+	for i := 0; i < len(hexed); i += 2 {
+		colons = append(colons, hexed[i:i+2])
+	}
+
+	for _, s := range []string{hexed, "sha256:" + hexed, strings.ToUpper(hexed), strings.Join(colons, ":")} {
+		fp, err := parseDockerFingerprint(s)
+		if err != nil {
+			t.Fatalf("%s: err: %v", s, err)
+		}
+		if !bytes.Equal(fp, sum[:]) {
+			t.Fatalf("%s: bad: %x", s, fp)
+		}
+	}
+	for _, s := range []string{"", "zz", hexed[:10], "md5:" + hexed} {
+		if _, err := parseDockerFingerprint(s); err == nil {
+			t.Fatalf("%s: should fail", s)
+		}
+	}
+}
+
+func TestPinDockerClient(t *testing.T) {
+	t.Parallel()
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	}))
+	defer srv.Close()
+	host := "tcp://" + srv.Listener.Addr().String()
+	sum := sha256.Sum256(srv.Certificate().RawSubjectPublicKeyInfo)
+
+	client, err := docker.NewClient(host)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	pinned, err := pinDockerClient(client, hex.EncodeToString(sum[:]))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := pinned.Ping(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	client, err = docker.NewClient(host)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	other := sha256.Sum256([]byte("other"))
+	pinned, err = pinDockerClient(client, hex.EncodeToString(other[:]))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	err = pinned.Ping()
+	if err == nil || !strings.Contains(err.Error(), "doesn't match the configured TLS fingerprint") {
+		t.Fatalf("bad: %v", err)
+	}
+
+	client, err = docker.NewClient("unix:///var/run/docker.sock")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := pinDockerClient(client, hex.EncodeToString(sum[:])); err == nil {
+		t.Fatal("should fail for a unix socket")
+	}
+}
+
+func TestNewDockerClient_AgentTLS(t *testing.T) {
+	t.Parallel()
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"ID":"abc"}`))
+	}))
+	defer srv.Close()
+	dir := testutil.TempDir(t, "docker-tls")
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.pem")
+	block := &pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}
+	if err := ioutil.WriteFile(caFile, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	logger := log.New(ioutil.Discard, "", 0)
+
+	cfg := DockerConfig{
+		Host:        "tcp://" + srv.Listener.Addr().String(),
+		UseAgentTLS: true,
+		TLSCAFile:   caFile,
+	}
+	client, err := newDockerClient(cfg, logger)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := client.InspectExec("abc"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	cfg.TLSCAFile = "../test/ca/root.cer"
+	client, err = newDockerClient(cfg, logger)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, err = client.InspectExec("abc")
+	if err == nil || !strings.Contains(err.Error(), "isn't valid for the agent's ca_file") {
+		t.Fatalf("bad: %v", err)
+	}
+
+	for _, bad := range []DockerConfig{
+		{UseAgentTLS: true, TLSCAFile: caFile},
+		{UseAgentTLS: true, Host: "unix:///var/run/docker.sock", TLSCAFile: caFile},
+		{UseAgentTLS: true, Host: cfg.Host},
+		{UseAgentTLS: true, Host: cfg.Host, TLSCAFile: caFile, TLSCertFile: "../test/key/ourdomain.cer"},
+	} {
+		if _, err := newDockerClient(bad, logger); err == nil {
+			t.Fatalf("%#v: should fail", bad)
+		}
+	}
+}
+
+func TestNewDockerClient_TLS(t *testing.T) {
+	t.Parallel()
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) == 0 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"ID":"abc"}`))
+	}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	srv.StartTLS()
+	defer srv.Close()
+	dir := testutil.TempDir(t, "docker-tls")
+	defer os.RemoveAll(dir)
+	block := &pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}
+	if err := ioutil.WriteFile(filepath.Join(dir, "ca.pem"), pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	copyFile(t, "../test/key/ourdomain.cer", filepath.Join(dir, "cert.pem"))
+	copyFile(t, "../test/key/ourdomain.key", filepath.Join(dir, "key.pem"))
+	logger := log.New(ioutil.Discard, "", 0)
+	host := "tcp://" + srv.Listener.Addr().String()
+
+	inspect := func(cfg DockerConfig) error {
+		client, err := newDockerClient(cfg, logger)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		_, err = client.InspectExec("abc")
+		return err
+	}
+
+	// The files are found in the cert path and the certificate is
+	// reloaded like the one of the environment.
+	cfg := DockerConfig{Host: host, CertPath: dir}
+	if err := inspect(cfg); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	certFile, keyFile, ok := dockerClientCertFiles(cfg)
+	if !ok || certFile != filepath.Join(dir, "cert.pem") || keyFile != filepath.Join(dir, "key.pem") {
+		t.Fatalf("got %q %q %v", certFile, keyFile, ok)
+	}
+
+	// The daemon is verified with a CA which didn't sign it or, without a
+	// CA, with the roots of the system.
+	for _, cfg := range []DockerConfig{
+		{Host: host, CertPath: dir, CAFile: "../test/ca/root.cer"},
+		{Host: host, CertFile: filepath.Join(dir, "cert.pem"), KeyFile: filepath.Join(dir, "key.pem")},
+	} {
+		if err := inspect(cfg); err == nil || !strings.Contains(err.Error(), "x509: ") {
+			t.Fatalf("%#v: got error %v", cfg, err)
+		}
+	}
+
+	// Unless verification is turned off.
+	cfg = DockerConfig{Host: host, CertFile: filepath.Join(dir, "cert.pem"), KeyFile: filepath.Join(dir, "key.pem"), TLSSkipVerify: true}
+	if err := inspect(cfg); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	for _, bad := range []DockerConfig{
+		{Host: "unix:///var/run/docker.sock", CertPath: dir},
+		{Host: host, CAFile: filepath.Join(dir, "missing.pem")},
+		{Host: host, CertFile: filepath.Join(dir, "cert.pem")},
+		{Context: "remote", CertPath: dir},
+		{Host: host, UseAgentTLS: true, TLSCAFile: filepath.Join(dir, "ca.pem"), CertPath: dir},
+	} {
+		if _, err := newDockerClient(bad, logger); err == nil {
+			t.Fatalf("%#v: should fail", bad)
+		}
+	}
+}
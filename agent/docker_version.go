@@ -0,0 +1,71 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// ErrDaemonVersionUnsupported is returned when the Docker client can't
+// query the version of the daemon.
+var ErrDaemonVersionUnsupported = errors.New("Docker client does not support querying the daemon version")
+
+// DockerVersionClient defines the operation of a docker client which
+// reports the version of the daemon.
+type DockerVersionClient interface {
+	Version() (*docker.Env, error)
+}
+
+// DaemonVersion is the version reported by the /version endpoint of the
+// Docker daemon.
+type DaemonVersion struct {
+	// Version is the version of the Docker engine, like "17.06.0-ce".
+	Version string
+
+	// APIVersion is the highest version of the API the daemon supports.
+	APIVersion docker.APIVersion
+}
+
+// AtLeast returns true if the daemon supports the API version, like
+// "1.25". Features which need a newer daemon can branch on it.
+func (v DaemonVersion) AtLeast(apiVersion string) bool {
+	want, err := docker.NewAPIVersion(apiVersion)
+	if err != nil {
+		return false
+	}
+	return v.APIVersion.GreaterThanOrEqualTo(want)
+}
+
+// daemonVersionCache caches the version of the daemon so that it's only
+// queried once per client instead of on every run of a check. A failed
+// query is retried on the next call.
+type daemonVersionCache struct {
+	lock    sync.Mutex
+	version *DaemonVersion
+}
+
+// Get returns the version of the daemon the client talks to.
+func (c *daemonVersionCache) Get(client DockerClient) (DaemonVersion, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.version != nil {
+		return *c.version, nil
+	}
+	vc, ok := client.(DockerVersionClient)
+	if !ok {
+		return DaemonVersion{}, ErrDaemonVersionUnsupported
+	}
+	env, err := vc.Version()
+	if err != nil {
+		return DaemonVersion{}, fmt.Errorf("Unable to query Docker version: %s", err)
+	}
+	apiVersion, err := docker.NewAPIVersion(env.Get("ApiVersion"))
+	if err != nil {
+		return DaemonVersion{}, fmt.Errorf("Invalid Docker API version: %s", err)
+	}
+	c.version = &DaemonVersion{Version: env.Get("Version"), APIVersion: apiVersion}
+	return *c.version, nil
+}
@@ -0,0 +1,53 @@
+package agent
+
+import (
+	"errors"
+	"testing"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+type fakeDockerClientWithVersion struct {
+	fakeDockerClientWithNoErrors
+	calls int
+	err   error
+}
+
+func (d *fakeDockerClientWithVersion) Version() (*docker.Env, error) {
+	d.calls++
+	if d.err != nil {
+		return nil, d.err
+	}
+	return &docker.Env{"Version=17.06.0-ce", "ApiVersion=1.30"}, nil
+}
+
+func TestDaemonVersionCache(t *testing.T) {
+	t.Parallel()
+	client := &fakeDockerClientWithVersion{err: errors.New("connection refused")}
+	var cache daemonVersionCache
+	if _, err := cache.Get(client); err == nil {
+		t.Fatal("should fail")
+	}
+
+	// A failed query is retried and a successful one is cached.
+	client.err = nil
+	for i := 0; i < 2; i++ {
+		v, err := cache.Get(client)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if v.Version != "17.06.0-ce" || v.APIVersion.String() != "1.30" {
+			t.Fatalf("bad: %#v", v)
+		}
+		if !v.AtLeast("1.25") || !v.AtLeast("1.30") || v.AtLeast("1.31") {
+			t.Fatalf("bad comparison for %s", v.APIVersion)
+		}
+	}
+	if client.calls != 2 {
+		t.Fatalf("got %d calls", client.calls)
+	}
+
+	if _, err := new(daemonVersionCache).Get(&fakeDockerClientWithNoErrors{}); err != ErrDaemonVersionUnsupported {
+		t.Fatalf("got error %v", err)
+	}
+}
@@ -0,0 +1,77 @@
+package agent
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+// grpcHealthCheckMethod is the method of the standard gRPC health checking
+// protocol, see https://github.com/grpc/grpc/blob/master/doc/health-checking.md.
+const grpcHealthCheckMethod = "/grpc.health.v1.Health/Check"
+
+// The serving statuses of grpc.health.v1.HealthCheckResponse.
+const (
+	grpcHealthUnknown    int32 = 0
+	grpcHealthServing    int32 = 1
+	grpcHealthNotServing int32 = 2
+)
+
+// grpcHealthStatusNames are the names of the serving statuses in the
+// protocol, used for the output of checks.
+var grpcHealthStatusNames = map[int32]string{
+	grpcHealthUnknown:    "UNKNOWN",
+	grpcHealthServing:    "SERVING",
+	grpcHealthNotServing: "NOT_SERVING",
+	3:                    "SERVICE_UNKNOWN",
+}
+
+// grpcHealthCheckRequest is grpc.health.v1.HealthCheckRequest. The
+// messages of the protocol are declared here like protoc would generate
+// them since they are all the agent needs from the grpc health package.
+type grpcHealthCheckRequest struct {
+	Service string `protobuf:"bytes,1,opt,name=service" json:"service,omitempty"`
+}
+
+func (m *grpcHealthCheckRequest) Reset()         { *m = grpcHealthCheckRequest{} }
+func (m *grpcHealthCheckRequest) String() string { return proto.CompactTextString(m) }
+func (*grpcHealthCheckRequest) ProtoMessage()    {}
+
+// grpcHealthCheckResponse is grpc.health.v1.HealthCheckResponse.
+type grpcHealthCheckResponse struct {
+	Status int32 `protobuf:"varint,1,opt,name=status" json:"status,omitempty"`
+}
+
+func (m *grpcHealthCheckResponse) Reset()         { *m = grpcHealthCheckResponse{} }
+func (m *grpcHealthCheckResponse) String() string { return proto.CompactTextString(m) }
+func (*grpcHealthCheckResponse) ProtoMessage()    {}
+
+// grpcHealthCheck asks the server of conn for the serving status of the
+// service. An empty service asks for the status of the server as a whole.
+func grpcHealthCheck(ctx context.Context, conn *grpc.ClientConn, service string) (int32, error) {
+	var resp grpcHealthCheckResponse
+	if err := grpc.Invoke(ctx, grpcHealthCheckMethod, &grpcHealthCheckRequest{Service: service}, &resp, conn); err != nil {
+		return 0, err
+	}
+	return resp.Status, nil
+}
+
+// parseGRPCTarget splits the target of a gRPC check, "host:port" or
+// "host:port/service", into the address to dial and the service.
+func parseGRPCTarget(target string) (addr, service string) {
+	if i := strings.Index(target, "/"); i >= 0 {
+		return target[:i], target[i+1:]
+	}
+	return target, ""
+}
+
+// grpcHealthStatusName returns the name of a serving status.
+func grpcHealthStatusName(status int32) string {
+	if name, ok := grpcHealthStatusNames[status]; ok {
+		return name
+	}
+	return "status " + strconv.Itoa(int(status))
+}
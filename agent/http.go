@@ -91,6 +91,7 @@ func (s *HTTPServer) handler(enableDebug bool) http.Handler {
 	}
 	handleFuncMetrics("/v1/agent/self", s.wrap(s.AgentSelf))
 	handleFuncMetrics("/v1/agent/maintenance", s.wrap(s.AgentNodeMaintenance))
+	handleFuncMetrics("/v1/agent/docker/pause", s.wrap(s.AgentDockerPause))
 	handleFuncMetrics("/v1/agent/reload", s.wrap(s.AgentReload))
 	handleFuncMetrics("/v1/agent/monitor", s.wrap(s.AgentMonitor))
 	handleFuncMetrics("/v1/agent/services", s.wrap(s.AgentServices))
@@ -0,0 +1,18 @@
+//go:build !windows
+// +build !windows
+
+package agent
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// namedPipesSupported is whether npipe:// hosts can be connected to.
+const namedPipesSupported = false
+
+// dialNamedPipe fails since named pipes only exist on Windows.
+func dialNamedPipe(path string, timeout time.Duration) (net.Conn, error) {
+	return nil, fmt.Errorf("Unable to connect to named pipe %s: named pipes are only supported on Windows", path)
+}
@@ -0,0 +1,23 @@
+//go:build windows
+// +build windows
+
+package agent
+
+import (
+	"net"
+	"time"
+
+	"github.com/Microsoft/go-winio"
+)
+
+// namedPipesSupported is whether npipe:// hosts can be connected to.
+const namedPipesSupported = true
+
+// dialNamedPipe connects to the named pipe at path, like
+// //./pipe/docker_engine.
+func dialNamedPipe(path string, timeout time.Duration) (net.Conn, error) {
+	if timeout <= 0 {
+		return winio.DialPipe(path, nil)
+	}
+	return winio.DialPipe(path, &timeout)
+}
@@ -1,97 +1,1779 @@
 package agent
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/hashicorp/consul/lib"
+	multierror "github.com/hashicorp/go-multierror"
+	"github.com/hashicorp/serf/serf"
+	"google.golang.org/api/googleapi"
+)
+
+// retryJoinPeersFile is the file in the data directory the servers of the
+// LAN pool are saved to when retry_join_last_known is set.
+const retryJoinPeersFile = "retry_join_peers.json"
+
+// The Serf clusters a RetryJoinError can be for.
+const (
+	RetryJoinLAN = "LAN"
+	RetryJoinWAN = "WAN"
 )
 
+// RetryJoinError is sent on the retry join channel when the maximum number
+// of join attempts has been exhausted. It carries the details of the failed
+// attempts so that a useful diagnostic can be logged before exiting.
+type RetryJoinError struct {
+	// Cluster is the Serf cluster that could not be joined, RetryJoinLAN
+	// or RetryJoinWAN.
+	Cluster string
+
+	// Attempts is the number of join attempts that were made.
+	Attempts int
+
+	// Elapsed is the time spent trying to join.
+	Elapsed time.Duration
+
+	// Servers is the list of servers tried on the last attempt.
+	Servers []string
+
+	// Err is the error returned by the last attempt.
+	Err error
+}
+
+func (e *RetryJoinError) Error() string {
+	return fmt.Sprintf("agent: max join %s retry exhausted after %d attempts in %s, servers tried: %v, last error: %v",
+		e.Cluster, e.Attempts, e.Elapsed, e.Servers, e.Err)
+}
+
+// The states of a retry join a RetryJoinEvent can report.
+const (
+	RetryJoinAttempting    = "attempting"
+	RetryJoinJoined        = "joined"
+	RetryJoinFailedAttempt = "failed-attempt"
+	RetryJoinExhausted     = "exhausted"
+)
+
+// retryJoinStatusBuffer is the number of events the retry join status
+// channel holds before the oldest are dropped.
+const retryJoinStatusBuffer = 16
+
+// RetryJoinEvent is sent on the retry join status channel whenever a
+// retry join changes state.
+type RetryJoinEvent struct {
+	// Cluster is the Serf cluster being joined, RetryJoinLAN or
+	// RetryJoinWAN.
+	Cluster string
+
+	// State is the new state, one of the RetryJoin state constants.
+	State string
+
+	// Attempt is the number of the attempt, starting at 1.
+	Attempt int
+
+	// Err is the error of a failed attempt or of the last attempt once
+	// the retries are exhausted.
+	Err error
+}
+
+// retryJoinStatus sends an event on the retry join status channel without
+// blocking. If the channel is full the oldest event is dropped, so a slow
+// consumer always sees the latest state.
+func (a *Agent) retryJoinStatus(cluster, state string, attempt int, err error) {
+	ev := RetryJoinEvent{Cluster: cluster, State: state, Attempt: attempt, Err: err}
+	for {
+		select {
+		case a.retryJoinStatusCh <- ev:
+			return
+		default:
+		}
+		select {
+		case <-a.retryJoinStatusCh:
+		default:
+		}
+	}
+}
+
 // RetryJoin is used to handle retrying a join until it succeeds or all
 // retries are exhausted.
 func (a *Agent) retryJoin() {
-	cfg := a.config
+	a.retryJoinWith(a.JoinLAN, time.After)
+}
 
-	ec2Enabled := cfg.RetryJoinEC2.TagKey != "" && cfg.RetryJoinEC2.TagValue != ""
-	gceEnabled := cfg.RetryJoinGCE.TagValue != ""
-	azureEnabled := cfg.RetryJoinAzure.TagName != "" && cfg.RetryJoinAzure.TagValue != ""
+// retryJoinWith does the work of retryJoin. It joins the servers with join
+// and waits between attempts on the channels returned by after so tests
+// can run it without a cluster or a real clock. It returns early when the
+// agent shuts down.
+func (a *Agent) retryJoinWith(join func([]string) (int, error), after func(time.Duration) <-chan time.Time) {
+	cfg := a.config
 
-	if len(cfg.RetryJoin) == 0 && !ec2Enabled && !gceEnabled && !azureEnabled {
+	if len(cfg.RetryJoin) == 0 && len(cfg.RetryJoinFallback) == 0 && len(cfg.RetryJoinSeeds) == 0 && !cfg.discoveryEnabled() {
 		return
 	}
 
 	a.logger.Printf("[INFO] agent: Joining cluster...")
+	if a.inCluster(cfg, 1) {
+		return
+	}
+	lastKnown := cfg.RetryJoinLastKnown && cfg.DataDir != ""
+	if lastKnown {
+		a.retryJoinStatus(RetryJoinLAN, RetryJoinAttempting, 1, nil)
+		if a.joinLastKnown(join) {
+			a.retryJoinStatus(RetryJoinLAN, RetryJoinJoined, 1, nil)
+			return
+		}
+	}
+
+	discoverLogger := newDiscoverLogger(a.logger, cfg.DisableDiscoveryLogs)
+	discoverErrs := &discoverErrorLog{logger: a.logger}
+	providers := cfg.discoveryProviders()
+	interval := a.retryJoinInterval("retry_interval", cfg.RetryInterval)
+	// The watches are restarted when the providers are reloaded.
+	var stopWatches context.CancelFunc
+	watch := func() <-chan struct{} {
+		if stopWatches != nil {
+			stopWatches()
+		}
+		var ctx context.Context
+		ctx, stopWatches = context.WithCancel(context.Background())
+		return a.watchDiscovery(ctx, discoverLogger, providers)
+	}
+	changed := watch()
+	defer func() { stopWatches() }()
+	schedule := newProviderSchedule(cfg.RetryJoinProviderRetry)
+	list := &joinServerList{
+		dead:     newDeadServers(cfg.RetryJoinSkipAfter),
+		excluded: make(map[string]bool),
+	}
+	backoff := retryJoinBackoffFor(a.retryJoinBackoff, interval, cfg.RetryMaxInterval)
+	backoff.Reset()
+	reload := func(newCfg *Config) {
+		cfg = reloadRetryJoinConfig(cfg, newCfg)
+		providers = cfg.discoveryProviders()
+		schedule = newProviderSchedule(cfg.RetryJoinProviderRetry)
+		changed = watch()
+		a.logger.Printf("[INFO] agent: Reloaded retry_join configuration, %d servers and %d discovery providers",
+			len(cfg.RetryJoin)+len(cfg.RetryJoinFallback)+len(cfg.RetryJoinSeeds), len(providers))
+	}
+	start := time.Now()
+	// reportExhausted reports that retry join gave up after the attempts.
+	reportExhausted := func(attempts int, servers []string, err error) {
+		a.retryJoinStatus(RetryJoinLAN, RetryJoinExhausted, attempts, err)
+		a.retryJoinCh <- &RetryJoinError{
+			Cluster:  RetryJoinLAN,
+			Attempts: attempts,
+			Elapsed:  time.Since(start),
+			Servers:  servers,
+			Err:      err,
+		}
+	}
 	attempt := 0
 	for {
+		if attempt > 0 && a.inCluster(cfg, attempt+1) {
+			return
+		}
 		var servers []string
 		var err error
-		switch {
-		case ec2Enabled:
-			servers, err = cfg.discoverEc2Hosts(a.logger)
-			if err != nil {
-				a.logger.Printf("[ERR] agent: Unable to query EC2 instances: %s", err)
+		a.retryJoinStatus(RetryJoinLAN, RetryJoinAttempting, attempt+1, nil)
+
+		// Remember where each server came from so the join can be
+		// attributed to the sources that contributed to it.
+		sources := make(map[string]string)
+		domains := make(map[string]string)
+		queried := providers
+		if cfg.RetryJoinRoundRobin && len(providers) > 1 {
+			queried = roundRobinProvider(providers, attempt)
+		}
+		queried = schedule.due(queried, time.Now())
+		ctx, cancel := context.WithTimeout(context.Background(), retryJoinDiscoveryTimeout)
+		run := startDiscovery(ctx, discoverLogger, queried)
+	DISCOVER:
+		for {
+			select {
+			case <-run.done:
+				break DISCOVER
+			case newCfg := <-a.retryJoinReloadCh:
+				// The providers the reload removed are cancelled so that
+				// their servers don't make it into this attempt.
+				reload(newCfg)
+				if removed := run.cancelRemoved(providers); len(removed) > 0 {
+					a.logger.Printf("[INFO] agent: Cancelled discovery from %s, removed by the reload",
+						strings.Join(removed, ", "))
+				}
+			case <-a.shutdownCh:
+				cancel()
+				return
 			}
-			a.logger.Printf("[INFO] agent: Discovered %d servers from EC2", len(servers))
-		case gceEnabled:
-			servers, err = cfg.discoverGCEHosts(a.logger)
-			if err != nil {
-				a.logger.Printf("[ERR] agent: Unable to query GCE instances: %s", err)
+		}
+		cancel()
+		results := run.results()
+		schedule.record(results)
+		var failed []string
+		for _, res := range results {
+			if res.Err != nil && cfg.RetryJoinFailFast && isPermanentDiscoveryError(res.Err) {
+				a.logger.Printf("[ERR] agent: Permanent discovery error from %s, not retrying it: %s", res.Name, res.Err)
+				failed = append(failed, res.Name)
+				continue
 			}
-			a.logger.Printf("[INFO] agent: Discovered %d servers from GCE", len(servers))
-		case azureEnabled:
-			servers, err = cfg.discoverAzureHosts(a.logger)
-			if err != nil {
-				a.logger.Printf("[ERR] agent: Unable to query Azure instances: %s", err)
+			if res.Err != nil {
+				discoverErrs.Printf("Unable to discover servers from %s: %s", res.Name, res.Err)
+			}
+			a.logger.Printf("[INFO] agent: Discovered %d servers from %s", len(res.Servers), res.Name)
+			// Some providers only return IP addresses, so the Serf LAN
+			// port is added like it is to the static servers.
+			for i, s := range joinAddrsWithPort(res.Servers, cfg.Ports.SerfLan) {
+				if _, ok := sources[s]; !ok {
+					sources[s] = res.Provider
+					servers = append(servers, s)
+				}
+				if domain, ok := res.Domains[res.Servers[i]]; ok {
+					domains[s] = domain
+				}
+			}
+		}
+
+		if len(failed) > 0 {
+			providers = withoutProviders(providers, failed)
+			if len(providers) == 0 && len(cfg.RetryJoin) == 0 && len(cfg.RetryJoinFallback) == 0 && len(cfg.RetryJoinSeeds) == 0 {
+				reportExhausted(attempt+1, nil, fmt.Errorf("Permanent discovery errors from %s", strings.Join(failed, ", ")))
+				return
 			}
-			a.logger.Printf("[INFO] agent: Discovered %d servers from Azure", len(servers))
 		}
 
-		servers = append(servers, cfg.RetryJoin...)
+		discovered := len(servers)
+		servers, static := a.retryJoinServers(cfg, attempt, servers, sources, domains, list)
+		checkDomains := cfg.RetryJoinMinDomains > 0 && len(domains) > 0
 		if len(servers) == 0 {
 			err = fmt.Errorf("No servers to join")
 		} else {
-			n, err := a.JoinLAN(servers)
+			var n int
+			var failed []string
+			if list.dead != nil || checkDomains {
+				// The servers are joined one at a time to know which of
+				// the static ones failed and which domains were reached.
+				n, failed, err = joinEach(join, servers)
+				if n > 0 {
+					err = nil
+				}
+				if list.dead != nil {
+					list.dead.update(static, failed)
+				}
+			} else {
+				n, err = join(servers)
+			}
+			a.logJoinAttempt(RetryJoinLAN, servers, n, err)
+			if err == nil {
+				err = checkJoinedAgents(n, cfg.RetryJoinMinAgents)
+			}
+			if err == nil && checkDomains {
+				err = checkJoinedDomains(servers, failed, domains, cfg.RetryJoinMinDomains)
+			}
 			if err == nil {
-				a.logger.Printf("[INFO] agent: Join completed. Synced with %d initial agents", n)
+				used := joinSources(servers, sources)
+				via := joinVia(used)
+				a.logger.Printf("[INFO] agent: Join completed. Synced with %d initial agents using servers from %s (%s)",
+					n, strings.Join(used, ", "), via)
+				for _, source := range used {
+					metrics.IncrCounter([]string{"consul", "agent", "retry_join", "source", source}, 1)
+				}
+				retryJoinViaMetric(via)
+				if cfg.discoveryEnabled() {
+					metrics.SetGauge([]string{"consul", "agent", "retry_join", "servers_discovered"}, float32(discovered))
+				}
+				metrics.SetGauge([]string{"consul", "agent", "retry_join", "servers_joined"}, float32(n))
+				if lastKnown {
+					a.saveLastKnown()
+				}
+				a.retryJoinStatus(RetryJoinLAN, RetryJoinJoined, attempt+1, nil)
 				return
 			}
 		}
 
 		attempt++
+		if cfg.RetryJoinOnce {
+			reportExhausted(attempt, servers, err)
+			return
+		}
+		exhausted := schedule.exhausted(providers)
+		if len(exhausted) > 0 {
+			a.logger.Printf("[WARN] agent: Max attempts of discovery from %s reached, not querying it anymore",
+				strings.Join(exhausted, ", "))
+		}
+		for _, name := range schedule.failing(providers) {
+			a.logger.Printf("[WARN] agent: Discovery from %s failed %d times in a row, not querying it anymore",
+				name, schedule.failures[name])
+			exhausted = append(exhausted, name)
+		}
+		if len(exhausted) > 0 {
+			providers = withoutProviders(providers, exhausted)
+			if len(providers) == 0 && len(cfg.RetryJoin) == 0 && len(cfg.RetryJoinFallback) == 0 && len(cfg.RetryJoinSeeds) == 0 {
+				reportExhausted(attempt, servers, err)
+				return
+			}
+		}
 		if cfg.RetryMaxAttempts > 0 && attempt > cfg.RetryMaxAttempts {
-			a.retryJoinCh <- fmt.Errorf("agent: max join retry exhausted, exiting")
+			reportExhausted(attempt, servers, err)
 			return
 		}
 
-		a.logger.Printf("[WARN] agent: Join failed: %v, retrying in %v", err, cfg.RetryInterval)
-		time.Sleep(cfg.RetryInterval)
+		a.retryJoinStatus(RetryJoinLAN, RetryJoinFailedAttempt, attempt, err)
+		wait := backoff.Next(attempt)
+		wait = schedule.wait(providers, time.Now(), wait)
+		metrics.IncrCounter([]string{"consul", "agent", "retry_join", "failed_attempts"}, 1)
+		metrics.AddSample([]string{"consul", "agent", "retry_join", "backoff"}, float32(wait.Seconds()*1000))
+		a.logger.Printf("[WARN] agent: Join failed: %v, retrying in %v", err, wait)
+		timer := after(wait)
+	WAIT:
+		for {
+			select {
+			case <-timer:
+				break WAIT
+			case <-changed:
+				a.logger.Printf("[INFO] agent: Discovered servers changed, retrying join now")
+				break WAIT
+			case newCfg := <-a.retryJoinReloadCh:
+				// The new sources are used from the next attempt on.
+				reload(newCfg)
+			case <-a.shutdownCh:
+				return
+			}
+		}
+	}
+}
+
+// joinServerList is what retryJoinServers keeps across the attempts: the
+// static servers which failed too often, and the excluded servers and the
+// missing failure domains which were already logged.
+type joinServerList struct {
+	dead            *deadServers
+	excluded        map[string]bool
+	warnedNoDomains bool
+}
+
+// retryJoinServers returns the servers to join on an attempt and the static
+// servers among them. The discovered and static servers are put in the
+// order of retry_join_order and the fallback servers are added once they
+// are due. The excluded servers are then dropped, the rest are spread over
+// their failure domains if retry_join_min_domains needs them and the seeds
+// are put first. sources records where each server came from.
+func (a *Agent) retryJoinServers(cfg *Config, attempt int, discovered []string, sources, domains map[string]string, list *joinServerList) (servers, static []string) {
+	// DNS names are passed through as-is since Serf resolves them on
+	// every join, so each attempt sees the current set of addresses.
+	static, skipped := list.dead.skip(cfg.RetryJoinAddrs())
+	if len(skipped) > 0 {
+		a.logger.Printf("[DEBUG] agent: Skipping retry_join servers which failed the last %d attempts: %s",
+			cfg.RetryJoinSkipAfter, strings.Join(skipped, ", "))
+	}
+	for _, s := range static {
+		if _, ok := sources[s]; !ok {
+			sources[s] = "static"
+		}
+	}
+	if cfg.RetryJoinOrder == "static" {
+		servers = append(append([]string(nil), static...), discovered...)
+	} else {
+		servers = append(discovered, static...)
+	}
+	if attempt >= cfg.RetryJoinFallbackAfter {
+		if attempt == cfg.RetryJoinFallbackAfter && attempt > 0 && len(cfg.RetryJoinFallback) > 0 {
+			a.logger.Printf("[WARN] agent: Join failed %d times, adding the retry_join_fallback servers", attempt)
+		}
+		for _, s := range cfg.RetryJoinFallbackAddrs() {
+			if _, ok := sources[s]; !ok {
+				sources[s] = "fallback"
+				servers = append(servers, s)
+			}
+		}
+	}
+
+	exclude, err := parseJoinExclude(cfg.RetryJoinExclude)
+	if err != nil {
+		a.logger.Printf("[ERR] agent: Invalid retry_join_exclude, not excluding any servers: %v", err)
+	}
+	servers = a.excludeServers(servers, exclude, list.excluded)
+	servers = preferAddrFamily(servers, cfg.RetryJoinAddressFamily)
+	if cfg.RetryJoinMinDomains > 0 && len(domains) > 0 {
+		servers = spreadDomains(servers, domains)
+	} else if cfg.RetryJoinMinDomains > 0 && !list.warnedNoDomains {
+		a.logger.Printf("[WARN] agent: No failure domains of the servers to join are known, not requiring retry_join_min_domains")
+		list.warnedNoDomains = true
+	}
+
+	seeds, _ := cfg.RetryJoinSeedAddrs()
+	for _, s := range seeds {
+		if _, ok := sources[s]; !ok {
+			sources[s] = "static"
+		}
+	}
+	return pinSeeds(servers, seeds), static
+}
+
+// inCluster returns true if the agent already has enough peers in the LAN
+// pool, at least retry_join_min_agents or one, so that retry join can stop.
+// This happens when it was joined some other way, like with consul join,
+// while retry join was running.
+func (a *Agent) inCluster(cfg *Config, attempt int) bool {
+	if a.retryJoinPeers == nil {
+		return false
+	}
+	min := cfg.RetryJoinMinAgents
+	if min < 1 {
+		min = 1
+	}
+	n := a.retryJoinPeers()
+	if n < min {
+		return false
+	}
+	a.logger.Printf("[INFO] agent: Already in a cluster with %d other agents, stopping retry join", n)
+	a.retryJoinStatus(RetryJoinLAN, RetryJoinJoined, attempt, nil)
+	return true
+}
+
+// lanPeers returns the number of alive members of the LAN pool other than
+// the agent itself.
+func (a *Agent) lanPeers() int {
+	n := 0
+	for _, m := range a.LANMembers() {
+		if m.Status == serf.StatusAlive && m.Name != a.config.NodeName {
+			n++
+		}
+	}
+	return n
+}
+
+// reloadRetryJoin passes a reloaded configuration to the retry join loop
+// of the LAN, if it's still running. Only the latest configuration is
+// kept if the loop hasn't picked up the one before.
+func (a *Agent) reloadRetryJoin(cfg *Config) {
+	for {
+		select {
+		case a.retryJoinReloadCh <- cfg:
+			return
+		default:
+		}
+		select {
+		case <-a.retryJoinReloadCh:
+		default:
+		}
+	}
+}
+
+// reloadRetryJoinConfig returns a copy of the configuration of the retry
+// join loop with the servers, discovery providers and their settings of
+// the reloaded configuration. The other retry join settings, such as the
+// intervals, keep applying as they were when the loop started.
+func reloadRetryJoinConfig(cfg, reloaded *Config) *Config {
+	c := *cfg
+	c.RetryJoin = reloaded.RetryJoin
+	c.RetryJoinFallback = reloaded.RetryJoinFallback
+	c.RetryJoinSeeds = reloaded.RetryJoinSeeds
+	c.RetryJoinEC2 = reloaded.RetryJoinEC2
+	c.RetryJoinGCE = reloaded.RetryJoinGCE
+	c.RetryJoinAzure = reloaded.RetryJoinAzure
+	c.RetryJoinExec = reloaded.RetryJoinExec
+	c.RetryJoinK8s = reloaded.RetryJoinK8s
+	c.RetryJoinNomad = reloaded.RetryJoinNomad
+	c.RetryJoinTagFilter = reloaded.RetryJoinTagFilter
+	c.RetryJoinExclude = reloaded.RetryJoinExclude
+	c.RetryJoinProviderRetry = reloaded.RetryJoinProviderRetry
+	return &c
+}
+
+// DiscoveryResult is what one of the discovery providers of retry join
+// found.
+type DiscoveryResult struct {
+	// Provider is the source the servers are attributed to, like "ec2".
+	Provider string
+
+	// Name describes the provider in messages.
+	Name string
+
+	// Servers are the addresses of the servers which were found.
+	Servers []string
+
+	// Domains maps the addresses of Servers to their failure domains,
+	// like the availability zone, for providers which know them.
+	Domains map[string]string
+
+	// Err is the error of the provider, if any.
+	Err error
+}
+
+// discoveryEnabled returns true if any discovery provider is configured.
+func (c *Config) discoveryEnabled() bool {
+	return (c.RetryJoinEC2.TagKey != "" && c.RetryJoinEC2.TagValue != "") ||
+		c.RetryJoinGCE.TagValue != "" ||
+		(c.RetryJoinAzure.TagName != "" && c.RetryJoinAzure.TagValue != "") ||
+		c.RetryJoinExec.Command != "" ||
+		c.RetryJoinK8s.Service != "" ||
+		c.RetryJoinNomad.Service != ""
+}
+
+// permanentDiscoveryError marks an error of a discovery provider which
+// retrying won't fix, such as invalid credentials.
+type permanentDiscoveryError struct {
+	err error
+}
+
+func (e *permanentDiscoveryError) Error() string {
+	return e.err.Error()
+}
+
+// isPermanentDiscoveryError returns true if the error of a discovery
+// provider is caused by its configuration or credentials, so that it will
+// fail the same way on every attempt.
+func isPermanentDiscoveryError(err error) bool {
+	switch e := err.(type) {
+	case *permanentDiscoveryError:
+		return true
+	case awserr.Error:
+		switch e.Code() {
+		case "AuthFailure", "InvalidClientTokenId", "NoCredentialProviders",
+			"SignatureDoesNotMatch", "UnauthorizedOperation":
+			return true
+		}
+	case *googleapi.Error:
+		return e.Code == http.StatusUnauthorized || e.Code == http.StatusForbidden
+	}
+	return false
+}
+
+// resolveDiscoverySecret returns the value of a credential of a discovery
+// provider. A value of "env:NAME" is read from the environment variable
+// NAME and "file:PATH" from the file at PATH, with surrounding whitespace
+// trimmed, so that secrets don't have to be in the configuration. Other
+// values are used as they are. The secret is resolved on every query so a
+// rotated file is picked up, and errors only name the setting, never the
+// value.
+func resolveDiscoverySecret(name, value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, "env:"):
+		env := strings.TrimPrefix(value, "env:")
+		v, ok := os.LookupEnv(env)
+		if !ok || v == "" {
+			return "", &permanentDiscoveryError{fmt.Errorf("Environment variable %s of %s is not set", env, name)}
+		}
+		return v, nil
+	case strings.HasPrefix(value, "file:"):
+		path := strings.TrimPrefix(value, "file:")
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("Unable to read %s from %s: %v", name, path, err)
+		}
+		return strings.TrimSpace(string(b)), nil
+	}
+	return value, nil
+}
+
+// providerSchedule tracks the queries of the discovery providers so that
+// those with their own retry settings in retry_join_provider_retry are
+// queried on their own schedule.
+type providerSchedule struct {
+	retry     map[string]RetryJoinProviderRetry
+	lastQuery map[string]time.Time
+	queries   map[string]int
+
+	// failures counts the queries in a row each provider failed.
+	failures map[string]int
+}
+
+func newProviderSchedule(retry map[string]RetryJoinProviderRetry) *providerSchedule {
+	return &providerSchedule{
+		retry:     retry,
+		lastQuery: make(map[string]time.Time),
+		queries:   make(map[string]int),
+		failures:  make(map[string]int),
+	}
+}
+
+// due returns the providers to query at now, which are those without an
+// interval of their own and those whose interval has passed since they
+// were last queried. It records that they are queried.
+func (s *providerSchedule) due(providers []discoveryProvider, now time.Time) []discoveryProvider {
+	var out []discoveryProvider
+	for _, p := range providers {
+		last, ok := s.lastQuery[p.name]
+		if interval := s.retry[p.provider].Interval; ok && now.Sub(last) < interval {
+			continue
+		}
+		s.lastQuery[p.name] = now
+		s.queries[p.name]++
+		out = append(out, p)
+	}
+	return out
+}
+
+// exhausted returns the names of the providers which have been queried on
+// as many attempts as their max_attempts.
+func (s *providerSchedule) exhausted(providers []discoveryProvider) []string {
+	var names []string
+	for _, p := range providers {
+		if max := s.retry[p.provider].MaxAttempts; max > 0 && s.queries[p.name] >= max {
+			names = append(names, p.name)
+		}
+	}
+	return names
+}
+
+// record counts the results of a failed query, one which returned an
+// error or no servers, towards the max_failures of its provider. A query
+// which found servers resets the count.
+func (s *providerSchedule) record(results []DiscoveryResult) {
+	for _, res := range results {
+		if res.Err != nil || len(res.Servers) == 0 {
+			s.failures[res.Name]++
+		} else {
+			s.failures[res.Name] = 0
+		}
+	}
+}
+
+// failing returns the names of the providers which failed as many queries
+// in a row as their max_failures.
+func (s *providerSchedule) failing(providers []discoveryProvider) []string {
+	var names []string
+	for _, p := range providers {
+		if max := s.retry[p.provider].MaxFailures; max > 0 && s.failures[p.name] >= max {
+			names = append(names, p.name)
+		}
+	}
+	return names
+}
+
+// wait shortens the wait before the next attempt to when the next provider
+// with an interval of its own is due, if that's sooner.
+func (s *providerSchedule) wait(providers []discoveryProvider, now time.Time, wait time.Duration) time.Duration {
+	for _, p := range providers {
+		interval := s.retry[p.provider].Interval
+		if interval <= 0 {
+			continue
+		}
+		if until := s.lastQuery[p.name].Add(interval).Sub(now); until < wait {
+			wait = until
+		}
+	}
+	if wait < 0 {
+		wait = 0
+	}
+	return wait
+}
+
+// roundRobinProvider returns the provider to query on the given attempt
+// when retry_join_round_robin is set.
+func roundRobinProvider(providers []discoveryProvider, attempt int) []discoveryProvider {
+	i := attempt % len(providers)
+	return providers[i : i+1]
+}
+
+// retryJoinDiscoveryTimeout is how long the discovery providers of a
+// retry join attempt may take in total.
+var retryJoinDiscoveryTimeout = time.Minute
+
+// retryJoinDiscoveryWorkers is the number of discovery providers which are
+// queried at the same time.
+const retryJoinDiscoveryWorkers = 4
+
+// discoveryProvider is a configured discovery provider of retry join.
+type discoveryProvider struct {
+	provider string
+	name     string
+	discover func(*log.Logger) ([]string, map[string]string, error)
+
+	// watch, if set, signals changed whenever the servers of the provider
+	// change, until ctx is done or it fails. Providers without it are
+	// only queried on every attempt.
+	watch func(ctx context.Context, logger *log.Logger, changed chan<- struct{}) error
+}
+
+// watchDiscovery starts the watches of the providers which support them.
+// The returned channel is signalled when the servers of one of them
+// change and is nil if none can be watched. A watch which fails is logged
+// and its provider is only polled from then on.
+func (a *Agent) watchDiscovery(ctx context.Context, logger *log.Logger, providers []discoveryProvider) <-chan struct{} {
+	var changed chan struct{}
+	for _, p := range providers {
+		if p.watch == nil {
+			continue
+		}
+		if changed == nil {
+			changed = make(chan struct{}, 1)
+		}
+		go func(p discoveryProvider) {
+			if err := p.watch(ctx, logger, changed); err != nil && ctx.Err() == nil {
+				a.logger.Printf("[WARN] agent: Unable to watch %s, polling it every attempt instead: %v", p.name, err)
+			}
+		}(p)
+	}
+	return changed
+}
+
+// discoveryProviders returns the configured discovery providers. All of
+// them are queried and their servers are joined together, so that the
+// servers of a deployment spread over several clouds can all be found.
+func (c *Config) discoveryProviders() []discoveryProvider {
+	var providers []discoveryProvider
+	if c.RetryJoinEC2.TagKey != "" && c.RetryJoinEC2.TagValue != "" {
+		providers = append(providers, discoveryProvider{"ec2", "EC2", c.discoverEc2Hosts, nil})
+	}
+	if c.RetryJoinGCE.TagValue != "" {
+		providers = append(providers, discoveryProvider{"gce", "GCE", c.discoverGCEHosts, nil})
+	}
+	if c.RetryJoinAzure.TagName != "" && c.RetryJoinAzure.TagValue != "" {
+		providers = append(providers, discoveryProvider{"azure", "Azure", withoutDomains(c.discoverAzureHosts), nil})
+	}
+	if c.RetryJoinExec.Command != "" {
+		providers = append(providers, discoveryProvider{"exec", c.RetryJoinExec.Command, c.discoverExecHosts, nil})
+	}
+	if c.RetryJoinK8s.Service != "" {
+		providers = append(providers, discoveryProvider{"k8s", "Kubernetes", withoutDomains(c.discoverK8sHosts), c.watchK8sHosts})
+	}
+	if c.RetryJoinNomad.Service != "" {
+		providers = append(providers, discoveryProvider{"nomad", "Nomad", withoutDomains(c.discoverNomadHosts), nil})
+	}
+	return providers
+}
+
+// withoutDomains adapts the discovery of a provider which doesn't know the
+// failure domains of its servers.
+func withoutDomains(discover func(*log.Logger) ([]string, error)) func(*log.Logger) ([]string, map[string]string, error) {
+	return func(logger *log.Logger) ([]string, map[string]string, error) {
+		servers, err := discover(logger)
+		return servers, nil, err
+	}
+}
+
+// withoutProviders returns the providers without those with the names.
+func withoutProviders(providers []discoveryProvider, names []string) []discoveryProvider {
+	var out []discoveryProvider
+	for _, p := range providers {
+		drop := false
+		for _, name := range names {
+			if p.name == name {
+				drop = true
+			}
+		}
+		if !drop {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// DiscoverServers queries the configured discovery providers like every
+// attempt of retry join does. The providers are queried concurrently and
+// those which haven't answered when ctx is done fail with its error. The
+// results are in the order of the providers.
+func (c *Config) DiscoverServers(ctx context.Context, logger *log.Logger) []DiscoveryResult {
+	return discoverServers(ctx, logger, c.discoveryProviders())
+}
+
+// discoverServers queries the providers with at most
+// retryJoinDiscoveryWorkers at a time.
+func discoverServers(ctx context.Context, logger *log.Logger, providers []discoveryProvider) []DiscoveryResult {
+	run := startDiscovery(ctx, logger, providers)
+	<-run.done
+	return run.results()
+}
+
+// discoveryRun is a round of discovery started by startDiscovery. Every
+// provider is queried with a context of its own, so that the providers a
+// reload removes can be cancelled while the others keep running.
+type discoveryRun struct {
+	providers []discoveryProvider
+	cancels   []context.CancelFunc
+	cancelled []bool
+
+	// done is closed once every provider answered, failed or was
+	// cancelled. res is only read after that.
+	done chan struct{}
+	res  []DiscoveryResult
+}
+
+// startDiscovery queries the providers in the background with at most
+// retryJoinDiscoveryWorkers at a time. The providers which haven't answered
+// when ctx is done, or which are cancelled, fail with the error of their
+// context and are left to finish in the background.
+func startDiscovery(ctx context.Context, logger *log.Logger, providers []discoveryProvider) *discoveryRun {
+	type result struct {
+		i   int
+		res DiscoveryResult
 	}
+	r := &discoveryRun{
+		providers: providers,
+		cancels:   make([]context.CancelFunc, len(providers)),
+		cancelled: make([]bool, len(providers)),
+		done:      make(chan struct{}),
+		res:       make([]DiscoveryResult, len(providers)),
+	}
+	resultCh := make(chan result, len(providers))
+	sem := make(chan struct{}, retryJoinDiscoveryWorkers)
+	for i, p := range providers {
+		var pctx context.Context
+		pctx, r.cancels[i] = context.WithCancel(ctx)
+		go func(i int, p discoveryProvider, ctx context.Context) {
+			res := DiscoveryResult{Provider: p.provider, Name: p.name}
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				res.Err = ctx.Err()
+				resultCh <- result{i, res}
+				return
+			}
+			found := make(chan DiscoveryResult, 1)
+			go func() {
+				defer func() { <-sem }()
+				servers, domains, err := p.discover(logger)
+				found <- DiscoveryResult{Provider: p.provider, Name: p.name, Servers: servers, Domains: domains, Err: err}
+			}()
+			select {
+			case res = <-found:
+			case <-ctx.Done():
+				res.Err = ctx.Err()
+			}
+			resultCh <- result{i, res}
+		}(i, p, pctx)
+	}
+	go func() {
+		for pending := len(providers); pending > 0; pending-- {
+			res := <-resultCh
+			r.res[res.i] = res.res
+		}
+		for _, cancel := range r.cancels {
+			cancel()
+		}
+		close(r.done)
+	}()
+	return r
+}
+
+// cancelRemoved cancels the providers of the run which aren't among the
+// given providers anymore and returns their names.
+func (r *discoveryRun) cancelRemoved(providers []discoveryProvider) []string {
+	var names []string
+	for i, p := range r.providers {
+		if r.cancelled[i] || hasProvider(providers, p) {
+			continue
+		}
+		r.cancelled[i] = true
+		r.cancels[i]()
+		names = append(names, p.name)
+	}
+	return names
+}
+
+// results returns the results of the providers which weren't cancelled,
+// in the order of the providers. It must only be called once done is
+// closed.
+func (r *discoveryRun) results() []DiscoveryResult {
+	var results []DiscoveryResult
+	for i, res := range r.res {
+		if !r.cancelled[i] {
+			results = append(results, res)
+		}
+	}
+	return results
+}
+
+// hasProvider returns true if one of the providers is p.
+func hasProvider(providers []discoveryProvider, p discoveryProvider) bool {
+	for _, q := range providers {
+		if q.provider == p.provider && q.name == p.name {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateRetryJoin returns an error if the retry_join_* options are
+// invalid. It runs on every config file as it is decoded and on the merged
+// configuration when the agent starts and reloads, so retry join can rely
+// on the options being valid.
+func (c *Config) ValidateRetryJoin() error {
+	switch c.RetryJoinAddressFamily {
+	case "", "any", "ipv4", "ipv6":
+	default:
+		return fmt.Errorf("retry_join_address_family must be one of ipv4, ipv6 or any, got %q", c.RetryJoinAddressFamily)
+	}
+	switch c.RetryJoinOrder {
+	case "", "discovered", "static":
+	default:
+		return fmt.Errorf("retry_join_order must be one of discovered or static, got %q", c.RetryJoinOrder)
+	}
+	if _, invalid := c.RetryJoinSeedAddrs(); len(invalid) > 0 {
+		return fmt.Errorf("retry_join_seeds has invalid addresses: %s", strings.Join(invalid, ", "))
+	}
+	if c.RetryJoinMinDomains < 0 {
+		return fmt.Errorf("retry_join_min_domains can't be negative")
+	}
+	if c.RetryJoinFallbackAfter < 0 {
+		return fmt.Errorf("retry_join_fallback_after can't be negative")
+	}
+	if _, err := parseTagFilter(c.RetryJoinTagFilter); err != nil {
+		return fmt.Errorf("RetryJoinTagFilter invalid: %v", err)
+	}
+	if _, err := parseJoinExclude(c.RetryJoinExclude); err != nil {
+		return fmt.Errorf("RetryJoinExclude invalid: %v", err)
+	}
+	return nil
+}
+
+// RetryJoinAddrs returns the addresses of retry_join with the Serf LAN
+// port added to those without a port.
+func (c *Config) RetryJoinAddrs() []string {
+	return joinAddrsWithPort(c.RetryJoin, c.Ports.SerfLan)
+}
+
+// RetryJoinFallbackAddrs returns the addresses of retry_join_fallback with
+// the Serf LAN port added to those without a port.
+func (c *Config) RetryJoinFallbackAddrs() []string {
+	return joinAddrsWithPort(c.RetryJoinFallback, c.Ports.SerfLan)
+}
+
+// RetryJoinSeedAddrs returns the deduplicated addresses of retry_join_seeds
+// with the Serf LAN port added to those without a port, and the invalid
+// addresses separately.
+func (c *Config) RetryJoinSeedAddrs() (valid, invalid []string) {
+	return cleanJoinAddrs(joinAddrsWithPort(c.RetryJoinSeeds, c.Ports.SerfLan))
+}
+
+// pinSeeds returns the servers with the seeds in front of them. The seeds
+// are only tried once if they're among the servers too.
+func pinSeeds(servers, seeds []string) []string {
+	if len(seeds) == 0 {
+		return servers
+	}
+	pinned := make(map[string]bool)
+	for _, s := range seeds {
+		pinned[s] = true
+	}
+	out := append([]string(nil), seeds...)
+	for _, s := range servers {
+		if !pinned[s] {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// RetryJoinWanAddrs returns the deduplicated addresses of retry_join_wan
+// with the Serf WAN port added to those without a port, and the invalid
+// addresses separately.
+func (c *Config) RetryJoinWanAddrs() (valid, invalid []string) {
+	return cleanJoinAddrs(joinAddrsWithPort(c.RetryJoinWan, c.Ports.SerfWan))
+}
+
+// checkJoinedAgents returns an error if a join synced with fewer than min
+// agents, so that the attempt is retried.
+func checkJoinedAgents(n, min int) error {
+	if n < min {
+		return fmt.Errorf("Synced with %d agents, fewer than the %d required by retry_join_min_agents", n, min)
+	}
+	return nil
+}
+
+// checkJoinedDomains returns an error if the servers which were joined,
+// those which didn't fail, are in fewer than min failure domains.
+func checkJoinedDomains(servers, failed []string, domains map[string]string, min int) error {
+	failedSet := make(map[string]bool)
+	for _, s := range failed {
+		failedSet[s] = true
+	}
+	seen := make(map[string]bool)
+	var reached []string
+	for _, s := range servers {
+		domain, ok := domains[s]
+		if !ok || failedSet[s] || seen[domain] {
+			continue
+		}
+		seen[domain] = true
+		reached = append(reached, domain)
+	}
+	if len(reached) < min {
+		return fmt.Errorf("Joined servers in %d failure domains %v, fewer than the %d required by retry_join_min_domains",
+			len(reached), reached, min)
+	}
+	return nil
+}
+
+// spreadDomains orders the servers so that they take turns between their
+// failure domains, in the order the domains first appear. The servers in
+// no known domain come last.
+func spreadDomains(servers []string, domains map[string]string) []string {
+	var order []string
+	byDomain := make(map[string][]string)
+	var unknown []string
+	for _, s := range servers {
+		domain, ok := domains[s]
+		if !ok {
+			unknown = append(unknown, s)
+			continue
+		}
+		if _, ok := byDomain[domain]; !ok {
+			order = append(order, domain)
+		}
+		byDomain[domain] = append(byDomain[domain], s)
+	}
+
+	out := make([]string, 0, len(servers))
+	for len(out) < len(servers)-len(unknown) {
+		for _, domain := range order {
+			if rest := byDomain[domain]; len(rest) > 0 {
+				out = append(out, rest[0])
+				byDomain[domain] = rest[1:]
+			}
+		}
+	}
+	return append(out, unknown...)
+}
+
+// joinLastKnown joins the servers saved by the last successful retry join
+// and returns whether this worked. It's only tried once since discovery
+// takes over if the servers have moved.
+func (a *Agent) joinLastKnown(join func([]string) (int, error)) bool {
+	servers, err := readPeersFile(filepath.Join(a.config.DataDir, retryJoinPeersFile))
+	if err != nil {
+		a.logger.Printf("[WARN] agent: Unable to read last known servers: %v", err)
+		return false
+	}
+	if len(servers) == 0 {
+		return false
+	}
+
+	n, err := join(servers)
+	if err == nil {
+		err = checkJoinedAgents(n, a.config.RetryJoinMinAgents)
+	}
+	if err != nil {
+		a.logger.Printf("[WARN] agent: Join with last known servers failed: %v", err)
+		return false
+	}
+	a.logger.Printf("[INFO] agent: Join completed. Synced with %d initial agents using last known servers (%s)", n, joinViaStatic)
+	metrics.IncrCounter([]string{"consul", "agent", "retry_join", "source", "last_known"}, 1)
+	retryJoinViaMetric(joinViaStatic)
+	metrics.SetGauge([]string{"consul", "agent", "retry_join", "servers_joined"}, float32(n))
+	a.saveLastKnown()
+	return true
+}
+
+// saveLastKnown saves the servers of the LAN pool for joinLastKnown.
+func (a *Agent) saveLastKnown() {
+	servers := lanServers(a.LANMembers())
+	if len(servers) == 0 {
+		return
+	}
+	if err := writePeersFile(filepath.Join(a.config.DataDir, retryJoinPeersFile), servers); err != nil {
+		a.logger.Printf("[WARN] agent: Unable to save last known servers: %v", err)
+	}
+}
+
+// lanServers returns the sorted addresses of the alive servers among the
+// members.
+func lanServers(members []serf.Member) []string {
+	var servers []string
+	for _, m := range members {
+		if m.Tags["role"] != "consul" || m.Status != serf.StatusAlive {
+			continue
+		}
+		servers = append(servers, net.JoinHostPort(m.Addr.String(), strconv.Itoa(int(m.Port))))
+	}
+	sort.Strings(servers)
+	return servers
+}
+
+// readPeersFile returns the servers saved in the given file, or nothing if
+// the file doesn't exist.
+func readPeersFile(path string) ([]string, error) {
+	buf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var servers []string
+	if err := json.Unmarshal(buf, &servers); err != nil {
+		return nil, fmt.Errorf("failed decoding %s: %v", path, err)
+	}
+	return servers, nil
+}
+
+// writePeersFile saves the servers to the given file.
+func writePeersFile(path string, servers []string) error {
+	buf, err := json.Marshal(servers)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, buf)
 }
 
 // RetryJoinWan is used to handle retrying a join -wan until it succeeds or all
-// retries are exhausted.
+// retries are exhausted. The join is considered successful once at least one
+// server has been reached since that is enough for gossip to converge. The
+// servers that could not be reached are retried on the following attempts.
 func (a *Agent) retryJoinWan() {
+	a.retryJoinWanWith(a.JoinWAN, time.After)
+}
+
+// retryJoinWanRetriesAfterJoin is how many more attempts join -wan makes
+// for the servers which failed once another server was joined. The join
+// already succeeded then, so they aren't retried until retry_max_wan runs
+// out, which is never by default.
+const retryJoinWanRetriesAfterJoin = 3
+
+// retryJoinWanWith does the work of retryJoinWan like retryJoinWith.
+func (a *Agent) retryJoinWanWith(join func([]string) (int, error), after func(time.Duration) <-chan time.Time) {
 	cfg := a.config
 
-	if len(cfg.RetryJoinWan) == 0 {
+	discovery := cfg.RetryJoinWanDiscovery && cfg.discoveryEnabled()
+	if len(cfg.RetryJoinWan) == 0 && !discovery {
 		return
 	}
 
 	a.logger.Printf("[INFO] agent: Joining WAN cluster...")
 
+	servers, invalid := cfg.RetryJoinWanAddrs()
+	for _, addr := range invalid {
+		a.logger.Printf("[WARN] agent: Skipping invalid -retry-join-wan address %q", addr)
+	}
+	if len(servers) == 0 && !discovery {
+		a.logger.Printf("[ERR] agent: No valid -retry-join-wan addresses, not joining WAN cluster")
+		return
+	}
+	var discoverLogger *log.Logger
+	var providers []discoveryProvider
+	if discovery {
+		discoverLogger = newDiscoverLogger(a.logger, cfg.DisableDiscoveryLogs)
+		providers = cfg.discoveryProviders()
+	}
+	interval := a.retryJoinInterval("retry_interval_wan", cfg.RetryIntervalWan)
+	backoff := retryJoinBackoffFor(a.retryJoinWanBackoff, interval, cfg.RetryMaxIntervalWan)
+	backoff.Reset()
+	pending := servers
+	reached := make(map[string]bool)
+	discovered := 0
+	joined := false
+	joinedAttempt := 0
+	start := time.Now()
 	attempt := 0
 	for {
-		n, err := a.JoinWAN(cfg.RetryJoinWan)
-		if err == nil {
+		if !joined {
+			a.retryJoinStatus(RetryJoinWAN, RetryJoinAttempting, attempt+1, nil)
+		}
+		if discovery {
+			// The discovered servers which haven't been reached yet are
+			// joined along with those which failed before.
+			found := a.discoverWanServers(cfg, discoverLogger, providers)
+			discovered = len(found)
+			for _, s := range found {
+				if !reached[s] && !lib.StrContains(pending, s) {
+					pending = append(pending, s)
+				}
+			}
+		}
+		var n int
+		var failed []string
+		var err error
+		if len(pending) == 0 {
+			err = fmt.Errorf("No servers to join -wan were discovered")
+		} else {
+			n, failed, err = joinEach(func(addrs []string) (int, error) {
+				n, err := join(addrs)
+				a.logJoinAttempt(RetryJoinWAN, addrs, n, err)
+				return n, err
+			}, pending)
+			for _, s := range pending {
+				if !lib.StrContains(failed, s) {
+					reached[s] = true
+				}
+			}
+		}
+		if n > 0 && !joined {
+			joined = true
+			joinedAttempt = attempt + 1
 			a.logger.Printf("[INFO] agent: Join -wan completed. Synced with %d initial agents", n)
+			if discovery {
+				metrics.SetGauge([]string{"consul", "agent", "retry_join_wan", "servers_discovered"}, float32(discovered))
+			}
+			metrics.SetGauge([]string{"consul", "agent", "retry_join_wan", "servers_joined"}, float32(n))
+			a.retryJoinStatus(RetryJoinWAN, RetryJoinJoined, attempt+1, nil)
+		}
+		if len(pending) > 0 && len(failed) == 0 {
 			return
 		}
+		pending = failed
 
 		attempt++
+		if joined && attempt-joinedAttempt >= retryJoinWanRetriesAfterJoin {
+			a.logger.Printf("[WARN] agent: Giving up join -wan with %v after %d attempts since the join completed: %v",
+				failed, retryJoinWanRetriesAfterJoin, err)
+			return
+		}
 		if cfg.RetryMaxAttemptsWan > 0 && attempt > cfg.RetryMaxAttemptsWan {
-			a.retryJoinCh <- fmt.Errorf("agent: max join -wan retry exhausted, exiting")
+			if joined {
+				a.logger.Printf("[WARN] agent: Giving up join -wan with %v: %v", failed, err)
+				return
+			}
+			a.retryJoinStatus(RetryJoinWAN, RetryJoinExhausted, attempt, err)
+			a.retryJoinCh <- &RetryJoinError{
+				Cluster:  RetryJoinWAN,
+				Attempts: attempt,
+				Elapsed:  time.Since(start),
+				Servers:  servers,
+				Err:      err,
+			}
+			return
+		}
+
+		if !joined {
+			a.retryJoinStatus(RetryJoinWAN, RetryJoinFailedAttempt, attempt, err)
+		}
+		wait := backoff.Next(attempt)
+		metrics.IncrCounter([]string{"consul", "agent", "retry_join_wan", "failed_attempts"}, 1)
+		metrics.AddSample([]string{"consul", "agent", "retry_join_wan", "backoff"}, float32(wait.Seconds()*1000))
+		a.logger.Printf("[WARN] agent: Join -wan failed for %v: %v, retrying in %v", failed, err, wait)
+		select {
+		case <-after(wait):
+		case <-a.shutdownCh:
 			return
 		}
+	}
+}
 
-		a.logger.Printf("[WARN] agent: Join -wan failed: %v, retrying in %v", err, cfg.RetryIntervalWan)
-		time.Sleep(cfg.RetryIntervalWan)
+// discoverWanServers queries the discovery providers for join -wan and
+// returns the servers they found with the Serf WAN port. A provider which
+// fails is logged and the servers of the others are still returned.
+func (a *Agent) discoverWanServers(cfg *Config, logger *log.Logger, providers []discoveryProvider) []string {
+	ctx, cancel := context.WithTimeout(context.Background(), retryJoinDiscoveryTimeout)
+	defer cancel()
+	var servers []string
+	for _, res := range discoverServers(ctx, logger, providers) {
+		if res.Err != nil {
+			a.logger.Printf("[WARN] agent: Unable to discover WAN servers from %s: %s", res.Name, res.Err)
+			continue
+		}
+		a.logger.Printf("[INFO] agent: Discovered %d WAN servers from %s", len(res.Servers), res.Name)
+		servers = append(servers, joinAddrsWithPort(res.Servers, cfg.Ports.SerfWan)...)
+	}
+	valid, _ := cleanJoinAddrs(servers)
+	return valid
+}
+
+// newDiscoverLogger returns the logger passed to the discovery providers.
+// Their output is logged at debug level with a [discover] prefix so that
+// it stays out of the normal logs, or dropped entirely if disabled is set.
+func newDiscoverLogger(logger *log.Logger, disabled bool) *log.Logger {
+	if disabled {
+		return log.New(ioutil.Discard, "", 0)
+	}
+	return log.New(&discoverLogWriter{logger: logger}, "", 0)
+}
+
+// discoverLogWriter rewrites the log lines of the discovery providers to
+// debug level before passing them on to the agent logger.
+type discoverLogWriter struct {
+	logger *log.Logger
+}
+
+func (w *discoverLogWriter) Write(p []byte) (int, error) {
+	line := strings.TrimSpace(string(p))
+	if strings.HasPrefix(line, "[") {
+		if i := strings.Index(line, "] "); i > 0 {
+			line = line[i+2:]
+		}
+	}
+	line = strings.TrimPrefix(line, "agent: ")
+	w.logger.Printf("[DEBUG] agent: [discover] %s", line)
+	return len(p), nil
+}
+
+// discoverErrorInterval is the minimum time between logging the same
+// discovery error at error level.
+const discoverErrorInterval = 5 * time.Minute
+
+// discoverErrorLog logs discovery errors. An error which repeats the last
+// one is logged at debug level unless discoverErrorInterval has passed,
+// so a provider that keeps failing doesn't flood the logs on every retry.
+type discoverErrorLog struct {
+	logger *log.Logger
+	last   string
+	lastAt time.Time
+}
+
+func (l *discoverErrorLog) Printf(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if msg == l.last && time.Since(l.lastAt) < discoverErrorInterval {
+		l.logger.Printf("[DEBUG] agent: %s", msg)
+		return
+	}
+	l.last, l.lastAt = msg, time.Now()
+	l.logger.Printf("[ERR] agent: %s", msg)
+}
+
+// retryJoinIntervalFloor is the interval between join attempts if the
+// configured one is zero or negative, so that retry join doesn't spin.
+const retryJoinIntervalFloor = time.Second
+
+// retryJoinInterval returns the configured interval between join attempts,
+// or retryJoinIntervalFloor with a warning if it isn't positive.
+func (a *Agent) retryJoinInterval(name string, interval time.Duration) time.Duration {
+	if interval > 0 {
+		return interval
+	}
+	a.logger.Printf("[WARN] agent: %s is %v, waiting %v between join attempts instead", name, interval, retryJoinIntervalFloor)
+	return retryJoinIntervalFloor
+}
+
+// Backoff computes the time a retry join loop waits between its attempts.
+// Next is passed the number of failed attempts so far, starting at 1, and
+// Reset is called when a loop starts. A Backoff is only used by one loop
+// at a time, so it doesn't need to be safe for concurrent use.
+type Backoff interface {
+	Next(attempt int) time.Duration
+	Reset()
+}
+
+// ExponentialBackoff is the Backoff used unless another one is set with
+// SetRetryJoinBackoff. It waits Interval after the first failed attempt
+// and doubles the wait with every attempt up to Max, with jitter.
+type ExponentialBackoff struct {
+	Interval time.Duration
+	Max      time.Duration
+}
+
+// Next returns the wait after the given number of failed attempts.
+func (b *ExponentialBackoff) Next(attempt int) time.Duration {
+	return retryJoinBackoff(attempt, b.Interval, b.Max)
+}
+
+// Reset does nothing since the wait only depends on the attempt.
+func (b *ExponentialBackoff) Reset() {}
+
+// retryJoinBackoffFor returns the backoff set for a join loop, or the
+// default exponential backoff for the interval and max if none was set.
+func retryJoinBackoffFor(b Backoff, interval, max time.Duration) Backoff {
+	if b != nil {
+		return b
+	}
+	return &ExponentialBackoff{Interval: interval, Max: max}
+}
+
+// retryJoinBackoff returns the time to wait after the given number of
+// failed attempts. The wait starts at interval and doubles with every
+// attempt up to max. A random jitter of up to half the wait is subtracted
+// so agents started together don't retry in lockstep. A zero max disables
+// the backoff and interval is returned unchanged.
+func retryJoinBackoff(attempt int, interval, max time.Duration) time.Duration {
+	if max <= 0 || interval <= 0 {
+		return interval
+	}
+	wait := interval
+	for i := 1; i < attempt && wait < max; i++ {
+		wait *= 2
+	}
+	if wait > max {
+		wait = max
+	}
+	return wait - lib.RandomStagger(wait/2)
+}
+
+// deadServers tracks the static retry_join servers which failed on
+// consecutive attempts so that they can be skipped until they're probed
+// again. A nil deadServers skips nothing.
+type deadServers struct {
+	after    int
+	failures map[string]int
+	skips    map[string]int
+}
+
+// newDeadServers returns the tracker for servers which are skipped once
+// they failed after attempts in a row. It returns nil if after isn't
+// positive.
+func newDeadServers(after int) *deadServers {
+	if after <= 0 {
+		return nil
+	}
+	return &deadServers{after: after, failures: make(map[string]int), skips: make(map[string]int)}
+}
+
+// skip returns the servers to join on the next attempt and the servers
+// which are skipped because they failed the last attempts. A failing
+// server is probed again after it was skipped after times, so a server
+// which comes back is found again.
+func (d *deadServers) skip(servers []string) (keep, skipped []string) {
+	if d == nil {
+		return servers, nil
+	}
+	for _, s := range servers {
+		if d.failures[s] >= d.after && d.skips[s] < d.after {
+			d.skips[s]++
+			skipped = append(skipped, s)
+			continue
+		}
+		d.skips[s] = 0
+		keep = append(keep, s)
+	}
+	return keep, skipped
+}
+
+// update counts the failures of the servers which were joined.
+func (d *deadServers) update(servers, failed []string) {
+	isFailed := make(map[string]bool, len(failed))
+	for _, s := range failed {
+		isFailed[s] = true
+	}
+	for _, s := range servers {
+		if isFailed[s] {
+			d.failures[s]++
+		} else {
+			delete(d.failures, s)
+			delete(d.skips, s)
+		}
+	}
+}
+
+// joinEach joins the servers one at a time so that the servers which
+// could not be reached are known. It returns the number of nodes joined,
+// the servers that failed and the last error.
+func joinEach(join func([]string) (int, error), servers []string) (int, []string, error) {
+	var n int
+	var failed []string
+	var err error
+	for _, s := range servers {
+		m, joinErr := join([]string{s})
+		if joinErr != nil {
+			failed = append(failed, s)
+			err = joinErr
+			continue
+		}
+		n += m
+	}
+	return n, failed, err
+}
+
+// logJoinAttempt logs the servers a join attempt dialed and, at debug
+// level, the error of each one which failed. Memberlist joins the servers
+// one by one and returns a multierror of their errors, which already name
+// the address.
+func (a *Agent) logJoinAttempt(cluster string, servers []string, n int, err error) {
+	a.logger.Printf("[DEBUG] agent: (%s) Join attempt dialed %v, synced with %d agents", cluster, servers, n)
+	for _, e := range joinAttemptErrors(err) {
+		a.logger.Printf("[DEBUG] agent: (%s) Join attempt error: %v", cluster, e)
+	}
+}
+
+// joinAttemptErrors returns the errors of the addresses of a join, or the
+// error itself if it isn't a multierror.
+func joinAttemptErrors(err error) []error {
+	if err == nil {
+		return nil
+	}
+	if merr, ok := err.(*multierror.Error); ok {
+		return merr.Errors
+	}
+	return []error{err}
+}
+
+// tagFilter is a parsed retry_join_tag_filter. An instance matches if its
+// tags match all of the expressions.
+type tagFilter []tagExpr
+
+// tagExpr is a "key=value", "key!=value" or "key" expression of a tag
+// filter.
+type tagExpr struct {
+	key   string
+	op    string
+	value string
+}
+
+// parseTagFilter parses the expressions of a tag filter.
+func parseTagFilter(exprs []string) (tagFilter, error) {
+	var filter tagFilter
+	for _, e := range exprs {
+		var expr tagExpr
+		if i := strings.Index(e, "!="); i >= 0 {
+			expr = tagExpr{key: e[:i], op: "!=", value: e[i+2:]}
+		} else if i := strings.Index(e, "="); i >= 0 {
+			expr = tagExpr{key: e[:i], op: "=", value: e[i+1:]}
+		} else {
+			expr = tagExpr{key: e}
+		}
+		expr.key = strings.TrimSpace(expr.key)
+		expr.value = strings.TrimSpace(expr.value)
+		if expr.key == "" {
+			return nil, fmt.Errorf("missing tag key in %q", e)
+		}
+		filter = append(filter, expr)
+	}
+	return filter, nil
+}
+
+// Match returns whether the tags match all of the expressions of the
+// filter. An empty filter matches everything.
+func (f tagFilter) Match(tags map[string]string) bool {
+	for _, expr := range f {
+		v, ok := tags[expr.key]
+		switch expr.op {
+		case "=":
+			if !ok || v != expr.value {
+				return false
+			}
+		case "!=":
+			if ok && v == expr.value {
+				return false
+			}
+		default:
+			if !ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// joinExclude is a parsed retry_join_exclude. A server is excluded if it
+// matches any of the expressions.
+type joinExclude []excludeExpr
+
+// excludeExpr is a CIDR block, or a host matching on any port unless the
+// expression has one.
+type excludeExpr struct {
+	expr string
+	cidr *net.IPNet
+	host string
+	port string
+}
+
+// parseJoinExclude parses the expressions of retry_join_exclude.
+func parseJoinExclude(exprs []string) (joinExclude, error) {
+	var exclude joinExclude
+	for _, e := range exprs {
+		if strings.Contains(e, "/") {
+			_, cidr, err := net.ParseCIDR(e)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CIDR %q", e)
+			}
+			exclude = append(exclude, excludeExpr{expr: e, cidr: cidr})
+			continue
+		}
+		valid, _ := cleanJoinAddrs([]string{e})
+		if len(valid) == 0 {
+			return nil, fmt.Errorf("invalid address %q", e)
+		}
+		host, port := splitJoinAddr(valid[0])
+		exclude = append(exclude, excludeExpr{expr: e, host: host, port: port})
+	}
+	return exclude, nil
+}
+
+// Match returns the expression the server matches, or an empty string if
+// it matches none.
+func (x joinExclude) Match(server string) string {
+	if len(x) == 0 {
+		return ""
+	}
+	valid, _ := cleanJoinAddrs([]string{server})
+	if len(valid) == 0 {
+		return ""
+	}
+	host, port := splitJoinAddr(valid[0])
+	ip := net.ParseIP(host)
+	for _, expr := range x {
+		switch {
+		case expr.cidr != nil:
+			if ip != nil && expr.cidr.Contains(ip) {
+				return expr.expr
+			}
+		case expr.host == host && (expr.port == "" || expr.port == port):
+			return expr.expr
+		}
+	}
+	return ""
+}
+
+// splitJoinAddr splits a join address cleaned by cleanJoinAddrs into its
+// host, without brackets, and port, which is empty if it has none.
+func splitJoinAddr(addr string) (host, port string) {
+	if h, p, err := net.SplitHostPort(addr); err == nil {
+		return h, p
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]"), ""
+}
+
+// excludeServers drops the servers matching the exclusion. Each excluded
+// server is logged the first time it's dropped.
+func (a *Agent) excludeServers(servers []string, exclude joinExclude, logged map[string]bool) []string {
+	if len(exclude) == 0 {
+		return servers
+	}
+	var keep []string
+	for _, s := range servers {
+		expr := exclude.Match(s)
+		if expr == "" {
+			keep = append(keep, s)
+			continue
+		}
+		if !logged[s] {
+			a.logger.Printf("[INFO] agent: Excluding retry_join server %s matching %q of retry_join_exclude", s, expr)
+			logged[s] = true
+		}
+	}
+	return keep
+}
+
+// joinSources returns the sorted list of sources the servers came from.
+func joinSources(servers []string, sources map[string]string) []string {
+	seen := make(map[string]bool)
+	var used []string
+	for _, s := range servers {
+		if source := sources[s]; !seen[source] {
+			seen[source] = true
+			used = append(used, source)
+		}
+	}
+	sort.Strings(used)
+	return used
+}
+
+// How a successful join found the servers, as returned by joinVia.
+const (
+	joinViaDiscovery = "via-discovery"
+	joinViaStatic    = "via-static"
+	joinViaMixed     = "mixed"
+)
+
+// joinVia returns whether the sources of a join were only discovery
+// providers, only addresses from the configuration or both. The static,
+// fallback and last known servers count as static addresses.
+func joinVia(sources []string) string {
+	discovery, static := false, false
+	for _, source := range sources {
+		switch source {
+		case "static", "fallback", "last_known":
+			static = true
+		default:
+			discovery = true
+		}
+	}
+	switch {
+	case discovery && static:
+		return joinViaMixed
+	case discovery:
+		return joinViaDiscovery
+	default:
+		return joinViaStatic
+	}
+}
+
+// retryJoinViaMetric counts a successful join by how it found the servers.
+func retryJoinViaMetric(via string) {
+	metrics.IncrCounter([]string{"consul", "agent", "retry_join", "join_type", via}, 1)
+}
+
+// preferAddrFamily returns the addresses of the given family, "ipv4" or
+// "ipv6", and all entries which are DNS names. Addresses of the other
+// family are only dropped if there is at least one address of the
+// preferred family. Any other family returns addrs unchanged.
+func preferAddrFamily(addrs []string, family string) []string {
+	if family != "ipv4" && family != "ipv6" {
+		return addrs
+	}
+
+	var preferred, names []string
+	for _, addr := range addrs {
+		host := addr
+		if h, _, err := net.SplitHostPort(addr); err == nil {
+			host = h
+		}
+		ip := net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"))
+		switch {
+		case ip == nil:
+			names = append(names, addr)
+		case (ip.To4() != nil) == (family == "ipv4"):
+			preferred = append(preferred, addr)
+		}
+	}
+	if len(preferred) == 0 {
+		return addrs
+	}
+	return append(preferred, names...)
+}
+
+// cleanJoinAddrs normalizes and deduplicates join addresses. IP addresses
+// are written in their canonical form, so "[::0:1]:8302" and "[::1]:8302"
+// are the same server, and host names are lowercased. Entries which are
+// not a valid host or host:port are returned separately.
+func cleanJoinAddrs(addrs []string) (valid, invalid []string) {
+	seen := make(map[string]bool)
+	for _, addr := range addrs {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			host, port = strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]"), ""
+			if strings.Contains(host, ":") && net.ParseIP(host) == nil {
+				invalid = append(invalid, addr)
+				continue
+			}
+		}
+		if host == "" || strings.ContainsAny(host, " \t/") {
+			invalid = append(invalid, addr)
+			continue
+		}
+		if port != "" {
+			if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+				invalid = append(invalid, addr)
+				continue
+			}
+		}
+		if ip := net.ParseIP(host); ip != nil {
+			host = ip.String()
+		} else {
+			host = strings.ToLower(host)
+		}
+		switch {
+		case port != "":
+			addr = net.JoinHostPort(host, port)
+		case strings.Contains(host, ":"):
+			addr = "[" + host + "]"
+		default:
+			addr = host
+		}
+		if seen[addr] {
+			continue
+		}
+		seen[addr] = true
+		valid = append(valid, addr)
+	}
+	return valid, invalid
+}
+
+// joinAddrsWithPort returns a copy of addrs where every entry that does not
+// specify a port has the given port appended. Bare IPv6 addresses, with or
+// without brackets, are returned in bracket form. A zero port leaves the
+// addresses unchanged.
+func joinAddrsWithPort(addrs []string, port int) []string {
+	if port == 0 {
+		return addrs
+	}
+	out := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		if _, _, err := net.SplitHostPort(addr); err == nil {
+			out = append(out, addr)
+			continue
+		}
+		host := strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+		out = append(out, net.JoinHostPort(host, strconv.Itoa(port)))
 	}
+	return out
 }
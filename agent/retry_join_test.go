@@ -0,0 +1,1608 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/hashicorp/consul/testutil"
+	"github.com/hashicorp/consul/testutil/retry"
+	multierror "github.com/hashicorp/go-multierror"
+	"github.com/hashicorp/serf/serf"
+	"google.golang.org/api/googleapi"
+)
+
+func TestJoinAddrsWithPort(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		desc string
+		in   []string
+		port int
+		out  []string
+	}{
+		{"no port", []string{"1.2.3.4", "host"}, 8301, []string{"1.2.3.4:8301", "host:8301"}},
+		{"port kept", []string{"1.2.3.4:1234", "host:5678"}, 8301, []string{"1.2.3.4:1234", "host:5678"}},
+		{"ipv6 bare", []string{"::1", "fe80::1"}, 8302, []string{"[::1]:8302", "[fe80::1]:8302"}},
+		{"ipv6 bracket", []string{"[::1]"}, 8302, []string{"[::1]:8302"}},
+		{"ipv6 with port", []string{"[::1]:1234"}, 8302, []string{"[::1]:1234"}},
+		{"zero port", []string{"1.2.3.4"}, 0, []string{"1.2.3.4"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			if got, want := joinAddrsWithPort(tt.in, tt.port), tt.out; !reflect.DeepEqual(got, want) {
+				t.Fatalf("got %v want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestCleanJoinAddrs(t *testing.T) {
+	t.Parallel()
+	in := []string{
+		"1.2.3.4:8302",
+		"1.2.3.4:8302",
+		"Server.DC2.example.com:8302",
+		"server.dc2.example.com:8302",
+		"[::0:1]:8302",
+		"[::1]:8302",
+		"host",
+		"::1",
+		"1.2.3.4:0",
+		"1.2.3.4:http",
+		":8302",
+		"bad host:8302",
+		"a:b:c",
+	}
+	valid, invalid := cleanJoinAddrs(in)
+	if want := []string{"1.2.3.4:8302", "server.dc2.example.com:8302", "[::1]:8302", "host", "[::1]"}; !reflect.DeepEqual(valid, want) {
+		t.Fatalf("got valid %v want %v", valid, want)
+	}
+	if want := []string{"1.2.3.4:0", "1.2.3.4:http", ":8302", "bad host:8302", "a:b:c"}; !reflect.DeepEqual(invalid, want) {
+		t.Fatalf("got invalid %v want %v", invalid, want)
+	}
+}
+
+func TestConfig_ValidateRetryJoin(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		desc string
+		c    *Config
+		err  string
+	}{
+		{"empty", &Config{}, ""},
+		{"valid", &Config{RetryJoinAddressFamily: "ipv4", RetryJoinOrder: "static", RetryJoinSeeds: []string{"10.0.0.1"},
+			RetryJoinTagFilter: []string{"cluster=prod"}, RetryJoinExclude: []string{"10.1.0.0/16"}}, ""},
+		{"address family", &Config{RetryJoinAddressFamily: "ipv5"}, "retry_join_address_family"},
+		{"order", &Config{RetryJoinOrder: "random"}, "retry_join_order"},
+		{"seeds", &Config{RetryJoinSeeds: []string{"10.0.0.1:99999"}}, "retry_join_seeds"},
+		{"min domains", &Config{RetryJoinMinDomains: -1}, "retry_join_min_domains"},
+		{"fallback after", &Config{RetryJoinFallback: []string{"10.0.0.9"}, RetryJoinFallbackAfter: -1}, "retry_join_fallback_after"},
+		{"tag filter", &Config{RetryJoinTagFilter: []string{"=prod"}}, "RetryJoinTagFilter"},
+		{"exclude", &Config{RetryJoinExclude: []string{"10.1.0.0/33"}}, "RetryJoinExclude"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			err := tt.c.ValidateRetryJoin()
+			if tt.err == "" && err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Fatalf("got error %v want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestDiscoverServers(t *testing.T) {
+	t.Parallel()
+	logger := log.New(ioutil.Discard, "", 0)
+
+	var lock sync.Mutex
+	running, maxRunning := 0, 0
+	provider := func(servers []string, err error, wait time.Duration) func(*log.Logger) ([]string, map[string]string, error) {
+		return withoutDomains(func(*log.Logger) ([]string, error) {
+			lock.Lock()
+			running++
+			if running > maxRunning {
+				maxRunning = running
+			}
+			lock.Unlock()
+			time.Sleep(wait)
+			lock.Lock()
+			running--
+			lock.Unlock()
+			return servers, err
+		})
+	}
+	var providers []discoveryProvider
+	for i := 0; i < retryJoinDiscoveryWorkers+2; i++ {
+		providers = append(providers, discoveryProvider{"exec", fmt.Sprintf("p%d", i), provider([]string{fmt.Sprintf("10.0.0.%d", i)}, nil, 20*time.Millisecond), nil})
+	}
+	providers = append(providers, discoveryProvider{"k8s", "failing", provider(nil, errors.New("boom"), 0), nil})
+
+	results := discoverServers(context.Background(), logger, providers)
+	if len(results) != len(providers) {
+		t.Fatalf("got %d results", len(results))
+	}
+	for i, res := range results[:len(results)-1] {
+		if res.Err != nil || !reflect.DeepEqual(res.Servers, []string{fmt.Sprintf("10.0.0.%d", i)}) {
+			t.Fatalf("bad result %d: %#v", i, res)
+		}
+	}
+	if res := results[len(results)-1]; res.Name != "failing" || res.Err == nil {
+		t.Fatalf("bad result: %#v", res)
+	}
+	lock.Lock()
+	if maxRunning > retryJoinDiscoveryWorkers {
+		t.Fatalf("%d providers ran at once", maxRunning)
+	}
+	lock.Unlock()
+
+	// A provider which doesn't answer before the deadline fails.
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	results = discoverServers(ctx, logger, []discoveryProvider{
+		{"exec", "fast", provider([]string{"10.0.0.1"}, nil, 0), nil},
+		{"k8s", "slow", provider([]string{"10.0.0.2"}, nil, time.Second), nil},
+	})
+	if results[0].Err != nil || len(results[0].Servers) != 1 {
+		t.Fatalf("bad result: %#v", results[0])
+	}
+	if results[1].Err != context.DeadlineExceeded || results[1].Servers != nil {
+		t.Fatalf("bad result: %#v", results[1])
+	}
+}
+
+func TestWatchDiscovery(t *testing.T) {
+	t.Parallel()
+	buf := newLockedBuffer(4096)
+	a := &Agent{logger: log.New(buf, "", 0)}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if changed := a.watchDiscovery(ctx, a.logger, []discoveryProvider{{provider: "ec2", name: "EC2"}}); changed != nil {
+		t.Fatalf("should not watch providers without a watch")
+	}
+
+	watching := func(ctx context.Context, logger *log.Logger, changed chan<- struct{}) error {
+		changed <- struct{}{}
+		<-ctx.Done()
+		return nil
+	}
+	failing := func(ctx context.Context, logger *log.Logger, changed chan<- struct{}) error {
+		return errors.New("no watch")
+	}
+	changed := a.watchDiscovery(ctx, a.logger, []discoveryProvider{
+		{provider: "k8s", name: "Kubernetes", watch: watching},
+		{provider: "exec", name: "failing", watch: failing},
+	})
+	select {
+	case <-changed:
+	case <-time.After(time.Second):
+		t.Fatal("should have signalled a change")
+	}
+	retry.Run(t, func(r *retry.R) {
+		if log := string(buf.Bytes()); !strings.Contains(log, "[WARN] agent: Unable to watch failing, polling it every attempt instead: no watch") {
+			r.Fatalf("bad log: %q", log)
+		}
+	})
+}
+
+func TestProviderSchedule(t *testing.T) {
+	t.Parallel()
+	providers := []discoveryProvider{{provider: "ec2", name: "EC2"}, {provider: "k8s", name: "Kubernetes"}}
+	s := newProviderSchedule(map[string]RetryJoinProviderRetry{
+		"k8s": {Interval: 10 * time.Second, MaxAttempts: 2},
+	})
+	names := func(providers []discoveryProvider) []string {
+		var out []string
+		for _, p := range providers {
+			out = append(out, p.name)
+		}
+		return out
+	}
+
+	now := time.Now()
+	if got, want := names(s.due(providers, now)), []string{"EC2", "Kubernetes"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v want %v", got, want)
+	}
+	if got := s.wait(providers, now, time.Minute); got != 10*time.Second {
+		t.Fatalf("got wait %v", got)
+	}
+	if got := s.wait(providers, now, time.Second); got != time.Second {
+		t.Fatalf("got wait %v", got)
+	}
+
+	// Kubernetes isn't due again until its interval has passed.
+	now = now.Add(time.Second)
+	if got, want := names(s.due(providers, now)), []string{"EC2"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v want %v", got, want)
+	}
+	if got := s.exhausted(providers); len(got) != 0 {
+		t.Fatalf("got exhausted %v", got)
+	}
+	now = now.Add(10 * time.Second)
+	if got, want := names(s.due(providers, now)), []string{"EC2", "Kubernetes"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v want %v", got, want)
+	}
+	if got, want := s.exhausted(providers), []string{"Kubernetes"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got exhausted %v want %v", got, want)
+	}
+}
+
+func TestProviderSchedule_Failing(t *testing.T) {
+	t.Parallel()
+	providers := []discoveryProvider{{provider: "ec2", name: "EC2"}, {provider: "k8s", name: "Kubernetes"}}
+	s := newProviderSchedule(map[string]RetryJoinProviderRetry{
+		"ec2": {MaxFailures: 2},
+		"k8s": {MaxFailures: 2},
+	})
+	failed := []DiscoveryResult{{Name: "EC2", Err: errors.New("denied")}, {Name: "Kubernetes"}}
+	s.record(failed)
+	if got := s.failing(providers); len(got) != 0 {
+		t.Fatalf("got failing %v", got)
+	}
+
+	// Finding servers resets the failures of Kubernetes.
+	s.record([]DiscoveryResult{failed[0], {Name: "Kubernetes", Servers: []string{"10.0.0.1"}}})
+	s.record(failed)
+	if got, want := s.failing(providers), []string{"EC2"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got failing %v want %v", got, want)
+	}
+}
+
+func TestRetryJoin_ProviderMaxFailures(t *testing.T) {
+	t.Parallel()
+	dir := testutil.TempDir(t, "retry-join")
+	defer os.RemoveAll(dir)
+	runs := filepath.Join(dir, "runs")
+
+	cfg := TestConfig()
+	cfg.RetryJoin = []string{"10.0.0.1"}
+	cfg.RetryJoinExec = RetryJoinExec{Command: "/bin/sh", Args: []string{"-c", "echo run >> " + runs + "; exit 1"}}
+	cfg.RetryJoinProviderRetry = map[string]RetryJoinProviderRetry{"exec": {MaxFailures: 2}}
+	a := newRetryJoinTestAgent(cfg)
+
+	// The static server is still joined after the exec provider was
+	// dropped.
+	calls := 0
+	clock := &fakeClock{}
+	a.retryJoinWith(failingJoin(4, &calls), clock.after)
+	if calls != 5 {
+		t.Fatalf("got %d joins", calls)
+	}
+	out, err := ioutil.ReadFile(runs)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if n := strings.Count(string(out), "run"); n != 2 {
+		t.Fatalf("got %d runs of the exec provider", n)
+	}
+}
+
+func TestRoundRobinProvider(t *testing.T) {
+	t.Parallel()
+	providers := []discoveryProvider{{provider: "ec2", name: "ec2"}, {provider: "gce", name: "gce"}, {provider: "k8s", name: "k8s"}}
+	var got []string
+	for attempt := 0; attempt < 4; attempt++ {
+		queried := roundRobinProvider(providers, attempt)
+		if len(queried) != 1 {
+			t.Fatalf("got %d providers", len(queried))
+		}
+		got = append(got, queried[0].name)
+	}
+	if want := []string{"ec2", "gce", "k8s", "ec2"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v want %v", got, want)
+	}
+}
+
+func TestRetryJoinError(t *testing.T) {
+	t.Parallel()
+	err := &RetryJoinError{
+		Cluster:  RetryJoinWAN,
+		Attempts: 3,
+		Elapsed:  2 * time.Second,
+		Servers:  []string{"1.2.3.4:8302"},
+		Err:      errors.New("timeout"),
+	}
+	want := "agent: max join WAN retry exhausted after 3 attempts in 2s, servers tried: [1.2.3.4:8302], last error: timeout"
+	if got := err.Error(); got != want {
+		t.Fatalf("got %q want %q", got, want)
+	}
+}
+
+func TestRetryJoinStatus(t *testing.T) {
+	t.Parallel()
+	a := &Agent{retryJoinStatusCh: make(chan RetryJoinEvent, 2)}
+	a.retryJoinStatus(RetryJoinLAN, RetryJoinAttempting, 1, nil)
+	a.retryJoinStatus(RetryJoinLAN, RetryJoinFailedAttempt, 1, errors.New("timeout"))
+	a.retryJoinStatus(RetryJoinLAN, RetryJoinAttempting, 2, nil)
+
+	// The oldest event was dropped instead of blocking.
+	want := []RetryJoinEvent{
+		{Cluster: RetryJoinLAN, State: RetryJoinFailedAttempt, Attempt: 1, Err: errors.New("timeout")},
+		{Cluster: RetryJoinLAN, State: RetryJoinAttempting, Attempt: 2},
+	}
+	for _, w := range want {
+		if got := <-a.retryJoinStatusCh; !reflect.DeepEqual(got, w) {
+			t.Fatalf("got %#v want %#v", got, w)
+		}
+	}
+}
+
+func TestAgent_RetryJoinStatusCh(t *testing.T) {
+	t.Parallel()
+	cfg := TestConfig()
+	cfg.RetryJoin = []string{"127.0.0.1:1"}
+	cfg.RetryMaxAttempts = 1
+	cfg.RetryInterval = 10 * time.Millisecond
+	a := NewTestAgent(t.Name(), cfg)
+	defer a.Shutdown()
+
+	select {
+	case err := <-a.RetryJoinCh():
+		if _, ok := err.(*RetryJoinError); !ok {
+			t.Fatalf("bad: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("retry join didn't give up")
+	}
+
+	var states []string
+	for len(a.RetryJoinStatusCh()) > 0 {
+		ev := <-a.RetryJoinStatusCh()
+		if ev.Cluster != RetryJoinLAN {
+			t.Fatalf("bad: %#v", ev)
+		}
+		if (ev.State == RetryJoinFailedAttempt || ev.State == RetryJoinExhausted) && ev.Err == nil {
+			t.Fatalf("should have an error: %#v", ev)
+		}
+		states = append(states, fmt.Sprintf("%s %d", ev.State, ev.Attempt))
+	}
+	want := []string{"attempting 1", "failed-attempt 1", "attempting 2", "exhausted 2"}
+	if !reflect.DeepEqual(states, want) {
+		t.Fatalf("got %v want %v", states, want)
+	}
+}
+
+// fakeClock records the waits of a retry join loop. Its channels fire
+// right away unless it's blocked, in which case they never fire.
+type fakeClock struct {
+	lock    sync.Mutex
+	waits   []time.Duration
+	blocked bool
+	waited  chan struct{}
+}
+
+func (c *fakeClock) after(d time.Duration) <-chan time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.waits = append(c.waits, d)
+	if c.waited != nil {
+		select {
+		case c.waited <- struct{}{}:
+		default:
+		}
+	}
+	ch := make(chan time.Time, 1)
+	if !c.blocked {
+		ch <- time.Now()
+	}
+	return ch
+}
+
+// failingJoin returns a join function which fails the given number of
+// times before it joins one agent, or always fails if failures is
+// negative. It counts its calls in calls.
+func failingJoin(failures int, calls *int) func([]string) (int, error) {
+	return func([]string) (int, error) {
+		*calls++
+		if failures < 0 || *calls <= failures {
+			return 0, fmt.Errorf("join %d failed", *calls)
+		}
+		return 1, nil
+	}
+}
+
+func newRetryJoinTestAgent(cfg *Config) *Agent {
+	return &Agent{
+		config:            cfg,
+		logger:            log.New(ioutil.Discard, "", 0),
+		retryJoinCh:       make(chan error, 1),
+		retryJoinStatusCh: make(chan RetryJoinEvent, retryJoinStatusBuffer),
+		retryJoinReloadCh: make(chan *Config, 1),
+		shutdownCh:        make(chan struct{}),
+	}
+}
+
+func TestRetryJoin_Backoff(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		name        string
+		interval    time.Duration
+		maxInterval time.Duration
+		maxAttempts int
+		failures    int
+		waits       []time.Duration
+		jitter      bool
+		exhausted   bool
+	}{
+		{
+			name:     "joins on first attempt",
+			interval: time.Second,
+			failures: 0,
+		},
+		{
+			name:     "fixed interval",
+			interval: 2 * time.Second,
+			failures: 3,
+			waits:    []time.Duration{2 * time.Second, 2 * time.Second, 2 * time.Second},
+		},
+		{
+			name:     "interval below the floor",
+			interval: 0,
+			failures: 2,
+			waits:    []time.Duration{retryJoinIntervalFloor, retryJoinIntervalFloor},
+		},
+		{
+			name:        "backoff up to the max interval with jitter",
+			interval:    time.Second,
+			maxInterval: 4 * time.Second,
+			failures:    4,
+			waits:       []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second},
+			jitter:      true,
+		},
+		{
+			name:        "max attempts exhausted",
+			interval:    time.Second,
+			maxAttempts: 2,
+			failures:    -1,
+			waits:       []time.Duration{time.Second, time.Second},
+			exhausted:   true,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := TestConfig()
+			cfg.RetryJoin = []string{"10.0.0.1"}
+			cfg.RetryInterval = tc.interval
+			cfg.RetryMaxInterval = tc.maxInterval
+			cfg.RetryMaxAttempts = tc.maxAttempts
+			a := newRetryJoinTestAgent(cfg)
+			clock := &fakeClock{}
+			var calls int
+			a.retryJoinWith(failingJoin(tc.failures, &calls), clock.after)
+
+			if len(clock.waits) != len(tc.waits) {
+				t.Fatalf("got waits %v want %v", clock.waits, tc.waits)
+			}
+			for i, want := range tc.waits {
+				got := clock.waits[i]
+				if (!tc.jitter && got != want) || (tc.jitter && (got <= want/2 || got > want)) {
+					t.Fatalf("wait %d: got %v want %v (jitter %v)", i, got, want, tc.jitter)
+				}
+			}
+
+			select {
+			case err := <-a.retryJoinCh:
+				if !tc.exhausted {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				rerr, ok := err.(*RetryJoinError)
+				if !ok {
+					t.Fatalf("bad: %#v", err)
+				}
+				// The error of the last attempt is reported, not lost.
+				wantErr := fmt.Sprintf("join %d failed", calls)
+				if rerr.Attempts != tc.maxAttempts+1 || rerr.Err == nil || rerr.Err.Error() != wantErr {
+					t.Fatalf("bad: %#v", rerr)
+				}
+				if want := cfg.RetryJoinAddrs(); !reflect.DeepEqual(rerr.Servers, want) {
+					t.Fatalf("got servers %v", rerr.Servers)
+				}
+			default:
+				if tc.exhausted {
+					t.Fatal("should have exhausted the retries")
+				}
+			}
+		})
+	}
+}
+
+func TestRetryJoinWan_Backoff(t *testing.T) {
+	t.Parallel()
+	cfg := TestConfig()
+	cfg.RetryJoinWan = []string{"10.0.0.1:8302"}
+	cfg.RetryIntervalWan = time.Second
+	cfg.RetryMaxIntervalWan = 3 * time.Second
+	cfg.RetryMaxAttemptsWan = 3
+	a := newRetryJoinTestAgent(cfg)
+	clock := &fakeClock{}
+	var calls int
+	a.retryJoinWanWith(failingJoin(-1, &calls), clock.after)
+
+	want := []time.Duration{time.Second, 2 * time.Second, 3 * time.Second}
+	if len(clock.waits) != len(want) {
+		t.Fatalf("got waits %v want %v", clock.waits, want)
+	}
+	for i, w := range want {
+		if got := clock.waits[i]; got <= w/2 || got > w {
+			t.Fatalf("wait %d: got %v want %v with jitter", i, got, w)
+		}
+	}
+	select {
+	case err := <-a.retryJoinCh:
+		rerr, ok := err.(*RetryJoinError)
+		if !ok || rerr.Cluster != RetryJoinWAN || rerr.Attempts != 4 || rerr.Err == nil {
+			t.Fatalf("bad: %#v", err)
+		}
+	default:
+		t.Fatal("should have exhausted the retries")
+	}
+}
+
+func TestRetryJoinWan_Discovery(t *testing.T) {
+	t.Parallel()
+	cfg := TestConfig()
+	cfg.RetryJoinWan = []string{"10.0.0.1:8302"}
+	cfg.RetryJoinWanDiscovery = true
+	cfg.RetryJoinExec = RetryJoinExec{Command: "/bin/sh", Args: []string{"-c", "echo 10.0.0.1; echo 10.0.0.2"}}
+	cfg.RetryMaxAttemptsWan = 3
+	a := newRetryJoinTestAgent(cfg)
+
+	// The server which failed is retried, the joined one isn't joined
+	// again even though it's discovered on every attempt.
+	var got []string
+	failures := 1
+	join := func(servers []string) (int, error) {
+		got = append(got, servers...)
+		if servers[0] == "10.0.0.2:8302" && failures > 0 {
+			failures--
+			return 0, fmt.Errorf("failed")
+		}
+		return 1, nil
+	}
+	clock := &fakeClock{}
+	a.retryJoinWanWith(join, clock.after)
+	want := []string{"10.0.0.1:8302", "10.0.0.2:8302", "10.0.0.2:8302"}
+	if !reflect.DeepEqual(got, want) || len(clock.waits) != 1 {
+		t.Fatalf("got servers %v and waits %v", got, clock.waits)
+	}
+
+	// Without any servers the attempts fail until the retries run out.
+	cfg.RetryJoinWan = nil
+	cfg.RetryJoinExec = RetryJoinExec{Command: "/bin/sh", Args: []string{"-c", "true"}}
+	a = newRetryJoinTestAgent(cfg)
+	calls := 0
+	a.retryJoinWanWith(failingJoin(0, &calls), (&fakeClock{}).after)
+	if calls != 0 {
+		t.Fatalf("got %d joins", calls)
+	}
+	select {
+	case err := <-a.retryJoinCh:
+		rerr, ok := err.(*RetryJoinError)
+		if !ok || rerr.Cluster != RetryJoinWAN || rerr.Attempts != 4 {
+			t.Fatalf("bad: %#v", err)
+		}
+	default:
+		t.Fatal("should have exhausted the retries")
+	}
+
+	// Discovery is only used by join -wan if it's enabled.
+	cfg.RetryJoinWanDiscovery = false
+	a = newRetryJoinTestAgent(cfg)
+	a.retryJoinWanWith(failingJoin(0, &calls), (&fakeClock{}).after)
+	if calls != 0 || len(a.retryJoinCh) != 0 {
+		t.Fatalf("got %d joins", calls)
+	}
+}
+
+func TestRetryJoinWan_RetriesAfterJoin(t *testing.T) {
+	t.Parallel()
+	cfg := TestConfig()
+	cfg.RetryJoinWan = []string{"10.0.0.1:8302", "10.0.0.2:8302"}
+	cfg.RetryMaxAttemptsWan = 0
+	a := newRetryJoinTestAgent(cfg)
+
+	// Once the first server is joined, the one which keeps failing is
+	// only retried a few times even though the retries are unlimited.
+	var failed int
+	join := func(servers []string) (int, error) {
+		if servers[0] == "10.0.0.2:8302" {
+			failed++
+			return 0, fmt.Errorf("failed")
+		}
+		return 1, nil
+	}
+	clock := &fakeClock{}
+	a.retryJoinWanWith(join, clock.after)
+	if failed != 1+retryJoinWanRetriesAfterJoin || len(clock.waits) != retryJoinWanRetriesAfterJoin {
+		t.Fatalf("got %d joins and waits %v", failed, clock.waits)
+	}
+	if len(a.retryJoinCh) != 0 {
+		t.Fatalf("join -wan should not fail")
+	}
+}
+
+func TestDiscoveryProviders_All(t *testing.T) {
+	t.Parallel()
+	cfg := TestConfig()
+	cfg.RetryJoinEC2.TagKey = "consul"
+	cfg.RetryJoinEC2.TagValue = "server"
+	cfg.RetryJoinGCE.TagValue = "consul-server"
+	cfg.RetryJoinExec = RetryJoinExec{Command: "/bin/discover"}
+	var got []string
+	for _, p := range cfg.discoveryProviders() {
+		got = append(got, p.provider)
+	}
+	if want := []string{"ec2", "gce", "exec"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got providers %v want %v", got, want)
+	}
+}
+
+func TestRetryJoin_LogsAttempts(t *testing.T) {
+	t.Parallel()
+	cfg := TestConfig()
+	cfg.RetryJoin = []string{"10.0.0.1", "10.0.0.2"}
+	cfg.RetryMaxAttempts = 1
+	a := newRetryJoinTestAgent(cfg)
+	var buf bytes.Buffer
+	a.logger = log.New(&buf, "", 0)
+	join := func([]string) (int, error) {
+		var errs error
+		errs = multierror.Append(errs, errors.New("Failed to join 10.0.0.1: dial tcp 10.0.0.1:8301: i/o timeout"))
+		errs = multierror.Append(errs, errors.New("Failed to join 10.0.0.2: connection refused"))
+		return 0, errs
+	}
+	a.retryJoinWith(join, (&fakeClock{}).after)
+
+	out := buf.String()
+	for _, want := range []string{
+		"[DEBUG] agent: (LAN) Join attempt dialed [10.0.0.1:8301 10.0.0.2:8301], synced with 0 agents",
+		"[DEBUG] agent: (LAN) Join attempt error: Failed to join 10.0.0.1: dial tcp 10.0.0.1:8301: i/o timeout",
+		"[DEBUG] agent: (LAN) Join attempt error: Failed to join 10.0.0.2: connection refused",
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("missing %q in %s", want, out)
+		}
+	}
+}
+
+func TestRetryJoin_Reload(t *testing.T) {
+	t.Parallel()
+	cfg := TestConfig()
+	cfg.RetryJoin = []string{"10.0.0.1"}
+	cfg.RetryInterval = time.Hour
+	a := newRetryJoinTestAgent(cfg)
+
+	joins := make(chan []string, 2)
+	join := func(servers []string) (int, error) {
+		joins <- servers
+		if servers[0] == "10.0.0.1:8301" {
+			return 0, errors.New("unreachable")
+		}
+		return 1, nil
+	}
+	ticks := make(chan time.Time)
+	after := func(time.Duration) <-chan time.Time { return ticks }
+	done := make(chan struct{})
+	go func() {
+		a.retryJoinWith(join, after)
+		close(done)
+	}()
+
+	if got, want := <-joins, []string{"10.0.0.1:8301"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got servers %v want %v", got, want)
+	}
+	reloaded := TestConfig()
+	reloaded.RetryJoin = []string{"10.0.0.2"}
+	a.reloadRetryJoin(reloaded)
+	retry.Run(t, func(r *retry.R) {
+		if len(a.retryJoinReloadCh) != 0 {
+			r.Fatal("the reload should be picked up while waiting")
+		}
+	})
+	ticks <- time.Now()
+
+	if got, want := <-joins, []string{"10.0.0.2:8301"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got servers %v want %v", got, want)
+	}
+	<-done
+}
+
+func TestRetryJoin_ReloadCancelsDiscovery(t *testing.T) {
+	t.Parallel()
+	cfg := TestConfig()
+	cfg.RetryJoin = []string{"10.0.0.1"}
+	cfg.RetryJoinExec = RetryJoinExec{
+		Command: "/bin/sh",
+		Args:    []string{"-c", "sleep 5; echo 10.0.0.9"},
+	}
+	a := newRetryJoinTestAgent(cfg)
+
+	joins := make(chan []string, 1)
+	join := func(servers []string) (int, error) {
+		joins <- servers
+		return 1, nil
+	}
+	start := time.Now()
+	done := make(chan struct{})
+	go func() {
+		a.retryJoinWith(join, (&fakeClock{}).after)
+		close(done)
+	}()
+
+	// The provider is removed while it's still running, so the attempt
+	// goes on with the reloaded servers without waiting for it.
+	reloaded := TestConfig()
+	reloaded.RetryJoin = []string{"10.0.0.2"}
+	a.reloadRetryJoin(reloaded)
+	if got, want := <-joins, []string{"10.0.0.2:8301"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got servers %v want %v", got, want)
+	}
+	<-done
+	if d := time.Since(start); d >= 5*time.Second {
+		t.Fatalf("waited %s for the removed provider", d)
+	}
+}
+
+func TestDiscoveryRun_CancelRemoved(t *testing.T) {
+	t.Parallel()
+	logger := log.New(ioutil.Discard, "", 0)
+	block := make(chan struct{})
+	defer close(block)
+	slow := func(*log.Logger) ([]string, map[string]string, error) {
+		<-block
+		return []string{"10.0.0.2"}, nil, nil
+	}
+	fast := func(*log.Logger) ([]string, map[string]string, error) {
+		return []string{"10.0.0.1"}, nil, nil
+	}
+	kept := discoveryProvider{"exec", "fast", fast, nil}
+	run := startDiscovery(context.Background(), logger, []discoveryProvider{
+		kept,
+		{"k8s", "Kubernetes", slow, nil},
+	})
+	if got := run.cancelRemoved([]discoveryProvider{kept}); !reflect.DeepEqual(got, []string{"Kubernetes"}) {
+		t.Fatalf("got %v", got)
+	}
+	if got := run.cancelRemoved(nil); !reflect.DeepEqual(got, []string{"fast"}) {
+		t.Fatalf("got %v", got)
+	}
+	<-run.done
+	if res := run.results(); len(res) != 0 {
+		t.Fatalf("got %#v", res)
+	}
+}
+
+func TestRetryJoin_DiscoveredAddrsWithoutPort(t *testing.T) {
+	t.Parallel()
+	cfg := TestConfig()
+	cfg.RetryJoinExec = RetryJoinExec{
+		Command: "/bin/sh",
+		Args:    []string{"-c", "echo 10.0.0.1; echo 10.0.0.2:9301; echo ::1"},
+	}
+	a := newRetryJoinTestAgent(cfg)
+
+	var got []string
+	join := func(servers []string) (int, error) {
+		got = servers
+		return 1, nil
+	}
+	a.retryJoinWith(join, time.After)
+	want := []string{"10.0.0.1:8301", "10.0.0.2:9301", "[::1]:8301"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got servers %v want %v", got, want)
+	}
+}
+
+func TestRetryJoin_Order(t *testing.T) {
+	t.Parallel()
+	for order, want := range map[string][]string{
+		"":           {"10.0.0.1:8301", "10.0.0.2:8301"},
+		"discovered": {"10.0.0.1:8301", "10.0.0.2:8301"},
+		"static":     {"10.0.0.2:8301", "10.0.0.1:8301"},
+	} {
+		cfg := TestConfig()
+		cfg.RetryJoin = []string{"10.0.0.2"}
+		cfg.RetryJoinExec = RetryJoinExec{Command: "/bin/sh", Args: []string{"-c", "echo 10.0.0.1"}}
+		cfg.RetryJoinOrder = order
+		a := newRetryJoinTestAgent(cfg)
+
+		var got []string
+		join := func(servers []string) (int, error) {
+			got = servers
+			return 1, nil
+		}
+		a.retryJoinWith(join, time.After)
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("%q: got servers %v want %v", order, got, want)
+		}
+	}
+}
+
+func TestRetryJoin_MinDomains(t *testing.T) {
+	t.Parallel()
+	cfg := TestConfig()
+	cfg.RetryJoin = []string{"10.0.0.4"}
+	cfg.RetryJoinExec = RetryJoinExec{Command: "/bin/sh", Args: []string{"-c",
+		"echo 10.0.0.1 domain=a; echo 10.0.0.2 domain=a; echo 10.0.0.3 domain=b"}}
+	cfg.RetryJoinMinDomains = 2
+	a := newRetryJoinTestAgent(cfg)
+
+	// The only server in domain b fails the first attempt, which is
+	// retried even though two servers were joined.
+	var got []string
+	failures := 1
+	join := func(servers []string) (int, error) {
+		got = append(got, servers...)
+		if servers[0] == "10.0.0.3:8301" && failures > 0 {
+			failures--
+			return 0, fmt.Errorf("failed")
+		}
+		return 1, nil
+	}
+	clock := &fakeClock{}
+	a.retryJoinWith(join, clock.after)
+	want := []string{
+		"10.0.0.1:8301", "10.0.0.3:8301", "10.0.0.2:8301", "10.0.0.4:8301",
+		"10.0.0.1:8301", "10.0.0.3:8301", "10.0.0.2:8301", "10.0.0.4:8301",
+	}
+	if !reflect.DeepEqual(got, want) || len(clock.waits) != 1 {
+		t.Fatalf("got servers %v and waits %v", got, clock.waits)
+	}
+
+	// Without any known domains the join is accepted.
+	cfg.RetryJoinExec = RetryJoinExec{}
+	a = newRetryJoinTestAgent(cfg)
+	calls := 0
+	clock = &fakeClock{}
+	a.retryJoinWith(failingJoin(0, &calls), clock.after)
+	if calls != 1 || len(clock.waits) != 0 {
+		t.Fatalf("got %d joins and waits %v", calls, clock.waits)
+	}
+}
+
+func TestSpreadDomains(t *testing.T) {
+	t.Parallel()
+	domains := map[string]string{"a1": "a", "a2": "a", "a3": "a", "b1": "b", "c1": "c", "c2": "c"}
+	servers := []string{"a1", "x", "a2", "a3", "b1", "c1", "c2"}
+	want := []string{"a1", "b1", "c1", "a2", "c2", "a3", "x"}
+	if got := spreadDomains(servers, domains); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v want %v", got, want)
+	}
+}
+
+func TestCheckJoinedDomains(t *testing.T) {
+	t.Parallel()
+	domains := map[string]string{"a1": "a", "a2": "a", "b1": "b"}
+	servers := []string{"a1", "b1", "a2", "x"}
+	if err := checkJoinedDomains(servers, nil, domains, 2); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	err := checkJoinedDomains(servers, []string{"b1"}, domains, 2)
+	if err == nil || !strings.Contains(err.Error(), "1 failure domains [a]") {
+		t.Fatalf("got error %v", err)
+	}
+}
+
+func TestRetryJoin_AlreadyInCluster(t *testing.T) {
+	t.Parallel()
+	cfg := TestConfig()
+	cfg.RetryJoin = []string{"10.0.0.1"}
+	cfg.RetryJoinMinAgents = 2
+	a := newRetryJoinTestAgent(cfg)
+
+	// The agent is joined to two other agents by hand while the first
+	// attempt fails, so the loop stops without another one.
+	peers := 0
+	a.retryJoinPeers = func() int { return peers }
+	calls := 0
+	join := func(servers []string) (int, error) {
+		calls++
+		peers = 2
+		return 0, fmt.Errorf("join %d failed", calls)
+	}
+	clock := &fakeClock{}
+	a.retryJoinWith(join, clock.after)
+	if calls != 1 || len(clock.waits) != 1 {
+		t.Fatalf("got %d joins and waits %v", calls, clock.waits)
+	}
+	var last RetryJoinEvent
+	for len(a.retryJoinStatusCh) > 0 {
+		last = <-a.retryJoinStatusCh
+	}
+	if want := (RetryJoinEvent{Cluster: RetryJoinLAN, State: RetryJoinJoined, Attempt: 2}); !reflect.DeepEqual(last, want) {
+		t.Fatalf("got %#v want %#v", last, want)
+	}
+
+	// A single peer is too few.
+	a = newRetryJoinTestAgent(cfg)
+	peers = 1
+	a.retryJoinPeers = func() int { return peers }
+	calls = 0
+	join = func(servers []string) (int, error) {
+		calls++
+		return 2, nil
+	}
+	a.retryJoinWith(join, clock.after)
+	if calls != 1 {
+		t.Fatalf("got %d joins", calls)
+	}
+}
+
+func TestRetryJoin_Once(t *testing.T) {
+	t.Parallel()
+	cfg := TestConfig()
+	cfg.RetryJoin = []string{"10.0.0.1"}
+	cfg.RetryJoinOnce = true
+	a := newRetryJoinTestAgent(cfg)
+
+	calls := 0
+	clock := &fakeClock{}
+	a.retryJoinWith(failingJoin(-1, &calls), clock.after)
+	err, ok := (<-a.retryJoinCh).(*RetryJoinError)
+	if !ok || err.Attempts != 1 || !reflect.DeepEqual(err.Servers, []string{"10.0.0.1:8301"}) {
+		t.Fatalf("got %#v", err)
+	}
+	if calls != 1 || len(clock.waits) != 0 {
+		t.Fatalf("got %d joins and waits %v", calls, clock.waits)
+	}
+
+	// A successful join reports nothing.
+	a = newRetryJoinTestAgent(cfg)
+	calls = 0
+	a.retryJoinWith(failingJoin(0, &calls), clock.after)
+	if len(a.retryJoinCh) != 0 || calls != 1 {
+		t.Fatalf("got %d joins", calls)
+	}
+}
+
+func TestRetryJoin_FallbackAfterDefault(t *testing.T) {
+	t.Parallel()
+	cfg := TestConfig()
+	cfg.RetryJoin = []string{"10.0.0.1"}
+	cfg.RetryJoinFallback = []string{"10.0.0.9"}
+	cfg.RetryMaxAttempts = 3
+	a := newRetryJoinTestAgent(cfg)
+
+	// Without retry_join_fallback_after the fallback servers are still
+	// only tried after the default number of failed attempts.
+	var got [][]string
+	join := func(servers []string) (int, error) {
+		got = append(got, servers)
+		return 0, fmt.Errorf("failed")
+	}
+	a.retryJoinWith(join, (&fakeClock{}).after)
+	static := []string{"10.0.0.1:8301"}
+	want := [][]string{static, static, static, {"10.0.0.1:8301", "10.0.0.9:8301"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got servers %v want %v", got, want)
+	}
+}
+
+func TestRetryJoin_SkipAfter(t *testing.T) {
+	t.Parallel()
+	cfg := TestConfig()
+	cfg.RetryJoin = []string{"10.0.0.1", "10.0.0.2"}
+	cfg.RetryJoinSkipAfter = 2
+	cfg.RetryJoinMinAgents = 2
+	cfg.RetryMaxAttempts = 3
+	a := newRetryJoinTestAgent(cfg)
+
+	var joined []string
+	join := func(servers []string) (int, error) {
+		joined = append(joined, servers...)
+		if servers[0] == "10.0.0.1:8301" {
+			return 0, errors.New("unreachable")
+		}
+		return 1, nil
+	}
+	clock := &fakeClock{}
+	a.retryJoinWith(join, clock.after)
+	if err := <-a.retryJoinCh; err == nil {
+		t.Fatal("should give up")
+	}
+
+	// 10.0.0.1 fails the first two attempts and is skipped on the next
+	// two.
+	want := []string{
+		"10.0.0.1:8301", "10.0.0.2:8301",
+		"10.0.0.1:8301", "10.0.0.2:8301",
+		"10.0.0.2:8301",
+		"10.0.0.2:8301",
+	}
+	if !reflect.DeepEqual(joined, want) {
+		t.Fatalf("got %v want %v", joined, want)
+	}
+}
+
+func TestRetryJoin_Seeds(t *testing.T) {
+	t.Parallel()
+	cfg := TestConfig()
+	cfg.RetryJoin = []string{"10.0.0.1", "10.0.0.2"}
+	cfg.RetryJoinSeeds = []string{"10.0.0.1", "10.0.0.1:8301"}
+	cfg.RetryJoinSkipAfter = 1
+	cfg.RetryJoinMinAgents = 2
+	cfg.RetryMaxAttempts = 3
+	a := newRetryJoinTestAgent(cfg)
+
+	var joined []string
+	join := func(servers []string) (int, error) {
+		joined = append(joined, servers...)
+		if servers[0] == "10.0.0.1:8301" {
+			return 0, errors.New("unreachable")
+		}
+		return 1, nil
+	}
+	clock := &fakeClock{}
+	a.retryJoinWith(join, clock.after)
+	if err := <-a.retryJoinCh; err == nil {
+		t.Fatal("should give up")
+	}
+
+	// The seed is tried first and only once on every attempt, though it
+	// keeps failing.
+	want := []string{
+		"10.0.0.1:8301", "10.0.0.2:8301",
+		"10.0.0.1:8301", "10.0.0.2:8301",
+		"10.0.0.1:8301", "10.0.0.2:8301",
+		"10.0.0.1:8301", "10.0.0.2:8301",
+	}
+	if !reflect.DeepEqual(joined, want) {
+		t.Fatalf("got %v want %v", joined, want)
+	}
+}
+
+func TestRetryJoinServers(t *testing.T) {
+	t.Parallel()
+	a := &Agent{logger: log.New(ioutil.Discard, "", 0)}
+	cfg := &Config{
+		RetryJoin:              []string{"10.0.0.2:8301", "10.0.0.3:8301"},
+		RetryJoinOrder:         "static",
+		RetryJoinFallback:      []string{"10.0.0.9:8301"},
+		RetryJoinFallbackAfter: 2,
+		RetryJoinSeeds:         []string{"10.0.0.3:8301"},
+		RetryJoinExclude:       []string{"10.0.0.4"},
+	}
+	list := &joinServerList{excluded: make(map[string]bool)}
+
+	sources := make(map[string]string)
+	servers, static := a.retryJoinServers(cfg, 1, []string{"10.0.0.1:8301", "10.0.0.4:8301"}, sources, nil, list)
+	if want := []string{"10.0.0.3:8301", "10.0.0.2:8301", "10.0.0.1:8301"}; !reflect.DeepEqual(servers, want) {
+		t.Fatalf("got servers %v want %v", servers, want)
+	}
+	if want := []string{"10.0.0.2:8301", "10.0.0.3:8301"}; !reflect.DeepEqual(static, want) {
+		t.Fatalf("got static %v want %v", static, want)
+	}
+	if !list.excluded["10.0.0.4:8301"] {
+		t.Fatalf("excluded server should be logged")
+	}
+
+	// The fallback servers are added once the attempts are due.
+	sources = map[string]string{"10.0.0.1:8301": "aws"}
+	servers, _ = a.retryJoinServers(cfg, 2, []string{"10.0.0.1:8301"}, sources, nil, list)
+	if want := []string{"10.0.0.3:8301", "10.0.0.2:8301", "10.0.0.1:8301", "10.0.0.9:8301"}; !reflect.DeepEqual(servers, want) {
+		t.Fatalf("got servers %v want %v", servers, want)
+	}
+	if got := sources["10.0.0.9:8301"]; got != "fallback" {
+		t.Fatalf("got source %q", got)
+	}
+}
+
+func TestPinSeeds(t *testing.T) {
+	t.Parallel()
+	got := pinSeeds([]string{"a", "b", "c"}, []string{"c", "d"})
+	if want := []string{"c", "d", "a", "b"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v want %v", got, want)
+	}
+	if got := pinSeeds([]string{"a"}, nil); !reflect.DeepEqual(got, []string{"a"}) {
+		t.Fatalf("got %v", got)
+	}
+}
+
+func TestRetryJoin_Exclude(t *testing.T) {
+	t.Parallel()
+	cfg := TestConfig()
+	cfg.RetryJoin = []string{"10.0.0.1", "10.1.2.3", "10.0.0.2:8302", "10.0.0.3"}
+	cfg.RetryJoinExclude = []string{"10.1.0.0/16", "10.0.0.2", "10.0.0.3:8301"}
+	a := newRetryJoinTestAgent(cfg)
+
+	var joined []string
+	join := func(servers []string) (int, error) {
+		joined = append(joined, servers...)
+		return 1, nil
+	}
+	clock := &fakeClock{}
+	a.retryJoinWith(join, clock.after)
+	if len(a.retryJoinCh) != 0 {
+		t.Fatal("should join")
+	}
+	if want := []string{"10.0.0.1:8301"}; !reflect.DeepEqual(joined, want) {
+		t.Fatalf("got %v want %v", joined, want)
+	}
+}
+
+func TestDeadServers(t *testing.T) {
+	t.Parallel()
+	var none *deadServers
+	if keep, skipped := none.skip([]string{"a"}); !reflect.DeepEqual(keep, []string{"a"}) || skipped != nil {
+		t.Fatalf("got %v %v", keep, skipped)
+	}
+
+	d := newDeadServers(1)
+	d.update([]string{"a", "b"}, []string{"a"})
+	keep, skipped := d.skip([]string{"a", "b"})
+	if !reflect.DeepEqual(keep, []string{"b"}) || !reflect.DeepEqual(skipped, []string{"a"}) {
+		t.Fatalf("got %v %v", keep, skipped)
+	}
+	// The skipped server is probed again on the next attempt.
+	if keep, _ := d.skip([]string{"a", "b"}); !reflect.DeepEqual(keep, []string{"a", "b"}) {
+		t.Fatalf("got %v", keep)
+	}
+
+	// A server which joins again isn't skipped anymore.
+	d = newDeadServers(2)
+	d.update([]string{"a"}, []string{"a"})
+	d.update([]string{"a"}, []string{"a"})
+	d.update([]string{"a"}, nil)
+	if keep, _ := d.skip([]string{"a"}); !reflect.DeepEqual(keep, []string{"a"}) {
+		t.Fatalf("got %v", keep)
+	}
+}
+
+func TestReloadRetryJoin_KeepsLatest(t *testing.T) {
+	t.Parallel()
+	a := newRetryJoinTestAgent(TestConfig())
+	first, second := TestConfig(), TestConfig()
+	a.reloadRetryJoin(first)
+	a.reloadRetryJoin(second)
+	if got := <-a.retryJoinReloadCh; got != second {
+		t.Fatalf("should keep the latest configuration")
+	}
+}
+
+func TestJoinAttemptErrors(t *testing.T) {
+	t.Parallel()
+	if errs := joinAttemptErrors(nil); errs != nil {
+		t.Fatalf("got %v", errs)
+	}
+	err := errors.New("unreachable")
+	if got := joinAttemptErrors(err); !reflect.DeepEqual(got, []error{err}) {
+		t.Fatalf("got %v", got)
+	}
+	merr := multierror.Append(nil, err, err)
+	if got := joinAttemptErrors(merr); len(got) != 2 {
+		t.Fatalf("got %v", got)
+	}
+}
+
+func TestResolveDiscoverySecret(t *testing.T) {
+	t.Parallel()
+	dir := testutil.TempDir(t, "secret")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "key")
+	if err := ioutil.WriteFile(path, []byte("from-file\n"), 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	os.Setenv("CONSUL_TEST_DISCOVERY_SECRET", "from-env")
+	defer os.Unsetenv("CONSUL_TEST_DISCOVERY_SECRET")
+
+	for in, want := range map[string]string{
+		"inline":                           "inline",
+		"":                                 "",
+		"env:CONSUL_TEST_DISCOVERY_SECRET": "from-env",
+		"file:" + path:                     "from-file",
+	} {
+		got, err := resolveDiscoverySecret("secret_access_key", in)
+		if err != nil || got != want {
+			t.Fatalf("%q: got %q, %v want %q", in, got, err, want)
+		}
+	}
+
+	_, err := resolveDiscoverySecret("secret_access_key", "env:CONSUL_TEST_DISCOVERY_SECRET_UNSET")
+	if err == nil || !isPermanentDiscoveryError(err) {
+		t.Fatalf("got %v want a permanent error", err)
+	}
+	_, err = resolveDiscoverySecret("secret_access_key", "file:"+filepath.Join(dir, "missing"))
+	if err == nil || isPermanentDiscoveryError(err) {
+		t.Fatalf("got %v want a temporary error", err)
+	}
+}
+
+func TestRetryJoin_Shutdown(t *testing.T) {
+	t.Parallel()
+	for _, wan := range []bool{false, true} {
+		cfg := TestConfig()
+		cfg.RetryJoin = []string{"10.0.0.1"}
+		cfg.RetryJoinWan = []string{"10.0.0.1:8302"}
+		cfg.RetryInterval = time.Hour
+		cfg.RetryIntervalWan = time.Hour
+		a := newRetryJoinTestAgent(cfg)
+		clock := &fakeClock{blocked: true, waited: make(chan struct{}, 1)}
+		var calls int
+		done := make(chan struct{})
+		go func() {
+			if wan {
+				a.retryJoinWanWith(failingJoin(-1, &calls), clock.after)
+			} else {
+				a.retryJoinWith(failingJoin(-1, &calls), clock.after)
+			}
+			close(done)
+		}()
+
+		<-clock.waited
+		close(a.shutdownCh)
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("wan %v: retry join didn't stop on shutdown", wan)
+		}
+		select {
+		case err := <-a.retryJoinCh:
+			t.Fatalf("wan %v: unexpected error: %v", wan, err)
+		default:
+		}
+	}
+}
+
+func TestJoinEach(t *testing.T) {
+	t.Parallel()
+	join := func(addrs []string) (int, error) {
+		if addrs[0] == "bad" {
+			return 0, errors.New("unreachable")
+		}
+		return 1, nil
+	}
+	n, failed, err := joinEach(join, []string{"a", "bad", "b"})
+	if n != 2 {
+		t.Fatalf("got %d joined want 2", n)
+	}
+	if got, want := failed, []string{"bad"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got failed %v want %v", got, want)
+	}
+	if err == nil || err.Error() != "unreachable" {
+		t.Fatalf("got error %v want unreachable", err)
+	}
+
+	n, failed, err = joinEach(join, []string{"a"})
+	if n != 1 || failed != nil || err != nil {
+		t.Fatalf("got %d %v %v", n, failed, err)
+	}
+}
+
+// linearBackoff waits a second longer after every failed attempt.
+type linearBackoff struct {
+	attempts []int
+	resets   int
+}
+
+func (b *linearBackoff) Next(attempt int) time.Duration {
+	b.attempts = append(b.attempts, attempt)
+	return time.Duration(attempt) * time.Second
+}
+
+func (b *linearBackoff) Reset() {
+	b.resets++
+}
+
+func TestRetryJoin_SetBackoff(t *testing.T) {
+	t.Parallel()
+	cfg := TestConfig()
+	cfg.RetryJoin = []string{"10.0.0.1"}
+	cfg.RetryJoinWan = []string{"10.0.0.2"}
+	a := newRetryJoinTestAgent(cfg)
+	lan, wan := &linearBackoff{}, &linearBackoff{}
+	a.SetRetryJoinBackoff(lan, wan)
+
+	calls := 0
+	clock := &fakeClock{}
+	a.retryJoinWith(failingJoin(3, &calls), clock.after)
+	want := []time.Duration{time.Second, 2 * time.Second, 3 * time.Second}
+	if !reflect.DeepEqual(clock.waits, want) {
+		t.Fatalf("got waits %v want %v", clock.waits, want)
+	}
+	if !reflect.DeepEqual(lan.attempts, []int{1, 2, 3}) || lan.resets != 1 {
+		t.Fatalf("got attempts %v and %d resets", lan.attempts, lan.resets)
+	}
+
+	calls = 0
+	clock = &fakeClock{}
+	a.retryJoinWanWith(failingJoin(2, &calls), clock.after)
+	if want := want[:2]; !reflect.DeepEqual(clock.waits, want) {
+		t.Fatalf("got waits %v want %v", clock.waits, want)
+	}
+	if wan.resets != 1 || len(lan.attempts) != 3 {
+		t.Fatalf("got %d resets and LAN attempts %v", wan.resets, lan.attempts)
+	}
+}
+
+func TestRetryJoinBackoff(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		attempt       int
+		interval, max time.Duration
+		want          time.Duration
+	}{
+		{1, time.Second, time.Minute, time.Second},
+		{2, time.Second, time.Minute, 2 * time.Second},
+		{4, time.Second, time.Minute, 8 * time.Second},
+		{10, time.Second, time.Minute, time.Minute},
+		{1, time.Minute, time.Second, time.Second},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 100; i++ {
+			got := retryJoinBackoff(tt.attempt, tt.interval, tt.max)
+			if got > tt.want || got < tt.want/2 {
+				t.Fatalf("attempt %d: got %v want between %v and %v", tt.attempt, got, tt.want/2, tt.want)
+			}
+		}
+	}
+
+	if got := retryJoinBackoff(5, time.Second, 0); got != time.Second {
+		t.Fatalf("backoff should be disabled, got %v", got)
+	}
+}
+
+func TestRetryJoinInterval(t *testing.T) {
+	t.Parallel()
+	var buf bytes.Buffer
+	a := &Agent{logger: log.New(&buf, "", 0)}
+	if got := a.retryJoinInterval("retry_interval", 10*time.Millisecond); got != 10*time.Millisecond {
+		t.Fatalf("got %v", got)
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("should not warn: %q", buf.String())
+	}
+	if got := a.retryJoinInterval("retry_interval", 0); got != retryJoinIntervalFloor {
+		t.Fatalf("got %v want %v", got, retryJoinIntervalFloor)
+	}
+	if !strings.Contains(buf.String(), "[WARN] agent: retry_interval is 0s") {
+		t.Fatalf("bad log: %q", buf.String())
+	}
+}
+
+func TestDiscoverLogger(t *testing.T) {
+	t.Parallel()
+	var buf bytes.Buffer
+	logger := log.New(&buf, "", 0)
+
+	newDiscoverLogger(logger, false).Printf("[INFO] agent: Discovered GCE zones: a, b")
+	if got, want := buf.String(), "[DEBUG] agent: [discover] Discovered GCE zones: a, b\n"; got != want {
+		t.Fatalf("got %q want %q", got, want)
+	}
+
+	buf.Reset()
+	newDiscoverLogger(logger, true).Printf("[INFO] agent: Discovered GCE zones: a, b")
+	if buf.Len() != 0 {
+		t.Fatalf("logs should be dropped: %q", buf.String())
+	}
+}
+
+func TestDiscoverErrorLog(t *testing.T) {
+	t.Parallel()
+	var buf bytes.Buffer
+	l := &discoverErrorLog{logger: log.New(&buf, "", 0)}
+	l.Printf("Unable to query EC2 instances: %s", "denied")
+	l.Printf("Unable to query EC2 instances: %s", "denied")
+	l.Printf("Unable to query EC2 instances: %s", "throttled")
+
+	want := "[ERR] agent: Unable to query EC2 instances: denied\n" +
+		"[DEBUG] agent: Unable to query EC2 instances: denied\n" +
+		"[ERR] agent: Unable to query EC2 instances: throttled\n"
+	if got := buf.String(); got != want {
+		t.Fatalf("got %q want %q", got, want)
+	}
+}
+
+func TestPreferAddrFamily(t *testing.T) {
+	t.Parallel()
+	addrs := []string{"1.2.3.4:8301", "[::1]:8301", "consul.example.com", "5.6.7.8", "fe80::1"}
+	tests := []struct {
+		family string
+		addrs  []string
+		want   []string
+	}{
+		{"", addrs, addrs},
+		{"any", addrs, addrs},
+		{"ipv4", addrs, []string{"1.2.3.4:8301", "5.6.7.8", "consul.example.com"}},
+		{"ipv6", addrs, []string{"[::1]:8301", "fe80::1", "consul.example.com"}},
+		{"ipv6", []string{"1.2.3.4", "consul.example.com"}, []string{"1.2.3.4", "consul.example.com"}},
+	}
+	for _, tt := range tests {
+		if got := preferAddrFamily(tt.addrs, tt.family); !reflect.DeepEqual(got, tt.want) {
+			t.Fatalf("%q: got %v want %v", tt.family, got, tt.want)
+		}
+	}
+}
+
+func TestJoinSources(t *testing.T) {
+	t.Parallel()
+	sources := map[string]string{
+		"10.0.0.1": "ec2",
+		"10.0.0.2": "ec2",
+		"10.0.1.1": "static",
+	}
+	got := joinSources([]string{"10.0.1.1", "10.0.0.2", "10.0.0.1"}, sources)
+	if want := []string{"ec2", "static"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v want %v", got, want)
+	}
+	got = joinSources([]string{"10.0.0.1"}, sources)
+	if want := []string{"ec2"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v want %v", got, want)
+	}
+}
+
+func TestJoinVia(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		sources []string
+		want    string
+	}{
+		{[]string{"ec2"}, joinViaDiscovery},
+		{[]string{"exec", "k8s"}, joinViaDiscovery},
+		{[]string{"static"}, joinViaStatic},
+		{[]string{"fallback", "static"}, joinViaStatic},
+		{[]string{"last_known"}, joinViaStatic},
+		{[]string{"ec2", "static"}, joinViaMixed},
+		{[]string{"fallback", "gce"}, joinViaMixed},
+	}
+	for _, tc := range cases {
+		if got := joinVia(tc.sources); got != tc.want {
+			t.Fatalf("%v: got %q want %q", tc.sources, got, tc.want)
+		}
+	}
+}
+
+func TestLANServers(t *testing.T) {
+	t.Parallel()
+	members := []serf.Member{
+		{Addr: net.ParseIP("10.0.0.2"), Port: 8301, Tags: map[string]string{"role": "consul"}, Status: serf.StatusAlive},
+		{Addr: net.ParseIP("10.0.0.1"), Port: 8301, Tags: map[string]string{"role": "consul"}, Status: serf.StatusAlive},
+		{Addr: net.ParseIP("10.0.0.3"), Port: 8301, Tags: map[string]string{"role": "consul"}, Status: serf.StatusFailed},
+		{Addr: net.ParseIP("10.0.0.4"), Port: 8301, Tags: map[string]string{"role": "node"}, Status: serf.StatusAlive},
+		{Addr: net.ParseIP("::1"), Port: 8301, Tags: map[string]string{"role": "consul"}, Status: serf.StatusAlive},
+	}
+	want := []string{"10.0.0.1:8301", "10.0.0.2:8301", "[::1]:8301"}
+	if got := lanServers(members); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v want %v", got, want)
+	}
+}
+
+func TestPeersFile(t *testing.T) {
+	t.Parallel()
+	dir := testutil.TempDir(t, "peers")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, retryJoinPeersFile)
+
+	servers, err := readPeersFile(path)
+	if err != nil || servers != nil {
+		t.Fatalf("got %v %v", servers, err)
+	}
+
+	want := []string{"10.0.0.1:8301", "10.0.0.2:8301"}
+	if err := writePeersFile(path, want); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	servers, err = readPeersFile(path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !reflect.DeepEqual(servers, want) {
+		t.Fatalf("got %v want %v", servers, want)
+	}
+}
+
+func TestTagFilter(t *testing.T) {
+	t.Parallel()
+	filter, err := parseTagFilter([]string{"cluster=prod", "role != client", "consul"})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	tests := []struct {
+		tags  map[string]string
+		match bool
+	}{
+		{map[string]string{"cluster": "prod", "consul": ""}, true},
+		{map[string]string{"cluster": "prod", "consul": "", "role": "server"}, true},
+		{map[string]string{"cluster": "prod", "consul": "", "role": "client"}, false},
+		{map[string]string{"cluster": "dev", "consul": ""}, false},
+		{map[string]string{"cluster": "prod"}, false},
+		{nil, false},
+	}
+	for _, tt := range tests {
+		if got := filter.Match(tt.tags); got != tt.match {
+			t.Fatalf("tags %v: got %v want %v", tt.tags, got, tt.match)
+		}
+	}
+
+	if !tagFilter(nil).Match(nil) {
+		t.Fatal("empty filter should match everything")
+	}
+	if _, err := parseTagFilter([]string{"!=client"}); err == nil {
+		t.Fatal("should fail")
+	}
+}
+
+func TestJoinExclude(t *testing.T) {
+	t.Parallel()
+	exclude, err := parseJoinExclude([]string{"10.1.0.0/16", "10.0.0.2", "Old.Example.Com:8301", "::1"})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	tests := []struct {
+		server string
+		match  string
+	}{
+		{"10.1.2.3:8301", "10.1.0.0/16"},
+		{"10.0.0.2:8302", "10.0.0.2"},
+		{"old.example.com:8301", "Old.Example.Com:8301"},
+		{"old.example.com:8302", ""},
+		{"[::0:1]:8301", "::1"},
+		{"10.0.0.1:8301", ""},
+		{"10.1.example.com:8301", ""},
+	}
+	for _, tt := range tests {
+		if got := exclude.Match(tt.server); got != tt.match {
+			t.Fatalf("server %s: got %q want %q", tt.server, got, tt.match)
+		}
+	}
+
+	a := &Agent{logger: log.New(ioutil.Discard, "", 0)}
+	logged := make(map[string]bool)
+	keep := a.excludeServers([]string{"10.0.0.1:8301", "10.0.0.2:8301"}, exclude, logged)
+	if !reflect.DeepEqual(keep, []string{"10.0.0.1:8301"}) || !logged["10.0.0.2:8301"] {
+		t.Fatalf("got %v, logged %v", keep, logged)
+	}
+
+	for _, e := range []string{"10.1.0.0/33", "a b"} {
+		if _, err := parseJoinExclude([]string{e}); err == nil {
+			t.Fatalf("%q should fail", e)
+		}
+	}
+}
+
+func TestCheckJoinedAgents(t *testing.T) {
+	t.Parallel()
+	if err := checkJoinedAgents(1, 0); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := checkJoinedAgents(3, 3); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := checkJoinedAgents(1, 3); err == nil {
+		t.Fatal("should fail")
+	}
+}
+
+func TestIsPermanentDiscoveryError(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		err       error
+		permanent bool
+	}{
+		{errors.New("connection refused"), false},
+		{&permanentDiscoveryError{errors.New("bad credentials")}, true},
+		{awserr.New("AuthFailure", "bad credentials", nil), true},
+		{awserr.New("RequestLimitExceeded", "slow down", nil), false},
+		{&googleapi.Error{Code: 403}, true},
+		{&googleapi.Error{Code: 503}, false},
+	}
+	for _, tt := range tests {
+		if got := isPermanentDiscoveryError(tt.err); got != tt.permanent {
+			t.Fatalf("%v: got %v want %v", tt.err, got, tt.permanent)
+		}
+	}
+}
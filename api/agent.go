@@ -15,6 +15,19 @@ type AgentCheck struct {
 	Output      string
 	ServiceID   string
 	ServiceName string
+
+	// Exec is the last exec of a Docker check, nil for other checks and
+	// before the check ran.
+	Exec *AgentCheckExec `json:",omitempty"`
+}
+
+// AgentCheckExec describes the last exec of a Docker check.
+type AgentCheckExec struct {
+	ExitCode    int
+	Duration    string
+	Truncated   bool
+	OutputBytes int64
+	Error       string `json:",omitempty"`
 }
 
 // AgentService represents a service known to the agent
@@ -67,19 +80,40 @@ type AgentCheckRegistration struct {
 
 // AgentServiceCheck is used to define a node or service level check
 type AgentServiceCheck struct {
-	Script            string              `json:",omitempty"`
-	DockerContainerID string              `json:",omitempty"`
-	Shell             string              `json:",omitempty"` // Only supported for Docker.
-	Interval          string              `json:",omitempty"`
-	Timeout           string              `json:",omitempty"`
-	TTL               string              `json:",omitempty"`
-	HTTP              string              `json:",omitempty"`
-	Header            map[string][]string `json:",omitempty"`
-	Method            string              `json:",omitempty"`
-	TCP               string              `json:",omitempty"`
-	Status            string              `json:",omitempty"`
-	Notes             string              `json:",omitempty"`
-	TLSSkipVerify     bool                `json:",omitempty"`
+	Script                string              `json:",omitempty"`
+	DockerContainerID     string              `json:",omitempty"`
+	DockerContainerLabels []string            `json:",omitempty"` // Only supported for Docker.
+	ContainerRuntime      string              `json:",omitempty"` // Only supported for Docker.
+	Shell                 string              `json:",omitempty"` // Only supported for Docker.
+	Privileged            bool                `json:",omitempty"` // Only supported for Docker.
+	JSONStatusField       string              `json:",omitempty"` // Only supported for Docker.
+	ScriptTemplate        bool                `json:",omitempty"` // Only supported for Docker.
+	WarningExitCodes      []int               `json:",omitempty"` // Only supported for Docker.
+	DiscardStderr         bool                `json:",omitempty"` // Only supported for Docker.
+	StartGracePeriod      string              `json:",omitempty"` // Only supported for Docker.
+	KillSignal            string              `json:",omitempty"` // Only supported for Docker.
+	KillGracePeriod       string              `json:",omitempty"` // Only supported for Docker.
+	Locale                string              `json:",omitempty"` // Only supported for Docker.
+	ConsoleWidth          int                 `json:",omitempty"` // Only supported for Docker.
+	ConsoleHeight         int                 `json:",omitempty"` // Only supported for Docker.
+	CheckContainerState   bool                `json:",omitempty"` // Only supported for Docker.
+	OutputEncoding        string              `json:",omitempty"` // Only supported for Docker.
+	StdoutContains        string              `json:",omitempty"` // Only supported for Docker.
+	StdoutMatches         string              `json:",omitempty"` // Only supported for Docker.
+	StdoutNegate          bool                `json:",omitempty"` // Only supported for Docker.
+	Interval              string              `json:",omitempty"`
+	Timeout               string              `json:",omitempty"`
+	TTL                   string              `json:",omitempty"`
+	HTTP                  string              `json:",omitempty"`
+	Header                map[string][]string `json:",omitempty"`
+	Method                string              `json:",omitempty"`
+	TCP                   string              `json:",omitempty"`
+	GRPC                  string              `json:",omitempty"`
+	GRPCUseTLS            bool                `json:",omitempty"`
+	TLSServerName         string              `json:",omitempty"`
+	Status                string              `json:",omitempty"`
+	Notes                 string              `json:",omitempty"`
+	TLSSkipVerify         bool                `json:",omitempty"`
 
 	// In Consul 0.7 and later, checks that are associated with a service
 	// may also contain this optional DeregisterCriticalServiceAfter field,
@@ -1,6 +1,7 @@
 package command
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -47,6 +48,7 @@ type AgentCommand struct {
 	logFilter         *logutils.LevelFilter
 	logOutput         io.Writer
 	logger            *log.Logger
+	retryJoinDryRun   bool
 }
 
 // readConfig is responsible for setup of our configuration using
@@ -55,7 +57,9 @@ func (cmd *AgentCommand) readConfig() *agent.Config {
 	var cmdCfg agent.Config
 	var cfgFiles []string
 	var retryInterval string
+	var retryMaxInterval string
 	var retryIntervalWan string
+	var retryMaxIntervalWan string
 	var dnsRecursors []string
 	var dev bool
 	var nodeMeta []string
@@ -134,6 +138,10 @@ func (cmd *AgentCommand) readConfig() *agent.Config {
 		"Maximum number of join attempts. Defaults to 0, which will retry indefinitely.")
 	f.StringVar(&retryInterval, "retry-interval", "",
 		"Time to wait between join attempts.")
+	f.StringVar(&retryMaxInterval, "retry-max-interval", "",
+		"Maximum time to wait between join attempts as the wait backs off.")
+	f.BoolVar(&cmd.retryJoinDryRun, "retry-join-dry-run", false,
+		"Prints the servers retry join would join and exits without starting the agent.")
 	f.StringVar(&cmdCfg.RetryJoinEC2.Region, "retry-join-ec2-region", "",
 		"EC2 Region to discover servers in.")
 	f.StringVar(&cmdCfg.RetryJoinEC2.TagKey, "retry-join-ec2-tag-key", "",
@@ -159,6 +167,8 @@ func (cmd *AgentCommand) readConfig() *agent.Config {
 		"Maximum number of join -wan attempts. Defaults to 0, which will retry indefinitely.")
 	f.StringVar(&retryIntervalWan, "retry-interval-wan", "",
 		"Time to wait between join -wan attempts.")
+	f.StringVar(&retryMaxIntervalWan, "retry-max-interval-wan", "",
+		"Maximum time to wait between join -wan attempts as the wait backs off.")
 
 	// deprecated flags
 	var dcDeprecated string
@@ -206,6 +216,15 @@ func (cmd *AgentCommand) readConfig() *agent.Config {
 		cmdCfg.RetryInterval = dur
 	}
 
+	if retryMaxInterval != "" {
+		dur, err := time.ParseDuration(retryMaxInterval)
+		if err != nil {
+			cmd.UI.Error(fmt.Sprintf("Error: %s", err))
+			return nil
+		}
+		cmdCfg.RetryMaxInterval = dur
+	}
+
 	if retryIntervalWan != "" {
 		dur, err := time.ParseDuration(retryIntervalWan)
 		if err != nil {
@@ -215,6 +234,15 @@ func (cmd *AgentCommand) readConfig() *agent.Config {
 		cmdCfg.RetryIntervalWan = dur
 	}
 
+	if retryMaxIntervalWan != "" {
+		dur, err := time.ParseDuration(retryMaxIntervalWan)
+		if err != nil {
+			cmd.UI.Error(fmt.Sprintf("Error: %s", err))
+			return nil
+		}
+		cmdCfg.RetryMaxIntervalWan = dur
+	}
+
 	if len(nodeMeta) > 0 {
 		cmdCfg.Meta = make(map[string]string)
 		for _, entry := range nodeMeta {
@@ -437,9 +465,53 @@ func (cmd *AgentCommand) readConfig() *agent.Config {
 		}
 	}
 
-	// EC2 and GCE discovery are mutually exclusive
-	if cfg.RetryJoinEC2.TagKey != "" && cfg.RetryJoinEC2.TagValue != "" && cfg.RetryJoinGCE.TagValue != "" {
-		cmd.UI.Error("EC2 and GCE discovery are mutually exclusive. Please provide one or the other.")
+	if err := cfg.ValidateRetryJoin(); err != nil {
+		cmd.UI.Error(err.Error())
+		return nil
+	}
+
+	if cfg.DockerConfig.ExecOutputBytes < 0 || cfg.DockerConfig.OutputMaxBytes < 0 {
+		cmd.UI.Error("docker_config exec_output_bytes and output_max_bytes can't be negative")
+		return nil
+	}
+	if cfg.DockerConfig.UseAgentTLS && cfg.CAFile == "" {
+		cmd.UI.Error("docker_config use_agent_tls requires ca_file to be set")
+		return nil
+	}
+	if cfg.DockerConfig.UseAgentTLS && cfg.DockerConfig.TLSEnabled() {
+		cmd.UI.Error("docker_config use_agent_tls can't be combined with ca_file, cert_file, key_file, cert_path or tls_skip_verify")
+		return nil
+	}
+	if (cfg.DockerConfig.CertFile == "") != (cfg.DockerConfig.KeyFile == "") {
+		cmd.UI.Error("docker_config cert_file and key_file must both be set, or neither")
+		return nil
+	}
+	if cfg.DockerConfig.MaxBytesPerInterval < 0 {
+		cmd.UI.Error("docker_config max_bytes_per_interval can't be negative")
+		return nil
+	}
+	if r := cfg.DockerConfig.BreakerErrorRate; r < 0 || r > 1 {
+		cmd.UI.Error(fmt.Sprintf("docker_config breaker_error_rate must be between 0 and 1, got %v", r))
+		return nil
+	}
+	if cfg.DockerConfig.BreakerCooldown < 0 {
+		cmd.UI.Error("docker_config breaker_cooldown can't be negative")
+		return nil
+	}
+	switch cfg.DockerConfig.OutputKeep {
+	case "", "head", "tail":
+	default:
+		cmd.UI.Error(fmt.Sprintf("docker_config output_keep must be one of head or tail, got %q", cfg.DockerConfig.OutputKeep))
+		return nil
+	}
+	switch cfg.DockerConfig.InfrastructureStatus {
+	case "", "warning", "critical":
+	default:
+		cmd.UI.Error(fmt.Sprintf("docker_config infrastructure_status must be one of warning or critical, got %q", cfg.DockerConfig.InfrastructureStatus))
+		return nil
+	}
+	if _, err := agent.ParseContainerRuntime(cfg.DockerConfig.ContainerRuntime); err != nil {
+		cmd.UI.Error(fmt.Sprintf("docker_config container_runtime is invalid: %v", err))
 		return nil
 	}
 
@@ -656,6 +728,52 @@ func (cmd *AgentCommand) Run(args []string) int {
 	return code
 }
 
+// logRetryJoinError logs the error which made the retry join of the LAN or
+// WAN cluster give up.
+func (cmd *AgentCommand) logRetryJoinError(err error) {
+	if e, ok := err.(*agent.RetryJoinError); ok && e.Cluster == agent.RetryJoinWAN {
+		cmd.logger.Println("[ERR] Retry join -wan failed: ", err)
+		return
+	}
+	cmd.logger.Println("[ERR] Retry join failed: ", err)
+}
+
+// dryRunRetryJoin prints the servers every provider of retry join finds and
+// the static addresses it would join. It returns 1 if any provider failed.
+func (cmd *AgentCommand) dryRunRetryJoin(cfg *agent.Config) int {
+	code := 0
+	cmd.UI.Output("Retry join servers:")
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	for _, res := range cfg.DiscoverServers(ctx, cmd.logger) {
+		if res.Err != nil {
+			cmd.UI.Error(fmt.Sprintf("%s: %s", res.Name, res.Err))
+			code = 1
+			continue
+		}
+		cmd.UI.Info(fmt.Sprintf("%s: %v", res.Name, res.Servers))
+	}
+	if len(cfg.RetryJoin) > 0 {
+		cmd.UI.Info(fmt.Sprintf("retry_join: %v", cfg.RetryJoinAddrs()))
+	}
+	if len(cfg.RetryJoinFallback) > 0 {
+		cmd.UI.Info(fmt.Sprintf("retry_join_fallback: %v", cfg.RetryJoinFallbackAddrs()))
+	}
+	if len(cfg.RetryJoinSeeds) > 0 {
+		seeds, _ := cfg.RetryJoinSeedAddrs()
+		cmd.UI.Info(fmt.Sprintf("retry_join_seeds: %v", seeds))
+	}
+	if len(cfg.RetryJoinWan) > 0 {
+		servers, invalid := cfg.RetryJoinWanAddrs()
+		cmd.UI.Info(fmt.Sprintf("retry_join_wan: %v", servers))
+		for _, addr := range invalid {
+			cmd.UI.Error(fmt.Sprintf("retry_join_wan: invalid address %q", addr))
+			code = 1
+		}
+	}
+	return code
+}
+
 func (cmd *AgentCommand) run(args []string) int {
 	cmd.UI = &cli.PrefixedUi{
 		OutputPrefix: "==> ",
@@ -685,6 +803,10 @@ func (cmd *AgentCommand) run(args []string) int {
 	cmd.logOutput = logOutput
 	cmd.logger = log.New(logOutput, "", log.LstdFlags)
 
+	if cmd.retryJoinDryRun {
+		return cmd.dryRunRetryJoin(config)
+	}
+
 	if err := startupTelemetry(config); err != nil {
 		cmd.UI.Error(err.Error())
 		return 1
@@ -761,7 +883,7 @@ func (cmd *AgentCommand) run(args []string) int {
 		case <-cmd.ShutdownCh:
 			sig = os.Interrupt
 		case err := <-agent.RetryJoinCh():
-			cmd.logger.Println("[ERR] Retry join failed: ", err)
+			cmd.logRetryJoinError(err)
 			return 1
 		case <-agent.ShutdownCh():
 			// agent is already down!